@@ -0,0 +1,68 @@
+package ndt5
+
+import "time"
+
+// MessageSizeSample is a sample of the upload speed measured while
+// using a specific upload message size.
+type MessageSizeSample struct {
+	Size int     // size of the upload message in bytes
+	Mbps float64 // speed measured since the previous sample
+}
+
+const (
+	// adaptiveMinMessageSize is the initial size of the upload
+	// message when using the adaptive upload.
+	adaptiveMinMessageSize = 1 << 13
+
+	// adaptiveMaxMessageSize is the maximum size of the upload
+	// message when using the adaptive upload.
+	adaptiveMaxMessageSize = 1 << 20
+
+	// adaptiveGrowthThreshold is the minimum relative speed increase
+	// for which we consider the speed to be still climbing.
+	adaptiveGrowthThreshold = 1.1
+)
+
+// messageSizer adapts the size of the upload message. It starts with
+// a modest message size and doubles it as long as the speed keeps
+// climbing. It is only used by the uploader goroutine.
+type messageSizer struct {
+	testconn    MeasurementConn
+	testdata    []byte
+	size        int
+	best        MessageSizeSample
+	curve       []MessageSizeSample
+	lastCount   int64
+	lastElapsed time.Duration
+	lastMbps    float64
+}
+
+// newMessageSizer creates a new messageSizer that uses slices of
+// testdata as the upload message and sets the initial message.
+func newMessageSizer(testconn MeasurementConn, testdata []byte) *messageSizer {
+	ms := &messageSizer{testconn: testconn, testdata: testdata}
+	ms.size = adaptiveMinMessageSize
+	if ms.size > len(testdata) {
+		ms.size = len(testdata)
+	}
+	testconn.SetPreparedMessage(testdata[:ms.size])
+	return ms
+}
+
+// update updates the message size given the latest speed sample.
+func (ms *messageSizer) update(speed *Speed) {
+	current := MessageSizeSample{
+		Size: ms.size,
+		Mbps: mbps(speed.Count-ms.lastCount, speed.Elapsed-ms.lastElapsed),
+	}
+	ms.curve = append(ms.curve, current)
+	if current.Mbps > ms.best.Mbps {
+		ms.best = current
+	}
+	climbing := current.Mbps > ms.lastMbps*adaptiveGrowthThreshold
+	ms.lastCount, ms.lastElapsed, ms.lastMbps = speed.Count, speed.Elapsed, current.Mbps
+	if climbing && ms.size*2 <= len(ms.testdata) {
+		ms.size *= 2
+		ms.testconn.SetPreparedMessage(ms.testdata[:ms.size])
+	}
+}
@@ -0,0 +1,65 @@
+package ndt5
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// AnonymizationMode is how we anonymize the client IP.
+type AnonymizationMode int
+
+const (
+	// AnonymizeNone means that we don't anonymize the client IP. It's
+	// the default.
+	AnonymizeNone = AnonymizationMode(iota)
+
+	// AnonymizeNetblock means that we mask the client IP, keeping only its
+	// /24 netblock for IPv4 and its /48 netblock for IPv6.
+	AnonymizeNetblock
+
+	// AnonymizeRemove means that we remove the client IP altogether.
+	AnonymizeRemove
+)
+
+// AnonymizeIP returns ip anonymized using mode, or an empty string when
+// mode is AnonymizeRemove or ip is not a valid IP address, since we cannot
+// tell which part of it we should keep.
+func AnonymizeIP(ip string, mode AnonymizationMode) string {
+	switch mode {
+	case AnonymizeNone:
+		return ip
+	case AnonymizeNetblock:
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return ""
+		}
+		addr = addr.Unmap()
+		bits := 48
+		if addr.Is4() {
+			bits = 24
+		}
+		prefix, err := addr.WithZone("").Prefix(bits)
+		if err != nil {
+			return ""
+		}
+		return prefix.Addr().String()
+	default:
+		return ""
+	}
+}
+
+// anonymizeWeb100 returns the web100 message m with the client IP, if it
+// contains it, anonymized using c.AnonymizeClientIP, or an empty string if
+// we should drop the message.
+func (c *Client) anonymizeWeb100(m string) string {
+	key, value, found := strings.Cut(m, ":")
+	if c.AnonymizeClientIP == AnonymizeNone || !found ||
+		strings.TrimSpace(key) != Web100KeyClientIP {
+		return m
+	}
+	ip := AnonymizeIP(strings.TrimSpace(value), c.AnonymizeClientIP)
+	if ip == "" {
+		return ""
+	}
+	return key + ": " + ip
+}
@@ -0,0 +1,64 @@
+package ndt5_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt5-client-go"
+)
+
+func TestUnitAnonymizeIP(t *testing.T) {
+	for _, tc := range []struct {
+		ip     string
+		mode   ndt5.AnonymizationMode
+		expect string
+	}{
+		{"192.0.2.123", ndt5.AnonymizeNone, "192.0.2.123"},
+		{"192.0.2.123", ndt5.AnonymizeNetblock, "192.0.2.0"},
+		{"::ffff:192.0.2.123", ndt5.AnonymizeNetblock, "192.0.2.0"},
+		{"2001:db8:1234:5678::1", ndt5.AnonymizeNetblock, "2001:db8:1234::"},
+		{"fe80::1%eth0", ndt5.AnonymizeNetblock, "fe80::"},
+		{"192.0.2.123", ndt5.AnonymizeRemove, ""},
+		{"2001:db8:1234:5678::1", ndt5.AnonymizeRemove, ""},
+		{"not-an-ip", ndt5.AnonymizeNetblock, ""},
+	} {
+		if got := ndt5.AnonymizeIP(tc.ip, tc.mode); got != tc.expect {
+			t.Errorf("%s (%d): expected %q, got %q", tc.ip, tc.mode, tc.expect, got)
+		}
+	}
+}
+
+func TestUnitClientAnonymizeClientIP(t *testing.T) {
+	for _, tc := range []struct {
+		mode   ndt5.AnonymizationMode
+		expect string
+	}{
+		{ndt5.AnonymizeNone, "2001:db8:1234:5678::1"},
+		{ndt5.AnonymizeNetblock, "2001:db8:1234::"},
+		{ndt5.AnonymizeRemove, ""},
+	} {
+		server := &FakeServer{
+			TestIDs:         "4",
+			Duration:        100 * time.Millisecond,
+			DownloadTestMsg: "1000",
+			Web100:          []string{ndt5.Web100KeyClientIP + ": 2001:db8:1234:5678::1"},
+		}
+		client := NewFakeServerClient(server)
+		client.AnonymizeClientIP = tc.mode
+		ch, err := client.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ev := range ch {
+			if ev.InfoMessage != nil && tc.mode != ndt5.AnonymizeNone &&
+				strings.Contains(ev.InfoMessage.Message, "5678") {
+				t.Fatalf("%d: leaked the client IP: %s", tc.mode, ev.InfoMessage.Message)
+			}
+		}
+		if got := client.Result.Web100[ndt5.Web100KeyClientIP]; got != tc.expect {
+			t.Fatalf("%d: expected %q, got %q", tc.mode, tc.expect, got)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package ndt5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrCaptureNotSupported is the warning emitted when the MeasurementConn
+// does not support Client.MeasurementCapture.
+var ErrCaptureNotSupported = errors.New("the measurement connection does not support capturing")
+
+// measurementCapturer is implemented by a MeasurementConn able to copy the
+// payload it reads and writes to a writer.
+type measurementCapturer interface {
+	SetCapture(w io.Writer)
+}
+
+// captureWriter copies up to remaining bytes to w, or all of them when
+// remaining is negative. It never fails, so that capturing cannot break
+// the measurement: it stops capturing when w fails and saves the error.
+type captureWriter struct {
+	w         io.Writer
+	remaining int64
+	err       error
+}
+
+// newCaptureWriter creates a captureWriter copying up to limit bytes to
+// w, or all of them when limit is zero.
+func newCaptureWriter(w io.Writer, limit int64) *captureWriter {
+	if limit <= 0 {
+		limit = -1
+	}
+	return &captureWriter{w: w, remaining: limit}
+}
+
+// Write implements io.Writer.
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	size := len(b)
+	if cw.err != nil || cw.remaining == 0 {
+		return size, nil
+	}
+	if cw.remaining > 0 && int64(len(b)) > cw.remaining {
+		b = b[:cw.remaining]
+	}
+	written, err := cw.w.Write(b)
+	if cw.remaining > 0 {
+		cw.remaining -= int64(written)
+	}
+	cw.err = err
+	return size, nil
+}
+
+// setCapture configures testconn to copy its payload to c.capture, if
+// c.MeasurementCapture is set, emitting a warning if that's not possible.
+func (c *Client) setCapture(ctx context.Context, testconn MeasurementConn, ch chan<- *Output) {
+	if c.capture == nil {
+		return
+	}
+	capturer, ok := testconn.(measurementCapturer)
+	if !ok {
+		c.emitWarning(ctx, ErrCaptureNotSupported, ch)
+		return
+	}
+	capturer.SetCapture(c.capture)
+}
+
+// checkCapture emits a warning if writing to c.MeasurementCapture failed,
+// which stops the capture.
+func (c *Client) checkCapture(ctx context.Context, ch chan<- *Output) {
+	if c.capture != nil && c.capture.err != nil {
+		c.emitWarning(ctx, fmt.Errorf("cannot capture the payload: %w", c.capture.err), ch)
+		c.capture.err = nil
+		c.capture.remaining = 0 // don't try again
+	}
+}
@@ -4,13 +4,20 @@ package ndt5
 import (
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"math"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/netip"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/m-lab/ndt5-client-go/mlabns"
@@ -27,6 +34,12 @@ type MlabNSClient interface {
 	Query(ctx context.Context) (fqdn string, err error)
 }
 
+// MlabNSClientV2 is an mlab-ns client that also supports the locate v2
+// API, which returns the access token required by token-gated servers.
+type MlabNSClientV2 interface {
+	QueryV2(ctx context.Context) (*mlabns.Target, error)
+}
+
 // MeasurementConn is a measurement connection.
 type MeasurementConn interface {
 	// SetDeadline sets the read and write deadlines.
@@ -50,6 +63,17 @@ type MeasurementConn interface {
 	// message. Returns number of bytes written or error.
 	WritePreparedMessage() (int, error)
 
+	// CongestionControl returns the TCP congestion control algorithm
+	// used by the connection (e.g. "cubic" or "bbr"). This is only
+	// supported on Linux and fails with ErrNotSupported elsewhere.
+	CongestionControl() (string, error)
+
+	// LocalAddr returns the local address of the connection.
+	LocalAddr() net.Addr
+
+	// RemoteAddr returns the remote address of the connection.
+	RemoteAddr() net.Addr
+
 	// Close closes the measurement connection.
 	Close() error
 }
@@ -70,6 +94,140 @@ const (
 // message size than a ndt5 frame can transport.
 var ErrMessageSize = errors.New("message too large for ndt5 frame")
 
+// ErrProtocolMismatch indicates that the server does not seem to speak
+// ndt5 using the selected transport (e.g. we received an HTTP response
+// on the raw TCP port, or a text message over WebSocket).
+var ErrProtocolMismatch = errors.New(
+	"protocol mismatch: check that the server speaks ndt5 using the selected transport and port")
+
+// ErrUnexpectedTestIDs is the warning emitted when the list of tests that
+// the server asks us to run contains duplicate or unknown test IDs. We only
+// run each test once, and we do not run the tests we don't know.
+var ErrUnexpectedTestIDs = errors.New("unexpected test IDs")
+
+// ErrTestTimeout indicates that the deadline of the context passed to
+// Start expired before the test completed, which bounds all the phases of
+// the test, including discovery and waiting in queue. The error tells the
+// phase (e.g. "queue") during which the deadline expired.
+var ErrTestTimeout = errors.New("the test did not complete in time")
+
+// ErrDiscoveryFailed indicates that Start could not discover a server.
+var ErrDiscoveryFailed = errors.New("cannot discover a server")
+
+// ErrSubtestTimeout indicates that a subtest took longer than the
+// Client.SubtestTimeout.
+var ErrSubtestTimeout = errors.New("subtest timed out")
+
+// ErrControlReconnect is the warning emitted when we reconnect the control
+// connection after a failed subtest. See Client.ReconnectControlOnError.
+var ErrControlReconnect = errors.New("reconnecting the control connection")
+
+// ErrReconnectNotSupported indicates that the Protocol does not allow us
+// to choose the tests to run, so we cannot reconnect.
+var ErrReconnectNotSupported = errors.New("the protocol does not support reconnecting")
+
+// remoteAddrer is implemented by a Protocol or a ControlConn exposing the
+// remote address of the control connection.
+type remoteAddrer interface {
+	RemoteAddr() net.Addr
+}
+
+// addressFamily returns the family ("ipv4" or "ipv6") of the address of
+// the given Protocol, if it exposes it.
+func addressFamily(proto Protocol) string {
+	conn, ok := proto.(remoteAddrer)
+	if !ok || conn.RemoteAddr() == nil {
+		return ""
+	}
+	addrport, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	if addrport.Addr().Unmap().Is4() {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// testSuiteSetter is implemented by a Protocol allowing us to choose the
+// tests to request when logging in.
+type testSuiteSetter interface {
+	SetTestSuite(suite uint8)
+}
+
+// streamCounter is implemented by a Protocol telling the number of
+// parallel streams announced by the last TestPrepare message.
+type streamCounter interface {
+	Streams() int
+}
+
+// emitHookSetter is implemented by a Protocol emitting its own events
+// (e.g. the progress while waiting in queue), which allows us to pass
+// them through Client.emit like the events we emit.
+type emitHookSetter interface {
+	SetEmitHook(hook func(msg *Output))
+}
+
+// hookEmit makes proto emit its events using c.emit, if possible.
+func (c *Client) hookEmit(ctx context.Context, proto Protocol, ch chan<- *Output) {
+	if setter, ok := proto.(emitHookSetter); ok {
+		setter.SetEmitHook(func(msg *Output) {
+			c.emit(ctx, msg, ch)
+		})
+	}
+}
+
+// ErrPathMTUBlackHole is the warning emitted when the upload does not
+// send any byte during the Client.BlackHoleWindow.
+var ErrPathMTUBlackHole = errors.New("possible path MTU black hole")
+
+// ErrUploadStalled is the warning emitted when a write of the upload takes
+// longer than the Client.UploadWriteTimeout.
+var ErrUploadStalled = errors.New("the upload stalled")
+
+// ErrMeasurementPortUnreachable indicates that we could not connect to
+// the measurement port although the control connection works, which is
+// usually caused by a firewall filtering the ports differently.
+var ErrMeasurementPortUnreachable = errors.New("the measurement port is unreachable")
+
+// measurementDialError returns the error to return when we fail to dial
+// the measurement connection to portnum, which wraps
+// ErrMeasurementPortUnreachable unless ctx is done, e.g., when the test
+// timed out while dialing.
+func measurementDialError(ctx context.Context, portnum string, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("cannot create measurement connection: %w", err)
+	}
+	return fmt.Errorf("%w: port %s: %w", ErrMeasurementPortUnreachable, portnum, err)
+}
+
+// ErrMaxBytesReached is the warning emitted when we stop measuring
+// because we reached the Client.MaxBytes cap.
+var ErrMaxBytesReached = errors.New("reached the maximum number of bytes")
+
+// ErrSpeedDivergence is the warning emitted when the client-measured and
+// the server-measured speeds differ by more than Client.SpeedDivergence.
+var ErrSpeedDivergence = errors.New("client-measured and server-measured speeds diverge")
+
+// ErrInvalidServerVersion is the warning emitted when the version sent
+// by the server does not look like a version. We still run the test.
+var ErrInvalidServerVersion = errors.New("invalid server version")
+
+// validVersion returns whether version looks like a version sent by a
+// ndt5 server, i.e., it starts with a number (e.g. "3.7.0.2"), optionally
+// preceded by "v" (e.g. "v3.7.0" or "v5.0-NDTinGO").
+func validVersion(version string) bool {
+	version = strings.TrimPrefix(version, "v")
+	return version != "" && version[0] >= '0' && version[0] <= '9'
+}
+
+// ErrMaxRetransmission is the warning emitted when the download
+// retransmission rate exceeds Client.MaxRetransmission.
+var ErrMaxRetransmission = errors.New("retransmission rate exceeds the maximum")
+
+// httpResponsePrefix is the prefix of any HTTP/1.x response.
+var httpResponsePrefix = []byte("HTTP/")
+
 // NewFrame creates a new frame
 func NewFrame(mtype uint8, message []byte) (*Frame, error) {
 	// <type: uint8> <length: uint16> <message: [0..65535]byte>
@@ -87,6 +245,84 @@ func NewFrame(mtype uint8, message []byte) (*Frame, error) {
 	}, nil
 }
 
+// Timings contains the duration of the phases of a test. A zero value
+// means that we did not measure the corresponding phase.
+type Timings struct {
+	// DNSResolve is the time it took to resolve the FQDN. See the
+	// Client.ResolveFQDN option.
+	DNSResolve time.Duration
+
+	// LoginRTT is the time between sending the login message and receiving
+	// the kickoff message, i.e., the application-layer RTT of the control
+	// connection plus the server processing time. It's the earliest latency
+	// measurement, available even if the test fails later.
+	LoginRTT time.Duration
+}
+
+// TCPInfoSample is a timestamped snapshot of the server's TCP state, built
+// from the web100 variables sent by the server after the download. Each
+// sample contains the latest value of each variable received so far.
+type TCPInfoSample struct {
+	Time time.Time
+
+	// CongestionWindow is the CurCwnd variable in bytes.
+	CongestionWindow int64
+
+	// SendBufCur is the X_Sndbuf variable in bytes.
+	SendBufCur int64
+
+	// RTT is the SmoothedRTT (or TCPInfo.RTT) variable.
+	RTT time.Duration
+}
+
+// RTTProber is implemented by a ControlConn able to measure the
+// application-layer round-trip time, such as the WebSocket ControlConn,
+// which uses WebSocket ping and pong frames. The raw ndt5 protocol does
+// not have a message suitable for this purpose.
+type RTTProber interface {
+	// SendRTTProbe sends a probe. We measure the RTT when we receive the
+	// reply, which only happens while reading frames.
+	SendRTTProbe() error
+
+	// RTTSamples returns the RTTs measured so far.
+	RTTSamples() []time.Duration
+}
+
+// RTTStats contains statistics about a set of RTT samples.
+type RTTStats struct {
+	Count int
+	Min   time.Duration
+	Avg   time.Duration
+	Max   time.Duration
+}
+
+// newRTTStats computes the statistics of samples. It returns nil
+// when there are no samples.
+func newRTTStats(samples []time.Duration) *RTTStats {
+	if len(samples) < 1 {
+		return nil
+	}
+	stats := &RTTStats{Count: len(samples), Min: samples[0], Max: samples[0]}
+	var sum time.Duration
+	for _, sample := range samples {
+		if sample < stats.Min {
+			stats.Min = sample
+		}
+		if sample > stats.Max {
+			stats.Max = sample
+		}
+		sum += sample
+	}
+	stats.Avg = sum / time.Duration(len(samples))
+	return stats
+}
+
+// controlRTTMeasurer is implemented by a Protocol measuring the RTT of
+// the control connection while waiting in queue.
+type controlRTTMeasurer interface {
+	ControlRTT() *RTTStats
+}
+
 // FrameReadWriteObserver observes when ndt5 frames are
 // read or written on the control conn. You MUST NOT change
 // the frames that you see, but you can log them.
@@ -147,6 +383,15 @@ type ControlConn interface {
 // ConnectionsFactory creates connections. There are several ndt5
 // transports (e.g. raw TCP, WebSocket) and, for each of them, there
 // is a specific ConnectionFactory that you can use.
+//
+// This is also the extension point for custom transports: set your own
+// ConnectionsFactory as the ConnectionsFactory of a ProtocolFactory5 and
+// the client will use it for all the connections. If your transport
+// provides a net.Conn carrying the raw ndt5 protocol (e.g. a pipe or a
+// QUIC stream), CustomConnectionsFactory does all of this for you, while
+// NewRawControlConn and NewRawMeasurementConn implement the ndt5 framing
+// if you need more control. Options such as the congestion control algorithm
+// or the access token only apply to the factories of this package.
 type ConnectionsFactory interface {
 	// DialControlConn dials a control connection. The code shall check
 	// whether the address contain a port and use the default port for
@@ -163,6 +408,27 @@ type ConnectionsFactory interface {
 		ctx context.Context, address, userAgent string) (MeasurementConn, error)
 }
 
+// TestMsg is the body of a TestMsg message containing the speed measured
+// by the server. Old servers send a plain-text body, while modern servers
+// send a JSON body. We parse both formats.
+type TestMsg struct {
+	// Message is the body in the legacy plain-text format, i.e., either
+	// the throughput or "<throughput> <unsent> <total-sent>".
+	Message string
+
+	// ThroughputValue is the throughput in kbit/s.
+	ThroughputValue float64
+
+	// UnsentDataAmount is the amount of data in the server's send queue,
+	// when the server provides it (download only).
+	UnsentDataAmount int64
+
+	// TotalSentByte is the number of bytes sent by the server during the
+	// download, when the server provides it. During the upload, it's the
+	// number of bytes the server received, if the server provides it.
+	TotalSentByte int64
+}
+
 // Protocol manages a ControlConn. We currently only support the
 // ndt5 control protocol. You may still want to override the protocol
 // instance used by the client for testing purposes.
@@ -176,9 +442,22 @@ type Protocol interface {
 	DialDownloadConn(ctx context.Context, address, userAgent string) (MeasurementConn, error)
 	DialUploadConn(ctx context.Context, address, userAgent string) (MeasurementConn, error)
 	ExpectTestStart() error
-	ExpectTestMsg() (info string, err error)
+	// ExpectTestMsg receives a TestMsg message and parses its body, which
+	// may either be JSON or the legacy plain-text format.
+	ExpectTestMsg() (msg *TestMsg, err error)
+
 	ExpectTestFinalize() error
+
+	// SetDeadline sets the read and write deadlines of the control
+	// connection, which bound every subsequent protocol read and write.
+	SetDeadline(deadline time.Time) error
+
+	// SendTestMsg sends data as the body of a single TestMsg message. The
+	// data is never split across several messages, so this method fails
+	// with an error wrapping ErrMessageSize if the data is larger than
+	// the maximum body size of a ndt5 frame (i.e. 65535 bytes).
 	SendTestMsg(data []byte) error
+
 	ReceiveTestFinalizeOrTestMsg() (mtype uint8, mdata []byte, err error)
 	ReceiveLogoutOrResults() (mtype uint8, mdata []byte, err error)
 	Close() error
@@ -190,11 +469,156 @@ type ProtocolFactory interface {
 		ctx context.Context, fqdn, userAgent string, ch chan<- *Output) (Protocol, error)
 }
 
-// TestResult is a struct storing the results of the NDT5 test.
+// TestResult is a struct storing the results of the NDT5 test. It can be
+// serialized to JSON and back without losing information, so you can
+// archive it. Optional fields are omitted when empty.
 type TestResult struct {
-	ClientMeasuredDownload Speed
-	ServerMeasuredUpload   float64
-	Web100                 map[string]string
+	ClientMeasuredDownload Speed             `json:"ClientMeasuredDownload"`
+	ServerMeasuredUpload   float64           `json:"ServerMeasuredUpload"`
+	Web100                 map[string]string `json:",omitempty"`
+
+	// ServerMeasuredDownload is the download speed in kbit/s measured by
+	// the server, or zero if the server did not send a valid speed.
+	ServerMeasuredDownload float64 `json:"ServerMeasuredDownload"`
+
+	// ServerUnsentDataAmount and ServerTotalSentByte are the amount of
+	// data that the server did not send and the total amount of data
+	// it sent during the download, when it reports them.
+	ServerUnsentDataAmount int64 `json:",omitempty"`
+	ServerTotalSentByte    int64 `json:",omitempty"`
+
+	// ConvergedDownload and ConvergedUpload are the mean speeds in kbit/s
+	// over Client.ConvergenceWindow when we stopped the download and the
+	// upload early because the speed converged, and zero otherwise.
+	ConvergedDownload float64 `json:",omitempty"`
+	ConvergedUpload   float64 `json:",omitempty"`
+
+	// DownloadTTFB is the time between the TestStart message and the
+	// first byte of the download, which reveals the ramp-up and queueing
+	// delay of the server that the average speed hides.
+	DownloadTTFB time.Duration `json:",omitempty"`
+
+	// ClientMeasuredUpload is the last upload speed sample.
+	ClientMeasuredUpload Speed `json:"ClientMeasuredUpload"`
+
+	// ServerVersion is the version sent by the server and VersionValid
+	// tells whether it looks like a version (e.g. "v3.7.0"). An invalid
+	// version suggests that the server is in a weird state.
+	ServerVersion string `json:",omitempty"`
+	VersionValid  bool   `json:",omitempty"`
+
+	// CongestionControl is the congestion control algorithm used by the
+	// last measurement connection, if known. See MeasurementConn.
+	CongestionControl string `json:",omitempty"`
+
+	// MSS is the maximum segment size of the last measurement connection,
+	// if known, which, along with the RTT, tells whether the measured speed
+	// is plausible for the path. It's only available on Linux.
+	MSS int `json:",omitempty"`
+
+	// UploadMessageSize is the upload message size that achieved the best
+	// speed when using Client.AdaptiveUpload.
+	UploadMessageSize int `json:",omitempty"`
+
+	// UploadMessageSizeCurve contains the speed measured with each upload
+	// message size when using Client.AdaptiveUpload.
+	UploadMessageSizeCurve []MessageSizeSample `json:",omitempty"`
+
+	// UploadAcknowledgedBytes is the number of bytes that the server
+	// reported having received during the upload, if it reports them.
+	// See Client.ReconcileUpload.
+	UploadAcknowledgedBytes int64 `json:",omitempty"`
+
+	// TCPInfoSeries contains a snapshot of the TCP state of the server
+	// each time it sends one of the web100 variables we track.
+	TCPInfoSeries []TCPInfoSample `json:",omitempty"`
+
+	// Timings contains the duration of the phases of the test.
+	Timings Timings `json:"Timings"`
+
+	// ControlRTT contains the application-layer RTT of the control connection
+	// measured while waiting in queue, if any. See ProtocolFactory5.
+	ControlRTT *RTTStats `json:",omitempty"`
+
+	// MaxBytesReached indicates that we stopped measuring because we
+	// transferred Client.MaxBytes bytes.
+	MaxBytesReached bool `json:",omitempty"`
+
+	// MaxRetransmissionExceeded indicates that the download retransmission
+	// rate exceeded Client.MaxRetransmission.
+	MaxRetransmissionExceeded bool `json:",omitempty"`
+
+	// BelowThreshold contains the directions ("download" or "upload")
+	// whose speed was below Client.MinDownload or Client.MinUpload.
+	BelowThreshold []string `json:",omitempty"`
+
+	// Labels contains a copy of the Client.Labels used for this test.
+	Labels map[string]string `json:",omitempty"`
+
+	// Metadata contains the metadata describing the client (e.g. the OS)
+	// that we send to the server using the META test, unless you set
+	// Client.DisableMetadata. See the MetadataKey constants.
+	Metadata map[string]string `json:",omitempty"`
+
+	// ServerDistance is the approximate distance between the client and
+	// the server in km, if we know both locations. See Client.ClientLocation.
+	ServerDistance float64 `json:",omitempty"`
+
+	// AddressFamily is the address family ("ipv4" or "ipv6") of the
+	// control connection, which matters on dual-stack hosts, since the
+	// same FQDN may be reached using either. It's empty when unknown,
+	// e.g., when the ControlConn does not expose its remote address.
+	AddressFamily string `json:",omitempty"`
+
+	// TrailingMessages contains the results messages that the server sent
+	// after the logout message. See Client.DrainAfterLogout.
+	TrailingMessages []string `json:",omitempty"`
+
+	// TestIDs contains the IDs of the tests that the server asked us to
+	// run, without duplicates. When reconnecting, it's the list received
+	// before the first reconnection. See also ErrUnexpectedTestIDs.
+	TestIDs []int `json:",omitempty"`
+
+	// Subtests contains a record of each subtest, in the order in which
+	// the server asked us to run them.
+	Subtests []SubtestRecord `json:",omitempty"`
+}
+
+// SubtestRecord is the record of a subtest (e.g. the download).
+type SubtestRecord struct {
+	// ID is the ndt5 test ID (e.g. 4 for the download).
+	ID uint8
+
+	// Direction is "download", "upload", or "meta".
+	Direction string
+
+	// Start and End are the times when the subtest started and ended.
+	Start time.Time
+	End   time.Time
+
+	// Success indicates whether the subtest succeeded.
+	Success bool
+
+	// Error is the error that occurred, if any.
+	Error string `json:",omitempty"`
+}
+
+// DownloadRetransmission returns the percentage of bytes retransmitted by
+// the server during the download, computed from the TCPInfo.BytesRetrans
+// and TCPInfo.BytesSent web100 variables. It returns false when they are
+// missing or invalid, which includes BytesSent not being positive, which
+// should never happen on M-Lab's servers but has been reported in some
+// custom deployments.
+func (r *TestResult) DownloadRetransmission() (float64, bool) {
+	retrans, err := strconv.ParseFloat(r.Web100[Web100KeyBytesRetrans], 64)
+	if err != nil {
+		return 0, false
+	}
+	sent, err := strconv.ParseFloat(r.Web100[Web100KeyBytesSent], 64)
+	if err != nil || sent <= 0 {
+		return 0, false
+	}
+	return retrans / sent * 100, true
 }
 
 // Client is an ndt5 client.
@@ -213,6 +637,11 @@ type Client struct {
 	// This is generally only required for testing.
 	ProtocolFactory ProtocolFactory
 
+	// SpeedFormatter formats the client-measured download speed that we
+	// send to the server at the end of the download. It's set to its
+	// default value (FormatSpeedFloat) by NewClient; you may override it.
+	SpeedFormatter SpeedFormatter
+
 	// FQDN is the optional server FQDN. We will discover the FQDN of
 	// a nearby M-Lab server for you if this field is empty.
 	//
@@ -223,20 +652,384 @@ type Client struct {
 	// defaults in NewClient and you may override it.
 	MLabNSClient MlabNSClient
 
+	// DiscoveryCacheTTL is the amount of time for which we reuse a
+	// discovered server FQDN across calls to Start (and hence across
+	// RunN runs). When it expires, the next Start discovers a server
+	// again. A FQDN that you set explicitly never expires. Zero, the
+	// default, means that a discovered FQDN never expires either.
+	DiscoveryCacheTTL time.Duration
+
+	// LocateV2 indicates that we should discover a server using the locate
+	// v2 API, which also returns the access token required by token-gated
+	// servers. It's ignored unless MLabNSClient implements MlabNSClientV2,
+	// as the default mlabns client does.
+	LocateV2 bool
+
+	// AccessToken is the optional access token for token-gated servers. It's
+	// set when we discover a server using LocateV2; you may also set it. We
+	// pass it to a WSConnectionsFactory, while it's ignored by the raw
+	// transport, which does not support access tokens.
+	AccessToken string
+
+	// AccessTokenFile is the optional path of a file containing the access
+	// token, e.g., when a separate system provisions tokens rather than
+	// locate. When set, we read the file before each test, so that we pick
+	// up rotated tokens, and its content replaces AccessToken. Start fails
+	// if the file cannot be read or is empty.
+	AccessTokenFile string
+
+	// DiscoveryHTTPClient is the optional HTTP client used to discover
+	// a server. When set, it replaces the HTTPClient of the default
+	// mlabns client, so you can use a custom transport (e.g. a proxy or a
+	// custom TLS config). It's ignored if you override MLabNSClient.
+	DiscoveryHTTPClient *http.Client
+
+	// AdaptiveUpload enables the experimental adaptive upload, where the
+	// size of the upload message starts small and doubles as long as the
+	// measured speed keeps climbing, to find the message size maximizing
+	// the upload speed. The default is to use a fixed-size message.
+	AdaptiveUpload bool
+
+	// Streams is the number of parallel streams we would like to use for
+	// the download and the upload. When it's greater than one, we also ask
+	// for the extended tests of the legacy web100srv server (NDT v3.7),
+	// which may use several streams. The classic protocol cannot tell the
+	// server how many, so we open as many measurement connections as the
+	// server announces. Servers not implementing the extended tests, such
+	// as the M-Lab ndt-server, ignore the request and run the classic
+	// tests, which use a single stream. AdaptiveUpload is ignored when we
+	// use several streams. The default is a single stream.
+	Streams int
+
+	// ReconcileUpload caps the count of the final upload sample (i.e. of
+	// Result.ClientMeasuredUpload) to the number of bytes the server
+	// reported having received, when it reports them. We count the bytes
+	// we hand to the socket, so, with a large socket buffer, the count
+	// includes the bytes still buffered when the test ends, which the
+	// server never received, and thus overestimates the speed.
+	ReconcileUpload bool
+
+	// ResolveFQDN makes Start resolve the FQDN explicitly, recording how
+	// long it took in Result.Timings.DNSResolve. We then use the resolved
+	// address for the control and measurement connections, which avoids
+	// more lookups and separates DNS latency from connection latency.
+	ResolveFQDN bool
+
+	// SubtestTimeout is the optional maximum duration of each subtest (i.e.
+	// download and upload), including the control messages exchanged after
+	// the measurement. When a subtest times out, we emit a warning and
+	// continue with the next subtest. Zero, the default, means that each
+	// subtest is only bounded by the connections' deadlines.
+	SubtestTimeout time.Duration
+
+	// ReconnectControlOnError enables reconnecting the control connection
+	// when a subtest fails and there are more subtests to run, e.g., when
+	// the upload fails after the download. We cannot resume in the middle
+	// of the protocol, so we log in again requesting only the remaining
+	// subtests, and we wait in queue again. The failed subtest is not
+	// retried, and reconnecting after the last subtest is not possible,
+	// so we still fail if we cannot receive the results. We emit a warning
+	// each time we reconnect.
+	ReconnectControlOnError bool
+
+	// SpeedDivergence is the optional maximum percentage by which the
+	// client-measured and the server-measured speeds of a subtest may
+	// differ, relative to the server-measured speed. When they differ by
+	// more, we emit a warning wrapping ErrSpeedDivergence, since this
+	// usually indicates a middlebox, buffering, or a measurement bug.
+	// Zero, the default, disables the check.
+	SpeedDivergence float64
+
+	// MaxRetransmission is the optional maximum download retransmission
+	// rate, in percent (see TestResult.DownloadRetransmission). When it's
+	// exceeded, e.g., because the path is unacceptably lossy, we complete
+	// the test as usual but we emit a warning wrapping ErrMaxRetransmission
+	// and set Result.MaxRetransmissionExceeded. Zero, the default, disables
+	// the check.
+	MaxRetransmission float64
+
+	// MinDownload and MinUpload are the optional minimum acceptable
+	// speeds, in kbit/s, e.g., to verify an SLA. We compare them with the
+	// client-measured download speed and the server-measured upload speed,
+	// respectively. When the speed is lower, we complete the test as usual
+	// but we emit a warning wrapping ErrBelowThreshold (see also
+	// BelowThresholdError) and add the direction to Result.BelowThreshold.
+	// Zero, the default, disables the check.
+	MinDownload float64
+	MinUpload   float64
+
+	// BlackHoleWindow is the optional initial window of the upload during
+	// which we expect to send some bytes. If we cannot send any byte while
+	// the control connection works fine, the full-sized packets are most
+	// likely being dropped, i.e., there's a path MTU black hole, so we emit
+	// a warning wrapping ErrPathMTUBlackHole. Zero, the default, disables
+	// the check.
+	BlackHoleWindow time.Duration
+
+	// UploadWriteTimeout is the optional maximum time each write of the
+	// upload may take. When a write takes longer, e.g., because the
+	// connection stalled, we stop the upload and emit a warning wrapping
+	// ErrUploadStalled, rather than blocking until the deadline of the
+	// whole upload. Zero, the default, disables the per-write timeout.
+	UploadWriteTimeout time.Duration
+
+	// AnonymizeClientIP controls how we anonymize the client IP sent by
+	// the server in the web100 variables, before storing it in the Result
+	// and emitting it, which is useful for privacy-preserving publishing
+	// of the results. By default, we don't anonymize it.
+	AnonymizeClientIP AnonymizationMode
+
+	// ClientLocation is the optional location of the client, which the
+	// locate service does not return, e.g., a probe's configured location.
+	// When set, and when we know the location of the server's M-Lab metro
+	// (see ServerLocation), we save their distance in the Result.
+	ClientLocation *GeoLocation
+
+	// MaxServerDistance is the optional maximum plausible distance in km
+	// between the client and the server. When it's exceeded, e.g., because
+	// of a wrong region hint or a fallback of the locate service, we emit a
+	// warning wrapping ErrServerTooFar, since the geography then dominates
+	// the latency. Zero, the default, disables the check, which also
+	// requires ClientLocation.
+	MaxServerDistance float64
+
+	// MaxBytes is the optional cap on the number of bytes transferred by
+	// the download and the upload together. When the cap is reached, we stop
+	// measuring, emit a warning, and report the speed measured so far.
+	// Zero, the default, means no cap.
+	MaxBytes int64
+
+	// IdleTimeout is the optional maximum amount of time during which
+	// nothing may happen, i.e., we neither read nor write control messages
+	// nor collect measurement samples. When it's exceeded, e.g., because
+	// the server accepted the connection but stopped progressing with the
+	// protocol, we close the control connection and fail with an error
+	// wrapping ErrIdleTimeout. Zero, the default, disables the watchdog, so
+	// we're only bounded by the connections' deadlines.
+	IdleTimeout time.Duration
+
+	// Limiter is the optional Limiter bounding the number of concurrent
+	// tests, which you may share among several clients. When set, Start
+	// blocks until the Limiter allows the test to run, and the test holds
+	// the Limiter until its output channel is closed.
+	Limiter Limiter
+
+	// MeasurementCapture is the optional writer to which we copy the
+	// payload received during the download and sent during the upload,
+	// e.g., to check whether the server sends random data rather than
+	// compressible data that a middlebox might deflate. If writing fails,
+	// we emit a warning and stop capturing, but the test continues.
+	MeasurementCapture io.Writer
+
+	// MeasurementCaptureLimit is the maximum number of bytes we copy to
+	// MeasurementCapture during each test. Zero, the default, means that
+	// we copy all the bytes.
+	MeasurementCaptureLimit int64
+
+	// Rand is the optional source of randomness used to generate the
+	// upload payload, e.g., to get deterministic payloads in tests and
+	// benchmarks. We use it from the test goroutine only, so you must
+	// not share it among concurrent clients. When nil, the default, we
+	// use a new source seeded with the current time for each upload.
+	Rand *rand.Rand
+
+	// ReusePayload makes the upload use a random payload generated once and
+	// shared by all the tests and clients in the process, rather than a new
+	// one for each upload, which saves CPU time and memory on constrained
+	// devices (e.g. routers). Reusing the same payload is fine for measuring
+	// the throughput, since the payload is not compressed. Rand is ignored.
+	ReusePayload bool
+
+	// RepeatPause is the amount of time RunN waits between two
+	// consecutive runs. It's zero by default; you may override it.
+	RepeatPause time.Duration
+
+	// PostTestDelay is the optional amount of time we wait at the end of
+	// the measurement phase of each subtest, before sending our TestMsg
+	// in the download and before waiting for the server's one in the
+	// upload, so that the TCP stack of the server settles and its final
+	// TCPInfo snapshots are accurate. It should be smaller than
+	// IdleTimeout, which keeps running while we wait.
+	PostTestDelay time.Duration
+
+	// Strict makes RunN treat warnings, e.g., the failure of a subtest
+	// after which we continue with the next one, as errors, which is
+	// useful in CI. Each run still completes. It does not affect Start.
+	Strict bool
+
+	// ConvergenceThreshold and ConvergenceWindow enable stopping each
+	// subtest early once the speed has converged, i.e., when the
+	// coefficient of variation (the standard deviation divided by the
+	// mean) of the speeds measured between consecutive samples stays
+	// below ConvergenceThreshold (e.g. 0.05) over the last
+	// ConvergenceWindow. This saves time and data on stable links. See
+	// Result.ConvergedDownload and Result.ConvergedUpload. The default is
+	// to always measure for the duration chosen by the server.
+	ConvergenceThreshold float64
+	ConvergenceWindow    time.Duration
+
+	// DrainAfterLogout is the optional amount of time during which we keep
+	// reading the control connection after the logout message, until EOF,
+	// saving any results message into Result.TrailingMessages, since some
+	// servers send diagnostic messages after logging out. The default is
+	// to stop reading at the logout message.
+	DrainAfterLogout time.Duration
+
+	// DisableMetadata disables sending the metadata describing the client
+	// (i.e. the OS, the architecture, the Go version, and the library and
+	// application versions) to the server using the META test, which gives
+	// M-Lab visibility into the clients population, as well as storing it
+	// in the Result. You may want to set it for privacy reasons.
+	DisableMetadata bool
+
+	// Labels contains optional client-provided labels (e.g. a probe ID
+	// or the connection type) that are copied verbatim into the Result
+	// of each test, so that they flow through to its output.
+	Labels map[string]string
+
+	// ResultProcessor is the optional hook called with the Result when a
+	// test started by Start completes, successfully or not, which may modify
+	// the Result, e.g., to add an ISP lookup, to anonymize the client IP,
+	// or to compute derived metrics. We call it once per test, before
+	// OnComplete, so that OnComplete and whoever reads the Result after the
+	// output channel is closed (e.g. RunN) see the processed Result.
+	ResultProcessor func(result *TestResult)
+
+	// OnComplete is the optional hook called with the Result when a test
+	// started by Start completes, successfully or not, just before the
+	// output channel is closed, and after ResultProcessor. If it fails, we
+	// emit a warning, so you can use it, e.g., to publish the results
+	// without failing the test.
+	OnComplete func(result *TestResult) error
+
+	// OnSample is the optional hook called with each sample of the download
+	// and of the upload, whose direction is "download" or "upload", which
+	// is simpler and cheaper than consuming the CurDownloadSpeed and the
+	// CurUploadSpeed events, e.g., to feed a moving average. It's called
+	// synchronously by the goroutine performing the measurement, so it
+	// must not block, or it would slow down the measurement.
+	OnSample func(direction string, s Speed)
+
+	// Observer is the optional ClientObserver notified of the progress of
+	// each test, which is a typed alternative to consuming the Output
+	// channel, e.g., for GUIs. See ClientObserver for the threading
+	// expectations.
+	Observer ClientObserver
+
+	// Logger is the optional structured logger. When set, every event
+	// emitted by the client is also logged with a level matching the
+	// event type and with the FQDN and the current phase as attributes.
+	// Events emitted by a FrameReadWriteObserver are not logged.
+	Logger *slog.Logger
+
+	// RecordEvents makes the client record every event it emits, along
+	// with its timestamp, which you can retrieve using Events after the
+	// test, e.g., for debugging or for generating test fixtures.
+	RecordEvents bool
+
 	// Results is the result of the test. It contains the bytes sent/received
 	// for each test and web100 data sent by the server at the end of an
 	// S2C test.
 	Result TestResult
+
+	// frameHandlers maps the custom message types to their handlers. See
+	// RegisterFrameHandler.
+	frameHandlers map[uint8]FrameHandler
+
+	// phase is the phase of the test we're currently running.
+	phase string
+
+	// stats tracks the measurement in progress.
+	stats statsTracker
+
+	// events records the emitted events when RecordEvents is true.
+	events eventRecorder
+
+	// capture copies the payload to MeasurementCapture, if set.
+	capture *captureWriter
+
+	// idle aborts the test when IdleTimeout is exceeded, if set.
+	idle *idleWatchdog
+
+	// discoveredFQDN is the FQDN we discovered, if any.
+	discoveredFQDN string
+
+	// discoveredAt is when we discovered discoveredFQDN.
+	discoveredAt time.Time
+
+	// address is the address we dial, which is either c.FQDN or, when
+	// using ResolveFQDN, the resolved address.
+	address string
+
+	// host is the host of c.address, without the port and the brackets
+	// of IPv6 literals, which we join with the port of each measurement
+	// connection.
+	host string
+
+	// conformance records the steps of the protocol while running Conform.
+	conformance *conformanceRecorder
+
+	// bytesUsed is the number of bytes transferred by the current test. It
+	// is only updated by the downloader and uploader goroutines, which do
+	// not run concurrently.
+	bytesUsed int64
 }
 
-// Output is the output emitted by ndt5
+// Output is the output emitted by ndt5. An ErrorMessage means that the
+// test failed, while a WarningMessage reports a problem after which the test
+// continues, e.g. a failed subtest or a malformed web100 message. Note that
+// earlier versions emitted such problems as ErrorMessage.
 type Output struct {
-	CurDownloadSpeed *Speed      `json:",omitempty"`
-	CurUploadSpeed   *Speed      `json:",omitempty"`
-	DebugMessage     *LogMessage `json:",omitempty"`
-	ErrorMessage     *Failure    `json:",omitempty"`
-	InfoMessage      *LogMessage `json:",omitempty"`
-	WarningMessage   *Failure    `json:",omitempty"`
+	Connected           *ConnectedInfo       `json:",omitempty"`
+	CurDownloadSpeed    *Speed               `json:",omitempty"`
+	CurUploadSpeed      *Speed               `json:",omitempty"`
+	DebugMessage        *LogMessage          `json:",omitempty"`
+	ErrorMessage        *Failure             `json:",omitempty"`
+	InfoMessage         *LogMessage          `json:",omitempty"`
+	MeasurementConnInfo *MeasurementConnInfo `json:",omitempty"`
+	Progress            *ProgressInfo        `json:",omitempty"`
+	WarningMessage      *Failure             `json:",omitempty"`
+}
+
+// SpeedFormatter formats the client-measured download speed, in kbit/s,
+// as the body of the TestMsg message sent to the server at the end of
+// the download. The server expects a decimal number of kbit/s.
+type SpeedFormatter func(kbitps float64) string
+
+// FormatSpeedFloat formats the speed using six decimal digits (e.g.
+// "1234.567890"), like libndt does. This is the default.
+func FormatSpeedFloat(kbitps float64) string {
+	return fmt.Sprintf("%f", kbitps)
+}
+
+// FormatSpeedInteger formats the speed as an integer (e.g. "1235"), like
+// the reference web client does.
+func FormatSpeedInteger(kbitps float64) string {
+	return strconv.FormatInt(int64(math.Round(kbitps)), 10)
+}
+
+// MeasurementConnInfo describes a measurement connection we established.
+type MeasurementConnInfo struct {
+	Direction  string // either "download" or "upload"
+	LocalAddr  string
+	RemoteAddr string
+}
+
+// subtestDuration is the nominal duration of the download and of the
+// upload. The server stops the download after about this time, and we
+// stop the upload after this time.
+const subtestDuration = 10 * time.Second
+
+// ProgressInfo tells the progress of the download or of the upload, which
+// we emit along with each speed sample, e.g., to drive a progress bar.
+type ProgressInfo struct {
+	Direction string // either "download" or "upload"
+
+	// Percent is the elapsed time as a percentage of the nominal duration
+	// of the subtest. It grows with each sample, restarts from zero with
+	// each subtest, and never exceeds 100, even if the subtest runs longer,
+	// while it does not reach 100 if the subtest stops early.
+	Percent float64
 }
 
 // LogMessage contains a log message
@@ -255,6 +1048,45 @@ type Speed struct {
 	Elapsed time.Duration // nanoseconds since beginning
 }
 
+// speedJSON is the JSON representation of Speed.
+type speedJSON struct {
+	Count          int64
+	Elapsed        time.Duration
+	ElapsedSeconds float64
+}
+
+// MarshalJSON implements json.Marshaler. Besides the Count and the Elapsed
+// nanoseconds, it emits the ElapsedSeconds, which are easier to read.
+func (s Speed) MarshalJSON() ([]byte, error) {
+	return json.Marshal(speedJSON{
+		Count:          s.Count,
+		Elapsed:        s.Elapsed,
+		ElapsedSeconds: s.Elapsed.Seconds(),
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It ignores ElapsedSeconds
+// unless Elapsed is missing, because Elapsed is more precise.
+func (s *Speed) UnmarshalJSON(data []byte) error {
+	var v speedJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	s.Count = v.Count
+	s.Elapsed = v.Elapsed
+	if s.Elapsed == 0 {
+		s.Elapsed = time.Duration(v.ElapsedSeconds * float64(time.Second))
+	}
+	return nil
+}
+
+// kbitps returns the speed in kbit/s, using a millisecond resolution
+// for the elapsed time like the ndt5 servers do.
+func (s *Speed) kbitps() float64 {
+	elapsed := float64(s.Elapsed / time.Millisecond)
+	return 8 * float64(s.Count) / elapsed
+}
+
 const (
 	// libraryName is the name of this library
 	libraryName = "ndt5-client-go"
@@ -271,10 +1103,23 @@ func NewClient(clientName, clientVersion, nsURL string) *Client {
 		ClientName:      clientName,
 		ClientVersion:   clientVersion,
 		ProtocolFactory: new(ProtocolFactory5),
+		SpeedFormatter:  FormatSpeedFloat,
 		MLabNSClient:    ns,
 	}
 }
 
+// copyLabels returns a copy of c.Labels or nil if there are no labels.
+func (c *Client) copyLabels() map[string]string {
+	if len(c.Labels) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(c.Labels))
+	for k, v := range c.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
 // makeUserAgent creates the user agent string
 func makeUserAgent(clientName, clientVersion string) string {
 	return clientName + "/" + clientVersion + " " + libraryName + "/" + libraryVersion
@@ -285,26 +1130,236 @@ func makeUserAgent(clientName, clientVersion string) string {
 // closed when the test ends. On failure, the error is non nil and you should
 // not attempt using the channel. A side effect of starting the test is that, if
 // you did not specify a server FQDN, we will discover a server for you and store
-// that value into the c.FQDN field. This is done without locking.
+// that value into the c.FQDN field. This is done without locking. Such value is
+// reused by later calls to Start until c.DiscoveryCacheTTL expires. When
+// c.Limiter is set, Start blocks until the Limiter allows the test to run.
+// The deadline of ctx, if any, bounds the whole test, including discovery
+// and waiting in queue, and the error emitted when it expires wraps
+// ErrTestTimeout and tells the phase during which it expired. The error
+// returned by Start, as well as the ErrorMessage emitted when the test fails,
+// is a *PhaseError, which you can pass to ErrorCode.
 func (c *Client) Start(ctx context.Context) (<-chan *Output, error) {
-	if c.FQDN == "" {
-		fqdn, err := c.MLabNSClient.Query(ctx)
+	if c.Limiter != nil {
+		if err := c.Limiter.Acquire(ctx); err != nil {
+			return nil, fmt.Errorf("cannot acquire the limiter: %w", err)
+		}
+	}
+	ch, err := c.start(ctx)
+	if err != nil {
+		c.release()
+		return nil, &PhaseError{Phase: c.phase, Err: err}
+	}
+	return ch, nil
+}
+
+// release releases the Limiter, if any.
+func (c *Client) release() {
+	if c.Limiter != nil {
+		c.Limiter.Release()
+	}
+}
+
+// start is like Start but does not acquire the Limiter.
+func (c *Client) start(ctx context.Context) (<-chan *Output, error) {
+	if c.FQDN == "" || c.discoveryExpired() {
+		c.setPhase(phaseDiscovery)
+		fqdn, err := c.discover(ctx)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%w: %w", ErrDiscoveryFailed, c.wrapTimeout(ctx, err))
 		}
 		c.FQDN = fqdn
+		c.discoveredFQDN = fqdn
+		c.discoveredAt = time.Now()
+	}
+	c.address = c.FQDN
+	c.setPhase(phaseConnect)
+	if c.ResolveFQDN {
+		if err := c.resolve(ctx); err != nil {
+			return nil, err
+		}
+	}
+	c.host = hostOf(c.address)
+	if err := c.applyAccessToken(); err != nil {
+		return nil, err
 	}
 	ch := make(chan *Output, 1) // buffer for connection established message
 	proto, err := c.ProtocolFactory.NewProtocol(
-		ctx, c.FQDN, makeUserAgent(c.ClientName, c.ClientVersion), ch,
+		ctx, c.address, makeUserAgent(c.ClientName, c.ClientVersion), ch,
 	)
 	if err != nil {
-		return nil, err
+		return nil, c.wrapTimeout(ctx, err)
+	}
+	c.Result.Labels = c.copyLabels()
+	c.Result.Metadata = nil
+	c.Result.Subtests = nil
+	c.Result.TestIDs = nil
+	c.Result.ServerDistance = 0
+	c.Result.TrailingMessages = nil
+	c.Result.AddressFamily = addressFamily(proto)
+	c.Result.MaxBytesReached = false
+	c.Result.BelowThreshold = nil
+	c.Result.MaxRetransmissionExceeded = false
+	if c.Observer != nil {
+		var addr net.Addr
+		if conn, ok := proto.(remoteAddrer); ok {
+			addr = conn.RemoteAddr()
+		}
+		c.Observer.OnConnected(addr)
+	}
+	suite := testSuite
+	if !c.DisableMetadata {
+		c.Result.Metadata = c.metadata()
+		suite |= nettestMeta
+	}
+	if c.Streams > 1 {
+		suite |= nettestUploadExt | nettestDownloadExt
+	}
+	if setter, ok := proto.(testSuiteSetter); ok && suite != testSuite {
+		setter.SetTestSuite(suite)
+	}
+	c.bytesUsed = 0
+	c.events.reset()
+	c.capture = nil
+	if c.MeasurementCapture != nil {
+		c.capture = newCaptureWriter(c.MeasurementCapture, c.MeasurementCaptureLimit)
 	}
 	go c.run(ctx, proto, ch)
 	return ch, nil
 }
 
+// RunN runs the whole ndt5 test n times against the same server and
+// returns the result of each run. Server discovery, if needed, only
+// happens before the first run. RunN waits for c.RepeatPause between
+// consecutive runs. The events emitted by each run are consumed and
+// discarded; if a run emits an error, RunN stops and returns the results
+// collected so far along with such error. With c.Strict, a warning (e.g.
+// a failed subtest) is treated like an error, although only once the run
+// has completed.
+func (c *Client) RunN(ctx context.Context, n int) ([]TestResult, error) {
+	var results []TestResult
+	for i := 0; i < n; i++ {
+		if i > 0 && c.RepeatPause > 0 {
+			select {
+			case <-time.After(c.RepeatPause):
+			case <-ctx.Done():
+				return results, ctx.Err()
+			}
+		}
+		c.Result = TestResult{}
+		ch, err := c.Start(ctx)
+		if err != nil {
+			return results, err
+		}
+		var failure error
+		for ev := range ch {
+			if ev.ErrorMessage != nil && failure == nil {
+				failure = ev.ErrorMessage.Error
+			}
+			if ev.WarningMessage != nil && c.Strict && failure == nil {
+				failure = ev.WarningMessage.Error
+			}
+		}
+		if failure != nil {
+			return results, failure
+		}
+		results = append(results, c.Result)
+	}
+	return results, nil
+}
+
+// discoveryExpired returns whether c.FQDN has been discovered by us
+// and c.DiscoveryCacheTTL has expired since then.
+func (c *Client) discoveryExpired() bool {
+	return c.DiscoveryCacheTTL > 0 && c.FQDN == c.discoveredFQDN &&
+		time.Since(c.discoveredAt) > c.DiscoveryCacheTTL
+}
+
+// resolve resolves the host of c.FQDN, records how long it took, and
+// replaces the host of c.address with the first resolved address. When
+// using WebSocket, we also make sure TLS still verifies c.FQDN.
+func (c *Client) resolve(ctx context.Context) error {
+	host, port, err := net.SplitHostPort(c.FQDN)
+	if err != nil {
+		host, port = hostOf(c.FQDN), ""
+	}
+	if net.ParseIP(host) != nil {
+		return nil // nothing to resolve
+	}
+	begin := time.Now()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return err
+	}
+	c.Result.Timings.DNSResolve = time.Since(begin)
+	c.address = addrs[0]
+	if port != "" {
+		c.address = net.JoinHostPort(addrs[0], port)
+	}
+	if pf, ok := c.ProtocolFactory.(*ProtocolFactory5); ok {
+		if ws, ok := pf.ConnectionsFactory.(*WSConnectionsFactory); ok {
+			ws.setServerName(host)
+		}
+	}
+	return nil
+}
+
+// applyAccessToken reads the AccessTokenFile, if any, and passes the
+// AccessToken, if any, to the WebSocket
+// connections factory used by the default ProtocolFactory.
+func (c *Client) applyAccessToken() error {
+	if c.AccessTokenFile != "" {
+		data, err := os.ReadFile(c.AccessTokenFile)
+		if err != nil {
+			return fmt.Errorf("cannot read the access token file: %w", err)
+		}
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return fmt.Errorf("the access token file %s is empty", c.AccessTokenFile)
+		}
+		c.AccessToken = token
+	}
+	if c.AccessToken == "" {
+		return nil
+	}
+	pf, ok := c.ProtocolFactory.(*ProtocolFactory5)
+	if !ok {
+		return nil
+	}
+	if ws, ok := pf.ConnectionsFactory.(*WSConnectionsFactory); ok {
+		ws.AccessToken = c.AccessToken
+	}
+	return nil
+}
+
+// Discover only discovers a nearby server, as Start would do, and returns
+// its FQDN, e.g., to share it with other tools. It does not change FQDN,
+// so you need to set it to test against the returned server; with
+// LocateV2, it saves the access token in AccessToken for such a test. The
+// returned error wraps ErrDiscoveryFailed.
+func (c *Client) Discover(ctx context.Context) (string, error) {
+	fqdn, err := c.discover(ctx)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrDiscoveryFailed, err)
+	}
+	return fqdn, nil
+}
+
+// discover discovers a nearby ndt5 server using mlabns.
+func (c *Client) discover(ctx context.Context) (string, error) {
+	if ns, ok := c.MLabNSClient.(*mlabns.Client); ok && c.DiscoveryHTTPClient != nil {
+		ns.HTTPClient = c.DiscoveryHTTPClient
+	}
+	if ns, ok := c.MLabNSClient.(MlabNSClientV2); ok && c.LocateV2 {
+		target, err := ns.QueryV2(ctx)
+		if err != nil {
+			return "", err
+		}
+		c.AccessToken = target.AccessToken()
+		return target.FQDN, nil
+	}
+	return c.MLabNSClient.Query(ctx)
+}
+
 const (
 	maxResultsLoops = 128
 
@@ -316,88 +1371,294 @@ const (
 	msgTestFinalize  uint8 = 6
 	msgResults       uint8 = 8
 	msgLogout        uint8 = 9
+	msgWaiting       uint8 = 10
 	msgExtendedLogin uint8 = 11
 
 	nettestUpload   uint8 = 1 << 1
 	nettestDownload uint8 = 1 << 2
 	nettestStatus   uint8 = 1 << 4
+	nettestMeta     uint8 = 1 << 5
+
+	nettestUploadExt   uint8 = 1 << 6
+	nettestDownloadExt uint8 = 1 << 7
+
+	phaseDiscovery = "discovery"
+	phaseConnect   = "connect"
+	phaseLogin     = "login"
+	phaseQueue     = "queue"
+	phaseDownload  = "download"
+	phaseUpload    = "upload"
+	phaseMeta      = "meta"
+	phaseResults   = "results"
 )
 
 // run performs the ndt5 experiment. This function takes ownership of
 // the conn argument and will close the ch argument when done.
 func (c *Client) run(ctx context.Context, proto Protocol, ch chan<- *Output) {
 	defer close(ch)
-	defer proto.Close()
-	c.emitProgress(fmt.Sprintf("using %s", c.FQDN), ch)
-	if err := proto.SendLogin(); err != nil {
-		c.emitError(fmt.Errorf("cannot send login message: %w", err), ch)
+	defer c.release()
+	defer c.complete(ctx, ch)
+	stop := closeOnDone(ctx, proto)
+	defer func() {
+		stop()
+		proto.Close()
+	}()
+	c.idle = nil
+	if c.IdleTimeout > 0 {
+		c.idle = newIdleWatchdog(c.IdleTimeout)
+		defer c.idle.stop()
+	}
+	c.idle.watch(proto)
+	c.hookEmit(ctx, proto, ch)
+	c.emitProgress(ctx, fmt.Sprintf("using %s", c.FQDN), ch)
+	c.checkServerDistance(ctx, ch)
+	testIDs, err := c.handshake(ctx, proto, ch)
+	if err != nil {
+		c.emitError(ctx, err, ch)
 		return
 	}
-	c.emitProgress("sent login message", ch)
-	if err := proto.ReceiveKickoff(); err != nil {
-		c.emitError(fmt.Errorf("cannot receive kickoff message: %w", err), ch)
+	if measurer, ok := proto.(controlRTTMeasurer); ok {
+		c.Result.ControlRTT = measurer.ControlRTT()
+	}
+	for len(testIDs) > 0 {
+		testID := testIDs[0]
+		testIDs = testIDs[1:]
+		if err := c.runTestID(ctx, proto, testID, ch); err == nil ||
+			!c.ReconnectControlOnError || len(testIDs) == 0 {
+			continue
+		}
+		newproto, err := c.reconnect(ctx, proto, testIDs, ch)
+		if err != nil {
+			c.emitError(ctx, fmt.Errorf("cannot reconnect: %w", err), ch)
+			return
+		}
+		stop()
+		proto.Close()
+		proto = newproto
+		stop = closeOnDone(ctx, proto)
+		c.idle.watch(proto)
+		c.hookEmit(ctx, proto, ch)
+		if testIDs, err = c.handshake(ctx, proto, ch); err != nil {
+			c.emitError(ctx, err, ch)
+			return
+		}
+	}
+	c.setPhase(phaseResults)
+	c.emitProgress(ctx, "receiving the results", ch)
+	if err := c.recvResultsAndLogout(ctx, proto, ch); err != nil {
+		c.emitError(ctx, fmt.Errorf("recvResultsAndLogout failed: %w", err), ch)
 		return
 	}
-	c.emitProgress("received the kickoff message", ch)
+	c.drainAfterLogout(ctx, proto, ch)
+	c.emitProgress(ctx, "finished successfully", ch)
+}
+
+// complete calls ResultProcessor, OnComplete, and the Observer, if set, and
+// emits a warning if OnComplete fails.
+func (c *Client) complete(ctx context.Context, ch chan<- *Output) {
+	if c.ResultProcessor != nil {
+		c.ResultProcessor(&c.Result)
+	}
+	if c.OnComplete != nil {
+		if err := c.OnComplete(&c.Result); err != nil {
+			c.emitWarning(ctx, fmt.Errorf("OnComplete failed: %w", err), ch)
+		}
+	}
+	if c.Observer != nil {
+		c.Observer.OnComplete(c.Result)
+	}
+}
+
+// closeOnDone arranges for proto to be closed as soon as ctx is done,
+// which unblocks any pending I/O. Call the returned func to stop it.
+func closeOnDone(ctx context.Context, proto Protocol) func() bool {
+	return context.AfterFunc(ctx, func() {
+		proto.Close()
+	})
+}
+
+// handshake logs in, waits in queue, and returns the IDs of the tests
+// that the server wants to run.
+func (c *Client) handshake(ctx context.Context, proto Protocol, ch chan<- *Output) ([]uint8, error) {
+	c.setPhase(phaseLogin)
+	begin := time.Now()
+	if err := proto.SendLogin(); err != nil {
+		return nil, fmt.Errorf("cannot send login message: %w", err)
+	}
+	c.emitProgress(ctx, "sent login message", ch)
+	if err := proto.ReceiveKickoff(); err != nil {
+		return nil, fmt.Errorf("cannot receive kickoff message: %w", err)
+	}
+	c.Result.Timings.LoginRTT = time.Since(begin)
+	c.emitProgress(ctx, fmt.Sprintf("received the kickoff message (login RTT: %s)",
+		c.Result.Timings.LoginRTT), ch)
+	c.setPhase(phaseQueue)
 	if err := proto.WaitInQueue(); err != nil {
-		c.emitError(fmt.Errorf("cannot wait in queue: %w", err), ch)
-		return
+		return nil, fmt.Errorf("cannot wait in queue: %w", err)
 	}
-	c.emitProgress("cleared to run the tests", ch)
+	c.emitProgress(ctx, "cleared to run the tests", ch)
+	c.setPhase(phaseLogin)
 	version, err := proto.ReceiveVersion()
 	if err != nil {
-		c.emitError(fmt.Errorf("cannot receive server's version: %w", err), ch)
-		return
+		return nil, fmt.Errorf("cannot receive server's version: %w", err)
+	}
+	c.emitProgress(ctx, fmt.Sprintf("got remote server version: %s", version), ch)
+	c.Result.ServerVersion = version
+	c.emitConnected(ctx, proto, ch)
+	c.Result.VersionValid = validVersion(version)
+	if !c.Result.VersionValid {
+		c.emitWarning(ctx, fmt.Errorf("%w: %q", ErrInvalidServerVersion, version), ch)
 	}
-	c.emitProgress(fmt.Sprintf("got remote server version: %s", version), ch)
 	testIDs, err := proto.ReceiveTestIDs()
 	if err != nil {
-		c.emitError(fmt.Errorf("cannot receive test IDs: %w", err), ch)
-		return
+		return nil, fmt.Errorf("cannot receive test IDs: %w", err)
 	}
-	c.emitProgress(fmt.Sprintf("got list of test IDs: %+v", testIDs), ch)
+	c.emitProgress(ctx, fmt.Sprintf("got list of test IDs: %+v", testIDs), ch)
+	testIDs = c.validateTestIDs(ctx, testIDs, ch)
+	if c.Result.TestIDs == nil {
+		c.Result.TestIDs = make([]int, 0, len(testIDs))
+		for _, testID := range testIDs {
+			c.Result.TestIDs = append(c.Result.TestIDs, int(testID))
+		}
+	}
+	return testIDs, nil
+}
+
+// validateTestIDs returns testIDs without the duplicate IDs, emitting a
+// warning for each of them, as well as for each ID we don't know, which
+// we keep but will not run.
+func (c *Client) validateTestIDs(ctx context.Context, testIDs []uint8, ch chan<- *Output) []uint8 {
+	var (
+		seen  = make(map[uint8]bool)
+		valid []uint8
+	)
 	for _, testID := range testIDs {
-		switch testID {
-		case nettestDownload:
-			c.emitProgress("running the download test", ch)
-			if err := c.runDownload(ctx, proto, ch); err != nil {
-				c.emitWarning(fmt.Errorf("download failed: %w", err), ch)
-				// don't stop testing
-			}
-		case nettestUpload:
-			c.emitProgress("running the upload test", ch)
-			if err := c.runUpload(ctx, proto, ch); err != nil {
-				c.emitWarning(fmt.Errorf("upload failed: %w", err), ch)
-				// don't stop testing
-			}
+		if seen[testID] {
+			c.emitWarning(ctx, fmt.Errorf("%w: duplicate test ID %d", ErrUnexpectedTestIDs, testID), ch)
+			continue
+		}
+		seen[testID] = true
+		if !c.knownTestID(testID) {
+			c.emitWarning(ctx, fmt.Errorf("%w: unknown test ID %d", ErrUnexpectedTestIDs, testID), ch)
 		}
+		valid = append(valid, testID)
 	}
-	c.emitProgress("receiving the results", ch)
-	if err := c.recvResultsAndLogout(proto, ch); err != nil {
-		c.emitError(fmt.Errorf("recvResultsAndLogout failed: %w", err), ch)
-		return
+	return valid
+}
+
+// knownTestID tells whether we know the test with the given ID, which is
+// the case for the extended tests only if we requested them.
+func (c *Client) knownTestID(testID uint8) bool {
+	switch testID {
+	case nettestDownload, nettestUpload, nettestMeta:
+		return true
+	case nettestDownloadExt, nettestUploadExt:
+		return c.Streams > 1
+	}
+	return false
+}
+
+// runTestID runs the test with the given ID. A failing test does not stop
+// testing, so we emit a warning and return the error.
+func (c *Client) runTestID(ctx context.Context, proto Protocol, testID uint8, ch chan<- *Output) error {
+	if !c.knownTestID(testID) {
+		return nil // we don't know this test, so we did not run it
 	}
-	c.emitProgress("finished successfully", ch)
+	record := SubtestRecord{ID: testID, Start: time.Now()}
+	var err error
+	switch testID {
+	case nettestDownload, nettestDownloadExt:
+		c.setPhase(phaseDownload)
+		c.emitProgress(ctx, "running the download test", ch)
+		if err = c.runSubtest(ctx, proto, ch, c.runDownload); err != nil {
+			err = fmt.Errorf("download failed: %w", err)
+		}
+	case nettestUpload, nettestUploadExt:
+		c.setPhase(phaseUpload)
+		c.emitProgress(ctx, "running the upload test", ch)
+		if err = c.runSubtest(ctx, proto, ch, c.runUpload); err != nil {
+			err = fmt.Errorf("upload failed: %w", err)
+		}
+	case nettestMeta:
+		c.setPhase(phaseMeta)
+		c.emitProgress(ctx, "running the meta test", ch)
+		if err = c.runSubtest(ctx, proto, ch, c.runMeta); err != nil {
+			err = fmt.Errorf("meta failed: %w", err)
+		}
+	}
+	record.Direction = c.phase
+	record.End = time.Now()
+	if c.Observer != nil {
+		c.Observer.OnPhaseComplete(Phase(c.phase), err)
+	}
+	record.Success = err == nil
+	if err != nil {
+		record.Error = err.Error()
+	}
+	c.Result.Subtests = append(c.Result.Subtests, record)
+	if err != nil {
+		c.emitWarning(ctx, c.wrapTimeout(ctx, c.idle.wrap(err)), ch)
+	}
+	return err
+}
+
+// reconnect creates a new protocol requesting only the given tests. The
+// caller is responsible for closing the old protocol and for performing
+// the handshake using the new protocol.
+func (c *Client) reconnect(
+	ctx context.Context, proto Protocol, testIDs []uint8, ch chan<- *Output) (Protocol, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	c.emitWarning(ctx, fmt.Errorf("%w: resuming with test IDs %+v", ErrControlReconnect, testIDs), ch)
+	newproto, err := c.ProtocolFactory.NewProtocol(
+		ctx, c.address, makeUserAgent(c.ClientName, c.ClientVersion), ch,
+	)
+	if err != nil {
+		return nil, err
+	}
+	setter, ok := newproto.(testSuiteSetter)
+	if !ok {
+		newproto.Close()
+		return nil, ErrReconnectNotSupported
+	}
+	suite := nettestStatus
+	for _, testID := range testIDs {
+		suite |= testID
+	}
+	setter.SetTestSuite(suite)
+	return newproto, nil
 }
 
 func (c *Client) runUpload(ctx context.Context, proto Protocol, ch chan<- *Output) error {
-	testdata := c.makeBuffer()
+	size := 1 << 17
+	if c.AdaptiveUpload {
+		size = adaptiveMaxMessageSize
+	}
+	testdata := c.makeBuffer(size)
 	portnum, err := proto.ExpectTestPrepare()
 	if err != nil {
 		err = fmt.Errorf("cannot get TestPrepare message: %w", err)
 		return err
 	}
-	c.emitProgress("got TestPrepare message", ch)
-	testconn, err := proto.DialUploadConn(
-		ctx, net.JoinHostPort(c.FQDN, portnum),
-		makeUserAgent(c.ClientName, c.ClientVersion),
-	)
+	c.emitProgress(ctx, "got TestPrepare message", ch)
+	testconn, err := c.dialMeasurementConns(
+		ctx, proto, net.JoinHostPort(c.host, portnum), proto.DialUploadConn)
 	if err != nil {
-		err = fmt.Errorf("cannot create measurement connection: %w", err)
-		return err
+		return measurementDialError(ctx, portnum, err)
 	}
-	c.emitProgress("created measurement connection", ch)
-	if err := testconn.SetDeadline(time.Now().Add(10 * time.Second)); err != nil {
+	c.emitProgress(ctx, "created measurement connection", ch)
+	defer testconn.Close() // in case we fail before starting the sampler
+	stop := context.AfterFunc(ctx, func() {
+		testconn.Close() // unblock the sampler
+	})
+	defer stop()
+	c.emitMeasurementConnInfo(ctx, testconn, ch)
+	c.saveCongestionControl(ctx, testconn, ch)
+	c.saveMSS(ctx, testconn, ch)
+	c.setCapture(ctx, testconn, ch)
+	deadline := time.Now().Add(subtestDuration)
+	if err := testconn.SetDeadline(deadline); err != nil {
 		err = fmt.Errorf("cannot set measurement connection deadline: %w", err)
 		return err
 	}
@@ -405,38 +1666,133 @@ func (c *Client) runUpload(ctx context.Context, proto Protocol, ch chan<- *Outpu
 		err = fmt.Errorf("cannot get TestStart message: %w", err)
 		return err
 	}
-	c.emitProgress("got TestStart message", ch)
-	testconn.SetPreparedMessage(testdata)
+	c.emitProgress(ctx, "got TestStart message", ch)
+	var sizer *messageSizer
+	if _, parallel := testconn.(*parallelConn); c.AdaptiveUpload && !parallel {
+		sizer = newMessageSizer(testconn, testdata)
+	} else {
+		testconn.SetPreparedMessage(testdata)
+	}
 	testch := make(chan *Speed)
-	go c.uploader(testconn, testch)
-	c.emitProgress("uploader goroutine forked off", ch)
-	for speed := range testch {
-		c.emit(&Output{CurUploadSpeed: speed}, ch)
+	c.stats.start(phaseUpload)
+	var writeErr error
+	go c.uploader(testconn, sizer, testch, deadline, &writeErr)
+	c.emitProgress(ctx, "uploader goroutine forked off", ch)
+	var window <-chan time.Time
+	if c.BlackHoleWindow > 0 {
+		timer := time.NewTimer(c.BlackHoleWindow)
+		defer timer.Stop()
+		window = timer.C
+	}
+	var lastSample *Speed
+	c.Result.ConvergedUpload = 0
+	convergence := newConvergenceDetector(c.ConvergenceThreshold, c.ConvergenceWindow)
+	for testch != nil {
+		select {
+		case <-window:
+			window = nil
+			c.checkBlackHole(ctx, ch)
+		case speed, ok := <-testch:
+			if !ok {
+				testch = nil
+				break
+			}
+			c.stats.sample(speed)
+			c.idle.reset()
+			c.emit(ctx, &Output{CurUploadSpeed: speed}, ch)
+			c.emitPercent(ctx, phaseUpload, speed, ch)
+			lastSample = speed
+			if c.Result.ConvergedUpload == 0 {
+				if mean, ok := convergence.add(*speed); ok {
+					c.Result.ConvergedUpload = mean
+					c.emitConvergence(ctx, phaseUpload, mean, ch)
+					testconn.Close() // stop the sampler
+				}
+			}
+		}
+	}
+	c.stats.stop()
+	c.checkUploadStall(ctx, writeErr, deadline, ch)
+	c.checkMaxBytes(ctx, ch)
+	c.checkCapture(ctx, ch)
+	if sizer != nil {
+		c.Result.UploadMessageSize = sizer.best.Size
+		c.Result.UploadMessageSizeCurve = sizer.curve
+		c.emitProgress(ctx, fmt.Sprintf("best upload message size: %d", sizer.best.Size), ch)
+	}
+	c.emitProgress(ctx, "uploader goroutine terminated", ch)
+	if err := c.postTestDelay(ctx); err != nil {
+		return err
 	}
-	c.emitProgress("uploader goroutine terminated", ch)
 	speed, err := proto.ExpectTestMsg()
 	if err != nil {
 		err = fmt.Errorf("cannot get TestMsg message: %w", err)
 		return err
 	}
-	c.Result.ServerMeasuredUpload, err = strconv.ParseFloat(speed, 64)
+	// The message may also contain the amount of data that was unsent and
+	// the total data received by the server (see TestMsg).
+	value, _, _ := strings.Cut(speed.Message, " ")
+	c.Result.ServerMeasuredUpload, err = strconv.ParseFloat(value, 64)
 	if err != nil {
 		err = fmt.Errorf("cannot convert server-measured upload speed: %w",
 			err)
 		return err
 	}
-	c.emitProgress(fmt.Sprintf("server-measured speed: %s", speed), ch)
+	c.emitProgress(ctx, fmt.Sprintf("server-measured speed: %s", speed.Message), ch)
+	c.checkThreshold(ctx, "upload", c.Result.ServerMeasuredUpload, c.MinUpload, ch)
+	c.Result.UploadAcknowledgedBytes = speed.TotalSentByte
+	if lastSample != nil {
+		c.Result.ClientMeasuredUpload = *lastSample
+		c.reconcileUpload(ctx, ch)
+		c.checkSpeedDivergence(ctx, "upload",
+			c.Result.ClientMeasuredUpload.kbitps(), c.Result.ServerMeasuredUpload, ch)
+	}
 	if err := proto.ExpectTestFinalize(); err != nil {
 		err = fmt.Errorf("cannot get TestFinalize message: %w", err)
 		return err
 	}
-	c.emitProgress("test terminated", ch)
+	c.emitProgress(ctx, "test terminated", ch)
 	return nil
 }
 
+// emitConvergence emits the info message telling that we stopped the
+// given direction early because the speed converged to kbitps.
+func (c *Client) emitConvergence(ctx context.Context, direction string, kbitps float64, ch chan<- *Output) {
+	c.emitProgress(ctx, fmt.Sprintf("%s converged at %s kbit/s: stopping early",
+		direction, c.SpeedFormatter(kbitps)), ch)
+}
+
+// postTestDelay waits for c.PostTestDelay, unless ctx is done first.
+func (c *Client) postTestDelay(ctx context.Context) error {
+	if c.PostTestDelay <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(c.PostTestDelay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reconcileUpload caps the count of the final upload sample to the bytes
+// acknowledged by the server, if c.ReconcileUpload is set.
+func (c *Client) reconcileUpload(ctx context.Context, ch chan<- *Output) {
+	acked, sample := c.Result.UploadAcknowledgedBytes, &c.Result.ClientMeasuredUpload
+	if !c.ReconcileUpload || acked <= 0 || acked >= sample.Count {
+		return
+	}
+	c.emitProgress(ctx, fmt.Sprintf("server-acknowledged bytes: %d (sent: %d)",
+		acked, sample.Count), ch)
+	sample.Count = acked
+}
+
 // uploader runs the async uploader. It takes ownership of the testconn
-// and closes the testch when it is done.
-func (c *Client) uploader(testconn MeasurementConn, testch chan<- *Speed) {
+// and closes the testch when it is done. The optional sizer is used to
+// adapt the size of the upload message. The deadline is the deadline of
+// the whole upload and writeErr receives the error that stopped it.
+func (c *Client) uploader(testconn MeasurementConn, sizer *messageSizer,
+	testch chan<- *Speed, deadline time.Time, writeErr *error) {
 	defer testconn.Close()
 	defer close(testch)
 	var (
@@ -446,19 +1802,62 @@ func (c *Client) uploader(testconn MeasurementConn, testch chan<- *Speed) {
 	ticker := time.NewTicker(250 * time.Millisecond)
 	defer ticker.Stop()
 	for {
+		if c.UploadWriteTimeout > 0 {
+			err := testconn.SetDeadline(writeDeadline(c.UploadWriteTimeout, deadline))
+			if err != nil {
+				*writeErr = err
+				return
+			}
+		}
 		num, err := testconn.WritePreparedMessage()
 		if err != nil {
+			// Safe because runUpload only reads it after testch is closed.
+			*writeErr = err
 			return
 		}
 		count += int64(num)
+		c.stats.add(int64(num))
+		if c.addBytesUsed(int64(num)) {
+			testch <- c.newSample(phaseUpload, count, begin)
+			return
+		}
 		select {
 		case <-ticker.C:
-			testch <- &Speed{Count: count, Elapsed: time.Since(begin)}
+			speed := c.newSample(phaseUpload, count, begin)
+			if sizer != nil {
+				sizer.update(speed)
+			}
+			testch <- speed
 		default:
 		}
 	}
 }
 
+// runSubtest runs subtest using a child context bounded by SubtestTimeout,
+// which also bounds the reads of the control connection. If the subtest
+// fails because of the timeout, the error wraps ErrSubtestTimeout.
+func (c *Client) runSubtest(ctx context.Context, proto Protocol, ch chan<- *Output,
+	subtest func(context.Context, Protocol, chan<- *Output) error) error {
+	if c.SubtestTimeout <= 0 {
+		return subtest(ctx, proto, ch)
+	}
+	subctx, cancel := context.WithTimeout(ctx, c.SubtestTimeout)
+	defer cancel()
+	deadline, _ := subctx.Deadline()
+	if err := proto.SetDeadline(deadline); err != nil {
+		return err
+	}
+	err := subtest(subctx, proto, ch)
+	if err != nil && ctx.Err() == nil && errors.Is(subctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("%w: %w", ErrSubtestTimeout, err)
+	}
+	resetErr := proto.SetDeadline(time.Now().Add(controlDeadline))
+	if err == nil {
+		err = resetErr
+	}
+	return err
+}
+
 func (c *Client) runDownload(ctx context.Context, proto Protocol, ch chan<- *Output) error {
 	const readBufferSize = 1 << 20
 	portnum, err := proto.ExpectTestPrepare()
@@ -466,16 +1865,22 @@ func (c *Client) runDownload(ctx context.Context, proto Protocol, ch chan<- *Out
 		err = fmt.Errorf("cannot get TestPrepare message: %w", err)
 		return err
 	}
-	c.emitProgress("got test prepare message", ch)
-	testconn, err := proto.DialDownloadConn(
-		ctx, net.JoinHostPort(c.FQDN, portnum),
-		makeUserAgent(c.ClientName, c.ClientVersion),
-	)
+	c.emitProgress(ctx, "got test prepare message", ch)
+	testconn, err := c.dialMeasurementConns(
+		ctx, proto, net.JoinHostPort(c.host, portnum), proto.DialDownloadConn)
 	if err != nil {
-		err = fmt.Errorf("cannot create measurement connection: %w", err)
-		return err
+		return measurementDialError(ctx, portnum, err)
 	}
-	c.emitProgress("created measurement connection", ch)
+	c.emitProgress(ctx, "created measurement connection", ch)
+	defer testconn.Close() // in case we fail before starting the sampler
+	stop := context.AfterFunc(ctx, func() {
+		testconn.Close() // unblock the sampler
+	})
+	defer stop()
+	c.emitMeasurementConnInfo(ctx, testconn, ch)
+	c.saveCongestionControl(ctx, testconn, ch)
+	c.saveMSS(ctx, testconn, ch)
+	c.setCapture(ctx, testconn, ch)
 	if err := testconn.SetDeadline(time.Now().Add(15 * time.Second)); err != nil {
 		err = fmt.Errorf("cannot set measurement connection deadline: %w", err)
 		return err
@@ -484,60 +1889,103 @@ func (c *Client) runDownload(ctx context.Context, proto Protocol, ch chan<- *Out
 		err = fmt.Errorf("cannot get TestStart message: %w", err)
 		return err
 	}
-	c.emitProgress("got test start message", ch)
+	c.emitProgress(ctx, "got test start message", ch)
 	testconn.AllocReadBuffer(readBufferSize)
 	testch := make(chan *Speed)
-	go c.downloader(testconn, testch)
-	c.emitProgress("downloader goroutine forked off", ch)
+	c.stats.start(phaseDownload)
+	c.Result.DownloadTTFB = 0
+	var readErr error
+	go c.downloader(testconn, testch, &readErr)
+	c.emitProgress(ctx, "downloader goroutine forked off", ch)
 	var lastSample *Speed
+	c.Result.ConvergedDownload = 0
+	convergence := newConvergenceDetector(c.ConvergenceThreshold, c.ConvergenceWindow)
 	for speed := range testch {
-		c.emit(&Output{CurDownloadSpeed: speed}, ch)
+		c.stats.sample(speed)
+		c.idle.reset()
+		c.emit(ctx, &Output{CurDownloadSpeed: speed}, ch)
+		c.emitPercent(ctx, phaseDownload, speed, ch)
 		lastSample = speed
+		if c.Result.ConvergedDownload == 0 {
+			if mean, ok := convergence.add(*speed); ok {
+				c.Result.ConvergedDownload = mean
+				c.emitConvergence(ctx, phaseDownload, mean, ch)
+				testconn.Close() // stop the sampler
+			}
+		}
+	}
+	c.stats.stop()
+	if errors.Is(readErr, ErrAbnormalClose) {
+		c.emitWarning(ctx, readErr, ch)
 	}
-	c.emitProgress("downloader goroutine terminated", ch)
+	c.checkMaxBytes(ctx, ch)
+	c.checkCapture(ctx, ch)
+	c.emitProgress(ctx, "downloader goroutine terminated", ch)
 	speed, err := proto.ExpectTestMsg()
 	if err != nil {
 		return err
 	}
-	// TODO(bassosimone): this information should probably be
-	// parsed and emitted in a much more actionable way
-	c.emitProgress(fmt.Sprintf("server-measured speed: %s kbit/s", speed), ch)
+	// With WebSocket, the message may also contain the amount of data that
+	// was unsent and the total data sent (see TestMsg).
+	c.Result.ServerMeasuredDownload = speed.ThroughputValue
+	c.Result.ServerUnsentDataAmount = speed.UnsentDataAmount
+	c.Result.ServerTotalSentByte = speed.TotalSentByte
+	c.emitProgress(ctx, fmt.Sprintf("server-measured speed: %s kbit/s",
+		strconv.FormatFloat(speed.ThroughputValue, 'f', -1, 64)), ch)
+	if speed.TotalSentByte > 0 {
+		c.emitProgress(ctx, fmt.Sprintf("server-sent bytes: %d (unsent: %d)",
+			speed.TotalSentByte, speed.UnsentDataAmount), ch)
+	}
 
 	var clientSpeed float64
 	if lastSample != nil {
 		c.Result.ClientMeasuredDownload = *lastSample
-		elapsed := float64(lastSample.Elapsed / time.Millisecond)
-		clientSpeed = 8 * float64(lastSample.Count) / elapsed
+		clientSpeed = lastSample.kbitps()
+		c.checkSpeedDivergence(ctx, "download", clientSpeed, speed.ThroughputValue, ch)
+		c.checkThreshold(ctx, "download", clientSpeed, c.MinDownload, ch)
 	}
 
-	clientSpeedStr := fmt.Sprintf("%f", clientSpeed)
-	c.emitProgress(fmt.Sprintf("client-measured speed: %s kbit/s", clientSpeedStr), ch)
+	clientSpeedStr := c.SpeedFormatter(clientSpeed)
+	c.emitProgress(ctx, fmt.Sprintf("client-measured speed: %s kbit/s", clientSpeedStr), ch)
+	if err := c.postTestDelay(ctx); err != nil {
+		return err
+	}
 	if err := proto.SendTestMsg([]byte(clientSpeedStr)); err != nil {
 		err = fmt.Errorf("cannot seend TestMsg message: %w", err)
 		return err
 	}
 	c.Result.Web100 = map[string]string{}
+	c.Result.TCPInfoSeries = nil
 	for i := 0; i < maxResultsLoops; i++ {
 		mtype, mdata, err := proto.ReceiveTestFinalizeOrTestMsg()
 		if err != nil {
+			if err = c.handleFrame(err); err == nil {
+				continue
+			}
 			err = fmt.Errorf("cannot get message: %w", err)
 			return err
 		}
 		if mtype == msgTestFinalize {
-			c.emitProgress("test terminated", ch)
+			c.emitProgress(ctx, "test terminated", ch)
+			c.checkRetransmission(ctx, ch)
 			return nil
 		}
-		c.emitProgress(fmt.Sprintf("web100: %s", string(mdata)), ch)
-		err = c.parseWeb100Message(string(mdata))
+		m := c.anonymizeWeb100(string(mdata))
+		if m == "" {
+			continue
+		}
+		c.emitProgress(ctx, fmt.Sprintf("web100: %s", m), ch)
+		err = c.parseWeb100Message(m)
 		if err != nil {
-			c.emitWarning(err, ch)
+			c.emitWarning(ctx, err, ch)
 		}
 	}
 	return errors.New("download: too many results")
 }
 
-// downloader is like uploader but for the download.
-func (c *Client) downloader(testconn MeasurementConn, testch chan<- *Speed) {
+// downloader is like uploader but for the download. It saves the error
+// that stopped reading, if any, into readErr before closing testch.
+func (c *Client) downloader(testconn MeasurementConn, testch chan<- *Speed, readErr *error) {
 	defer testconn.Close()
 	defer close(testch)
 	var (
@@ -549,21 +1997,175 @@ func (c *Client) downloader(testconn MeasurementConn, testch chan<- *Speed) {
 	for {
 		num, err := testconn.ReadDiscard()
 		if err != nil {
+			*readErr = err
 			return
 		}
+		if count == 0 && num > 0 {
+			// Safe because runDownload only reads it after testch is closed.
+			c.Result.DownloadTTFB = time.Since(begin)
+			if c.Observer != nil {
+				c.Observer.OnFirstByte(c.Result.DownloadTTFB)
+			}
+		}
 		count += num
+		c.stats.add(num)
+		if c.addBytesUsed(num) {
+			testch <- c.newSample(phaseDownload, count, begin)
+			return
+		}
 		select {
 		case <-ticker.C:
-			testch <- &Speed{Count: count, Elapsed: time.Since(begin)}
+			testch <- c.newSample(phaseDownload, count, begin)
 		default:
 		}
 	}
 }
 
-func (c *Client) recvResultsAndLogout(proto Protocol, ch chan<- *Output) error {
+// newSample creates a sample of the measurement in the given direction
+// that began at begin, and passes it to OnSample and the Observer, if set.
+func (c *Client) newSample(direction string, count int64, begin time.Time) *Speed {
+	speed := &Speed{Count: count, Elapsed: time.Since(begin)}
+	if c.OnSample != nil {
+		c.OnSample(direction, *speed)
+	}
+	if c.Observer != nil {
+		c.Observer.OnSample(direction, *speed)
+	}
+	return speed
+}
+
+// addBytesUsed adds num to the bytes used by the current test and returns
+// whether we have reached the MaxBytes cap.
+func (c *Client) addBytesUsed(num int64) bool {
+	c.bytesUsed += num
+	return c.MaxBytes > 0 && c.bytesUsed >= c.MaxBytes
+}
+
+// checkMaxBytes emits a warning if we have reached the MaxBytes cap.
+func (c *Client) checkMaxBytes(ctx context.Context, ch chan<- *Output) {
+	if c.MaxBytes <= 0 || c.bytesUsed < c.MaxBytes || c.Result.MaxBytesReached {
+		return
+	}
+	c.Result.MaxBytesReached = true
+	c.emitWarning(ctx, fmt.Errorf("%w: %d bytes", ErrMaxBytesReached, c.bytesUsed), ch)
+}
+
+// checkSpeedDivergence emits a warning if the client-measured and the
+// server-measured speeds, in kbit/s, differ by more than c.SpeedDivergence.
+func (c *Client) checkSpeedDivergence(
+	ctx context.Context, direction string, client, server float64, ch chan<- *Output) {
+	if c.SpeedDivergence <= 0 || server <= 0 {
+		return
+	}
+	divergence := 100 * math.Abs(client-server) / server
+	if divergence > c.SpeedDivergence {
+		c.emitWarning(ctx, fmt.Errorf(
+			"%w: %s: client %.1f kbit/s, server %.1f kbit/s (%.0f%%)",
+			ErrSpeedDivergence, direction, client, server, divergence), ch)
+	}
+}
+
+// checkRetransmission emits a warning if the download retransmission rate
+// exceeds c.MaxRetransmission.
+func (c *Client) checkRetransmission(ctx context.Context, ch chan<- *Output) {
+	if c.MaxRetransmission <= 0 {
+		return
+	}
+	rate, ok := c.Result.DownloadRetransmission()
+	if !ok || rate <= c.MaxRetransmission {
+		return
+	}
+	c.Result.MaxRetransmissionExceeded = true
+	c.emitWarning(ctx, fmt.Errorf("%w: %.2f%% > %.2f%%",
+		ErrMaxRetransmission, rate, c.MaxRetransmission), ch)
+}
+
+// writeDeadline returns the deadline of the next write of the upload,
+// which is timeout from now, but not later than the upload deadline.
+func writeDeadline(timeout time.Duration, deadline time.Time) time.Time {
+	if next := time.Now().Add(timeout); next.Before(deadline) {
+		return next
+	}
+	return deadline
+}
+
+// checkUploadStall emits a warning if the upload stopped because a write
+// took longer than the UploadWriteTimeout, before the upload deadline.
+func (c *Client) checkUploadStall(ctx context.Context, writeErr error, deadline time.Time, ch chan<- *Output) {
+	if c.UploadWriteTimeout <= 0 || !errors.Is(writeErr, os.ErrDeadlineExceeded) ||
+		!time.Now().Before(deadline) {
+		return
+	}
+	c.emitWarning(ctx, fmt.Errorf("%w: a write took longer than %s",
+		ErrUploadStalled, c.UploadWriteTimeout), ch)
+}
+
+// checkBlackHole emits a warning if we have not sent any byte yet during
+// the upload, which often indicates a path MTU black hole.
+func (c *Client) checkBlackHole(ctx context.Context, ch chan<- *Output) {
+	if c.stats.count.Load() > 0 {
+		return
+	}
+	c.emitWarning(ctx, fmt.Errorf("%w: sent no bytes during the first %s of the upload",
+		ErrPathMTUBlackHole, c.BlackHoleWindow), ch)
+}
+
+// emitPercent emits the progress of the subtest whose last sample is speed.
+// The percent grows with each sample, since the samples of a subtest are
+// taken at increasing elapsed times, and we clamp it at 100.
+func (c *Client) emitPercent(ctx context.Context, direction string, speed *Speed, ch chan<- *Output) {
+	percent := min(100, 100*speed.Elapsed.Seconds()/subtestDuration.Seconds())
+	c.emit(ctx, &Output{Progress: &ProgressInfo{Direction: direction, Percent: percent}}, ch)
+}
+
+// emitMeasurementConnInfo emits information about testconn.
+func (c *Client) emitMeasurementConnInfo(ctx context.Context, testconn MeasurementConn, ch chan<- *Output) {
+	c.emit(ctx, &Output{MeasurementConnInfo: &MeasurementConnInfo{
+		Direction:  c.phase,
+		LocalAddr:  testconn.LocalAddr().String(),
+		RemoteAddr: testconn.RemoteAddr().String(),
+	}}, ch)
+}
+
+// saveCongestionControl saves the congestion control algorithm used by
+// testconn into the results, when we're able to get it.
+func (c *Client) saveCongestionControl(ctx context.Context, testconn MeasurementConn, ch chan<- *Output) {
+	algo, err := testconn.CongestionControl()
+	if err != nil {
+		return
+	}
+	c.Result.CongestionControl = algo
+	c.emitProgress(ctx, fmt.Sprintf("congestion control: %s", algo), ch)
+}
+
+// mssReader is implemented by a MeasurementConn exposing its maximum
+// segment size, like the connections created by our factories.
+type mssReader interface {
+	MSS() (int, error)
+}
+
+// saveMSS saves the maximum segment size of testconn into the results,
+// when we're able to get it.
+func (c *Client) saveMSS(ctx context.Context, testconn MeasurementConn, ch chan<- *Output) {
+	reader, ok := testconn.(mssReader)
+	if !ok {
+		return
+	}
+	mss, err := reader.MSS()
+	if err != nil {
+		return
+	}
+	c.Result.MSS = mss
+	c.emitProgress(ctx, fmt.Sprintf("maximum segment size: %d", mss), ch)
+}
+
+func (c *Client) recvResultsAndLogout(ctx context.Context, proto Protocol, ch chan<- *Output) error {
 	for i := 0; i < maxResultsLoops; i++ {
 		mtype, mdata, err := proto.ReceiveLogoutOrResults()
 		if err != nil {
+			if err = c.handleFrame(err); err == nil {
+				continue
+			}
 			err = fmt.Errorf("cannot get message: %w", err)
 			return err
 		}
@@ -571,15 +2173,66 @@ func (c *Client) recvResultsAndLogout(proto Protocol, ch chan<- *Output) error {
 			return nil
 		}
 		// TODO(bassosimone): save these messages?
-		c.emitProgress(fmt.Sprintf("server: %s", string(mdata)), ch)
+		c.emitProgress(ctx, fmt.Sprintf("server: %s", string(mdata)), ch)
 	}
 	return errors.New("recvResultsAndLogout: too many results")
 }
 
-func (c *Client) makeBuffer() []byte {
+// drainAfterLogout reads the results messages that the server sends after
+// the logout message, until EOF or c.DrainAfterLogout expires, and saves
+// them. Because the test is over, we ignore any error.
+func (c *Client) drainAfterLogout(ctx context.Context, proto Protocol, ch chan<- *Output) {
+	if c.DrainAfterLogout <= 0 {
+		return
+	}
+	if err := proto.SetDeadline(time.Now().Add(c.DrainAfterLogout)); err != nil {
+		return
+	}
+	for i := 0; i < maxResultsLoops; i++ {
+		mtype, mdata, err := proto.ReceiveLogoutOrResults()
+		if err != nil {
+			if c.handleFrame(err) == nil {
+				continue
+			}
+			return // most likely EOF or the deadline
+		}
+		if mtype == msgResults {
+			c.Result.TrailingMessages = append(c.Result.TrailingMessages, string(mdata))
+			c.emitProgress(ctx, fmt.Sprintf("server (after logout): %s", string(mdata)), ch)
+		}
+	}
+}
+
+// sharedPayload is the payload used with ReusePayload. We only read the
+// bytes of the buffer once generated, so the clients may share it.
+var sharedPayload struct {
+	sync.Mutex
+	b []byte
+}
+
+// makeBuffer returns the upload payload of the given size, which is the
+// shared payload with ReusePayload and a new random one otherwise.
+func (c *Client) makeBuffer(size int) []byte {
+	if !c.ReusePayload {
+		return randomBuffer(c.Rand, size)
+	}
+	sharedPayload.Lock()
+	defer sharedPayload.Unlock()
+	if len(sharedPayload.b) < size {
+		// The previous buffer is still valid for the clients using it.
+		sharedPayload.b = randomBuffer(nil, size)
+	}
+	return sharedPayload.b[:size]
+}
+
+// randomBuffer returns a buffer of random letters generated using rnd or,
+// when it's nil, using a new source seeded with the current time.
+func randomBuffer(rnd *rand.Rand, size int) []byte {
 	// See https://stackoverflow.com/a/31832326
-	b := make([]byte, 1<<17)
-	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	b := make([]byte, size)
+	if rnd == nil {
+		rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
 	var letterRunes = []byte("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 	for i := range b {
 		b[i] = letterRunes[rnd.Intn(len(letterRunes))]
@@ -596,22 +2249,143 @@ func (c *Client) parseWeb100Message(m string) error {
 		return fmt.Errorf("cannot parse web100 message: %s", m)
 	}
 
-	c.Result.Web100[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+	c.Result.Web100[key] = value
+	if update, ok := tcpInfoVariables[key]; ok {
+		return c.addTCPInfoSample(update, value)
+	}
+	return nil
+}
+
+// tcpInfoVariables maps the web100 variables we track in the TCPInfoSeries
+// to the function updating a sample with their value.
+var tcpInfoVariables = map[string]func(sample *TCPInfoSample, value int64){
+	Web100KeyCurCwnd: func(sample *TCPInfoSample, value int64) {
+		sample.CongestionWindow = value
+	},
+	Web100KeySndbuf: func(sample *TCPInfoSample, value int64) {
+		sample.SendBufCur = value
+	},
+	Web100KeySmoothedRTT: func(sample *TCPInfoSample, value int64) {
+		sample.RTT = time.Duration(value) * time.Millisecond
+	},
+	Web100KeyRTT: func(sample *TCPInfoSample, value int64) {
+		sample.RTT = time.Duration(value) * time.Microsecond
+	},
+}
+
+// addTCPInfoSample appends to the TCPInfoSeries a sample containing the
+// previous values updated with the value of a tracked web100 variable.
+func (c *Client) addTCPInfoSample(update func(*TCPInfoSample, int64), value string) error {
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("cannot parse web100 value: %w", err)
+	}
+	var sample TCPInfoSample
+	if series := c.Result.TCPInfoSeries; len(series) > 0 {
+		sample = series[len(series)-1]
+	}
+	sample.Time = time.Now()
+	update(&sample, number)
+	c.Result.TCPInfoSeries = append(c.Result.TCPInfoSeries, sample)
 	return nil
 }
 
-func (c *Client) emitError(err error, ch chan<- *Output) {
-	c.emit(&Output{ErrorMessage: &Failure{Error: err}}, ch)
+func (c *Client) emitError(ctx context.Context, err error, ch chan<- *Output) {
+	err = &PhaseError{Phase: c.phase, Err: c.wrapTimeout(ctx, c.idle.wrap(err))}
+	c.emit(ctx, &Output{ErrorMessage: &Failure{Error: err}}, ch)
 }
 
-func (c *Client) emitWarning(err error, ch chan<- *Output) {
-	c.emit(&Output{ErrorMessage: &Failure{Error: err}}, ch)
+// emitWarning emits a WarningMessage reporting err, after which we continue.
+func (c *Client) emitWarning(ctx context.Context, err error, ch chan<- *Output) {
+	c.emit(ctx, &Output{WarningMessage: &Failure{Error: err}}, ch)
 }
 
-func (c *Client) emitProgress(msg string, ch chan<- *Output) {
-	c.emit(&Output{InfoMessage: &LogMessage{Message: msg}}, ch)
+func (c *Client) emitProgress(ctx context.Context, msg string, ch chan<- *Output) {
+	c.emit(ctx, &Output{InfoMessage: &LogMessage{Message: msg}}, ch)
 }
 
-func (c *Client) emit(msg *Output, ch chan<- *Output) {
-	ch <- msg
+// wrapTimeout wraps err with ErrTestTimeout, telling the current phase,
+// if the deadline of ctx expired, since it's then most likely the cause.
+func (c *Client) wrapTimeout(ctx context.Context, err error) error {
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) || errors.Is(err, ErrTestTimeout) {
+		return err
+	}
+	return fmt.Errorf("%w during the %s phase: %w", ErrTestTimeout, c.phase, err)
+}
+
+// emit emits msg on ch. If the consumer is not draining ch, we give up
+// emitting as soon as the context is done, rather than blocking forever.
+// We try sending first, so that we don't drop the events emitted after
+// the context is done, e.g., the error telling that it timed out, when
+// the consumer is draining ch.
+func (c *Client) emit(ctx context.Context, msg *Output, ch chan<- *Output) {
+	c.log(msg)
+	if c.RecordEvents {
+		c.events.record(msg)
+	}
+	if c.conformance != nil {
+		if msg.ErrorMessage != nil {
+			c.conformance.fail(msg.ErrorMessage.Error)
+		}
+		if msg.WarningMessage != nil {
+			c.conformance.fail(msg.WarningMessage.Error)
+		}
+	}
+	select {
+	case ch <- msg:
+		return
+	default:
+	}
+	select {
+	case ch <- msg:
+	case <-ctx.Done():
+	}
+}
+
+// log logs msg using c.Logger, if it has been configured.
+func (c *Client) log(msg *Output) {
+	if c.Logger == nil {
+		return
+	}
+	attrs := []any{slog.String("fqdn", c.FQDN), slog.String("phase", c.phase)}
+	if msg.DebugMessage != nil {
+		c.Logger.Debug(msg.DebugMessage.Message, attrs...)
+	}
+	if msg.InfoMessage != nil {
+		c.Logger.Info(msg.InfoMessage.Message, attrs...)
+	}
+	if msg.WarningMessage != nil {
+		c.Logger.Warn(msg.WarningMessage.Error.Error(), attrs...)
+	}
+	if msg.ErrorMessage != nil {
+		c.Logger.Error(msg.ErrorMessage.Error.Error(), attrs...)
+	}
+	if msg.Connected != nil {
+		c.Logger.Info("connected", append(attrs,
+			slog.String("transport", msg.Connected.Transport),
+			slog.String("remote_addr", msg.Connected.RemoteAddr),
+			slog.String("tls_version", msg.Connected.TLSVersion),
+			slog.String("server_version", msg.Connected.ServerVersion))...)
+	}
+	if msg.MeasurementConnInfo != nil {
+		c.Logger.Debug("measurement connection", append(attrs,
+			slog.String("local_addr", msg.MeasurementConnInfo.LocalAddr),
+			slog.String("remote_addr", msg.MeasurementConnInfo.RemoteAddr))...)
+	}
+	if msg.Progress != nil {
+		c.Logger.Debug("progress", append(attrs,
+			slog.String("direction", msg.Progress.Direction),
+			slog.Float64("percent", msg.Progress.Percent))...)
+	}
+	if msg.CurDownloadSpeed != nil {
+		c.Logger.Debug("download speed", append(attrs,
+			slog.Int64("count", msg.CurDownloadSpeed.Count),
+			slog.Duration("elapsed", msg.CurDownloadSpeed.Elapsed))...)
+	}
+	if msg.CurUploadSpeed != nil {
+		c.Logger.Debug("upload speed", append(attrs,
+			slog.Int64("count", msg.CurUploadSpeed.Count),
+			slog.Duration("elapsed", msg.CurUploadSpeed.Elapsed))...)
+	}
 }
@@ -1,11 +1,28 @@
 package ndt5_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/m-lab/ndt5-client-go"
 	"github.com/m-lab/ndt5-client-go/internal/trafficshaping"
+	"github.com/m-lab/ndt5-client-go/mlabns"
 )
 
 const (
@@ -51,3 +68,2106 @@ func TestIntegrationClientWSS(t *testing.T) {
 		t.Logf("%+v", ev)
 	}
 }
+
+func TestUnitClientRunN(t *testing.T) {
+	client := NewScriptedClient(ServeNoTests)
+	results, err := client.RunN(context.Background(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatal("expected three results here")
+	}
+}
+
+func TestUnitClientRunNFailure(t *testing.T) {
+	client := NewScriptedClient(func(conn net.Conn) {
+		conn.Close()
+	})
+	results, err := client.RunN(context.Background(), 3)
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if len(results) != 0 {
+		t.Fatal("expected no results here")
+	}
+}
+
+func TestUnitClientRunNContextCanceled(t *testing.T) {
+	client := NewScriptedClient(ServeNoTests)
+	client.RepeatPause = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	results, err := client.RunN(ctx, 2)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected context.DeadlineExceeded here")
+	}
+	if len(results) != 1 {
+		t.Fatal("expected one result here")
+	}
+}
+
+func TestUnitClientLogger(t *testing.T) {
+	client := NewScriptedClient(ServeNoTests)
+	buf := new(bytes.Buffer)
+	client.Logger = slog.New(slog.NewJSONHandler(buf, nil))
+	if _, err := client.RunN(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record struct {
+			Level string `json:"level"`
+			Msg   string `json:"msg"`
+			FQDN  string `json:"fqdn"`
+			Phase string `json:"phase"`
+		}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Level != "INFO" || record.FQDN != "127.0.0.1" {
+			t.Fatalf("unexpected log record: %s", line)
+		}
+		if record.Msg == "receiving the results" && record.Phase == "results" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("did not find the expected log record")
+	}
+}
+
+func TestUnitClientLoggerQueue(t *testing.T) {
+	client := NewScriptedClient(func(conn net.Conn) {
+		defer conn.Close()
+		login := make([]byte, 4)
+		if _, err := io.ReadFull(conn, login); err != nil {
+			return
+		}
+		conn.Write([]byte("123456 654321"))
+		WriteFrame(conn, 1, "1")
+		WriteFrame(conn, 1, "0")
+		WriteFrame(conn, 2, "v3.7.0")
+		WriteFrame(conn, 2, "")
+		WriteFrame(conn, 9, "")
+	})
+	buf := new(bytes.Buffer)
+	client.Logger = slog.New(slog.NewJSONHandler(buf, nil))
+	if _, err := client.RunN(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record struct {
+			Msg   string `json:"msg"`
+			Phase string `json:"phase"`
+		}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(record.Msg, "waiting in queue: position 1") && record.Phase == "queue" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("did not find the queue progress in the log")
+	}
+}
+
+func TestUnitClientLabels(t *testing.T) {
+	client := NewScriptedClient(ServeNoTests)
+	client.Labels = map[string]string{"probe": "p1"}
+	results, err := client.RunN(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Labels["probe"] = "p2"
+	if results[0].Labels["probe"] != "p1" {
+		t.Fatal("expected a copy of the labels in the result")
+	}
+}
+
+func TestUnitClientStopsWhenConsumerStallsAndContextIsCanceled(t *testing.T) {
+	client := NewScriptedClient(func(conn net.Conn) {
+		defer conn.Close()
+		login := make([]byte, 4)
+		io.ReadFull(conn, login)
+		io.Copy(io.Discard, conn) // stall until the client goes away
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	out, err := client.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond) // let the client block on emit
+	cancel()
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+	var count int
+	for {
+		select {
+		case _, ok := <-out:
+			if !ok {
+				if count > 2 {
+					t.Fatalf("expected the client to drop events, got %d", count)
+				}
+				return
+			}
+			count++
+		case <-timer.C:
+			t.Fatal("the client did not terminate")
+		}
+	}
+}
+
+type RoundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestUnitClientDiscoveryHTTPClient(t *testing.T) {
+	var called bool
+	client := NewScriptedClient(ServeNoTests)
+	client.FQDN = ""
+	client.DiscoveryHTTPClient = &http.Client{
+		Transport: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			called = true
+			return &http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(strings.NewReader(`{"fqdn":"127.0.0.1"}`)),
+			}, nil
+		}),
+	}
+	if _, err := client.RunN(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if !called {
+		t.Fatal("expected the discovery HTTP client to be used")
+	}
+	if client.FQDN != "127.0.0.1" {
+		t.Fatal("unexpected discovered FQDN")
+	}
+}
+
+func TestUnitFormatSpeed(t *testing.T) {
+	if s := ndt5.FormatSpeedFloat(1234.5678); s != "1234.567800" {
+		t.Fatalf("unexpected FormatSpeedFloat result: %s", s)
+	}
+	if s := ndt5.FormatSpeedInteger(1234.5678); s != "1235" {
+		t.Fatalf("unexpected FormatSpeedInteger result: %s", s)
+	}
+}
+
+func TestUnitClientSpeedFormatter(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:         "4",
+		Duration:        300 * time.Millisecond,
+		DownloadTestMsg: "1000",
+	}
+	client := NewFakeServerClient(server)
+	client.SpeedFormatter = func(kbitps float64) string {
+		return "formatted"
+	}
+	if _, err := client.RunN(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if server.ClientTestMsg != "formatted" {
+		t.Fatalf("unexpected client TestMsg: %s", server.ClientTestMsg)
+	}
+}
+
+type CountingMlabNSClient struct {
+	FQDN    string
+	Queries int
+}
+
+func (c *CountingMlabNSClient) Query(ctx context.Context) (string, error) {
+	c.Queries++
+	return c.FQDN, nil
+}
+
+func TestUnitClientDiscoveryCacheTTL(t *testing.T) {
+	for _, tc := range []struct {
+		ttl     time.Duration
+		queries int
+	}{
+		{0, 1},
+		{time.Hour, 1},
+		{10 * time.Millisecond, 2},
+	} {
+		ns := &CountingMlabNSClient{FQDN: "127.0.0.1"}
+		client := NewScriptedClient(ServeNoTests)
+		client.FQDN = ""
+		client.MLabNSClient = ns
+		client.DiscoveryCacheTTL = tc.ttl
+		client.RepeatPause = 50 * time.Millisecond
+		if _, err := client.RunN(context.Background(), 2); err != nil {
+			t.Fatal(err)
+		}
+		if ns.Queries != tc.queries {
+			t.Fatalf("ttl %s: expected %d queries, got %d", tc.ttl, tc.queries, ns.Queries)
+		}
+	}
+}
+
+func TestUnitClientDiscoveryCacheTTLExplicitFQDN(t *testing.T) {
+	ns := &CountingMlabNSClient{FQDN: "127.0.0.1"}
+	client := NewScriptedClient(ServeNoTests)
+	client.MLabNSClient = ns
+	client.DiscoveryCacheTTL = time.Nanosecond
+	if _, err := client.RunN(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	if ns.Queries != 0 {
+		t.Fatal("expected no queries with an explicit FQDN")
+	}
+}
+
+type FailingMlabNSClient struct{}
+
+func (FailingMlabNSClient) Query(ctx context.Context) (string, error) {
+	return "", ErrMocked
+}
+
+func TestUnitClientDiscover(t *testing.T) {
+	ns := &CountingMlabNSClient{FQDN: "ndt-mlab1-lga05.mlab-oti.measurement-lab.org"}
+	client := ndt5.NewClient(clientName, clientVersion, "")
+	client.MLabNSClient = ns
+	fqdn, err := client.Discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fqdn != ns.FQDN || ns.Queries != 1 {
+		t.Fatalf("unexpected FQDN %q after %d queries", fqdn, ns.Queries)
+	}
+	if client.FQDN != "" {
+		t.Fatal("Discover should not change FQDN")
+	}
+	client.MLabNSClient = FailingMlabNSClient{}
+	if _, err := client.Discover(context.Background()); !errors.Is(err, ndt5.ErrDiscoveryFailed) ||
+		!errors.Is(err, ErrMocked) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestUnitClientCurrentStats(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:         "4",
+		Duration:        600 * time.Millisecond,
+		DownloadTestMsg: "1000",
+	}
+	client := NewFakeServerClient(server)
+	if stats := client.CurrentStats(); stats != (ndt5.Stats{}) {
+		t.Fatal("expected empty stats before the test")
+	}
+	out, err := client.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seen ndt5.Stats
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range out {
+		}
+	}()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for loop := true; loop; {
+		select {
+		case <-done:
+			loop = false
+		case <-ticker.C:
+			if stats := client.CurrentStats(); stats.CurrentMbps > 0 {
+				seen = stats
+			}
+		}
+	}
+	if seen.Direction != "download" || seen.Count <= 0 || seen.AverageMbps <= 0 {
+		t.Fatalf("unexpected stats: %+v", seen)
+	}
+	if stats := client.CurrentStats(); stats != (ndt5.Stats{}) {
+		t.Fatal("expected empty stats after the test")
+	}
+}
+
+func TestUnitClientAdaptiveUpload(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:       "2",
+		Duration:      time.Second,
+		UploadTestMsg: "1000",
+	}
+	client := NewFakeServerClient(server)
+	client.AdaptiveUpload = true
+	results, err := client.RunN(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := results[0]
+	if len(result.UploadMessageSizeCurve) == 0 {
+		t.Fatal("expected a non-empty message size curve")
+	}
+	if result.UploadMessageSizeCurve[0].Size != 1<<13 {
+		t.Fatal("expected to start with a modest message size")
+	}
+	if result.UploadMessageSize < 1<<13 || result.UploadMessageSize > 1<<20 {
+		t.Fatalf("unexpected message size: %d", result.UploadMessageSize)
+	}
+}
+
+func TestUnitClientFixedUpload(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:       "2",
+		Duration:      300 * time.Millisecond,
+		UploadTestMsg: "1000",
+	}
+	client := NewFakeServerClient(server)
+	results, err := client.RunN(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].UploadMessageSize != 0 || results[0].UploadMessageSizeCurve != nil {
+		t.Fatal("expected no adaptive upload results")
+	}
+	if results[0].ServerMeasuredUpload != 1000 {
+		t.Fatal("unexpected server-measured upload")
+	}
+}
+
+func TestUnitClientMaxBytes(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:         "4 2",
+		Duration:        10 * time.Second,
+		DownloadTestMsg: "1000",
+		UploadTestMsg:   "1000",
+	}
+	client := NewFakeServerClient(server)
+	client.MaxBytes = 1 << 20
+	// Run twice on the same client, without resetting client.Result,
+	// to make sure that the cap is enforced by each test.
+	for run := 0; run < 2; run++ {
+		ch, err := client.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var warnings int
+		for ev := range ch {
+			if ev.ErrorMessage != nil {
+				t.Fatal(ev.ErrorMessage.Error)
+			}
+			if ev.WarningMessage != nil {
+				if !errors.Is(ev.WarningMessage.Error, ndt5.ErrMaxBytesReached) {
+					t.Fatal(ev.WarningMessage.Error)
+				}
+				warnings++
+			}
+		}
+		if warnings != 1 {
+			t.Fatalf("run %d: expected one warning, got %d", run, warnings)
+		}
+		if !client.Result.MaxBytesReached {
+			t.Fatalf("run %d: expected MaxBytesReached to be true", run)
+		}
+		if client.Result.ClientMeasuredDownload.Count < 1<<20 {
+			t.Fatalf("run %d: expected to download at least MaxBytes bytes", run)
+		}
+	}
+}
+
+// TestUnitClientStreams checks that we request the extended tests only
+// with Client.Streams, and that we then open as many measurement conns as
+// the server announces, if it supports them.
+func TestUnitClientStreams(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		clientStreams int
+		serverStreams int
+		expectLogin   uint8
+		expectConns   int
+	}{
+		{"default", 0, 3, 2 | 4 | 16 | 32, 1},
+		{"extended tests", 4, 3, 2 | 4 | 16 | 32 | 64 | 128, 3},
+		{"unsupported", 4, 0, 2 | 4 | 16 | 32 | 64 | 128, 1},
+	} {
+		server := &FakeServer{
+			TestIDs:         "4 2",
+			Duration:        100 * time.Millisecond,
+			DownloadTestMsg: "1000",
+			UploadTestMsg:   "1000",
+			Streams:         tc.serverStreams,
+		}
+		client := NewFakeServerClient(server)
+		client.Streams = tc.clientStreams
+		ch, err := client.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ev := range ch {
+			if ev.ErrorMessage != nil {
+				t.Fatalf("%s: %s", tc.name, ev.ErrorMessage.Error)
+			}
+			if ev.WarningMessage != nil {
+				t.Fatalf("%s: %s", tc.name, ev.WarningMessage.Error)
+			}
+		}
+		if len(server.Logins) != 1 || server.Logins[0] != tc.expectLogin {
+			t.Fatalf("%s: unexpected logins: %+v", tc.name, server.Logins)
+		}
+		conns := make(map[string]int)
+		for _, address := range server.Addresses {
+			_, port, _ := net.SplitHostPort(address)
+			conns[port]++
+		}
+		if conns["3002"] != tc.expectConns || conns["3003"] != tc.expectConns {
+			t.Fatalf("%s: unexpected measurement conns: %+v", tc.name, conns)
+		}
+		for _, subtest := range client.Result.Subtests {
+			if !subtest.Success {
+				t.Fatalf("%s: unexpected subtest failure: %+v", tc.name, subtest)
+			}
+		}
+	}
+}
+
+func TestUnitClientMeasurementConnInfo(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:         "4 2",
+		Duration:        100 * time.Millisecond,
+		DownloadTestMsg: "1000",
+		UploadTestMsg:   "1000",
+	}
+	client := NewFakeServerClient(server)
+	ch, err := client.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var infos []*ndt5.MeasurementConnInfo
+	for ev := range ch {
+		if ev.MeasurementConnInfo != nil {
+			infos = append(infos, ev.MeasurementConnInfo)
+		}
+	}
+	if len(infos) != 2 {
+		t.Fatalf("expected two events, got %d", len(infos))
+	}
+	for idx, direction := range []string{"download", "upload"} {
+		if infos[idx].Direction != direction {
+			t.Fatalf("expected %s, got %s", direction, infos[idx].Direction)
+		}
+		// net.Pipe uses "pipe" as the address of both ends
+		if infos[idx].LocalAddr != "pipe" || infos[idx].RemoteAddr != "pipe" {
+			t.Fatalf("unexpected addresses: %+v", infos[idx])
+		}
+	}
+}
+
+func TestUnitClientConnected(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:       "2",
+		Duration:      100 * time.Millisecond,
+		UploadTestMsg: "1000",
+	}
+	client := NewFakeServerClient(server)
+	ch, err := client.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var infos []*ndt5.ConnectedInfo
+	for ev := range ch {
+		if ev.Connected != nil {
+			infos = append(infos, ev.Connected)
+		}
+	}
+	if len(infos) != 1 {
+		t.Fatalf("expected one event, got %d", len(infos))
+	}
+	expected := ndt5.ConnectedInfo{
+		Transport:     "raw",
+		RemoteAddr:    "pipe",
+		ServerVersion: client.Result.ServerVersion,
+	}
+	if *infos[0] != expected || expected.ServerVersion == "" {
+		t.Fatalf("unexpected info: %+v", infos[0])
+	}
+}
+
+func TestUnitClientProgress(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:         "4 2",
+		Duration:        500 * time.Millisecond,
+		DownloadTestMsg: "1000",
+		UploadTestMsg:   "1000",
+	}
+	client := NewFakeServerClient(server)
+	ch, err := client.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var directions []string
+	var last float64
+	for ev := range ch {
+		if ev.Progress == nil {
+			continue
+		}
+		if len(directions) == 0 || directions[len(directions)-1] != ev.Progress.Direction {
+			directions = append(directions, ev.Progress.Direction)
+			last = 0
+		}
+		if ev.Progress.Percent < last || ev.Progress.Percent > 100 {
+			t.Fatalf("unexpected progress: %+v after %f", ev.Progress, last)
+		}
+		last = ev.Progress.Percent
+	}
+	if !reflect.DeepEqual(directions, []string{"download", "upload"}) {
+		t.Fatalf("unexpected directions: %v", directions)
+	}
+	if last <= 0 {
+		t.Fatal("expected the upload to progress")
+	}
+}
+
+func TestUnitClientSubtestTimeout(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:         "4",
+		Duration:        100 * time.Millisecond,
+		DownloadStall:   10 * time.Second,
+		DownloadTestMsg: "1000",
+	}
+	client := NewFakeServerClient(server)
+	client.SubtestTimeout = 500 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // stops the client when we return early
+	begin := time.Now()
+	ch, err := client.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ev := range ch {
+		if ev.WarningMessage != nil && errors.Is(ev.WarningMessage.Error, ndt5.ErrSubtestTimeout) {
+			if time.Since(begin) > 5*time.Second {
+				t.Fatal("the subtest did not fail quickly")
+			}
+			return // don't wait for the stalled server
+		}
+	}
+	t.Fatal("expected a subtest timeout warning")
+}
+
+func TestUnitClientBlackHole(t *testing.T) {
+	for _, stall := range []time.Duration{0, 500 * time.Millisecond} {
+		server := &FakeServer{
+			TestIDs:       "2",
+			Duration:      100 * time.Millisecond,
+			UploadStall:   stall,
+			UploadTestMsg: "1000",
+		}
+		client := NewFakeServerClient(server)
+		client.BlackHoleWindow = 100 * time.Millisecond
+		ch, err := client.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var warned bool
+		for ev := range ch {
+			if ev.ErrorMessage != nil {
+				t.Fatal(ev.ErrorMessage.Error)
+			}
+			if ev.WarningMessage != nil && errors.Is(ev.WarningMessage.Error, ndt5.ErrPathMTUBlackHole) {
+				warned = true
+			}
+		}
+		if warned != (stall > 0) {
+			t.Fatalf("stall %s: unexpected warned: %v", stall, warned)
+		}
+	}
+}
+
+func TestUnitClientUploadWriteTimeout(t *testing.T) {
+	for _, timeout := range []time.Duration{0, 200 * time.Millisecond} {
+		server := &FakeServer{
+			TestIDs:         "2",
+			Duration:        1500 * time.Millisecond,
+			UploadReadLimit: 1 << 17, // the first write
+			UploadTestMsg:   "1000",
+		}
+		client := NewFakeServerClient(server)
+		client.UploadWriteTimeout = timeout
+		ch, err := client.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			begin   = time.Now()
+			elapsed time.Duration
+			warned  bool
+		)
+		for ev := range ch {
+			if ev.ErrorMessage != nil {
+				t.Fatal(ev.ErrorMessage.Error)
+			}
+			if ev.WarningMessage != nil && errors.Is(ev.WarningMessage.Error, ndt5.ErrUploadStalled) {
+				warned = true
+			}
+			if ev.InfoMessage != nil && ev.InfoMessage.Message == "uploader goroutine terminated" {
+				elapsed = time.Since(begin)
+			}
+		}
+		if warned != (timeout > 0) {
+			t.Fatalf("timeout %s: unexpected warned: %v", timeout, warned)
+		}
+		// Without the timeout, the write blocks until the server closes the conn.
+		if (elapsed < server.Duration/2) != (timeout > 0) {
+			t.Fatalf("timeout %s: unexpected elapsed: %s", timeout, elapsed)
+		}
+	}
+}
+
+func TestUnitClientTestTimeoutInQueue(t *testing.T) {
+	client := NewScriptedClient(func(conn net.Conn) {
+		defer conn.Close()
+		login := make([]byte, 4)
+		if _, err := io.ReadFull(conn, login); err != nil {
+			return
+		}
+		conn.Write([]byte("123456 654321"))
+		WriteFrame(conn, 1, "1")
+		io.Copy(io.Discard, conn) // wait in queue forever
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	ch, err := client.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failure error
+	for ev := range ch {
+		if ev.ErrorMessage != nil {
+			failure = ev.ErrorMessage.Error
+		}
+	}
+	if !errors.Is(failure, ndt5.ErrTestTimeout) {
+		t.Fatalf("expected a test timeout error, got %v", failure)
+	}
+	if !strings.Contains(failure.Error(), "during the queue phase") {
+		t.Fatalf("expected the error to tell the phase, got %v", failure)
+	}
+}
+
+func TestUnitClientSubtests(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:         "2 4",
+		Duration:        100 * time.Millisecond,
+		DownloadTestMsg: "1000",
+		UploadTestMsg:   "1000",
+		DropControl:     true,
+	}
+	client := NewFakeServerClient(server)
+	client.DisableMetadata = true
+	ch, err := client.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range ch {
+		// drain
+	}
+	subtests := client.Result.Subtests
+	if len(subtests) != 2 {
+		t.Fatalf("unexpected subtests: %+v", subtests)
+	}
+	upload, download := subtests[0], subtests[1]
+	if upload.ID != 2 || upload.Direction != "upload" || !upload.Success || upload.Error != "" {
+		t.Fatalf("unexpected upload: %+v", upload)
+	}
+	if download.ID != 4 || download.Direction != "download" || download.Success || download.Error == "" {
+		t.Fatalf("unexpected download: %+v", download)
+	}
+	if upload.End.Before(upload.Start) || download.Start.Before(upload.End) {
+		t.Fatalf("unexpected times: %+v", subtests)
+	}
+}
+
+func TestUnitClientOnSample(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:         "4 2",
+		Duration:        600 * time.Millisecond,
+		DownloadTestMsg: "1000",
+		UploadTestMsg:   "1000",
+	}
+	client := NewFakeServerClient(server)
+	samples := make(map[string][]ndt5.Speed)
+	client.OnSample = func(direction string, s ndt5.Speed) {
+		samples[direction] = append(samples[direction], s)
+	}
+	var events []*ndt5.Speed
+	ch, err := client.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ev := range ch {
+		if ev.CurDownloadSpeed != nil {
+			events = append(events, ev.CurDownloadSpeed)
+		}
+	}
+	if len(samples["download"]) == 0 || len(samples["upload"]) == 0 {
+		t.Fatalf("expected download and upload samples, got %+v", samples)
+	}
+	if len(events) != len(samples["download"]) {
+		t.Fatalf("expected %d samples, got %d", len(events), len(samples["download"]))
+	}
+	for i, speed := range events {
+		if *speed != samples["download"][i] {
+			t.Fatalf("sample %d differs: %+v != %+v", i, *speed, samples["download"][i])
+		}
+	}
+}
+
+func TestUnitClientDownloadTTFB(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:         "4",
+		Duration:        200 * time.Millisecond,
+		DownloadTestMsg: "1000",
+	}
+	client := NewFakeServerClient(server)
+	ch, err := client.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range ch {
+		// drain
+	}
+	if ttfb := client.Result.DownloadTTFB; ttfb <= 0 || ttfb >= server.Duration {
+		t.Fatalf("unexpected TTFB: %v", ttfb)
+	}
+}
+
+func TestUnitClientReconcileUpload(t *testing.T) {
+	for _, reconcile := range []bool{false, true} {
+		server := &FakeServer{
+			TestIDs:       "2",
+			Duration:      600 * time.Millisecond,
+			UploadTestMsg: "1000 0 1024",
+		}
+		client := NewFakeServerClient(server)
+		client.ReconcileUpload = reconcile
+		ch, err := client.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range ch {
+			// drain
+		}
+		result := client.Result
+		if result.ServerMeasuredUpload != 1000 || result.UploadAcknowledgedBytes != 1024 {
+			t.Fatalf("unexpected result: %+v", result)
+		}
+		if count := result.ClientMeasuredUpload.Count; count <= 0 || (count == 1024) != reconcile {
+			t.Fatalf("reconcile %v: unexpected count %d", reconcile, count)
+		}
+	}
+}
+
+func TestUnitClientPostTestDelay(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:         "4 2",
+		Duration:        100 * time.Millisecond,
+		DownloadTestMsg: "1000",
+		UploadTestMsg:   "1000",
+	}
+	client := NewFakeServerClient(server)
+	client.PostTestDelay = 300 * time.Millisecond
+	ch, err := client.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range ch {
+		// drain
+	}
+	if len(client.Result.Subtests) != 2 {
+		t.Fatalf("unexpected subtests: %+v", client.Result.Subtests)
+	}
+	for _, subtest := range client.Result.Subtests {
+		if !subtest.Success || subtest.End.Sub(subtest.Start) < client.PostTestDelay {
+			t.Fatalf("unexpected subtest: %+v", subtest)
+		}
+	}
+	if server.ClientTestMsg == "" {
+		t.Fatal("expected the client TestMsg")
+	}
+}
+
+func TestUnitClientConvergence(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:         "4 2",
+		Duration:        10 * time.Second,
+		DownloadTestMsg: "1000",
+		UploadTestMsg:   "1000",
+	}
+	client := NewFakeServerClient(server)
+	// Loopback speeds are noisy, so use a threshold that always converges.
+	client.ConvergenceThreshold = 100
+	client.ConvergenceWindow = 500 * time.Millisecond
+	ch, err := client.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var converged int
+	for m := range ch {
+		if m.InfoMessage != nil && strings.Contains(m.InfoMessage.Message, "converged") {
+			converged++
+		}
+	}
+	if converged != 2 {
+		t.Fatalf("expected two convergence messages, got %d", converged)
+	}
+	if client.Result.ConvergedDownload <= 0 || client.Result.ConvergedUpload <= 0 {
+		t.Fatalf("unexpected result: %+v", client.Result)
+	}
+	for _, subtest := range client.Result.Subtests {
+		if !subtest.Success || subtest.End.Sub(subtest.Start) >= server.Duration {
+			t.Fatalf("unexpected subtest: %+v", subtest)
+		}
+	}
+}
+
+// RecordingObserver is a ClientObserver recording the events.
+type RecordingObserver struct {
+	ndt5.NopClientObserver
+	Phases    []ndt5.Phase
+	Connected net.Addr
+	FirstByte time.Duration
+	Samples   map[string]int
+	Completed []ndt5.Phase
+	Result    *ndt5.TestResult
+}
+
+func (o *RecordingObserver) OnPhaseChange(phase ndt5.Phase) {
+	o.Phases = append(o.Phases, phase)
+}
+
+func (o *RecordingObserver) OnConnected(addr net.Addr) {
+	o.Connected = addr
+}
+
+func (o *RecordingObserver) OnFirstByte(ttfb time.Duration) {
+	o.FirstByte = ttfb
+}
+
+func (o *RecordingObserver) OnSample(direction string, s ndt5.Speed) {
+	if o.Samples == nil {
+		o.Samples = make(map[string]int)
+	}
+	o.Samples[direction]++
+}
+
+func (o *RecordingObserver) OnPhaseComplete(phase ndt5.Phase, err error) {
+	if err == nil {
+		o.Completed = append(o.Completed, phase)
+	}
+}
+
+func (o *RecordingObserver) OnComplete(result ndt5.TestResult) {
+	o.Result = &result
+}
+
+func TestUnitClientObserver(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:         "4 2",
+		Duration:        600 * time.Millisecond,
+		DownloadTestMsg: "1000",
+		UploadTestMsg:   "1000",
+	}
+	client := NewFakeServerClient(server)
+	observer := new(RecordingObserver)
+	client.Observer = observer
+	ch, err := client.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range ch {
+		// drain
+	}
+	expectPhases := []ndt5.Phase{
+		ndt5.PhaseConnect, ndt5.PhaseLogin, ndt5.PhaseQueue, ndt5.PhaseLogin,
+		ndt5.PhaseDownload, ndt5.PhaseUpload, ndt5.PhaseResults,
+	}
+	if !reflect.DeepEqual(observer.Phases, expectPhases) {
+		t.Fatalf("unexpected phases: %v", observer.Phases)
+	}
+	if observer.Connected == nil || observer.FirstByte <= 0 {
+		t.Fatalf("unexpected observer: %+v", observer)
+	}
+	if observer.Samples["download"] == 0 || observer.Samples["upload"] == 0 {
+		t.Fatalf("unexpected samples: %+v", observer.Samples)
+	}
+	expectCompleted := []ndt5.Phase{ndt5.PhaseDownload, ndt5.PhaseUpload}
+	if !reflect.DeepEqual(observer.Completed, expectCompleted) {
+		t.Fatalf("unexpected completed phases: %v", observer.Completed)
+	}
+	if observer.Result == nil || len(observer.Result.Subtests) != 2 {
+		t.Fatalf("unexpected result: %+v", observer.Result)
+	}
+}
+
+func TestUnitClientAddressFamily(t *testing.T) {
+	for _, tc := range []struct {
+		address string
+		family  string
+	}{
+		{"127.0.0.1:0", "ipv4"},
+		{"[::1]:0", "ipv6"},
+	} {
+		listener, err := net.Listen("tcp", tc.address)
+		if err != nil {
+			t.Logf("skipping %s: %s", tc.family, err)
+			continue
+		}
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				ServeNoTests(conn)
+			}
+		}()
+		protocolFactory := ndt5.NewProtocolFactory5()
+		protocolFactory.ConnectionsFactory = ndt5.NewRawConnectionsFactory(
+			&RedirectDialer{Address: listener.Addr().String()},
+		)
+		client := ndt5.NewClient(clientName, clientVersion, "")
+		client.ProtocolFactory = protocolFactory
+		client.FQDN = "ndt5.example.com"
+		_, err = client.RunN(context.Background(), 1)
+		listener.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if client.Result.AddressFamily != tc.family {
+			t.Fatalf("expected %q, got %q", tc.family, client.Result.AddressFamily)
+		}
+	}
+	// The pipe used by the FakeServer has no address family.
+	client := NewScriptedClient(ServeNoTests)
+	if _, err := client.RunN(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if client.Result.AddressFamily != "" {
+		t.Fatalf("unexpected address family: %q", client.Result.AddressFamily)
+	}
+}
+
+func TestUnitClientDrainAfterLogout(t *testing.T) {
+	handler := func(conn net.Conn) {
+		defer conn.Close()
+		login := make([]byte, 4)
+		if _, err := io.ReadFull(conn, login); err != nil {
+			return
+		}
+		conn.Write([]byte("123456 654321"))
+		WriteFrame(conn, 1, "0")
+		WriteFrame(conn, 2, "v3.7.0")
+		WriteFrame(conn, 2, "")
+		WriteFrame(conn, 9, "")
+		WriteFrame(conn, 8, "trailing")
+	}
+	for _, drain := range []time.Duration{0, 10 * time.Second} {
+		client := NewScriptedClient(handler)
+		client.DrainAfterLogout = drain
+		begin := time.Now()
+		if _, err := client.RunN(context.Background(), 1); err != nil {
+			t.Fatal(err)
+		}
+		if time.Since(begin) >= 5*time.Second {
+			t.Fatal("expected to stop draining at EOF")
+		}
+		trailing := client.Result.TrailingMessages
+		if drain > 0 && !reflect.DeepEqual(trailing, []string{"trailing"}) {
+			t.Fatalf("unexpected trailing messages: %v", trailing)
+		}
+		if drain == 0 && trailing != nil {
+			t.Fatalf("unexpected trailing messages: %v", trailing)
+		}
+	}
+}
+
+func TestUnitClientStrict(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		client := NewFakeServerClient(&FakeServer{Version: "bogus"})
+		client.Strict = strict
+		results, err := client.RunN(context.Background(), 1)
+		if strict && (!errors.Is(err, ndt5.ErrInvalidServerVersion) || len(results) != 0) {
+			t.Fatalf("expected ErrInvalidServerVersion, got %v %+v", err, results)
+		}
+		if !strict && (err != nil || len(results) != 1) {
+			t.Fatalf("unexpected outcome: %v %+v", err, results)
+		}
+	}
+}
+
+func TestUnitClientUnexpectedTestIDs(t *testing.T) {
+	client := NewScriptedClient(ServeTestIDs("64 8 64"))
+	ch, err := client.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var warnings []string
+	for ev := range ch {
+		if ev.ErrorMessage != nil {
+			t.Fatal(ev.ErrorMessage.Error)
+		}
+		if ev.WarningMessage != nil && errors.Is(ev.WarningMessage.Error, ndt5.ErrUnexpectedTestIDs) {
+			warnings = append(warnings, ev.WarningMessage.Error.Error())
+		}
+	}
+	expect := []string{
+		"unexpected test IDs: unknown test ID 64",
+		"unexpected test IDs: unknown test ID 8",
+		"unexpected test IDs: duplicate test ID 64",
+	}
+	if !reflect.DeepEqual(warnings, expect) {
+		t.Fatalf("unexpected warnings: %q", warnings)
+	}
+	if !reflect.DeepEqual(client.Result.TestIDs, []int{64, 8}) {
+		t.Fatalf("unexpected test IDs: %v", client.Result.TestIDs)
+	}
+	if len(client.Result.Subtests) != 0 {
+		t.Fatalf("expected no subtests, got %+v", client.Result.Subtests)
+	}
+}
+
+func TestUnitClientIdleTimeout(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:         "4",
+		Duration:        100 * time.Millisecond,
+		DownloadStall:   10 * time.Second,
+		DownloadTestMsg: "1000",
+	}
+	client := NewFakeServerClient(server)
+	client.IdleTimeout = 500 * time.Millisecond
+	client.DisableMetadata = true
+	begin := time.Now()
+	ch, err := client.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failure error
+	for ev := range ch {
+		if ev.ErrorMessage != nil {
+			failure = ev.ErrorMessage.Error
+		}
+	}
+	if !errors.Is(failure, ndt5.ErrIdleTimeout) {
+		t.Fatalf("expected an idle timeout error, got %v", failure)
+	}
+	if time.Since(begin) > 5*time.Second {
+		t.Fatal("the test did not fail quickly")
+	}
+}
+
+type LocateV2Client struct {
+	Target mlabns.Target
+}
+
+func (c *LocateV2Client) Query(ctx context.Context) (string, error) {
+	return "", errors.New("should not be called")
+}
+
+func (c *LocateV2Client) QueryV2(ctx context.Context) (*mlabns.Target, error) {
+	return &c.Target, nil
+}
+
+func TestUnitClientLocateV2AccessToken(t *testing.T) {
+	_, factory := NewWSServer(t, func(conn *websocket.Conn) {})
+	protocolFactory := ndt5.NewProtocolFactory5()
+	protocolFactory.ConnectionsFactory = factory
+	client := ndt5.NewClient("ndt5-client-go-testing", "0.1.0", "")
+	client.ProtocolFactory = protocolFactory
+	client.LocateV2 = true
+	client.MLabNSClient = &LocateV2Client{Target: mlabns.Target{
+		FQDN: "127.0.0.1",
+		URLs: map[string]string{
+			"wss:///ndt_protocol": "wss://127.0.0.1:3010/ndt_protocol?access_token=xyz",
+		},
+	}}
+	ch, err := client.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range ch {
+		// drain
+	}
+	if client.FQDN != "127.0.0.1" {
+		t.Fatalf("unexpected FQDN: %s", client.FQDN)
+	}
+	if client.AccessToken != "xyz" || factory.AccessToken != "xyz" {
+		t.Fatal("the access token was not applied")
+	}
+}
+
+func TestUnitClientAccessTokenFile(t *testing.T) {
+	_, factory := NewWSServer(t, func(conn *websocket.Conn) {})
+	protocolFactory := ndt5.NewProtocolFactory5()
+	protocolFactory.ConnectionsFactory = factory
+	client := ndt5.NewClient("ndt5-client-go-testing", "0.1.0", "")
+	client.ProtocolFactory = protocolFactory
+	client.FQDN = "127.0.0.1"
+	client.AccessTokenFile = filepath.Join(t.TempDir(), "token")
+	// We must re-read the file before each test to pick up rotated tokens.
+	for _, token := range []string{"abc", "def"} {
+		if err := os.WriteFile(client.AccessTokenFile, []byte(token+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		ch, err := client.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range ch {
+			// drain
+		}
+		if client.AccessToken != token || factory.AccessToken != token {
+			t.Fatalf("the access token %s was not applied", token)
+		}
+	}
+	if err := os.WriteFile(client.AccessTokenFile, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Start(context.Background()); err == nil {
+		t.Fatal("expected an error with an empty file")
+	}
+	os.Remove(client.AccessTokenFile)
+	if _, err := client.Start(context.Background()); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestUnitClientReconnectControlOnError(t *testing.T) {
+	for _, reconnect := range []bool{false, true} {
+		server := &FakeServer{
+			TestIDs:         "4 2",
+			Duration:        100 * time.Millisecond,
+			DownloadTestMsg: "1000",
+			UploadTestMsg:   "1000",
+			DropControl:     true,
+		}
+		client := NewFakeServerClient(server)
+		client.ReconnectControlOnError = reconnect
+		ch, err := client.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reconnects, failures int
+		for ev := range ch {
+			if ev.WarningMessage != nil && errors.Is(ev.WarningMessage.Error, ndt5.ErrControlReconnect) {
+				reconnects++
+			}
+			if ev.ErrorMessage != nil {
+				failures++
+			}
+		}
+		if !reconnect {
+			if reconnects != 0 || failures != 1 || len(server.Logins) != 1 {
+				t.Fatalf("unexpected reconnects=%d failures=%d logins=%v",
+					reconnects, failures, server.Logins)
+			}
+			continue
+		}
+		if reconnects != 1 || failures != 0 {
+			t.Fatalf("unexpected reconnects=%d failures=%d", reconnects, failures)
+		}
+		// The first login also requests the META test, while the second login
+		// must only request the upload and the status tests.
+		if len(server.Logins) != 2 || server.Logins[0] != 54 || server.Logins[1] != 18 {
+			t.Fatalf("unexpected logins: %v", server.Logins)
+		}
+		if client.Result.ServerMeasuredUpload != 1000 {
+			t.Fatal("unexpected server-measured upload")
+		}
+	}
+}
+
+// NewFaultyClient returns a client connecting to server and failing the
+// steps listed in faults once.
+func NewFaultyClient(server *FakeServer, faults map[string]error) *ndt5.Client {
+	client := NewFakeServerClient(server)
+	client.ProtocolFactory = &FaultyProtocolFactory{
+		Factory: client.ProtocolFactory,
+		Faults:  faults,
+	}
+	return client
+}
+
+func TestUnitClientSubtestFaults(t *testing.T) {
+	for _, tc := range []struct {
+		step      string
+		testID    uint8
+		reconnect bool
+		expect    error
+	}{
+		{"DialDownloadConn", 4, true, ndt5.ErrMeasurementPortUnreachable},
+		{"ExpectTestStart", 4, true, ErrMocked},
+		{"ExpectTestMsg", 4, true, ErrMocked},
+		{"ExpectTestFinalize", 2, false, ErrMocked},
+	} {
+		server := &FakeServer{
+			TestIDs:         "4 2",
+			Duration:        100 * time.Millisecond,
+			DownloadTestMsg: "1000",
+			UploadTestMsg:   "1000",
+		}
+		client := NewFaultyClient(server, map[string]error{tc.step: ErrMocked})
+		client.ReconnectControlOnError = tc.reconnect
+		ch, err := client.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var failed bool
+		for ev := range ch {
+			if ev.ErrorMessage != nil {
+				t.Fatalf("%s: %s", tc.step, ev.ErrorMessage.Error)
+			}
+			if ev.WarningMessage != nil && errors.Is(ev.WarningMessage.Error, tc.expect) {
+				failed = true
+			}
+		}
+		if !failed {
+			t.Fatalf("%s: expected a warning", tc.step)
+		}
+		// The failed subtest must not stop the other one.
+		subtests := client.Result.Subtests
+		if len(subtests) != 2 {
+			t.Fatalf("%s: unexpected subtests: %+v", tc.step, subtests)
+		}
+		for _, subtest := range subtests {
+			if subtest.Success == (subtest.ID == tc.testID) {
+				t.Fatalf("%s: unexpected subtest: %+v", tc.step, subtest)
+			}
+		}
+	}
+}
+
+// TestUnitClientWarningCallers checks that the problems that we report
+// without stopping the test, which used to be emitted as ErrorMessage, are
+// emitted as WarningMessage, logged at the warning level, and do not make
+// RunN fail unless Strict is set.
+func TestUnitClientWarningCallers(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		web100 []string
+		faults map[string]error
+	}{
+		{"subtest failure", nil, map[string]error{"ExpectTestFinalize": ErrMocked}},
+		{"malformed web100", []string{"garbage"}, nil},
+	} {
+		server := &FakeServer{
+			TestIDs:         "4 2",
+			Duration:        100 * time.Millisecond,
+			DownloadTestMsg: "1000",
+			UploadTestMsg:   "1000",
+			Web100:          tc.web100,
+		}
+		client := NewFaultyClient(server, tc.faults)
+		buf := new(bytes.Buffer)
+		client.Logger = slog.New(slog.NewJSONHandler(buf, nil))
+		results, err := client.RunN(context.Background(), 1)
+		if err != nil || len(results) != 1 {
+			t.Fatalf("%s: unexpected outcome: %v %+v", tc.name, err, results)
+		}
+		levels := make(map[string]int)
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var record struct {
+				Level string `json:"level"`
+			}
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatal(err)
+			}
+			levels[record.Level]++
+		}
+		if levels["WARN"] != 1 || levels["ERROR"] != 0 {
+			t.Fatalf("%s: unexpected log levels: %+v", tc.name, levels)
+		}
+	}
+}
+
+// ConnProtocolFactory is a ProtocolFactory using an existing conn.
+type ConnProtocolFactory struct {
+	Conn net.Conn
+}
+
+func (f *ConnProtocolFactory) NewProtocol(
+	ctx context.Context, fqdn, userAgent string, ch chan<- *ndt5.Output) (ndt5.Protocol, error) {
+	return ndt5.NewProtocolFactory5().NewProtocolWithConn(ctx, ndt5.NewRawControlConn(f.Conn), ch)
+}
+
+func TestUnitClientWithExistingConn(t *testing.T) {
+	client, server := net.Pipe()
+	go ServeNoTests(server)
+	c := ndt5.NewClient("ndt5-client-go-testing", "0.1.0", "")
+	c.FQDN = "127.0.0.1"
+	c.ProtocolFactory = &ConnProtocolFactory{Conn: client}
+	ch, err := c.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var success bool
+	for ev := range ch {
+		if ev.ErrorMessage != nil {
+			t.Fatal(ev.ErrorMessage.Error)
+		}
+		if ev.InfoMessage != nil && ev.InfoMessage.Message == "finished successfully" {
+			success = true
+		}
+	}
+	if !success {
+		t.Fatal("the test did not finish successfully")
+	}
+}
+
+func TestUnitClientOnComplete(t *testing.T) {
+	for _, failure := range []error{nil, ErrMocked} {
+		server := &FakeServer{
+			TestIDs:       "2",
+			Duration:      100 * time.Millisecond,
+			UploadTestMsg: "1000",
+		}
+		client := NewFakeServerClient(server)
+		var upload float64
+		client.OnComplete = func(result *ndt5.TestResult) error {
+			upload = result.ServerMeasuredUpload
+			return failure
+		}
+		ch, err := client.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var warnings int
+		for ev := range ch {
+			if ev.ErrorMessage != nil {
+				t.Fatal(ev.ErrorMessage.Error)
+			}
+			if ev.WarningMessage != nil {
+				if !errors.Is(ev.WarningMessage.Error, ErrMocked) {
+					t.Fatal(ev.WarningMessage.Error)
+				}
+				warnings++
+			}
+		}
+		if upload != 1000 {
+			t.Fatal("OnComplete did not see the result")
+		}
+		if (failure != nil) != (warnings == 1) {
+			t.Fatalf("unexpected number of warnings: %d", warnings)
+		}
+	}
+}
+
+func TestUnitClientResultProcessor(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:       "2",
+		Duration:      100 * time.Millisecond,
+		UploadTestMsg: "1000",
+	}
+	client := NewFakeServerClient(server)
+	var calls []string
+	client.ResultProcessor = func(result *ndt5.TestResult) {
+		calls = append(calls, "ResultProcessor")
+		result.ServerMeasuredUpload *= 2
+	}
+	var upload float64
+	client.OnComplete = func(result *ndt5.TestResult) error {
+		calls = append(calls, "OnComplete")
+		upload = result.ServerMeasuredUpload
+		return nil
+	}
+	results, err := client.RunN(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(calls, []string{"ResultProcessor", "OnComplete"}) {
+		t.Fatalf("unexpected calls: %v", calls)
+	}
+	if upload != 2000 || results[0].ServerMeasuredUpload != 2000 {
+		t.Fatalf("the result was not processed: %f %+v", upload, results[0])
+	}
+}
+
+func TestUnitClientResolveFQDN(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:       "2",
+		Duration:      100 * time.Millisecond,
+		UploadTestMsg: "1000",
+	}
+	client := NewFakeServerClient(server)
+	client.FQDN = "localhost"
+	client.ResolveFQDN = true
+	results, err := client.RunN(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Timings.DNSResolve <= 0 {
+		t.Fatal("expected a positive DNS resolution time")
+	}
+	if results[0].Timings.LoginRTT <= 0 {
+		t.Fatal("expected a positive login RTT")
+	}
+	if len(server.Addresses) != 2 {
+		t.Fatalf("unexpected addresses: %v", server.Addresses)
+	}
+	for _, address := range server.Addresses {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil || net.ParseIP(host) == nil {
+			t.Fatalf("expected to dial an IP address, got %s", address)
+		}
+	}
+}
+
+func TestUnitClientSpeedDivergence(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:         "4 2",
+		Duration:        500 * time.Millisecond,
+		DownloadTestMsg: "1",
+		UploadTestMsg:   "1",
+	}
+	client := NewFakeServerClient(server)
+	client.SpeedDivergence = 50
+	ch, err := client.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var warnings []string
+	for ev := range ch {
+		if ev.ErrorMessage != nil {
+			t.Fatal(ev.ErrorMessage.Error)
+		}
+		if ev.WarningMessage != nil {
+			if !errors.Is(ev.WarningMessage.Error, ndt5.ErrSpeedDivergence) {
+				t.Fatal(ev.WarningMessage.Error)
+			}
+			warnings = append(warnings, ev.WarningMessage.Error.Error())
+		}
+	}
+	if len(warnings) != 2 || !strings.Contains(warnings[0], "download") ||
+		!strings.Contains(warnings[1], "upload") {
+		t.Fatalf("unexpected warnings: %v", warnings)
+	}
+	if client.Result.ServerMeasuredDownload != 1 {
+		t.Fatal("unexpected server-measured download")
+	}
+	if client.Result.ClientMeasuredUpload.Count <= 0 {
+		t.Fatal("expected a client-measured upload")
+	}
+}
+
+func TestUnitTestResultJSON(t *testing.T) {
+	result := ndt5.TestResult{
+		ClientMeasuredDownload: ndt5.Speed{Count: 1 << 20, Elapsed: 1500 * time.Millisecond},
+		ServerMeasuredUpload:   1000,
+		Web100:                 map[string]string{"MinRTT": "10"},
+		ServerMeasuredDownload: 5000.5,
+		ClientMeasuredUpload:   ndt5.Speed{Count: 1 << 10, Elapsed: time.Second},
+		CongestionControl:      "bbr",
+		UploadMessageSize:      8192,
+		UploadMessageSizeCurve: []ndt5.MessageSizeSample{{Size: 8192, Mbps: 10}},
+		Timings:                ndt5.Timings{DNSResolve: time.Millisecond},
+		ControlRTT:             &ndt5.RTTStats{Count: 1, Min: time.Millisecond},
+		MaxBytesReached:        true,
+		Labels:                 map[string]string{"probe": "1"},
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`"ElapsedSeconds":1.5`)) {
+		t.Fatalf("expected the elapsed seconds: %s", data)
+	}
+	var decoded ndt5.TestResult
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result, decoded) {
+		t.Fatalf("round trip mismatch: %+v != %+v", result, decoded)
+	}
+}
+
+func TestUnitSpeedUnmarshalJSONElapsedSeconds(t *testing.T) {
+	var speed ndt5.Speed
+	if err := json.Unmarshal([]byte(`{"Count":10,"ElapsedSeconds":0.25}`), &speed); err != nil {
+		t.Fatal(err)
+	}
+	if speed.Count != 10 || speed.Elapsed != 250*time.Millisecond {
+		t.Fatalf("unexpected speed: %+v", speed)
+	}
+	if err := json.Unmarshal([]byte(`[]`), &speed); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestUnitClientSkipKickoff(t *testing.T) {
+	for _, skip := range []bool{true, false} {
+		server := &FakeServer{
+			TestIDs:       "2",
+			Duration:      100 * time.Millisecond,
+			UploadTestMsg: "1000",
+			NoKickoff:     true,
+		}
+		client := NewFakeServerClient(server)
+		client.ProtocolFactory.(*ndt5.ProtocolFactory5).SkipKickoff = skip
+		_, err := client.RunN(context.Background(), 1)
+		if skip && err != nil {
+			t.Fatal(err)
+		}
+		if !skip && err == nil {
+			t.Fatal("expected to lose sync with the server")
+		}
+	}
+}
+
+func TestUnitClientWSSDownloadTestMsg(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:  "4",
+		Duration: 100 * time.Millisecond,
+		DownloadTestMsg: `{"ThroughputValue": "5000.5", "UnsentDataAmount": "10",` +
+			` "TotalSentByte": "1048576"}`,
+	}
+	client := NewFakeServerClient(server)
+	results, err := client.RunN(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := results[0]
+	if result.ServerMeasuredDownload != 5000.5 {
+		t.Fatalf("unexpected server-measured download: %f", result.ServerMeasuredDownload)
+	}
+	if result.ServerUnsentDataAmount != 10 || result.ServerTotalSentByte != 1048576 {
+		t.Fatalf("unexpected server data amounts: %+v", result)
+	}
+}
+
+func TestUnitClientRecordEvents(t *testing.T) {
+	client := NewScriptedClient(ServeNoTests)
+	client.RecordEvents = true
+	for i := 0; i < 2; i++ {
+		ch, err := client.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var received []*ndt5.Output
+		for ev := range ch {
+			received = append(received, ev)
+		}
+		events := client.Events()
+		if len(events) == 0 || len(events) != len(received) {
+			t.Fatalf("recorded %d events, received %d", len(events), len(received))
+		}
+		for j, ev := range events {
+			if ev.Output != received[j] {
+				t.Fatalf("event %d: recorded %+v, received %+v", j, ev.Output, received[j])
+			}
+			if j > 0 && ev.Time.Before(events[j-1].Time) {
+				t.Fatal("expected non-decreasing timestamps")
+			}
+		}
+	}
+}
+
+func TestUnitClientRecordEventsDisabled(t *testing.T) {
+	client := NewScriptedClient(ServeNoTests)
+	if _, err := client.RunN(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if events := client.Events(); events != nil {
+		t.Fatalf("expected no events, got %d", len(events))
+	}
+}
+
+func TestUnitClientServerVersion(t *testing.T) {
+	for _, tc := range []struct {
+		version string
+		valid   bool
+	}{
+		{"v3.7.0", true},
+		{"3.7.0.2", true},
+		{"v5.0-NDTinGO", true},
+		{" ", false},
+		{"vx", false},
+		{"<html>", false},
+	} {
+		server := &FakeServer{Version: tc.version}
+		client := NewFakeServerClient(server)
+		ch, err := client.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var warnings int
+		for ev := range ch {
+			if ev.ErrorMessage != nil {
+				t.Fatal(ev.ErrorMessage.Error)
+			}
+			if ev.WarningMessage != nil {
+				if !errors.Is(ev.WarningMessage.Error, ndt5.ErrInvalidServerVersion) {
+					t.Fatal(ev.WarningMessage.Error)
+				}
+				warnings++
+			}
+		}
+		if client.Result.ServerVersion != tc.version || client.Result.VersionValid != tc.valid {
+			t.Fatalf("%q: unexpected result: %+v", tc.version, client.Result)
+		}
+		if (warnings == 0) != tc.valid {
+			t.Fatalf("%q: unexpected number of warnings: %d", tc.version, warnings)
+		}
+	}
+}
+
+func TestUnitClientCustomConnectionsFactory(t *testing.T) {
+	for fqdn, expect := range map[string][]string{
+		"127.0.0.1":      {"127.0.0.1:3001", "127.0.0.1:3002", "127.0.0.1:3003"},
+		"[::1]":          {"[::1]:3001", "[::1]:3002", "[::1]:3003"},
+		"::1":            {"[::1]:3001", "[::1]:3002", "[::1]:3003"},
+		"localhost:3001": {"localhost:3001", "localhost:3002", "localhost:3003"},
+	} {
+		server := &FakeServer{
+			TestIDs:         "4 2",
+			Duration:        100 * time.Millisecond,
+			DownloadTestMsg: "1000",
+			UploadTestMsg:   "1000",
+		}
+		protocolFactory := ndt5.NewProtocolFactory5()
+		dial := func(ctx context.Context, address string) (net.Conn, error) {
+			return server.DialContext(ctx, "pipe", address)
+		}
+		protocolFactory.ConnectionsFactory = ndt5.NewCustomConnectionsFactory(dial, dial)
+		client := ndt5.NewClient(clientName, clientVersion, "")
+		client.ProtocolFactory = protocolFactory
+		client.FQDN = fqdn
+		results, err := client.RunN(context.Background(), 1)
+		if err != nil {
+			t.Fatalf("%s: %s", fqdn, err)
+		}
+		if results[0].ServerMeasuredDownload != 1000 || results[0].ServerMeasuredUpload != 1000 {
+			t.Fatalf("%s: unexpected result: %+v", fqdn, results[0])
+		}
+		if !reflect.DeepEqual(server.Addresses, expect) {
+			t.Fatalf("%s: unexpected addresses: %v", fqdn, server.Addresses)
+		}
+	}
+}
+
+func TestUnitClientCustomConnectionsFactoryWithConn(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:         "4 2",
+		Duration:        100 * time.Millisecond,
+		DownloadTestMsg: "1000",
+		UploadTestMsg:   "1000",
+	}
+	control, serverConn := net.Pipe()
+	go server.serveControl(serverConn)
+	protocolFactory := ndt5.NewProtocolFactory5()
+	protocolFactory.ConnectionsFactory = ndt5.NewCustomConnectionsFactoryWithConn(control,
+		func(ctx context.Context, address string) (net.Conn, error) {
+			return server.DialContext(ctx, "pipe", address)
+		})
+	client := ndt5.NewClient(clientName, clientVersion, "")
+	client.ProtocolFactory = protocolFactory
+	client.FQDN = "127.0.0.1"
+	results, err := client.RunN(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].ServerMeasuredDownload != 1000 || results[0].ServerMeasuredUpload != 1000 {
+		t.Fatalf("unexpected result: %+v", results[0])
+	}
+	// We cannot reuse the control conn for another run.
+	if _, err := client.RunN(context.Background(), 1); !errors.Is(err, ndt5.ErrControlConnUsed) {
+		t.Fatalf("expected ErrControlConnUsed, got %v", err)
+	}
+}
+
+func TestUnitClientMeasurementPortUnreachable(t *testing.T) {
+	control, serverConn := net.Pipe()
+	go func() {
+		defer serverConn.Close()
+		login := make([]byte, 4)
+		if _, err := io.ReadFull(serverConn, login); err != nil {
+			return
+		}
+		serverConn.Write([]byte("123456 654321"))
+		WriteFrame(serverConn, 1, "0")
+		WriteFrame(serverConn, 2, "v3.7.0")
+		WriteFrame(serverConn, 2, "4")
+		WriteFrame(serverConn, 3, "3002")
+	}()
+	protocolFactory := ndt5.NewProtocolFactory5()
+	protocolFactory.ConnectionsFactory = ndt5.NewCustomConnectionsFactoryWithConn(control,
+		func(ctx context.Context, address string) (net.Conn, error) {
+			return nil, syscall.ECONNREFUSED
+		})
+	client := ndt5.NewClient(clientName, clientVersion, "")
+	client.ProtocolFactory = protocolFactory
+	client.FQDN = "127.0.0.1"
+	ch, err := client.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found error
+	for ev := range ch {
+		for _, e := range []*ndt5.Failure{ev.ErrorMessage, ev.WarningMessage} {
+			if e != nil && errors.Is(e.Error, ndt5.ErrMeasurementPortUnreachable) {
+				found = e.Error
+			}
+		}
+	}
+	if found == nil {
+		t.Fatal("expected ErrMeasurementPortUnreachable")
+	}
+	if !errors.Is(found, syscall.ECONNREFUSED) || !strings.Contains(found.Error(), "port 3002") {
+		t.Fatalf("unexpected error: %v", found)
+	}
+}
+
+func TestUnitClientLimiter(t *testing.T) {
+	limiter := ndt5.NewLimiter(1)
+	newClient := func() *ndt5.Client {
+		client := NewFakeServerClient(&FakeServer{
+			TestIDs:       "2",
+			Duration:      200 * time.Millisecond,
+			UploadTestMsg: "1000",
+		})
+		client.Limiter = limiter
+		return client
+	}
+	first, second := newClient(), newClient()
+	ch, err := first.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := second.Start(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected to wait for the first test, got %v", err)
+	}
+	for range ch {
+		// drain
+	}
+	if _, err := second.RunN(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnitClientTCPInfoSeries(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:         "4",
+		Duration:        100 * time.Millisecond,
+		DownloadTestMsg: "1000",
+		Web100: []string{
+			"CurCwnd: 14480", "X_Sndbuf: 65536", "MinRTT: 10",
+			"SmoothedRTT: 12", "CurCwnd: 28960", "TCPInfo.RTT: 11500",
+		},
+	}
+	client := NewFakeServerClient(server)
+	results, err := client.RunN(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := results[0].TCPInfoSeries
+	if len(series) != 5 {
+		t.Fatalf("expected 5 samples, got %+v", series)
+	}
+	if series[0].CongestionWindow != 14480 || series[0].SendBufCur != 0 {
+		t.Fatalf("unexpected first sample: %+v", series[0])
+	}
+	if series[3].CongestionWindow != 28960 || series[3].SendBufCur != 65536 ||
+		series[3].RTT != 12*time.Millisecond {
+		t.Fatalf("unexpected fourth sample: %+v", series[3])
+	}
+	if series[4].RTT != 11500*time.Microsecond {
+		t.Fatalf("unexpected last sample: %+v", series[4])
+	}
+	for i := 1; i < len(series); i++ {
+		if series[i].Time.Before(series[i-1].Time) {
+			t.Fatal("expected non-decreasing timestamps")
+		}
+	}
+}
+
+func TestUnitClientTCPInfoSeriesInvalidValue(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:         "4",
+		Duration:        100 * time.Millisecond,
+		DownloadTestMsg: "1000",
+		Web100:          []string{"CurCwnd: many"},
+	}
+	client := NewFakeServerClient(server)
+	ch, err := client.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var warnings int
+	for ev := range ch {
+		if ev.WarningMessage != nil {
+			warnings++
+		}
+	}
+	if warnings != 1 || client.Result.TCPInfoSeries != nil {
+		t.Fatalf("unexpected warnings (%d) or series (%+v)", warnings, client.Result.TCPInfoSeries)
+	}
+	if client.Result.Web100["CurCwnd"] != "many" {
+		t.Fatal("expected to keep the raw value")
+	}
+}
+
+func TestUnitClientMaxRetransmission(t *testing.T) {
+	for _, tc := range []struct {
+		web100   []string
+		exceeded bool
+	}{
+		{[]string{"TCPInfo.BytesRetrans: 50", "TCPInfo.BytesSent: 1000"}, true},
+		{[]string{"TCPInfo.BytesRetrans: 5", "TCPInfo.BytesSent: 1000"}, false},
+		{[]string{"TCPInfo.BytesRetrans: 50", "TCPInfo.BytesSent: 0"}, false},
+		{[]string{"TCPInfo.BytesRetrans: 50"}, false},
+	} {
+		server := &FakeServer{
+			TestIDs:         "4 2",
+			Duration:        100 * time.Millisecond,
+			DownloadTestMsg: "1000",
+			UploadTestMsg:   "1000",
+			Web100:          tc.web100,
+		}
+		client := NewFakeServerClient(server)
+		client.MaxRetransmission = 1
+		ch, err := client.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var warnings int
+		for ev := range ch {
+			if ev.ErrorMessage != nil {
+				t.Fatal(ev.ErrorMessage.Error)
+			}
+			if ev.WarningMessage != nil {
+				if !errors.Is(ev.WarningMessage.Error, ndt5.ErrMaxRetransmission) {
+					t.Fatal(ev.WarningMessage.Error)
+				}
+				warnings++
+			}
+		}
+		if client.Result.MaxRetransmissionExceeded != tc.exceeded || (warnings > 0) != tc.exceeded {
+			t.Fatalf("%v: unexpected result (%d warnings)", tc.web100, warnings)
+		}
+	}
+}
+
+func TestUnitClientMinSpeed(t *testing.T) {
+	for _, tc := range []struct {
+		min   float64
+		below []string
+	}{
+		{1e12, []string{"download", "upload"}},
+		{0.5, nil},
+		{0, nil},
+	} {
+		server := &FakeServer{
+			TestIDs:         "4 2",
+			Duration:        500 * time.Millisecond,
+			DownloadTestMsg: "1",
+			UploadTestMsg:   "1",
+		}
+		client := NewFakeServerClient(server)
+		client.MinDownload = tc.min
+		client.MinUpload = tc.min
+		ch, err := client.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var warnings []string
+		for ev := range ch {
+			if ev.ErrorMessage != nil {
+				t.Fatal(ev.ErrorMessage.Error)
+			}
+			if ev.WarningMessage != nil {
+				var bte *ndt5.BelowThresholdError
+				if !errors.As(ev.WarningMessage.Error, &bte) ||
+					!errors.Is(ev.WarningMessage.Error, ndt5.ErrBelowThreshold) {
+					t.Fatal(ev.WarningMessage.Error)
+				}
+				if bte.Threshold != tc.min || bte.Speed >= bte.Threshold {
+					t.Fatalf("unexpected error: %+v", bte)
+				}
+				warnings = append(warnings, bte.Direction)
+			}
+		}
+		if !reflect.DeepEqual(warnings, tc.below) ||
+			!reflect.DeepEqual(client.Result.BelowThreshold, tc.below) {
+			t.Fatalf("%v: unexpected result: %v, %v", tc.min, warnings,
+				client.Result.BelowThreshold)
+		}
+	}
+}
+
+func TestUnitTestResultDownloadRetransmission(t *testing.T) {
+	result := ndt5.TestResult{Web100: map[string]string{
+		"TCPInfo.BytesRetrans": "25",
+		"TCPInfo.BytesSent":    "1000",
+	}}
+	if rate, ok := result.DownloadRetransmission(); !ok || rate != 2.5 {
+		t.Fatalf("unexpected rate: %f %v", rate, ok)
+	}
+	result.Web100["TCPInfo.BytesSent"] = "x"
+	if _, ok := result.DownloadRetransmission(); ok {
+		t.Fatal("expected an invalid rate")
+	}
+}
+
+func TestUnitClientMeasurementCapture(t *testing.T) {
+	for _, limit := range []int64{0, 1000} {
+		server := &FakeServer{
+			TestIDs:         "4",
+			Duration:        100 * time.Millisecond,
+			DownloadTestMsg: "1000",
+		}
+		client := NewFakeServerClient(server)
+		capture := new(bytes.Buffer)
+		client.MeasurementCapture = capture
+		client.MeasurementCaptureLimit = limit
+		if _, err := client.RunN(context.Background(), 1); err != nil {
+			t.Fatal(err)
+		}
+		if limit > 0 && int64(capture.Len()) != limit {
+			t.Fatalf("expected to capture %d bytes, got %d", limit, capture.Len())
+		}
+		if limit == 0 && capture.Len() <= 1000 {
+			t.Fatalf("expected to capture all the bytes, got %d", capture.Len())
+		}
+	}
+}
+
+func TestUnitClientRand(t *testing.T) {
+	capture := func(seed int64) []byte {
+		server := &FakeServer{
+			TestIDs:       "2",
+			Duration:      100 * time.Millisecond,
+			UploadTestMsg: "1000",
+		}
+		client := NewFakeServerClient(server)
+		client.Rand = rand.New(rand.NewSource(seed))
+		buf := new(bytes.Buffer)
+		client.MeasurementCapture = buf
+		client.MeasurementCaptureLimit = 1000
+		if _, err := client.RunN(context.Background(), 1); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	first, second, other := capture(42), capture(42), capture(43)
+	if len(first) != 1000 || !bytes.Equal(first, second) {
+		t.Fatal("expected the same seed to yield the same payload")
+	}
+	if bytes.Equal(first, other) {
+		t.Fatal("expected different seeds to yield different payloads")
+	}
+}
+
+func TestUnitClientReusePayload(t *testing.T) {
+	capture := func(seed int64) []byte {
+		server := &FakeServer{
+			TestIDs:       "2",
+			Duration:      100 * time.Millisecond,
+			UploadTestMsg: "1000",
+		}
+		client := NewFakeServerClient(server)
+		client.Rand = rand.New(rand.NewSource(seed)) // must be ignored
+		client.ReusePayload = true
+		buf := new(bytes.Buffer)
+		client.MeasurementCapture = buf
+		client.MeasurementCaptureLimit = 1000
+		if _, err := client.RunN(context.Background(), 1); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	first, second := capture(42), capture(43)
+	if len(first) != 1000 || !bytes.Equal(first, second) {
+		t.Fatal("expected the tests to share the same payload")
+	}
+}
+
+// FailingWriter is a writer that always fails.
+type FailingWriter struct{}
+
+func (FailingWriter) Write([]byte) (int, error) {
+	return 0, ErrMocked
+}
+
+func TestUnitClientMeasurementCaptureFailure(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:         "4 2",
+		Duration:        100 * time.Millisecond,
+		DownloadTestMsg: "1000",
+		UploadTestMsg:   "1000",
+	}
+	client := NewFakeServerClient(server)
+	client.MeasurementCapture = FailingWriter{}
+	ch, err := client.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var warnings int
+	for ev := range ch {
+		if ev.ErrorMessage != nil {
+			t.Fatal(ev.ErrorMessage.Error)
+		}
+		if ev.WarningMessage != nil {
+			if !errors.Is(ev.WarningMessage.Error, ErrMocked) {
+				t.Fatal(ev.WarningMessage.Error)
+			}
+			warnings++
+		}
+	}
+	if warnings != 1 {
+		t.Fatalf("expected one warning, got %d", warnings)
+	}
+}
+
+func TestUnitClientMetadata(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:       "32 2",
+		Duration:      100 * time.Millisecond,
+		UploadTestMsg: "1000",
+	}
+	client := NewFakeServerClient(server)
+	results, err := client.RunN(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := results[0].Metadata
+	if metadata[ndt5.MetadataKeyOSName] != runtime.GOOS ||
+		metadata[ndt5.MetadataKeyApplication] != clientName+"/"+clientVersion {
+		t.Fatalf("unexpected metadata: %+v", metadata)
+	}
+	if len(server.Metadata) != len(metadata) {
+		t.Fatalf("unexpected metadata sent: %+v", server.Metadata)
+	}
+	for _, entry := range server.Metadata {
+		key, value, _ := strings.Cut(entry, ":")
+		if metadata[key] != value {
+			t.Fatalf("unexpected metadata entry: %s", entry)
+		}
+	}
+}
+
+func TestUnitClientDisableMetadata(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:       "32 2",
+		Duration:      100 * time.Millisecond,
+		UploadTestMsg: "1000",
+	}
+	client := NewFakeServerClient(server)
+	client.DisableMetadata = true
+	results, err := client.RunN(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Metadata != nil || server.Metadata != nil {
+		t.Fatal("expected no metadata")
+	}
+	if server.Logins[0]&32 != 0 {
+		t.Fatal("expected not to request the META test")
+	}
+}
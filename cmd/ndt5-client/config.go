@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/m-lab/go/flagx"
+	"gopkg.in/yaml.v2"
+)
+
+// loadConfig reads the YAML (or JSON, which is a subset of YAML) config
+// file at path, which maps flag names to values, and assigns the values to
+// the flags of flagSet that were not set on the command line. A list sets
+// a repeatable flag (e.g. -label) more than once, while a map sets it once
+// for each key=value pair. Call loadConfig after parsing the command line
+// and before reading the environment, so the precedence is: command line
+// flags, environment variables, config file, and finally defaults.
+func loadConfig(flagSet *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("cannot parse config file %s: %w", path, err)
+	}
+	specified := flagx.AssignedFlags(flagSet)
+	for name, value := range config {
+		f := flagSet.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("config file %s: unknown flag: %s", path, name)
+		}
+		if _, ok := specified[name]; ok {
+			continue // the command line wins
+		}
+		for _, v := range configValues(value) {
+			if err := f.Value.Set(v); err != nil {
+				return fmt.Errorf("config file %s: invalid value for %s: %w", path, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configValues converts a config file value to flag values.
+func configValues(value interface{}) []string {
+	switch v := value.(type) {
+	case []interface{}:
+		var values []string
+		for _, entry := range v {
+			values = append(values, fmt.Sprint(entry))
+		}
+		return values
+	case map[interface{}]interface{}:
+		var values []string
+		for key, entry := range v {
+			values = append(values, fmt.Sprintf("%v=%v", key, entry))
+		}
+		sort.Strings(values) // make the order predictable
+		return values
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/flagx"
+)
+
+// newTestFlagSet returns a flag set containing a subset of our flags.
+func newTestFlagSet() (*flag.FlagSet, *flagx.StringArray, *time.Duration, *flagx.KeyValue) {
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	server := &flagx.StringArray{}
+	flagSet.Var(server, "server", "")
+	timeout := flagSet.Duration("timeout", defaultTimeout, "")
+	labels := &flagx.KeyValue{}
+	flagSet.Var(labels, "label", "")
+	return flagSet, server, timeout, labels
+}
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	for _, content := range []string{
+		"server: a.example.org\ntimeout: 10s\nlabel:\n  site: lga\n  probe: '1'\n",
+		`{"server": "a.example.org", "timeout": "10s", "label": ["probe=1", "site=lga"]}`,
+	} {
+		flagSet, server, timeout, labels := newTestFlagSet()
+		if err := flagSet.Parse([]string{"-server", "b.example.org"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadConfig(flagSet, writeConfig(t, content)); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual([]string(*server), []string{"b.example.org"}) {
+			t.Fatalf("the command line should override the config file: %v", *server)
+		}
+		if *timeout != 10*time.Second {
+			t.Fatal("the config file should override the default")
+		}
+		if got := labels.Get(); got["site"] != "lga" || got["probe"] != "1" {
+			t.Fatalf("unexpected labels: %v", got)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, content := range []string{
+		"nonexistent: 1\n",
+		"timeout: ten seconds\n",
+		"{",
+	} {
+		flagSet, _, _, _ := newTestFlagSet()
+		if err := loadConfig(flagSet, writeConfig(t, content)); err == nil {
+			t.Fatalf("expected an error for %q", content)
+		}
+	}
+	flagSet, _, _, _ := newTestFlagSet()
+	if err := loadConfig(flagSet, filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/m-lab/go/flagx"
+)
+
+// envPrefix is the prefix of the environment variables providing the
+// value of the flags, e.g., NDT5_TIMEOUT for -timeout.
+const envPrefix = "NDT5_"
+
+// envAliases maps the environment variables not named after a flag to
+// the name of the corresponding flag. The variables named after the flags
+// take precedence over them.
+var envAliases = []struct {
+	envVar string
+	flag   string
+}{
+	{"NDT5_HOSTNAME", "server"},
+}
+
+// argsFromEnv assigns to the flags of flagSet that were not set on the
+// command line the value of the corresponding environment variable, if
+// any, which is the first one set among the NDT5_ variable named after the
+// flag (e.g. NDT5_SERVER), its aliases (e.g. NDT5_HOSTNAME), and the
+// unprefixed variable named after the flag (e.g. SERVER). This keeps the
+// configuration out of the command line, which is visible in ps, and is
+// convenient for containers. Call argsFromEnv after loadConfig, because
+// the environment replaces the values of repeatable flags (e.g. -server)
+// read from the config file, instead of adding to them.
+func argsFromEnv(flagSet *flag.FlagSet) error {
+	specified := flagx.AssignedFlags(flagSet)
+	var err error
+	flagSet.VisitAll(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		if _, ok := specified[f.Name]; ok {
+			return // the command line wins
+		}
+		envVar, value, ok := lookupFlagEnv(f.Name)
+		if !ok {
+			return
+		}
+		resetFlag(f)
+		setErr := f.Value.Set(value)
+		if setErr != nil && envVar != flagx.MakeShellVariableName(f.Name) {
+			// We ignore invalid unprefixed variables, which may be
+			// unrelated to us (e.g. FORMAT).
+			err = fmt.Errorf("invalid value for %s: %w", envVar, setErr)
+		}
+	})
+	return err
+}
+
+// lookupFlagEnv returns the name and the value of the environment variable
+// with the highest precedence among the ones providing the value of the
+// flag with the given name, if any is set.
+func lookupFlagEnv(name string) (string, string, bool) {
+	envVars := []string{envPrefix + flagx.MakeShellVariableName(name)}
+	for _, alias := range envAliases {
+		if alias.flag == name {
+			envVars = append(envVars, alias.envVar)
+		}
+	}
+	envVars = append(envVars, flagx.MakeShellVariableName(name))
+	for _, envVar := range envVars {
+		if value, ok := os.LookupEnv(envVar); ok {
+			return envVar, value, true
+		}
+	}
+	return "", "", false
+}
+
+// resetFlag empties f if it's a repeatable flag whose Set appends to the
+// current values, which may come from a lower-precedence source.
+func resetFlag(f *flag.Flag) {
+	if values, ok := f.Value.(*flagx.StringArray); ok {
+		*values = nil
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestArgsFromEnv(t *testing.T) {
+	t.Setenv("NDT5_HOSTNAME", "a.example.org")
+	t.Setenv("NDT5_TIMEOUT", "10s")
+	t.Setenv("NDT5_LABEL", "site=lga")
+	flagSet, server, timeout, labels := newTestFlagSet()
+	if err := flagSet.Parse([]string{"-timeout", "20s"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := argsFromEnv(flagSet); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]string(*server), []string{"a.example.org"}) {
+		t.Fatalf("NDT5_HOSTNAME should set -server: %v", *server)
+	}
+	if *timeout != 20*time.Second {
+		t.Fatal("the command line should override the environment")
+	}
+	if labels.Get()["site"] != "lga" {
+		t.Fatalf("unexpected labels: %v", labels.Get())
+	}
+}
+
+func TestArgsFromEnvPrecedence(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"NDT5_HOSTNAME": "a.example.org", "NDT5_SERVER": "b.example.org"},
+		{"SERVER": "a.example.org", "NDT5_SERVER": "b.example.org"},
+		{"SERVER": "a.example.org", "NDT5_HOSTNAME": "b.example.org"},
+	} {
+		t.Run("", func(t *testing.T) {
+			for name, value := range env {
+				t.Setenv(name, value)
+			}
+			flagSet, server, _, _ := newTestFlagSet()
+			if err := argsFromEnv(flagSet); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual([]string(*server), []string{"b.example.org"}) {
+				t.Fatalf("%v: unexpected servers: %v", env, *server)
+			}
+		})
+	}
+}
+
+func TestArgsFromEnvReplacesConfig(t *testing.T) {
+	t.Setenv("NDT5_SERVER", "b.example.org,c.example.org")
+	flagSet, server, _, _ := newTestFlagSet()
+	path := writeConfig(t, "server: [a.example.org, d.example.org]\n")
+	if err := loadConfig(flagSet, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := argsFromEnv(flagSet); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]string(*server), []string{"b.example.org", "c.example.org"}) {
+		t.Fatalf("the environment should replace the config file: %v", *server)
+	}
+}
+
+func TestArgsFromEnvInvalidValue(t *testing.T) {
+	t.Setenv("NDT5_TIMEOUT", "ten seconds")
+	flagSet, _, _, _ := newTestFlagSet()
+	if err := argsFromEnv(flagSet); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestArgsFromEnvInvalidUnprefixedValue(t *testing.T) {
+	t.Setenv("TIMEOUT", "ten seconds")
+	flagSet, _, _, _ := newTestFlagSet()
+	if err := argsFromEnv(flagSet); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,148 @@
+// Package archive writes the results of the tests to a directory.
+package archive
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Writer writes JSON records to a JSONL file in a directory, creating the
+// file when writing the first record. The file name contains the time
+// when we created it, e.g., "ndt5-20200102T150405.123456789Z.jsonl". If
+// MaxFileSize or MaxRecords is set, we close the file when it reaches the
+// limit and create a new one when writing the next record, so that the
+// files of a long-running process can be shipped on a schedule.
+type Writer struct {
+	// Dir is the mandatory directory where we create the file. This is
+	// initialized by NewWriter.
+	Dir string
+
+	// Compress indicates whether we should gzip-compress the file, whose
+	// name then ends with ".jsonl.gz".
+	Compress bool
+
+	// Level is the gzip compression level. This is initialized by NewWriter
+	// to gzip.DefaultCompression, but you may override it.
+	Level int
+
+	// MaxFileSize is the size in bytes (compressed, if compressing) after
+	// which we rotate the file. Zero, the default, means no limit.
+	MaxFileSize int64
+
+	// MaxRecords is the number of records after which we rotate the file.
+	// Zero, the default, means no limit.
+	MaxRecords int
+
+	fp      *os.File
+	zw      *gzip.Writer
+	w       io.Writer
+	size    int64
+	records int
+}
+
+// NewWriter creates a new Writer for the given directory.
+func NewWriter(dir string) *Writer {
+	return &Writer{Dir: dir, Level: gzip.DefaultCompression}
+}
+
+// Write writes v as a single JSON line, rotating the file first if it
+// reached MaxFileSize or MaxRecords. When compressing, we flush the gzip
+// stream after each record, so that the records written so far, in any
+// file, can be decompressed even if we are killed before calling Close.
+func (w *Writer) Write(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if w.full() {
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	if w.fp == nil {
+		if err := w.create(); err != nil {
+			return err
+		}
+	}
+	if _, err := w.w.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	w.records++
+	if w.zw != nil {
+		return w.zw.Flush()
+	}
+	return nil
+}
+
+// full returns whether the current file reached MaxFileSize or MaxRecords.
+func (w *Writer) full() bool {
+	return w.fp != nil && ((w.MaxFileSize > 0 && w.size >= w.MaxFileSize) ||
+		(w.MaxRecords > 0 && w.records >= w.MaxRecords))
+}
+
+// countingWriter counts the bytes written to the file.
+type countingWriter struct {
+	w     io.Writer
+	count *int64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	*cw.count += int64(n)
+	return n, err
+}
+
+// create creates the file.
+func (w *Writer) create() error {
+	name := "ndt5-" + time.Now().UTC().Format("20060102T150405.000000000Z") + ".jsonl"
+	if w.Compress {
+		name += ".gz"
+	}
+	fp, err := os.OpenFile(filepath.Join(w.Dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	cw := countingWriter{w: fp, count: &w.size}
+	w.fp, w.w = fp, cw
+	if w.Compress {
+		zw, err := gzip.NewWriterLevel(cw, w.Level)
+		if err != nil {
+			fp.Close()
+			os.Remove(fp.Name())
+			w.fp = nil
+			return err
+		}
+		w.zw, w.w = zw, zw
+	}
+	return nil
+}
+
+// Name returns the path of the file, or an empty string if we did not
+// create it yet.
+func (w *Writer) Name() string {
+	if w.fp == nil {
+		return ""
+	}
+	return w.fp.Name()
+}
+
+// Close closes the gzip stream, if any, and the file.
+func (w *Writer) Close() error {
+	if w.fp == nil {
+		return nil
+	}
+	var err error
+	if w.zw != nil {
+		err = w.zw.Close()
+	}
+	if closeErr := w.fp.Close(); err == nil {
+		err = closeErr
+	}
+	w.fp, w.zw, w.w = nil, nil, nil
+	w.size, w.records = 0, 0
+	return err
+}
@@ -0,0 +1,133 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func readRecords(t *testing.T, name string, compress bool) []map[string]string {
+	fp, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	var r io.Reader = fp
+	if compress {
+		zr, err := gzip.NewReader(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	}
+	var records []map[string]string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var record map[string]string
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestWriter(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		w := NewWriter(t.TempDir())
+		w.Compress = compress
+		if w.Name() != "" {
+			t.Fatal("expected no file before writing")
+		}
+		for _, fqdn := range []string{"a.example.org", "b.example.org"} {
+			if err := w.Write(map[string]string{"ServerFQDN": fqdn}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		suffix := ".jsonl"
+		if compress {
+			suffix += ".gz"
+		}
+		if !strings.HasSuffix(w.Name(), suffix) {
+			t.Fatalf("unexpected name: %s", w.Name())
+		}
+		name := w.Name()
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		records := readRecords(t, name, compress)
+		if len(records) != 2 || records[1]["ServerFQDN"] != "b.example.org" {
+			t.Fatalf("unexpected records: %+v", records)
+		}
+	}
+}
+
+func TestWriterInvalidLevel(t *testing.T) {
+	w := NewWriter(t.TempDir())
+	w.Compress = true
+	w.Level = 42
+	if err := w.Write(map[string]string{}); err == nil {
+		t.Fatal("expected an error")
+	}
+	if w.Name() != "" {
+		t.Fatal("expected no file")
+	}
+}
+
+func TestWriterMissingDir(t *testing.T) {
+	w := NewWriter("/nonexistent")
+	if err := w.Write(map[string]string{}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestWriterRotate(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		size     int64
+		records  int
+		compress bool
+		files    int
+	}{
+		{"records", 0, 2, false, 3},
+		{"size", 1, 0, false, 5},
+		{"compressed size", 1, 0, true, 5},
+		{"none", 0, 0, false, 1},
+	} {
+		dir := t.TempDir()
+		w := NewWriter(dir)
+		w.MaxFileSize = tc.size
+		w.MaxRecords = tc.records
+		w.Compress = tc.compress
+		var names []string
+		for i := 0; i < 5; i++ {
+			if err := w.Write(map[string]string{"ServerFQDN": "a.example.org"}); err != nil {
+				t.Fatal(err)
+			}
+			if len(names) == 0 || names[len(names)-1] != w.Name() {
+				names = append(names, w.Name())
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != tc.files || len(entries) != tc.files {
+			t.Fatalf("%s: unexpected files: %v", tc.name, names)
+		}
+		var count int
+		for _, name := range names {
+			count += len(readRecords(t, name, tc.compress))
+		}
+		if count != 5 {
+			t.Fatalf("%s: unexpected number of records: %d", tc.name, count)
+		}
+	}
+}
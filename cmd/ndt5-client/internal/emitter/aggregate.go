@@ -0,0 +1,106 @@
+package emitter
+
+import "sort"
+
+// Stats contains the min, median, and max values of a metric
+// across several runs of the ndt5 test.
+type Stats struct {
+	Min    float64
+	Median float64
+	Max    float64
+	Unit   string
+}
+
+// Aggregate is a struct containing the values displayed to the user
+// at the end of several runs of the ndt5 test.
+type Aggregate struct {
+	// ServerFQDN is the FQDN of the server used for these tests.
+	ServerFQDN string
+
+	// Runs is the number of runs that have been aggregated.
+	Runs int
+
+	// Download contains statistics about the download speed.
+	Download Stats
+
+	// Upload contains statistics about the upload speed.
+	Upload Stats
+
+	// DownloadRetrans contains statistics about the retransmission rate.
+	DownloadRetrans Stats
+
+	// MinRTT contains statistics about the minimum round-trip time.
+	MinRTT Stats
+}
+
+// NewAggregate returns a new Aggregate computed from the given summaries.
+// The stats of each metric only include the runs where the corresponding
+// subtest succeeded, while Runs counts all of them.
+func NewAggregate(summaries []*Summary) *Aggregate {
+	a := &Aggregate{Runs: len(summaries)}
+	if len(summaries) > 0 {
+		a.ServerFQDN = summaries[0].ServerFQDN
+	}
+	a.Download = newStats(summaries, downloadOK, func(s *Summary) ValueUnitPair {
+		return s.Download
+	})
+	a.Upload = newStats(summaries, uploadOK, func(s *Summary) ValueUnitPair {
+		return s.Upload
+	})
+	a.DownloadRetrans = newStats(summaries, downloadOK, func(s *Summary) ValueUnitPair {
+		return s.DownloadRetrans
+	})
+	a.MinRTT = newStats(summaries, downloadOK, func(s *Summary) ValueUnitPair {
+		return s.MinRTT
+	})
+	return a
+}
+
+// downloadOK and uploadOK return whether the download and the upload of a
+// run succeeded, or their status is unknown. We exclude the other runs from
+// the stats, since their zero speed and missing metrics would skew them.
+func downloadOK(s *Summary) bool {
+	return s.DownloadStatus != StatusFailed && s.DownloadStatus != StatusSkipped
+}
+
+func uploadOK(s *Summary) bool {
+	return s.UploadStatus != StatusFailed && s.UploadStatus != StatusSkipped
+}
+
+// newStats returns the stats of the metric returned by get across the
+// summaries for which ok returns true.
+func newStats(
+	summaries []*Summary, ok func(s *Summary) bool, get func(s *Summary) ValueUnitPair,
+) Stats {
+	var (
+		stats  Stats
+		values []float64
+	)
+	for _, s := range summaries {
+		if !ok(s) {
+			continue
+		}
+		pair := get(s)
+		if pair.Unit != "" {
+			stats.Unit = pair.Unit
+		}
+		values = append(values, pair.Value)
+	}
+	if len(values) == 0 {
+		return stats
+	}
+	sort.Float64s(values)
+	stats.Min = values[0]
+	stats.Max = values[len(values)-1]
+	stats.Median = median(values)
+	return stats
+}
+
+// median returns the median of the given sorted values.
+func median(values []float64) float64 {
+	mid := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[mid-1] + values[mid]) / 2
+	}
+	return values[mid]
+}
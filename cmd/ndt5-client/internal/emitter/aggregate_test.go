@@ -0,0 +1,63 @@
+package emitter
+
+import (
+	"testing"
+)
+
+func TestNewAggregate(t *testing.T) {
+	var summaries []*Summary
+	for _, v := range []float64{30, 10, 20, 40} {
+		s := NewSummary("test")
+		s.Download = ValueUnitPair{Value: v, Unit: "Mbit/s"}
+		s.Upload = ValueUnitPair{Value: v / 10, Unit: "Mbit/s"}
+		summaries = append(summaries, s)
+	}
+	a := NewAggregate(summaries)
+	if a.ServerFQDN != "test" || a.Runs != 4 {
+		t.Fatal("NewAggregate(): unexpected FQDN or number of runs")
+	}
+	if a.Download != (Stats{Min: 10, Median: 25, Max: 40, Unit: "Mbit/s"}) {
+		t.Fatalf("NewAggregate(): unexpected download stats: %+v", a.Download)
+	}
+	if a.Upload != (Stats{Min: 1, Median: 2.5, Max: 4, Unit: "Mbit/s"}) {
+		t.Fatalf("NewAggregate(): unexpected upload stats: %+v", a.Upload)
+	}
+	a = NewAggregate(summaries[:3])
+	if a.Download.Median != 20 {
+		t.Fatal("NewAggregate(): unexpected median with odd number of runs")
+	}
+}
+
+func TestNewAggregateFailedRun(t *testing.T) {
+	var summaries []*Summary
+	for _, v := range []float64{30, 0, 10} {
+		s := NewSummary("test")
+		s.Download = ValueUnitPair{Value: v, Unit: "Mbit/s"}
+		s.Upload = ValueUnitPair{Value: v / 10, Unit: "Mbit/s"}
+		s.MinRTT = ValueUnitPair{Value: v, Unit: "ms"}
+		s.DownloadStatus, s.UploadStatus = StatusSucceeded, StatusSucceeded
+		summaries = append(summaries, s)
+	}
+	// The run in the middle failed the download and skipped the upload.
+	summaries[1].DownloadStatus, summaries[1].UploadStatus = StatusFailed, StatusSkipped
+	a := NewAggregate(summaries)
+	if a.Runs != 3 {
+		t.Fatal("NewAggregate(): unexpected number of runs")
+	}
+	if a.Download != (Stats{Min: 10, Median: 20, Max: 30, Unit: "Mbit/s"}) {
+		t.Fatalf("NewAggregate(): unexpected download stats: %+v", a.Download)
+	}
+	if a.Upload != (Stats{Min: 1, Median: 2, Max: 3, Unit: "Mbit/s"}) {
+		t.Fatalf("NewAggregate(): unexpected upload stats: %+v", a.Upload)
+	}
+	if a.MinRTT != (Stats{Min: 10, Median: 20, Max: 30, Unit: "ms"}) {
+		t.Fatalf("NewAggregate(): unexpected MinRTT stats: %+v", a.MinRTT)
+	}
+}
+
+func TestNewAggregateEmpty(t *testing.T) {
+	a := NewAggregate(nil)
+	if a.Runs != 0 || a.Download != (Stats{}) {
+		t.Fatal("NewAggregate(): expected empty aggregate")
+	}
+}
@@ -27,4 +27,7 @@ type Emitter interface {
 
 	// OnSummary is emitted after the test is over.
 	OnSummary(s *Summary) error
+
+	// OnAggregate is emitted after several runs of the test are over.
+	OnAggregate(a *Aggregate) error
 }
@@ -0,0 +1,31 @@
+package emitter
+
+// Error is a machine-readable error.
+type Error struct {
+	// Phase is the phase of the test during which the error occurred
+	// (e.g. "queue" or "download"), if known.
+	Phase string `json:",omitempty"`
+
+	// Code is a stable code telling the category of the error (e.g.
+	// "server_busy"), which does not change with the message.
+	Code string
+
+	// Message is the human-readable error message.
+	Message string
+}
+
+// ErrorEmitter is implemented by emitters that want to receive errors as
+// a machine-readable Error, rather than the message passed to OnError.
+type ErrorEmitter interface {
+	// OnErrorObject is emitted on errors instead of OnError.
+	OnErrorObject(e *Error) error
+}
+
+// EmitError passes e to em, using OnErrorObject if em is an ErrorEmitter
+// and passing the message to OnError otherwise.
+func EmitError(em Emitter, e *Error) error {
+	if ee, ok := em.(ErrorEmitter); ok {
+		return ee.OnErrorObject(e)
+	}
+	return em.OnError(e.Message)
+}
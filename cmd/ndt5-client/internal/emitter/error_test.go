@@ -0,0 +1,45 @@
+package emitter
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/m-lab/ndt5-client-go/cmd/ndt5-client/internal/mocks"
+)
+
+func TestEmitErrorJSON(t *testing.T) {
+	sw := &mocks.SavingWriter{}
+	err := EmitError(NewQuiet(NewJSON(sw)), &Error{
+		Phase:   "queue",
+		Code:    "server_busy",
+		Message: "WaitInQueue: server is busy",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `{"Key":"error","Value":{"Phase":"queue","Code":"server_busy",` +
+		`"Message":"WaitInQueue: server is busy"}}` + "\n"
+	if len(sw.Data) != 1 || string(sw.Data[0]) != expect {
+		t.Fatalf("unexpected data: %q", sw.Data)
+	}
+
+	err = EmitError(NewJSON(&mocks.FailingWriter{}), &Error{Code: "unknown"})
+	if err != mocks.ErrMocked {
+		t.Fatal("Not the error we expected")
+	}
+}
+
+func TestEmitErrorHumanReadable(t *testing.T) {
+	buf := new(bytes.Buffer)
+	err := EmitError(HumanReadable{buf}, &Error{
+		Phase:   "queue",
+		Code:    "server_busy",
+		Message: "WaitInQueue: server is busy",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "\rWaitInQueue: server is busy\n" {
+		t.Fatalf("unexpected output: %q", buf.String())
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
 )
 
 // HumanReadable is a human readable emitter. It emits the events generated
@@ -59,19 +60,77 @@ func (h HumanReadable) OnSummary(s *Summary) error {
 %15s: %s
 %15s: %7.1f %s
 %15s: %7.1f %s
-%15s: %7.1f %s
+%15s: %7.1f %s%s
+%15s: %7.1f %s%s
 %15s: %7.2f %s
 `
+	client := s.ClientIP
+	if s.AddressFamily != "" {
+		client = fmt.Sprintf("%s (%s)", client, s.AddressFamily)
+	}
 	_, err := fmt.Fprintf(h.out, summaryFormat,
 		"Server", s.ServerFQDN,
-		"Client", s.ClientIP,
+		"Client", client,
 		"Latency", s.MinRTT.Value, s.MinRTT.Unit,
-		"Download", s.Download.Value, s.Upload.Unit,
-		"Upload", s.Upload.Value, s.Upload.Unit,
+		"TTFB", s.DownloadTTFB.Value, s.DownloadTTFB.Unit,
+		"Download", s.Download.Value, s.Download.Unit, statusSuffix(s.DownloadStatus),
+		"Upload", s.Upload.Value, s.Upload.Unit, statusSuffix(s.UploadStatus),
 		"Retransmission", s.DownloadRetrans.Value, s.DownloadRetrans.Unit)
 	if err != nil {
 		return err
 	}
+	return h.emitWeb100(s.Web100)
+}
+
+// statusSuffix returns the suffix telling that a subtest did not succeed,
+// so that its zero speed is not mistaken for a measurement.
+func statusSuffix(status string) string {
+	if status == "" || status == StatusSucceeded {
+		return ""
+	}
+	return fmt.Sprintf(" (%s)", status)
+}
 
+// emitWeb100 emits the web100 variables, if any, as aligned key/value
+// lines sorted by key.
+func (h HumanReadable) emitWeb100(web100 map[string]string) error {
+	var (
+		keys  []string
+		width int
+	)
+	for key := range web100 {
+		keys = append(keys, key)
+		if len(key) > width {
+			width = len(key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, err := fmt.Fprintf(h.out, "%*s: %s\n", width, key, web100[key]); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// OnAggregate handles the aggregate event.
+func (h HumanReadable) OnAggregate(a *Aggregate) error {
+	const aggregateFormat = `%15s: %s
+%15s: %d
+%15s: %7s %7s %7s
+%15s: %7.1f %7.1f %7.1f %s
+%15s: %7.1f %7.1f %7.1f %s
+%15s: %7.1f %7.1f %7.1f %s
+%15s: %7.2f %7.2f %7.2f %s
+`
+	_, err := fmt.Fprintf(h.out, aggregateFormat,
+		"Server", a.ServerFQDN,
+		"Runs", a.Runs,
+		"", "min", "median", "max",
+		"Latency", a.MinRTT.Min, a.MinRTT.Median, a.MinRTT.Max, a.MinRTT.Unit,
+		"Download", a.Download.Min, a.Download.Median, a.Download.Max, a.Download.Unit,
+		"Upload", a.Upload.Min, a.Upload.Median, a.Upload.Max, a.Upload.Unit,
+		"Retransmission", a.DownloadRetrans.Min, a.DownloadRetrans.Median,
+		a.DownloadRetrans.Max, a.DownloadRetrans.Unit)
+	return err
+}
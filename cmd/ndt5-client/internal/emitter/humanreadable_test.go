@@ -1,7 +1,9 @@
 package emitter
 
 import (
+	"bytes"
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/m-lab/ndt5-client-go/cmd/ndt5-client/internal/mocks"
@@ -99,15 +101,17 @@ func TestHumanReadableOnSpeed(t *testing.T) {
 
 func TestHumanReadableOnSummary(t *testing.T) {
 	expected := `         Server: test
-         Client: test
+         Client: test (ipv6)
         Latency:    10.0 ms
+           TTFB:    25.0 ms
        Download:   100.0 Mbit/s
          Upload:   100.0 Mbit/s
  Retransmission:    1.00 %
 `
 	summary := &Summary{
-		ClientIP:   "test",
-		ServerFQDN: "test",
+		ClientIP:      "test",
+		AddressFamily: "ipv6",
+		ServerFQDN:    "test",
 		Download: ValueUnitPair{
 			Value: 100.0,
 			Unit:  "Mbit/s",
@@ -124,6 +128,10 @@ func TestHumanReadableOnSummary(t *testing.T) {
 			Value: 10.0,
 			Unit:  "ms",
 		},
+		DownloadTTFB: ValueUnitPair{
+			Value: 25.0,
+			Unit:  "ms",
+		},
 	}
 	sw := &mocks.SavingWriter{}
 	j := HumanReadable{sw}
@@ -142,6 +150,27 @@ func TestHumanReadableOnSummary(t *testing.T) {
 	}
 }
 
+func TestHumanReadableOnSummaryStatus(t *testing.T) {
+	summary := &Summary{
+		Download:       ValueUnitPair{Value: 100.0, Unit: "Mbit/s"},
+		DownloadStatus: StatusSucceeded,
+		Upload:         ValueUnitPair{Unit: "Mbit/s"},
+		UploadStatus:   StatusFailed,
+	}
+	buf := new(strings.Builder)
+	if err := (HumanReadable{buf}).OnSummary(summary); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"       Download:   100.0 Mbit/s\n",
+		"         Upload:     0.0 Mbit/s (failed)\n",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Fatalf("OnSummary(): missing %q in %q", line, buf.String())
+		}
+	}
+}
+
 func TestHumanReadableOnSummaryFailure(t *testing.T) {
 	sw := &mocks.FailingWriter{}
 	j := HumanReadable{sw}
@@ -164,3 +193,60 @@ func TestNewHumanReadableWithWriter(t *testing.T) {
 		t.Fatal("NewHumanReadableWithWriter() did not return a HumanReadable")
 	}
 }
+
+func TestHumanReadableOnAggregate(t *testing.T) {
+	expected := `         Server: test
+           Runs: 3
+               :     min  median     max
+        Latency:    10.0    11.0    12.0 ms
+       Download:    90.0   100.0   110.0 Mbit/s
+         Upload:    50.0    60.0    70.0 Mbit/s
+ Retransmission:    0.50    1.00    1.50 %
+`
+	aggregate := &Aggregate{
+		ServerFQDN:      "test",
+		Runs:            3,
+		Download:        Stats{Min: 90, Median: 100, Max: 110, Unit: "Mbit/s"},
+		Upload:          Stats{Min: 50, Median: 60, Max: 70, Unit: "Mbit/s"},
+		DownloadRetrans: Stats{Min: 0.5, Median: 1, Max: 1.5, Unit: "%"},
+		MinRTT:          Stats{Min: 10, Median: 11, Max: 12, Unit: "ms"},
+	}
+	sw := &mocks.SavingWriter{}
+	j := HumanReadable{sw}
+	err := j.OnAggregate(aggregate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sw.Data) != 1 {
+		t.Fatal("invalid length")
+	}
+	if string(sw.Data[0]) != expected {
+		fmt.Println(string(sw.Data[0]))
+		fmt.Println(expected)
+		t.Fatal("OnAggregate(): unexpected data")
+	}
+	j = HumanReadable{&mocks.FailingWriter{}}
+	if err := j.OnAggregate(aggregate); err != mocks.ErrMocked {
+		t.Fatal("Not the error we expected")
+	}
+}
+
+func TestHumanReadableOnSummaryWeb100(t *testing.T) {
+	summary := &Summary{
+		Web100: map[string]string{
+			"TCPInfo.MinRTT":         "1000",
+			"NDTResult.S2C.ClientIP": "127.0.0.1",
+		},
+	}
+	buf := new(bytes.Buffer)
+	j := HumanReadable{buf}
+	err := j.OnSummary(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "NDTResult.S2C.ClientIP: 127.0.0.1\n" +
+		"        TCPInfo.MinRTT: 1000\n"
+	if !strings.HasSuffix(buf.String(), "\n"+expected) {
+		t.Fatalf("OnSummary(): unexpected web100 data: %q", buf.String())
+	}
+}
@@ -51,6 +51,15 @@ func (j jsonEmitter) OnError(m string) error {
 	})
 }
 
+// OnErrorObject emits error events whose Value is the Error object, so
+// that consumers can branch on its Phase and Code.
+func (j jsonEmitter) OnErrorObject(e *Error) error {
+	return j.emitInterface(batchEvent{
+		Key:   "error",
+		Value: e,
+	})
+}
+
 // OnWarning emits warning events.
 func (j jsonEmitter) OnWarning(m string) error {
 	return j.emitInterface(batchEvent{
@@ -75,7 +84,27 @@ func (j jsonEmitter) OnSpeed(test string, speed string) error {
 	})
 }
 
+// percentEvent is the Value of a progress event.
+type percentEvent struct {
+	Test    string
+	Percent float64
+}
+
+// OnPercent emits progress events, whose Value contains the Test and the
+// Percent, e.g., to drive a progress bar.
+func (j jsonEmitter) OnPercent(test string, percent float64) error {
+	return j.emitInterface(batchEvent{
+		Key:   "progress",
+		Value: percentEvent{Test: test, Percent: percent},
+	})
+}
+
 // OnSummary handles the summary event, emitted after the test is over.
 func (j jsonEmitter) OnSummary(s *Summary) error {
 	return j.emitInterface(s)
 }
+
+// OnAggregate handles the aggregate event, emitted after several runs.
+func (j jsonEmitter) OnAggregate(a *Aggregate) error {
+	return j.emitInterface(a)
+}
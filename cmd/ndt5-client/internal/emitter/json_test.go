@@ -189,6 +189,35 @@ func TestEmitInterfaceFailure(t *testing.T) {
 	}
 }
 
+func TestJSONOnPercent(t *testing.T) {
+	sw := &mocks.SavingWriter{}
+	j := NewJSON(sw)
+	if err := EmitPercent(j, "download", 42.5); err != nil {
+		t.Fatal(err)
+	}
+	if len(sw.Data) != 1 {
+		t.Fatal("invalid length")
+	}
+	var event struct {
+		Key   string
+		Value struct {
+			Test    string
+			Percent float64
+		}
+	}
+	if err := json.Unmarshal(sw.Data[0], &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Key != "progress" || event.Value.Test != "download" || event.Value.Percent != 42.5 {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+
+	// Emitters that do not implement PercentEmitter ignore the event.
+	if err := EmitPercent(NewQuiet(j), "download", 50); err != nil || len(sw.Data) != 1 {
+		t.Fatal("expected the quiet emitter to ignore the event")
+	}
+}
+
 func TestJSONOnSummary(t *testing.T) {
 	summary := &Summary{}
 	sw := &mocks.SavingWriter{}
@@ -218,3 +247,48 @@ func TestJSONOnSummary(t *testing.T) {
 	}
 
 }
+
+func TestJSONOnAggregate(t *testing.T) {
+	aggregate := &Aggregate{
+		ServerFQDN: "test",
+		Runs:       2,
+		Download:   Stats{Min: 1, Median: 2, Max: 3, Unit: "Mbit/s"},
+	}
+	sw := &mocks.SavingWriter{}
+	j := NewJSON(sw)
+	err := j.OnAggregate(aggregate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sw.Data) != 1 {
+		t.Fatal("invalid length")
+	}
+	var output Aggregate
+	err = json.Unmarshal(sw.Data[0], &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != *aggregate {
+		t.Fatal("OnAggregate(): unexpected output")
+	}
+}
+
+func TestJSONOnSummaryLabels(t *testing.T) {
+	summary := &Summary{Labels: map[string]string{"ClientIP": "x"}}
+	sw := &mocks.SavingWriter{}
+	j := NewJSON(sw)
+	if err := j.OnSummary(summary); err != nil {
+		t.Fatal(err)
+	}
+	var output map[string]interface{}
+	if err := json.Unmarshal(sw.Data[0], &output); err != nil {
+		t.Fatal(err)
+	}
+	labels, ok := output["labels"].(map[string]interface{})
+	if !ok || labels["ClientIP"] != "x" {
+		t.Fatal("OnSummary(): expected labels under the labels key")
+	}
+	if output["ClientIP"] != "" {
+		t.Fatal("OnSummary(): labels must not override summary fields")
+	}
+}
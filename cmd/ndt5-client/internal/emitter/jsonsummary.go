@@ -0,0 +1,50 @@
+package emitter
+
+import "io"
+
+// jsonSummaryEmitter is a JSON emitter that only emits the summary, as a
+// single JSON object, and the aggregate. It emits messages consistent with
+// the cmd/ndt5-client/main.go documentation for `-format=json-summary`.
+type jsonSummaryEmitter struct {
+	jsonEmitter
+}
+
+// NewJSONSummary creates a new JSON summary emitter.
+func NewJSONSummary(w io.Writer) Emitter {
+	return jsonSummaryEmitter{jsonEmitter{w}}
+}
+
+// OnDebug does not emit anything.
+func (jsonSummaryEmitter) OnDebug(string) error {
+	return nil
+}
+
+// OnError does not emit anything.
+func (jsonSummaryEmitter) OnError(string) error {
+	return nil
+}
+
+// OnErrorObject does not emit anything.
+func (jsonSummaryEmitter) OnErrorObject(*Error) error {
+	return nil
+}
+
+// OnWarning does not emit anything.
+func (jsonSummaryEmitter) OnWarning(string) error {
+	return nil
+}
+
+// OnInfo does not emit anything.
+func (jsonSummaryEmitter) OnInfo(string) error {
+	return nil
+}
+
+// OnSpeed does not emit anything.
+func (jsonSummaryEmitter) OnSpeed(string, string) error {
+	return nil
+}
+
+// OnPercent does not emit anything.
+func (jsonSummaryEmitter) OnPercent(string, float64) error {
+	return nil
+}
@@ -0,0 +1,56 @@
+package emitter
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/m-lab/ndt5-client-go/cmd/ndt5-client/internal/mocks"
+)
+
+func TestJSONSummaryOnlyEmitsSummary(t *testing.T) {
+	buf := new(bytes.Buffer)
+	e := NewJSONSummary(buf)
+	for _, err := range []error{
+		e.OnDebug("test"),
+		e.OnError("test"),
+		EmitError(e, &Error{Code: "test", Message: "test"}),
+		e.OnWarning("test"),
+		e.OnInfo("test"),
+		e.OnSpeed("download", "test"),
+		EmitPercent(e, "download", 50),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected output: %q", buf.String())
+	}
+	summary := NewSummary("ndt5.example.com")
+	summary.ServerVersion = "v0.20.0"
+	summary.Timings = map[string]ValueUnitPair{
+		"DNSResolve": {Value: 12, Unit: "ms"},
+	}
+	if err := e.OnSummary(summary); err != nil {
+		t.Fatal(err)
+	}
+	var got Summary
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ServerFQDN != "ndt5.example.com" || got.ServerVersion != "v0.20.0" ||
+		got.Timings["DNSResolve"].Value != 12 {
+		t.Fatalf("unexpected summary: %+v", got)
+	}
+	if bytes.Count(buf.Bytes(), []byte("\n")) != 1 {
+		t.Fatal("expected exactly one line")
+	}
+}
+
+func TestJSONSummaryOnSummaryFailure(t *testing.T) {
+	e := NewJSONSummary(&mocks.FailingWriter{})
+	if err := e.OnSummary(NewSummary("ndt5.example.com")); err != mocks.ErrMocked {
+		t.Fatal("Not the error we expected")
+	}
+}
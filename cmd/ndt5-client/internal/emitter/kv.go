@@ -0,0 +1,63 @@
+package emitter
+
+import (
+	"fmt"
+	"io"
+)
+
+// KeyValue is a terse emitter. It doesn't emit anything during the test
+// and emits a single line of space-separated key=value pairs containing
+// the final results, which is easy to parse with shell tools.
+type KeyValue struct {
+	out io.Writer
+}
+
+// NewKeyValue returns a new key=value emitter using the specified writer.
+func NewKeyValue(w io.Writer) Emitter {
+	return KeyValue{w}
+}
+
+// OnDebug does not emit anything.
+func (kv KeyValue) OnDebug(string) error {
+	return nil
+}
+
+// OnError does not emit anything.
+func (kv KeyValue) OnError(string) error {
+	return nil
+}
+
+// OnWarning does not emit anything.
+func (kv KeyValue) OnWarning(string) error {
+	return nil
+}
+
+// OnInfo does not emit anything.
+func (kv KeyValue) OnInfo(string) error {
+	return nil
+}
+
+// OnSpeed does not emit anything.
+func (kv KeyValue) OnSpeed(string, string) error {
+	return nil
+}
+
+// OnSummary emits the summary as a single line of key=value pairs.
+func (kv KeyValue) OnSummary(s *Summary) error {
+	_, err := fmt.Fprintf(kv.out, "download=%.1f upload=%.1f rtt=%.1f retrans=%.1f\n",
+		s.Download.Value, s.Upload.Value, s.MinRTT.Value, s.DownloadRetrans.Value)
+	return err
+}
+
+// OnAggregate emits the aggregate as a single line of key=value pairs.
+func (kv KeyValue) OnAggregate(a *Aggregate) error {
+	_, err := fmt.Fprintf(kv.out, "runs=%d download_min=%.1f download_median=%.1f "+
+		"download_max=%.1f upload_min=%.1f upload_median=%.1f upload_max=%.1f "+
+		"rtt_min=%.1f rtt_median=%.1f rtt_max=%.1f retrans_min=%.1f "+
+		"retrans_median=%.1f retrans_max=%.1f\n", a.Runs,
+		a.Download.Min, a.Download.Median, a.Download.Max,
+		a.Upload.Min, a.Upload.Median, a.Upload.Max,
+		a.MinRTT.Min, a.MinRTT.Median, a.MinRTT.Max,
+		a.DownloadRetrans.Min, a.DownloadRetrans.Median, a.DownloadRetrans.Max)
+	return err
+}
@@ -0,0 +1,72 @@
+package emitter
+
+import (
+	"testing"
+
+	"github.com/m-lab/ndt5-client-go/cmd/ndt5-client/internal/mocks"
+)
+
+func TestNewKeyValue(t *testing.T) {
+	if NewKeyValue(&mocks.SavingWriter{}) == nil {
+		t.Fatal("NewKeyValue() did not return an Emitter")
+	}
+}
+
+func TestKeyValueEventsAreSilent(t *testing.T) {
+	sw := &mocks.SavingWriter{}
+	kv := KeyValue{sw}
+	for _, err := range []error{
+		kv.OnDebug("test"),
+		kv.OnError("test"),
+		kv.OnWarning("test"),
+		kv.OnInfo("test"),
+		kv.OnSpeed("test", "speed"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sw.Data) != 0 {
+		t.Fatal("unexpected data")
+	}
+}
+
+func TestKeyValueOnSummary(t *testing.T) {
+	summary := &Summary{
+		Download:        ValueUnitPair{Value: 943.21, Unit: "Mbit/s"},
+		Upload:          ValueUnitPair{Value: 112.5, Unit: "Mbit/s"},
+		MinRTT:          ValueUnitPair{Value: 12.34, Unit: "ms"},
+		DownloadRetrans: ValueUnitPair{Value: 0.4, Unit: "%"},
+	}
+	sw := &mocks.SavingWriter{}
+	kv := KeyValue{sw}
+	if err := kv.OnSummary(summary); err != nil {
+		t.Fatal(err)
+	}
+	if string(sw.Data[0]) != "download=943.2 upload=112.5 rtt=12.3 retrans=0.4\n" {
+		t.Fatalf("OnSummary(): unexpected output: %s", sw.Data[0])
+	}
+	kv = KeyValue{&mocks.FailingWriter{}}
+	if err := kv.OnSummary(summary); err != mocks.ErrMocked {
+		t.Fatal("Not the error we expected")
+	}
+}
+
+func TestKeyValueOnAggregate(t *testing.T) {
+	aggregate := &Aggregate{
+		Runs:     2,
+		Download: Stats{Min: 1, Median: 2, Max: 3},
+	}
+	sw := &mocks.SavingWriter{}
+	kv := KeyValue{sw}
+	if err := kv.OnAggregate(aggregate); err != nil {
+		t.Fatal(err)
+	}
+	expected := "runs=2 download_min=1.0 download_median=2.0 download_max=3.0 " +
+		"upload_min=0.0 upload_median=0.0 upload_max=0.0 rtt_min=0.0 " +
+		"rtt_median=0.0 rtt_max=0.0 retrans_min=0.0 retrans_median=0.0 " +
+		"retrans_max=0.0\n"
+	if string(sw.Data[0]) != expected {
+		t.Fatalf("OnAggregate(): unexpected output: %s", sw.Data[0])
+	}
+}
@@ -0,0 +1,115 @@
+package emitter
+
+import (
+	"io"
+	"time"
+)
+
+// SampleEmitter is implemented by emitters that want to receive the raw
+// number of bytes and elapsed time of each speed sample, rather than the
+// formatted speed passed to OnSpeed.
+type SampleEmitter interface {
+	// OnSample is emitted for each speed sample during a test.
+	OnSample(test string, numBytes int64, elapsed time.Duration) error
+}
+
+// ndt7Compat emits events using the same batch event schema used by the
+// JSON emitter of ndt7-client-go, so that the same parsers can be used for
+// both tools. Only the events having an ndt7 equivalent are emitted:
+//
+// - errors and warnings become "error" events whose Value contains
+// a Failure string (ndt7 has no warning events);
+//
+// - speed samples become client-side "measurement" events whose Value
+// contains AppInfo, Origin, and Test (ConnectionInfo and TCPInfo are
+// omitted because the ndt5 client does not know them);
+//
+// - the summary is emitted as is, because its fields are a superset
+// of the ndt7 summary fields.
+//
+// Debug and info messages, the progress, and the aggregate have no ndt7
+// equivalent and are omitted. The ndt7 "starting", "connected", and
+// "complete" events have no ndt5 equivalent and are never emitted.
+type ndt7Compat struct {
+	jsonEmitter
+}
+
+// NewNDT7Compat creates a new emitter using the ndt7-client-go JSON schema.
+func NewNDT7Compat(w io.Writer) Emitter {
+	return ndt7Compat{jsonEmitter{w}}
+}
+
+type ndt7BatchValue struct {
+	Failure string `json:",omitempty"`
+	Test    string
+}
+
+type ndt7AppInfo struct {
+	ElapsedTime int64 // microseconds
+	NumBytes    int64
+}
+
+type ndt7Measurement struct {
+	AppInfo *ndt7AppInfo
+	Origin  string
+	Test    string
+}
+
+// OnDebug does not emit anything.
+func (n ndt7Compat) OnDebug(string) error {
+	return nil
+}
+
+// OnError emits an error event.
+func (n ndt7Compat) OnError(m string) error {
+	return n.emitInterface(batchEvent{
+		Key:   "error",
+		Value: ndt7BatchValue{Failure: m},
+	})
+}
+
+// OnErrorObject emits an error event containing the message, because
+// the ndt7 schema has no phase or code.
+func (n ndt7Compat) OnErrorObject(e *Error) error {
+	return n.OnError(e.Message)
+}
+
+// OnWarning emits an error event.
+func (n ndt7Compat) OnWarning(m string) error {
+	return n.OnError(m)
+}
+
+// OnInfo does not emit anything.
+func (n ndt7Compat) OnInfo(string) error {
+	return nil
+}
+
+// OnSpeed does not emit anything, since we emit measurements in OnSample.
+func (n ndt7Compat) OnSpeed(string, string) error {
+	return nil
+}
+
+// OnPercent does not emit anything.
+func (n ndt7Compat) OnPercent(string, float64) error {
+	return nil
+}
+
+// OnSample emits a client-side measurement event.
+func (n ndt7Compat) OnSample(test string, numBytes int64, elapsed time.Duration) error {
+	return n.emitInterface(batchEvent{
+		Key: "measurement",
+		Value: ndt7Measurement{
+			AppInfo: &ndt7AppInfo{
+				ElapsedTime: elapsed.Microseconds(),
+				NumBytes:    numBytes,
+			},
+			Origin: "client",
+			Test:   test,
+		},
+	})
+}
+
+// OnAggregate does not emit anything.
+func (n ndt7Compat) OnAggregate(*Aggregate) error {
+	return nil
+}
@@ -0,0 +1,69 @@
+package emitter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt5-client-go/cmd/ndt5-client/internal/mocks"
+)
+
+func TestNewNDT7Compat(t *testing.T) {
+	e := NewNDT7Compat(&mocks.SavingWriter{})
+	if e == nil {
+		t.Fatal("NewNDT7Compat() did not return an Emitter")
+	}
+	if _, ok := e.(SampleEmitter); !ok {
+		t.Fatal("NewNDT7Compat() did not return a SampleEmitter")
+	}
+}
+
+func TestNDT7CompatSilentEvents(t *testing.T) {
+	sw := &mocks.SavingWriter{}
+	n := NewNDT7Compat(sw)
+	for _, err := range []error{
+		n.OnDebug("test"),
+		n.OnInfo("test"),
+		n.OnSpeed("test", "speed"),
+		EmitPercent(n, "download", 50),
+		n.OnAggregate(&Aggregate{}),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sw.Data) != 0 {
+		t.Fatal("unexpected data")
+	}
+}
+
+func TestNDT7CompatOnError(t *testing.T) {
+	sw := &mocks.SavingWriter{}
+	n := NewNDT7Compat(sw)
+	if err := n.OnError("test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.OnWarning("test"); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"Key":"error","Value":{"Failure":"test","Test":""}}` + "\n"
+	if len(sw.Data) != 2 || string(sw.Data[0]) != expected || string(sw.Data[1]) != expected {
+		t.Fatal("OnError(): unexpected output")
+	}
+}
+
+func TestNDT7CompatOnSample(t *testing.T) {
+	sw := &mocks.SavingWriter{}
+	n := NewNDT7Compat(sw).(SampleEmitter)
+	if err := n.OnSample("download", 1024, 250*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"Key":"measurement","Value":{"AppInfo":{"ElapsedTime":250000,` +
+		`"NumBytes":1024},"Origin":"client","Test":"download"}}` + "\n"
+	if string(sw.Data[0]) != expected {
+		t.Fatalf("OnSample(): unexpected output: %s", sw.Data[0])
+	}
+	n = NewNDT7Compat(&mocks.FailingWriter{}).(SampleEmitter)
+	if err := n.OnSample("download", 1024, time.Second); err != mocks.ErrMocked {
+		t.Fatal("Not the error we expected")
+	}
+}
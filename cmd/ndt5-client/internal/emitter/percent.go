@@ -0,0 +1,18 @@
+package emitter
+
+// PercentEmitter is implemented by emitters that want to receive the
+// progress of each subtest, e.g., to drive a progress bar.
+type PercentEmitter interface {
+	// OnPercent is emitted along with each speed sample, with the
+	// progress of the test (e.g. "download") in percent.
+	OnPercent(test string, percent float64) error
+}
+
+// EmitPercent passes the progress to em, if it's a PercentEmitter, and
+// does nothing otherwise.
+func EmitPercent(em Emitter, test string, percent float64) error {
+	if pe, ok := em.(PercentEmitter); ok {
+		return pe.OnPercent(test, percent)
+	}
+	return nil
+}
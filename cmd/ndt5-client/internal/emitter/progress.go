@@ -0,0 +1,100 @@
+package emitter
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Progress writes the current phase and speed to a separate writer (e.g.
+// stderr) as a single status line, which is overwritten using a carriage
+// return, like curl's progress bar. All the events are also passed to the
+// embedded Emitter, so that, when the embedded Emitter is a Quiet emitter,
+// the output of the embedded Emitter (e.g. stdout) stays machine-readable
+// while a human still gets some feedback.
+type Progress struct {
+	emitter Emitter
+	out     io.Writer
+	width   int // width of the status line currently shown, if any
+}
+
+// NewProgress returns a Progress emitter writing the status line to out
+// and passing all the events to the passed Emitter.
+func NewProgress(out io.Writer, e Emitter) Emitter {
+	return &Progress{emitter: e, out: out}
+}
+
+// clear erases the status line, if any, so that it does not get mixed
+// with the output of the embedded emitter when both go to a terminal.
+func (p *Progress) clear() error {
+	if p.width == 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(p.out, "\r%s\r", strings.Repeat(" ", p.width))
+	p.width = 0
+	return err
+}
+
+// OnDebug passes the debug event to the embedded emitter.
+func (p *Progress) OnDebug(m string) error {
+	return p.emitter.OnDebug(m)
+}
+
+// OnError clears the status line and passes the error event to the
+// embedded emitter.
+func (p *Progress) OnError(m string) error {
+	if err := p.clear(); err != nil {
+		return err
+	}
+	return p.emitter.OnError(m)
+}
+
+// OnErrorObject clears the status line and passes the error event to
+// the embedded emitter.
+func (p *Progress) OnErrorObject(e *Error) error {
+	if err := p.clear(); err != nil {
+		return err
+	}
+	return EmitError(p.emitter, e)
+}
+
+// OnWarning passes the warning event to the embedded emitter.
+func (p *Progress) OnWarning(m string) error {
+	return p.emitter.OnWarning(m)
+}
+
+// OnInfo passes the info event to the embedded emitter.
+func (p *Progress) OnInfo(m string) error {
+	return p.emitter.OnInfo(m)
+}
+
+// OnSpeed updates the status line and passes the speed event to the
+// embedded emitter.
+func (p *Progress) OnSpeed(test string, speed string) error {
+	line := fmt.Sprintf("%s: %s", test, speed)
+	// Pad the line to overwrite any leftover of a longer previous line.
+	_, err := fmt.Fprintf(p.out, "\r%-*s", p.width, line)
+	p.width = max(p.width, len(line))
+	if err != nil {
+		return err
+	}
+	return p.emitter.OnSpeed(test, speed)
+}
+
+// OnSummary clears the status line and passes the summary event to the
+// embedded emitter.
+func (p *Progress) OnSummary(s *Summary) error {
+	if err := p.clear(); err != nil {
+		return err
+	}
+	return p.emitter.OnSummary(s)
+}
+
+// OnAggregate clears the status line and passes the aggregate event to
+// the embedded emitter.
+func (p *Progress) OnAggregate(a *Aggregate) error {
+	if err := p.clear(); err != nil {
+		return err
+	}
+	return p.emitter.OnAggregate(a)
+}
@@ -0,0 +1,72 @@
+package emitter
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/ndt5-client-go/cmd/ndt5-client/internal/mocks"
+)
+
+func TestProgressOnSpeed(t *testing.T) {
+	stderr := new(bytes.Buffer)
+	stdout := &mocks.SavingWriter{}
+	p := NewProgress(stderr, NewQuiet(jsonEmitter{stdout}))
+	for _, err := range []error{
+		p.OnDebug("test"),
+		p.OnWarning("test"),
+		p.OnInfo("test"),
+		p.OnSpeed("download", "100.0 Mbit/s"),
+		p.OnSpeed("upload", "5 Mbit/s"),
+		p.OnSummary(&Summary{}),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	const first = "download: 100.0 Mbit/s"
+	expected := "\r" + first +
+		"\r" + "upload: 5 Mbit/s" + strings.Repeat(" ", len(first)-len("upload: 5 Mbit/s")) +
+		"\r" + strings.Repeat(" ", len(first)) + "\r"
+	if stderr.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, stderr.String())
+	}
+	if len(stdout.Data) != 1 {
+		t.Fatal("expected only the summary on stdout")
+	}
+}
+
+func TestProgressClearsOnlyWhenNeeded(t *testing.T) {
+	stderr := &mocks.SavingWriter{}
+	p := NewProgress(stderr, NewQuiet(jsonEmitter{&mocks.SavingWriter{}}))
+	if err := p.OnError("test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.OnAggregate(&Aggregate{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(stderr.Data) != 0 {
+		t.Fatal("unexpected data")
+	}
+}
+
+func TestProgressFailingWriter(t *testing.T) {
+	p := NewProgress(&mocks.FailingWriter{}, NewQuiet(jsonEmitter{&mocks.SavingWriter{}}))
+	if err := p.OnSpeed("download", "1 Mbit/s"); err != mocks.ErrMocked {
+		t.Fatal("OnSpeed(): unexpected error type or nil")
+	}
+	progress := &Progress{
+		emitter: NewQuiet(jsonEmitter{&mocks.SavingWriter{}}),
+		out:     &mocks.FailingWriter{},
+	}
+	for _, emit := range []func() error{
+		func() error { return progress.OnError("test") },
+		func() error { return progress.OnSummary(&Summary{}) },
+		func() error { return progress.OnAggregate(&Aggregate{}) },
+	} {
+		progress.width = 1 // pretend that there is a status line
+		if err := emit(); err != mocks.ErrMocked {
+			t.Fatal("unexpected error type or nil")
+		}
+	}
+}
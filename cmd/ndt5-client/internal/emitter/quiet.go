@@ -25,6 +25,11 @@ func (q Quiet) OnError(m string) error {
 	return q.emitter.OnError(m)
 }
 
+// OnErrorObject emits the error event.
+func (q Quiet) OnErrorObject(e *Error) error {
+	return EmitError(q.emitter, e)
+}
+
 // OnWarning does not emit anything.
 func (q Quiet) OnWarning(string) error {
 	return nil
@@ -44,3 +49,8 @@ func (q Quiet) OnSpeed(string, string) error {
 func (q Quiet) OnSummary(s *Summary) error {
 	return q.emitter.OnSummary(s)
 }
+
+// OnAggregate handles the aggregate event, emitted after several runs.
+func (q Quiet) OnAggregate(a *Aggregate) error {
+	return q.emitter.OnAggregate(a)
+}
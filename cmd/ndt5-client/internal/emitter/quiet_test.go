@@ -88,3 +88,15 @@ func TestQuiet_OnSummary(t *testing.T) {
 		t.Fatal("OnSummary(): unexpected error type or nil")
 	}
 }
+
+func TestQuiet_OnAggregate(t *testing.T) {
+	// The only thing to test here is that errors from the underlying emitter
+	// are passed back to the caller.
+	sw := &mocks.FailingWriter{}
+	e := jsonEmitter{sw}
+	quiet := Quiet{e}
+	err := quiet.OnAggregate(&Aggregate{})
+	if err != mocks.ErrMocked {
+		t.Fatal("OnAggregate(): unexpected error type or nil")
+	}
+}
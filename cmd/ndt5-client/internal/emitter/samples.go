@@ -0,0 +1,69 @@
+package emitter
+
+import (
+	"sort"
+	"time"
+)
+
+// Samples collects the cumulative speed samples of a test, so that we can
+// compute the speed rejecting outliers (e.g. the spike that we may see
+// after the initial burst on localhost and LAN tests). This only affects
+// the summary, not the samples emitted while the test is running.
+type Samples struct {
+	intervals []sampleInterval
+	lastCount int64
+	lastTime  time.Duration
+}
+
+// sampleInterval is the interval between two consecutive samples.
+type sampleInterval struct {
+	count   int64
+	elapsed time.Duration
+}
+
+// Add adds a sample containing the number of bytes transferred and
+// the time elapsed since the beginning of the test.
+func (s *Samples) Add(count int64, elapsed time.Duration) {
+	if elapsed <= s.lastTime {
+		return
+	}
+	s.intervals = append(s.intervals, sampleInterval{
+		count:   count - s.lastCount,
+		elapsed: elapsed - s.lastTime,
+	})
+	s.lastCount, s.lastTime = count, elapsed
+}
+
+// Mbps returns the speed in Mbit/s computed over the intervals between
+// samples, excluding the intervals whose speed is greater than factor
+// times the median speed. It returns false if there are no samples.
+func (s *Samples) Mbps(factor float64) (float64, bool) {
+	if len(s.intervals) < 1 {
+		return 0, false
+	}
+	var speeds []float64
+	for _, i := range s.intervals {
+		speeds = append(speeds, i.mbps())
+	}
+	sort.Float64s(speeds)
+	limit := factor * median(speeds)
+	var (
+		count   int64
+		elapsed time.Duration
+	)
+	for _, i := range s.intervals {
+		if i.mbps() <= limit {
+			count += i.count
+			elapsed += i.elapsed
+		}
+	}
+	if elapsed <= 0 {
+		return 0, false
+	}
+	return sampleInterval{count: count, elapsed: elapsed}.mbps(), true
+}
+
+// mbps returns the speed of the interval in Mbit/s.
+func (i sampleInterval) mbps() float64 {
+	return 8 * float64(i.count) / i.elapsed.Seconds() / 1000 / 1000
+}
@@ -0,0 +1,42 @@
+package emitter
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSamplesMbpsRejectsOutliers(t *testing.T) {
+	s := new(Samples)
+	// 10 Mbit/s for each 250 ms interval except the second one, which
+	// transfers 100x as many bytes.
+	const bytesPerInterval = 10 * 1000 * 1000 / 8 / 4
+	var count int64
+	for i := 1; i <= 8; i++ {
+		count += bytesPerInterval
+		if i == 2 {
+			count += 99 * bytesPerInterval
+		}
+		s.Add(count, time.Duration(i)*250*time.Millisecond)
+	}
+	mbps, ok := s.Mbps(3)
+	if !ok {
+		t.Fatal("expected some samples")
+	}
+	if math.Abs(mbps-10) > 1e-09 {
+		t.Fatalf("expected 10 Mbit/s, got %f", mbps)
+	}
+	// With a large enough factor we keep all the intervals.
+	mbps, _ = s.Mbps(1000)
+	if math.Abs(mbps-((8+99)*10/8.0)) > 1e-09 {
+		t.Fatalf("unexpected speed: %f", mbps)
+	}
+}
+
+func TestSamplesMbpsEmpty(t *testing.T) {
+	s := new(Samples)
+	s.Add(0, 0) // ignored because no time elapsed
+	if _, ok := s.Mbps(3); ok {
+		t.Fatal("expected no samples")
+	}
+}
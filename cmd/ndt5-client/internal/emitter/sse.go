@@ -0,0 +1,95 @@
+package emitter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// SSEEmitter is an emitter that formats each event as a Server-Sent Events
+// frame, e.g., "event: speed\ndata: {...}\n\n", so that an embedding web
+// server can stream the progress of a test to a browser using EventSource.
+// The event name is the same as the Key of the `-format=json` events, or
+// "summary" and "aggregate", and the data is always a JSON document.
+type SSEEmitter struct {
+	out     io.Writer
+	flusher http.Flusher
+}
+
+// NewSSE returns a new SSE emitter writing to w, which is usually an
+// http.ResponseWriter. In such case, we set the Content-Type and the
+// Cache-Control headers, so you must call NewSSE before writing the
+// response, and we flush the response after each event.
+func NewSSE(w io.Writer) Emitter {
+	if rw, ok := w.(http.ResponseWriter); ok {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.Header().Set("Cache-Control", "no-cache")
+	}
+	flusher, _ := w.(http.Flusher)
+	return SSEEmitter{out: w, flusher: flusher}
+}
+
+// emit writes a frame for the event with the given name and data, which
+// we serialize as JSON. JSON never contains newlines, so a single data
+// line is enough.
+func (s SSEEmitter) emit(event string, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.out, "event: %s\ndata: %s\n\n", event, body); err != nil {
+		return err
+	}
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+	return nil
+}
+
+// sseSpeed is the data of the speed event.
+type sseSpeed struct {
+	Test  string
+	Speed string
+}
+
+// OnDebug emits debug events.
+func (s SSEEmitter) OnDebug(m string) error {
+	return s.emit("debug", m)
+}
+
+// OnError emits error events.
+func (s SSEEmitter) OnError(m string) error {
+	return s.emit("error", m)
+}
+
+// OnWarning emits warning events.
+func (s SSEEmitter) OnWarning(m string) error {
+	return s.emit("warning", m)
+}
+
+// OnInfo emits info events.
+func (s SSEEmitter) OnInfo(m string) error {
+	return s.emit("info", m)
+}
+
+// OnSpeed emits speed events.
+func (s SSEEmitter) OnSpeed(test string, speed string) error {
+	return s.emit("speed", sseSpeed{Test: test, Speed: speed})
+}
+
+// OnPercent emits progress events, whose data contains the Test and the
+// Percent, e.g., to drive a progress bar.
+func (s SSEEmitter) OnPercent(test string, percent float64) error {
+	return s.emit("progress", percentEvent{Test: test, Percent: percent})
+}
+
+// OnSummary emits the summary event, after the test is over.
+func (s SSEEmitter) OnSummary(summary *Summary) error {
+	return s.emit("summary", summary)
+}
+
+// OnAggregate emits the aggregate event, after several runs.
+func (s SSEEmitter) OnAggregate(a *Aggregate) error {
+	return s.emit("aggregate", a)
+}
@@ -0,0 +1,74 @@
+package emitter
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/m-lab/ndt5-client-go/cmd/ndt5-client/internal/mocks"
+)
+
+func TestSSEEvents(t *testing.T) {
+	sw := &mocks.SavingWriter{}
+	e := NewSSE(sw)
+	for _, tc := range []struct {
+		emit   func() error
+		expect string
+	}{
+		{func() error { return e.OnDebug("a") }, "event: debug\ndata: \"a\"\n\n"},
+		{func() error { return e.OnError("b") }, "event: error\ndata: \"b\"\n\n"},
+		{func() error { return e.OnWarning("c") }, "event: warning\ndata: \"c\"\n\n"},
+		{func() error { return e.OnInfo("d") }, "event: info\ndata: \"d\"\n\n"},
+		{
+			func() error { return e.OnSpeed("download", "10 Mbit/s") },
+			"event: speed\ndata: {\"Test\":\"download\",\"Speed\":\"10 Mbit/s\"}\n\n",
+		},
+		{
+			func() error { return EmitPercent(e, "upload", 42.5) },
+			"event: progress\ndata: {\"Test\":\"upload\",\"Percent\":42.5}\n\n",
+		},
+		{
+			func() error { return e.OnSummary(&Summary{ServerFQDN: "test"}) },
+			"event: summary\ndata: {\"ServerFQDN\":\"test\",",
+		},
+		{
+			func() error { return e.OnAggregate(&Aggregate{Runs: 2}) },
+			"event: aggregate\ndata: {",
+		},
+	} {
+		sw.Data = nil
+		if err := tc.emit(); err != nil {
+			t.Fatal(err)
+		}
+		if len(sw.Data) != 1 {
+			t.Fatal("invalid length")
+		}
+		got := string(sw.Data[0])
+		if len(got) < len(tc.expect) || got[:len(tc.expect)] != tc.expect {
+			t.Fatalf("expected %q, got %q", tc.expect, got)
+		}
+	}
+}
+
+func TestSSEResponseWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	e := NewSSE(rec)
+	if err := e.OnInfo("test"); err != nil {
+		t.Fatal(err)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected Content-Type: %q", ct)
+	}
+	if !rec.Flushed {
+		t.Fatal("expected the response to be flushed")
+	}
+	if body := rec.Body.String(); body != "event: info\ndata: \"test\"\n\n" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+}
+
+func TestSSEFailure(t *testing.T) {
+	e := NewSSE(&mocks.FailingWriter{})
+	if err := e.OnInfo("test"); err != mocks.ErrMocked {
+		t.Fatal("Not the error we expected")
+	}
+}
@@ -18,6 +18,10 @@ type Summary struct {
 	// ClientIP is the IP address of the client.
 	ClientIP string
 
+	// AddressFamily is the address family ("ipv4" or "ipv6") used to
+	// reach the server, if known.
+	AddressFamily string `json:",omitempty"`
+
 	// DownloadUUID is the UUID of the download test.
 	DownloadUUID string
 
@@ -28,6 +32,13 @@ type Summary struct {
 	// Upload is the upload speed, in Mbit/s. This is measured at the sender.
 	Upload ValueUnitPair
 
+	// DownloadStatus and UploadStatus tell whether the download and the
+	// upload succeeded, failed, or were skipped (see StatusSucceeded and
+	// the other Status constants), so that a zero speed caused by a failed
+	// or skipped subtest is not mistaken for a measurement.
+	DownloadStatus string `json:",omitempty"`
+	UploadStatus   string `json:",omitempty"`
+
 	// DownloadRetrans is the retransmission rate. This is based on the TCPInfo
 	// values provided by the server during a download test.
 	DownloadRetrans ValueUnitPair
@@ -35,8 +46,36 @@ type Summary struct {
 	// MinRTT is the minimum round-trip time reported by the server in the
 	// last Measurement of a download test, in milliseconds.
 	MinRTT ValueUnitPair
+
+	// DownloadTTFB is the time between the start of the download test and
+	// the first byte received, in milliseconds.
+	DownloadTTFB ValueUnitPair
+
+	// Web100 optionally contains all the web100 and TCPInfo variables
+	// sent by the server during the download test.
+	Web100 map[string]string `json:",omitempty"`
+
+	// ServerVersion is the version of the server. We only set it with
+	// `-format=json-summary`.
+	ServerVersion string `json:",omitempty"`
+
+	// Timings maps the phases of the test (e.g. "DNSResolve") to their
+	// duration, in milliseconds. We only set it with `-format=json-summary`
+	// and we omit the phases we did not measure.
+	Timings map[string]ValueUnitPair `json:",omitempty"`
+
+	// Labels contains the client-provided labels for this test. They are
+	// nested under their own key so they cannot collide with other fields.
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
+// These are the values of Summary.DownloadStatus and Summary.UploadStatus.
+const (
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusSkipped   = "skipped"
+)
+
 // NewSummary returns a new Summary struct for a given FQDN.
 func NewSummary(FQDN string) *Summary {
 	return &Summary{
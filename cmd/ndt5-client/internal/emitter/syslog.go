@@ -0,0 +1,107 @@
+package emitter
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrSyslogNotSupported indicates that we cannot log to syslog on this
+// platform.
+var ErrSyslogNotSupported = errors.New("syslog is not supported on this platform")
+
+// syslogWriter is the subset of *syslog.Writer we use.
+type syslogWriter interface {
+	Info(m string) error
+	Err(m string) error
+}
+
+// Syslog passes all the events to the embedded Emitter and also writes
+// the summary and the aggregate, as JSON, at the INFO level, and the
+// errors at the ERR level, to syslog, so that headless probes can collect
+// the results using their syslog infrastructure. Failing to write to syslog
+// does not prevent passing the events to the embedded Emitter.
+type Syslog struct {
+	emitter Emitter
+	writer  syslogWriter
+}
+
+// newSyslog returns a Syslog passing the events to e. When e is a
+// SampleEmitter, so is the returned Emitter, otherwise e would only get
+// the speed events (e.g. ndt7compat ignores them).
+func newSyslog(e Emitter, w syslogWriter) Emitter {
+	s := &Syslog{emitter: e, writer: w}
+	if se, ok := e.(SampleEmitter); ok {
+		return &sampleSyslog{Syslog: s, sampleEmitter: se}
+	}
+	return s
+}
+
+// sampleSyslog is a Syslog whose embedded Emitter is a SampleEmitter.
+type sampleSyslog struct {
+	*Syslog
+	sampleEmitter SampleEmitter
+}
+
+// OnSample passes the sample event to the embedded emitter.
+func (s *sampleSyslog) OnSample(test string, numBytes int64, elapsed time.Duration) error {
+	return s.sampleEmitter.OnSample(test, numBytes, elapsed)
+}
+
+// OnDebug passes the debug event to the embedded emitter.
+func (s *Syslog) OnDebug(m string) error {
+	return s.emitter.OnDebug(m)
+}
+
+// OnError writes the error to syslog and passes the error event to the
+// embedded emitter.
+func (s *Syslog) OnError(m string) error {
+	return errors.Join(s.emitter.OnError(m), s.writer.Err(m))
+}
+
+// OnErrorObject writes the error message to syslog and passes the error
+// event to the embedded emitter.
+func (s *Syslog) OnErrorObject(e *Error) error {
+	return errors.Join(EmitError(s.emitter, e), s.writer.Err(e.Message))
+}
+
+// OnWarning passes the warning event to the embedded emitter.
+func (s *Syslog) OnWarning(m string) error {
+	return s.emitter.OnWarning(m)
+}
+
+// OnInfo passes the info event to the embedded emitter.
+func (s *Syslog) OnInfo(m string) error {
+	return s.emitter.OnInfo(m)
+}
+
+// OnSpeed passes the speed event to the embedded emitter.
+func (s *Syslog) OnSpeed(test string, speed string) error {
+	return s.emitter.OnSpeed(test, speed)
+}
+
+// OnPercent passes the progress event to the embedded emitter.
+func (s *Syslog) OnPercent(test string, percent float64) error {
+	return EmitPercent(s.emitter, test, percent)
+}
+
+// OnSummary writes the summary to syslog and passes the summary event to
+// the embedded emitter.
+func (s *Syslog) OnSummary(summary *Summary) error {
+	return errors.Join(s.emitter.OnSummary(summary), s.info(summary))
+}
+
+// OnAggregate writes the aggregate to syslog and passes the aggregate
+// event to the embedded emitter.
+func (s *Syslog) OnAggregate(a *Aggregate) error {
+	return errors.Join(s.emitter.OnAggregate(a), s.info(a))
+}
+
+// info writes v as JSON at the INFO level.
+func (s *Syslog) info(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.writer.Info(string(data))
+}
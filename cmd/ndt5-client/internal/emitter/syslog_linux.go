@@ -0,0 +1,36 @@
+package emitter
+
+import (
+	"fmt"
+	"log/syslog"
+)
+
+// syslogFacilities maps the names of the facilities to their values.
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":   syslog.LOG_KERN,
+	"user":   syslog.LOG_USER,
+	"daemon": syslog.LOG_DAEMON,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// NewSyslog returns a Syslog emitter connected to the local syslog daemon,
+// using the given facility (e.g. "daemon" or "local0") and tag, and passing
+// all the events to the passed Emitter.
+func NewSyslog(e Emitter, facility, tag string) (Emitter, error) {
+	priority, found := syslogFacilities[facility]
+	if !found {
+		return nil, fmt.Errorf("unknown syslog facility: %q", facility)
+	}
+	w, err := syslog.New(priority|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return newSyslog(e, w), nil
+}
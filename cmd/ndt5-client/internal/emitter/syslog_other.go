@@ -0,0 +1,9 @@
+//go:build !linux
+
+package emitter
+
+// NewSyslog fails with ErrSyslogNotSupported, because we only support
+// syslog on Linux.
+func NewSyslog(e Emitter, facility, tag string) (Emitter, error) {
+	return nil, ErrSyslogNotSupported
+}
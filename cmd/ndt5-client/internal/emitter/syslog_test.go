@@ -0,0 +1,85 @@
+package emitter
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt5-client-go/cmd/ndt5-client/internal/mocks"
+)
+
+// savingSyslogWriter saves the messages written at each level.
+type savingSyslogWriter struct {
+	infos, errs []string
+	err         error
+}
+
+func (w *savingSyslogWriter) Info(m string) error {
+	w.infos = append(w.infos, m)
+	return w.err
+}
+
+func (w *savingSyslogWriter) Err(m string) error {
+	w.errs = append(w.errs, m)
+	return w.err
+}
+
+func TestSyslog(t *testing.T) {
+	sw := &mocks.SavingWriter{}
+	w := new(savingSyslogWriter)
+	s := newSyslog(NewQuiet(NewJSON(sw)), w)
+	if err := s.OnInfo("info"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.OnError("failure"); err != nil {
+		t.Fatal(err)
+	}
+	if err := EmitError(s, &Error{Code: "unknown", Message: "object"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.OnSummary(&Summary{ServerFQDN: "ndt5.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.errs) != 2 || w.errs[0] != "failure" || w.errs[1] != "object" {
+		t.Fatalf("unexpected errors: %v", w.errs)
+	}
+	if len(w.infos) != 1 || !strings.Contains(w.infos[0], `"ServerFQDN":"ndt5.example.com"`) {
+		t.Fatalf("unexpected infos: %v", w.infos)
+	}
+	// The quiet embedded emitter only emits the errors and the summary.
+	if len(sw.Data) != 3 {
+		t.Fatalf("unexpected data: %q", sw.Data)
+	}
+}
+
+func TestSyslogSample(t *testing.T) {
+	sw := &mocks.SavingWriter{}
+	s := newSyslog(NewNDT7Compat(sw), new(savingSyslogWriter))
+	se, ok := s.(SampleEmitter)
+	if !ok {
+		t.Fatal("expected a SampleEmitter")
+	}
+	if err := se.OnSample("download", 1000, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(sw.Data) != 1 || !strings.Contains(string(sw.Data[0]), `"Key":"measurement"`) {
+		t.Fatalf("unexpected data: %q", sw.Data)
+	}
+	// Otherwise, we do not implement SampleEmitter, so that main passes
+	// the formatted speed to OnSpeed.
+	if _, ok := newSyslog(NewJSON(sw), new(savingSyslogWriter)).(SampleEmitter); ok {
+		t.Fatal("did not expect a SampleEmitter")
+	}
+}
+
+func TestSyslogFailure(t *testing.T) {
+	sw := &mocks.SavingWriter{}
+	s := newSyslog(NewJSON(sw), &savingSyslogWriter{err: mocks.ErrMocked})
+	if err := s.OnSummary(&Summary{}); !errors.Is(err, mocks.ErrMocked) {
+		t.Fatalf("expected ErrMocked, got %v", err)
+	}
+	if len(sw.Data) != 1 {
+		t.Fatal("expected the embedded emitter to emit the summary anyway")
+	}
+}
@@ -0,0 +1,73 @@
+// Package webhook posts the results of a test to a webhook.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DefaultTimeout is the default value for Poster.Timeout.
+const DefaultTimeout = 10 * time.Second
+
+// ErrPostFailed indicates a non-2xx status code.
+var ErrPostFailed = errors.New("webhook returned non-2xx status code")
+
+// Poster posts JSON documents to a webhook.
+type Poster struct {
+	// URL is the mandatory webhook URL. This is initialized by NewPoster.
+	URL string
+
+	// Authorization is the optional value of the Authorization header
+	// (e.g. "Bearer <token>").
+	Authorization string
+
+	// HTTPClient is the client that will perform the request. This is
+	// initialized by NewPoster to http.DefaultClient, but you may override it.
+	HTTPClient *http.Client
+
+	// Timeout is the maximum amount of time we're willing to wait for the
+	// webhook to respond. This is initialized by NewPoster to its default
+	// value, but you may override it.
+	Timeout time.Duration
+}
+
+// NewPoster creates a new Poster for the given webhook URL.
+func NewPoster(URL string) *Poster {
+	return &Poster{
+		URL:        URL,
+		HTTPClient: http.DefaultClient,
+		Timeout:    DefaultTimeout,
+	}
+}
+
+// Post marshals v as JSON and posts it to the webhook.
+func (p *Poster) Post(ctx context.Context, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "POST", p.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if p.Authorization != "" {
+		request.Header.Set("Authorization", p.Authorization)
+	}
+	response, err := p.HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%w: %d", ErrPostFailed, response.StatusCode)
+	}
+	return nil
+}
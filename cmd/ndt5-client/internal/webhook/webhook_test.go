@@ -0,0 +1,69 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPostSuccess(t *testing.T) {
+	var (
+		auth string
+		body map[string]string
+	)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			auth = r.Header.Get("Authorization")
+			json.NewDecoder(r.Body).Decode(&body)
+		}))
+	defer server.Close()
+	poster := NewPoster(server.URL)
+	poster.Authorization = "Bearer xyz"
+	err := poster.Post(context.Background(), map[string]string{"ServerFQDN": "a.b.c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth != "Bearer xyz" {
+		t.Fatal("unexpected Authorization header")
+	}
+	if body["ServerFQDN"] != "a.b.c" {
+		t.Fatal("unexpected body")
+	}
+}
+
+func TestPostStatusCode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(500)
+		}))
+	defer server.Close()
+	err := NewPoster(server.URL).Post(context.Background(), "x")
+	if !errors.Is(err, ErrPostFailed) {
+		t.Fatal("expected ErrPostFailed here")
+	}
+}
+
+func TestPostTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(time.Second)
+		}))
+	defer server.Close()
+	poster := NewPoster(server.URL)
+	poster.Timeout = 10 * time.Millisecond
+	err := poster.Post(context.Background(), "x")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+}
+
+func TestPostMarshalError(t *testing.T) {
+	err := NewPoster("http://127.0.0.1").Post(context.Background(), make(chan int))
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"strconv"
@@ -14,7 +18,9 @@ import (
 	"github.com/m-lab/go/flagx"
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/ndt5-client-go"
+	"github.com/m-lab/ndt5-client-go/cmd/ndt5-client/internal/archive"
 	"github.com/m-lab/ndt5-client-go/cmd/ndt5-client/internal/emitter"
+	"github.com/m-lab/ndt5-client-go/cmd/ndt5-client/internal/webhook"
 	"github.com/m-lab/ndt5-client-go/internal/trafficshaping"
 )
 
@@ -22,29 +28,102 @@ const (
 	clientName     = "ndt5-client-go-cmd"
 	clientVersion  = "0.1.0"
 	defaultTimeout = 55 * time.Second
+
+	// These are the exit codes. A test fails when it emits an error, in
+	// which case we use the -exit-on-error exit code, which by default
+	// is exitCodeTestFailure.
+	exitCodeTestFailure       = 1
+	exitCodeDiscoveryFailure  = 2
+	exitCodeMaxRetransmission = 3
+	exitCodeBelowThreshold    = 4
 )
 
 var (
-	flagServer   = flag.String("server", "", "Measurement server hostname")
+	flagServers  = flagx.StringArray{}
 	flagProtocol = flagx.Enum{
 		Options: []string{"ndt5", "ndt5+wss"},
 		Value:   "ndt5",
 	}
 	flagFormat = flagx.Enum{
-		Options: []string{"human", "json"},
+		Options: []string{"human", "json", "json-summary", "kv", "ndt7compat"},
 		Value:   "human",
 	}
+	flagUnits = flagx.Enum{
+		Options: []string{"kbit/s", "Mbit/s", "Gbit/s", "MB/s"},
+		Value:   "Mbit/s",
+	}
+	flagUpload = flagx.Enum{
+		Options: []string{"server", "client-sent", "client-acked"},
+		Value:   "server",
+	}
+	flagAnonymize = flagx.Enum{
+		Options: []string{"none", "netblock", "remove"},
+		Value:   "none",
+	}
 	flagNSURL    = flag.String("ns-url", "https://locate.measurementlab.net/", "Base URL to locate service")
 	flagThrottle = flag.Int64("throttle", 0, "Throttle connections to given rate for testing (bits/sec)")
 	flagTimeout  = flag.Duration(
 		"timeout", defaultTimeout, "time after which the test is aborted")
-	flagVerbose    = flag.Bool("verbose", false, "Log ndt5 messages")
-	flagQuiet      = flag.Bool("quiet", false, "emit summary and errors only")
-	flagExitOnErr  = flag.Int("exit-on-error", 0, "Exit code to use for errors")
-	flagExitOnWarn = flag.Int("exit-on-warning", 0, "Exit code to use when for warnings")
-	flagService    = flagx.URL{}
+	flagVerbose     = flag.Bool("verbose", false, "Log ndt5 messages")
+	flagFrameTrace  = flag.String("frame-trace-file", "", "Write the control frames to this file in a text2pcap-compatible format, for importing into Wireshark")
+	flagVerboseSum  = flag.Bool("verbose-summary", false, "Include all the web100 variables in the summary")
+	flagQuiet       = flag.Bool("quiet", false, "emit summary and errors only")
+	flagProgress    = flag.Bool("progress", false, "With -quiet, show the current phase and speed on a single stderr line")
+	flagExitOnErr   = flag.Int("exit-on-error", exitCodeTestFailure, "Exit code to use for errors")
+	flagExitOnWarn  = flag.Int("exit-on-warning", 0, "Exit code to use when for warnings")
+	flagStrict      = flag.Bool("strict", false, "Treat warnings (e.g. a failed subtest) as errors when choosing the exit code, e.g., for CI")
+	flagRepeat      = flag.Int("repeat", 1, "Number of times to run the test")
+	flagMaxRetrans  = flag.Float64("max-retransmission", 0, "Exit with a non-zero code if the download retransmission rate exceeds this percentage (0 means disabled)")
+	flagMinDownload = flag.Float64("min-download", 0, "Exit with a non-zero code if the download speed is below this many Mbit/s (0 means disabled)")
+	flagMinUpload   = flag.Float64("min-upload", 0, "Exit with a non-zero code if the upload speed is below this many Mbit/s (0 means disabled)")
+	flagWriteTO     = flag.Duration("upload-write-timeout", 0, "Stop the upload with a warning if a single write takes longer than this time, e.g., because the connection stalled (0 means disabled)")
+	flagBlackHole   = flag.Duration("black-hole-window", 0, "Warn about a possible path MTU black hole if the upload sends no bytes within this time, e.g. 1s (0, the default, means disabled)")
+	flagLocation    = flag.String("client-location", "", "Location of the client as latitude,longitude, to measure the distance to the server")
+	flagMaxDistance = flag.Float64("max-server-distance", 3000, "With -client-location, warn when the server is farther than this many km (0 means disabled)")
+	flagMaxBytes    = flag.Int64("max-bytes", 0, "Stop measuring after transferring this many bytes (0 means no limit)")
+	flagStreams     = flag.Int("streams", 1, "Number of parallel streams to request, which only legacy web100srv servers (NDT v3.7) supporting the extended tests honor (ndt5 only)")
+	flagNoKickoff   = flag.Bool("skip-kickoff", false, "Do not expect the kickoff message, which some newer raw ndt5 servers do not send")
+	flagExtLogin    = flag.Bool("extended-login", false, "Send the extended login message, including the client version, over raw TCP (ndt5 only)")
+	flagReuse       = flag.Bool("reuse-payload", false, "Reuse the same random upload payload across tests, saving CPU and memory on constrained devices")
+	flagChunkSize   = flag.Int("write-chunk-size", 0, "Write each upload message in chunks of this many bytes, for experiments (ndt5 only, 0 means the whole message)")
+	flagNoDelay     = flag.Bool("tcp-nodelay", true, "Disable Nagle's algorithm on measurement connections")
+	flagSubtestTO   = flag.Duration("subtest-timeout", 0, "time after which each subtest is aborted (0 means no timeout)")
+	flagIdleTO      = flag.Duration("idle-timeout", 0, "time without any progress after which the test is aborted (0 means no timeout)")
+	flagDiscover    = flag.Bool("discover-only", false, "Only discover a server using the locate service and print its FQDN in the -format output format")
+	flagLocateV2    = flag.Bool("locate-v2", false, "Use the locate v2 API, which supports token-gated servers")
+	flagTokenFile   = flag.String("token-file", "", "File containing the access token for token-gated servers, which is re-read before each test (ndt5+wss only)")
+	flagReconnect   = flag.Bool("reconnect-control", false, "Reconnect the control connection if a subtest fails")
+	flagRTTProbe    = flag.Duration("control-rtt-interval", 0, "Interval at which to probe the control connection RTT while in queue (ndt5+wss only)")
+	flagDatadir     = flag.String("datadir", "", "Directory where to write the summary and the result of each test as a JSONL record")
+	flagCompress    = flag.Bool("compress", false, "With -datadir, gzip-compress the JSONL file")
+	flagCompressLvl = flag.Int("compress-level", gzip.DefaultCompression, "With -compress, the gzip compression level (1-9, or -1 for the default)")
+	flagMaxFileSize = flag.Int64("max-file-size", 0, "With -datadir, start a new JSONL file when the current one reaches this many bytes (0 means no limit)")
+	flagMaxRecords  = flag.Int("max-records-per-file", 0, "With -datadir, start a new JSONL file when the current one contains this many records (0 means no limit)")
+	flagSyslog      = flag.Bool("syslog", false, "Also write the summary (at INFO) and the errors (at ERR) to syslog (Linux only)")
+	flagSyslogFac   = flag.String("syslog-facility", "user", "With -syslog, the syslog facility (e.g. user, daemon, or local0-local7)")
+	flagSyslogTag   = flag.String("syslog-tag", clientName, "With -syslog, the syslog tag")
+	flagWebhook     = flag.String("webhook-url", "", "URL to which to POST the summary of each test as JSON")
+	flagWebhookTO   = flag.Duration("webhook-timeout", webhook.DefaultTimeout, "time after which the webhook POST is aborted")
+	flagWebhookAuth = flag.String("webhook-auth", "", "Value of the Authorization header of the webhook POST")
+	flagDivergence  = flag.Float64("speed-divergence", 0, "Warn when the client-measured and server-measured speeds differ by more than this percentage (0 means disabled)")
+	flagOutliers    = flag.Float64("outlier-factor", 0, "Exclude from the summary download speed the samples faster than this multiple of the median (0 means disabled)")
+	flagConfig      = flag.String("config", "", "YAML or JSON file mapping flag names to values. Command line flags and environment variables take precedence.")
+	flagNoMetadata  = flag.Bool("disable-metadata", false, "Do not send the OS, architecture and versions of the client to the server")
+	flagResolve     = flag.Bool("resolve", false, "Resolve the server FQDN explicitly and measure the DNS resolution time")
+	flagCC          = flag.String("congestion-control", "", "TCP congestion control algorithm for measurement connections (Linux only)")
+	flagLocalPorts  = flag.String("local-port-range", "", "Range of local ports, written as min-max, to which to bind measurement connections")
+	flagPostTest    = flag.Duration("post-test-delay", 0, "time to wait at the end of the measurement phase of each subtest, so the server's final TCPInfo snapshots are accurate")
+	flagConvThresh  = flag.Float64("convergence-threshold", 0, "With -convergence-window, stop each subtest early once the coefficient of variation of the speed falls below this value, e.g. 0.05 (0 means disabled)")
+	flagConvWindow  = flag.Duration("convergence-window", 0, "Window over which to check whether the speed converged (0 means disabled)")
+	flagDrain       = flag.Duration("drain-after-logout", 0, "time during which to keep reading the results sent by the server after logging out (0 means stop at logout)")
+	flagRepeatWait  = flag.Duration(
+		"repeat-pause", 0, "time to wait between two consecutive runs")
+	flagService = flagx.URL{}
+	flagLabels  = flagx.KeyValue{}
 
 	osExit = os.Exit // Allow mocking os.Exit for unit tests.
+
+	archiver *archive.Writer // nil unless -datadir is set
 )
 
 func init() {
@@ -56,56 +135,269 @@ func init() {
 	flag.Var(
 		&flagFormat,
 		"format",
-		`Output format: "human" or "json"`,
+		`Output format: "human", "json", "json-summary", "kv", or "ndt7compat"`,
 	)
 	flag.Var(
 		&flagService,
 		"service-url",
 		"Service URL specifies target hostname and other URL fields like access token. Overrides -hostname.",
 	)
+	flag.Var(
+		&flagUnits,
+		"units",
+		`Throughput unit: "kbit/s", "Mbit/s", "Gbit/s", or "MB/s"`,
+	)
+	flag.Var(
+		&flagUpload,
+		"upload-source",
+		`Upload speed in the summary: measured by the "server", by the client counting the bytes it sent ("client-sent"), or counting the bytes the server acknowledged, when it reports them ("client-acked")`,
+	)
+	flag.Var(
+		&flagAnonymize,
+		"anonymize-client-ip",
+		`How to anonymize the client IP reported by the server: "none", "netblock", or "remove"`,
+	)
+	flag.Var(
+		&flagServers,
+		"server",
+		"Measurement server hostname. May be repeated or comma-separated to test each server in turn.",
+	)
+	flag.Var(
+		&flagLabels,
+		"label",
+		"Label to attach to the results, as key=value. May be repeated.",
+	)
 }
 
 func main() {
 	flag.Parse()
-	flagx.ArgsFromEnvWithLog(flag.CommandLine, false)
+	if *flagConfig != "" {
+		rtx.Must(loadConfig(flag.CommandLine, *flagConfig), "cannot load config file")
+	}
+	rtx.Must(argsFromEnv(flag.CommandLine), "cannot read flags from the environment")
 
 	var dialer ndt5.NetDialer = new(net.Dialer)
 	if *flagThrottle > 0 {
 		dialer = trafficshaping.NewDialerWithBitrate(*flagThrottle)
 	}
+	var localPorts ndt5.PortRange
+	if *flagLocalPorts != "" {
+		var err error
+		localPorts, err = parsePortRange(*flagLocalPorts)
+		rtx.Must(err, "cannot parse -local-port-range")
+	}
 	factory5 := ndt5.NewProtocolFactory5()
 	switch flagProtocol.Value {
 	case "ndt5":
-		factory5.ConnectionsFactory = ndt5.NewRawConnectionsFactory(dialer)
+		raw := ndt5.NewRawConnectionsFactory(dialer)
+		raw.CongestionControl = *flagCC
+		raw.EnableNagle = !*flagNoDelay
+		raw.LocalPortRange = localPorts
+		raw.WriteChunkSize = *flagChunkSize
+		if *flagExtLogin {
+			raw.LoginMode = ndt5.LoginExtended
+		}
+		factory5.ConnectionsFactory = raw
 	case "ndt5+wss":
 		if flagService.URL != nil {
-			*flagServer = flagService.Hostname()
+			flagServers = flagx.StringArray{flagService.Hostname()}
 		}
-		factory5.ConnectionsFactory = ndt5.NewWSConnectionsFactory(dialer, flagService.URL)
+		ws := ndt5.NewWSConnectionsFactory(dialer, flagService.URL)
+		ws.CongestionControl = *flagCC
+		ws.EnableNagle = !*flagNoDelay
+		ws.LocalPortRange = localPorts
+		factory5.ConnectionsFactory = ws
 	}
+	factory5.ControlRTTInterval = *flagRTTProbe
+	factory5.SkipKickoff = *flagNoKickoff
 	if *flagVerbose {
 		factory5.ObserverFactory = new(verboseFrameReadWriteObserverFactory)
 	}
+	if *flagFrameTrace != "" {
+		fp, err := os.Create(*flagFrameTrace)
+		rtx.Must(err, "cannot create the frame trace file")
+		trace := ndt5.NewFrameTraceObserverFactory(fp)
+		trace.Next = factory5.ObserverFactory
+		factory5.ObserverFactory = trace
+	}
 	client := ndt5.NewClient(clientName, clientVersion, *flagNSURL)
 	client.ProtocolFactory = factory5
-	client.FQDN = *flagServer
+	client.Labels = flagLabels.Get()
+	client.RepeatPause = *flagRepeatWait
+	client.MaxBytes = *flagMaxBytes
+	client.Streams = *flagStreams
+	client.BlackHoleWindow = *flagBlackHole
+	client.UploadWriteTimeout = *flagWriteTO
+	client.ReusePayload = *flagReuse
+	client.AnonymizeClientIP = anonymizationModes[flagAnonymize.Value]
+	client.ReconcileUpload = flagUpload.Value == "client-acked"
+	if *flagLocation != "" {
+		location, err := parseLocation(*flagLocation)
+		rtx.Must(err, "cannot parse -client-location")
+		client.ClientLocation = location
+		client.MaxServerDistance = *flagMaxDistance
+	}
+	client.LocateV2 = *flagLocateV2
+	client.AccessTokenFile = *flagTokenFile
+	client.ReconnectControlOnError = *flagReconnect
+	client.SubtestTimeout = *flagSubtestTO
+	client.IdleTimeout = *flagIdleTO
+	client.PostTestDelay = *flagPostTest
+	client.DrainAfterLogout = *flagDrain
+	client.ConvergenceThreshold = *flagConvThresh
+	client.ConvergenceWindow = *flagConvWindow
+	client.SpeedDivergence = *flagDivergence
+	client.MaxRetransmission = *flagMaxRetrans
+	// The library uses kbit/s.
+	client.MinDownload = *flagMinDownload * 1000
+	client.MinUpload = *flagMinUpload * 1000
+	client.ResolveFQDN = *flagResolve
+	client.DisableMetadata = *flagNoMetadata
+	if *flagWebhook != "" {
+		poster := webhook.NewPoster(*flagWebhook)
+		poster.Timeout = *flagWebhookTO
+		poster.Authorization = *flagWebhookAuth
+		client.OnComplete = func(result *ndt5.TestResult) error {
+			return poster.Post(context.Background(), makeSummary(client.FQDN, *result))
+		}
+	}
 
 	var e emitter.Emitter
-	if flagFormat.Value == "json" {
+	switch flagFormat.Value {
+	case "json":
 		e = emitter.NewJSON(os.Stdout)
-	} else {
+	case "json-summary":
+		e = emitter.NewJSONSummary(os.Stdout)
+	case "kv":
+		e = emitter.NewKeyValue(os.Stdout)
+	case "ndt7compat":
+		e = emitter.NewNDT7Compat(os.Stdout)
+	default:
 		e = emitter.NewHumanReadable()
 	}
 
 	if *flagQuiet {
 		e = emitter.NewQuiet(e)
+		if *flagProgress {
+			e = emitter.NewProgress(os.Stderr, e)
+		}
+	}
+	if *flagSyslog {
+		var err error
+		e, err = emitter.NewSyslog(e, *flagSyslogFac, *flagSyslogTag)
+		rtx.Must(err, "cannot use -syslog")
+	}
+	if *flagDiscover {
+		osExit(discoverOnly(client, e))
 	}
+	if *flagDatadir != "" {
+		archiver = archive.NewWriter(*flagDatadir)
+		archiver.Compress = *flagCompress
+		archiver.Level = *flagCompressLvl
+		archiver.MaxFileSize = *flagMaxFileSize
+		archiver.MaxRecords = *flagMaxRecords
+	}
+	exitCode := runServers(client, e, flagServers)
+	if archiver != nil {
+		rtx.Must(archiver.Close(), "cannot close the archive file")
+	}
+	osExit(exitCode)
+}
+
+// discoverOnly discovers a server using the locate service, prints its
+// FQDN to stdout according to -format, and returns the exit code.
+func discoverOnly(client *ndt5.Client, e emitter.Emitter) int {
+	ctx, cancel := context.WithTimeout(context.Background(), *flagTimeout)
+	defer cancel()
+	fqdn, err := client.Discover(ctx)
+	if err != nil {
+		emitError(e, fmt.Sprintf("client.Discover failed: %s", err), err)
+		return exitCodeDiscoveryFailure
+	}
+	rtx.Must(printDiscovered(os.Stdout, fqdn), "cannot print the discovered server")
+	return 0
+}
+
+// printDiscovered prints fqdn to w according to -format: as a JSON object
+// with the same ServerFQDN key of the summary for the JSON formats, as a
+// key=value pair for "kv", and as is otherwise.
+func printDiscovered(w io.Writer, fqdn string) error {
+	var err error
+	switch flagFormat.Value {
+	case "json", "json-summary", "ndt7compat":
+		err = json.NewEncoder(w).Encode(struct{ ServerFQDN string }{fqdn})
+	case "kv":
+		_, err = fmt.Fprintf(w, "server=%s\n", fqdn)
+	default:
+		_, err = fmt.Fprintln(w, fqdn)
+	}
+	return err
+}
+
+// runServers runs the tests against each of the given servers in turn, or
+// against the server returned by the locate service if there are none, and
+// returns the exit code of the last server that failed, if any.
+func runServers(client *ndt5.Client, e emitter.Emitter, servers []string) int {
+	if len(servers) == 0 {
+		servers = []string{""} // use the locate service
+	}
+	exitCode := 0
+	for _, server := range servers {
+		client.FQDN = server
+		if code := runServer(client, e); code != 0 {
+			exitCode = code
+		}
+	}
+	return exitCode
+}
+
+// runServer runs the test -repeat times against client.FQDN, or against
+// the server returned by the locate service if it's empty, emitting the
+// aggregate of the runs, if more than one, and returns the exit code. Unlike
+// client.RunN, which discards the events, we emit the events of each run
+// and keep going after a failed run, whose failed subtests NewAggregate
+// excludes from the stats. Like RunN, we wait client.RepeatPause between
+// consecutive runs.
+func runServer(client *ndt5.Client, e emitter.Emitter) int {
 	exitCode := 0
+	var summaries []*emitter.Summary
+	for i := 0; i < *flagRepeat; i++ {
+		if i > 0 {
+			time.Sleep(client.RepeatPause)
+		}
+		client.Result = ndt5.TestResult{}
+		code, summary := runTest(client, e)
+		if code != 0 {
+			exitCode = code
+		}
+		if summary == nil {
+			break // we could not start the test
+		}
+		summaries = append(summaries, summary)
+	}
+	if len(summaries) > 1 {
+		err := e.OnAggregate(emitter.NewAggregate(summaries))
+		rtx.Must(err, "emitter.OnAggregate failed")
+	}
+	return exitCode
+}
 
+// runTest runs a single ndt5 test using the given client, passes the
+// events to the given emitter, and returns the exit code along with the
+// summary of the test. The summary is nil if we cannot start the test.
+func runTest(client *ndt5.Client, e emitter.Emitter) (int, *emitter.Summary) {
 	ctx, cancel := context.WithTimeout(context.Background(), *flagTimeout)
 	defer cancel()
 	out, err := client.Start(ctx)
-	rtx.Must(err, "client.Start failed")
+	if err != nil {
+		emitError(e, fmt.Sprintf("client.Start failed: %s", err), err)
+		if errors.Is(err, ndt5.ErrDiscoveryFailed) {
+			return exitCodeDiscoveryFailure, nil
+		}
+		return *flagExitOnErr, nil
+	}
+	var failed, warned bool
+	samples := new(emitter.Samples)
 	for ev := range out {
 		if ev.DebugMessage != nil {
 			e.OnDebug(strings.Trim(ev.DebugMessage.Message, "\t\n "))
@@ -115,57 +407,105 @@ func main() {
 		}
 		if ev.WarningMessage != nil {
 			e.OnWarning(ev.WarningMessage.Error.Error())
-			exitCode = *flagExitOnWarn
+			warned = true
 		}
 		if ev.ErrorMessage != nil {
-			e.OnError(ev.ErrorMessage.Error.Error())
-			exitCode = *flagExitOnErr
+			emitError(e, ev.ErrorMessage.Error.Error(), ev.ErrorMessage.Error)
+			failed = true
 		}
 		if ev.CurDownloadSpeed != nil {
-			e.OnSpeed("download", computeSpeed(ev.CurDownloadSpeed))
+			emitSpeed(e, "download", ev.CurDownloadSpeed)
+			samples.Add(ev.CurDownloadSpeed.Count, ev.CurDownloadSpeed.Elapsed)
 		}
 		if ev.CurUploadSpeed != nil {
-			e.OnSpeed("upload", computeSpeed(ev.CurUploadSpeed))
+			emitSpeed(e, "upload", ev.CurUploadSpeed)
+		}
+		if ev.Progress != nil {
+			emitter.EmitPercent(e, ev.Progress.Direction, ev.Progress.Percent)
 		}
 	}
 
+	// A failure takes precedence over the other outcomes. With -strict,
+	// warnings count as failures.
+	exitCode := 0
+	switch {
+	case failed, warned && *flagStrict:
+		exitCode = *flagExitOnErr
+	case client.Result.MaxRetransmissionExceeded:
+		exitCode = exitCodeMaxRetransmission
+	case len(client.Result.BelowThreshold) > 0:
+		exitCode = exitCodeBelowThreshold
+	case warned:
+		exitCode = *flagExitOnWarn
+	}
 	summary := makeSummary(client.FQDN, client.Result)
+	if *flagOutliers > 0 {
+		if mbps, ok := samples.Mbps(*flagOutliers); ok {
+			summary.Download.Value = throughputUnit().FromBitsPerSecond(mbps * 1e6)
+		}
+	}
+	if *flagVerboseSum {
+		summary.Web100 = client.Result.Web100
+	}
+	if flagFormat.Value == "json-summary" {
+		summary.ServerVersion = client.Result.ServerVersion
+		summary.Timings = makeTimings(client.Result.Timings)
+	}
 	err = e.OnSummary(summary)
 	rtx.Must(err, "emitter.OnSummary failed")
-	osExit(exitCode)
+	if archiver != nil {
+		record := archiveRecord{Summary: summary, Result: client.Result}
+		if err := archiver.Write(record); err != nil {
+			e.OnWarning(fmt.Sprintf("cannot archive the result: %s", err))
+		}
+	}
+	return exitCode, summary
+}
+
+// archiveRecord is the record we write to the -datadir.
+type archiveRecord struct {
+	Summary *emitter.Summary
+	Result  ndt5.TestResult
 }
 
 func makeSummary(FQDN string, result ndt5.TestResult) *emitter.Summary {
 	s := emitter.NewSummary(FQDN)
+	s.Labels = result.Labels
 
-	if serverIP, ok := result.Web100["NDTResult.S2C.ServerIP"]; ok {
+	if serverIP, ok := result.Web100[ndt5.Web100KeyServerIP]; ok {
 		s.ServerIP = serverIP
 	}
 
-	if clientIP, ok := result.Web100["NDTResult.S2C.ClientIP"]; ok {
+	s.AddressFamily = result.AddressFamily
+	if clientIP, ok := result.Web100[ndt5.Web100KeyClientIP]; ok {
 		s.ClientIP = clientIP
 	}
 
-	if UUID, ok := result.Web100["NDTResult.S2C.UUID"]; ok {
+	if UUID, ok := result.Web100[ndt5.Web100KeyUUID]; ok {
 		s.DownloadUUID = UUID
 	}
 
-	elapsed := result.ClientMeasuredDownload.Elapsed.Seconds()
+	unit := throughputUnit()
 	s.Download = emitter.ValueUnitPair{
-		Value: (8.0 * float64(result.ClientMeasuredDownload.Count)) /
-			float64(elapsed) / 1000.0 / 1000.0,
-		Unit: "Mbit/s",
+		Value: result.ClientMeasuredDownload.In(unit),
+		Unit:  string(unit),
 	}
 
 	s.Upload = emitter.ValueUnitPair{
 		// Upload coming from the NDT server is in kbit/second.
-		Value: result.ServerMeasuredUpload / 1000,
-		Unit:  "Mbit/s",
+		Value: unit.FromKbitps(result.ServerMeasuredUpload),
+		Unit:  string(unit),
+	}
+	if flagUpload.Value != "server" {
+		// With "client-acked", the client has already reconciled the count.
+		s.Upload.Value = result.ClientMeasuredUpload.In(unit)
 	}
+	s.DownloadStatus = subtestStatus(result, "download")
+	s.UploadStatus = subtestStatus(result, "upload")
 
 	// Here we use the MinRTT provided by the server, assuming they are
 	// symmetrical.
-	if rtt, ok := result.Web100["TCPInfo.MinRTT"]; ok {
+	if rtt, ok := result.Web100[ndt5.Web100KeyMinRTT]; ok {
 		rtt, err := strconv.ParseFloat(rtt, 64)
 		if err == nil {
 			s.MinRTT = emitter.ValueUnitPair{
@@ -176,30 +516,126 @@ func makeSummary(FQDN string, result ndt5.TestResult) *emitter.Summary {
 		}
 	}
 
-	if bytesRetrans, ok := result.Web100["TCPInfo.BytesRetrans"]; ok {
-		if bytesSent, ok := result.Web100["TCPInfo.BytesSent"]; ok {
-			retrans, err1 := strconv.ParseFloat(bytesRetrans, 64)
-			sent, err2 := strconv.ParseFloat(bytesSent, 64)
+	if result.DownloadTTFB > 0 {
+		s.DownloadTTFB = emitter.ValueUnitPair{
+			Value: float64(result.DownloadTTFB) / float64(time.Millisecond),
+			Unit:  "ms",
+		}
+	}
 
-			// If BytesSent isn't > 0, something went wrong while getting the
-			// TCPInfo results. While this should never happen on M-Lab's
-			// servers, it's been reported in some custom deployments.
-			// In this case, we don't add the retransmission to the summary.
-			if err1 == nil && err2 == nil && sent > 0 {
-				s.DownloadRetrans = emitter.ValueUnitPair{
-					Value: retrans / sent * 100,
-					Unit:  "%",
-				}
-			}
+	// If the retransmission rate is invalid, something went wrong while
+	// getting the TCPInfo results. In this case, we don't add it to the
+	// summary.
+	if retrans, ok := result.DownloadRetransmission(); ok {
+		s.DownloadRetrans = emitter.ValueUnitPair{
+			Value: retrans,
+			Unit:  "%",
 		}
 	}
 	return s
 }
 
+// subtestStatus returns the status of the subtest in the given direction,
+// which is skipped when we did not run it, e.g., because the test failed
+// earlier or the server did not ask us to run it.
+func subtestStatus(result ndt5.TestResult, direction string) string {
+	for _, subtest := range result.Subtests {
+		if subtest.Direction != direction {
+			continue
+		}
+		if subtest.Success {
+			return emitter.StatusSucceeded
+		}
+		return emitter.StatusFailed
+	}
+	return emitter.StatusSkipped
+}
+
+// makeTimings returns the measured timings in milliseconds.
+func makeTimings(timings ndt5.Timings) map[string]emitter.ValueUnitPair {
+	m := make(map[string]emitter.ValueUnitPair)
+	add := func(name string, d time.Duration) {
+		if d > 0 {
+			m[name] = emitter.ValueUnitPair{
+				Value: float64(d) / float64(time.Millisecond),
+				Unit:  "ms",
+			}
+		}
+	}
+	add("DNSResolve", timings.DNSResolve)
+	add("LoginRTT", timings.LoginRTT)
+	return m
+}
+
+// emitError passes the error message to the emitter, along with the phase
+// and the code of err for the emitters that want a machine-readable error.
+func emitError(e emitter.Emitter, message string, err error) {
+	emitter.EmitError(e, &emitter.Error{
+		Phase:   ndt5.ErrorPhase(err),
+		Code:    ndt5.ErrorCode(err),
+		Message: message,
+	})
+}
+
+// emitSpeed passes a speed sample to the emitter, using OnSample for the
+// emitters that want the raw sample and OnSpeed otherwise.
+func emitSpeed(e emitter.Emitter, test string, speed *ndt5.Speed) {
+	if se, ok := e.(emitter.SampleEmitter); ok {
+		se.OnSample(test, speed.Count, speed.Elapsed)
+		return
+	}
+	e.OnSpeed(test, computeSpeed(speed))
+}
+
 func computeSpeed(speed *ndt5.Speed) string {
-	elapsed := speed.Elapsed.Seconds() * 1e06
-	formatted := float64(8*speed.Count) / elapsed
-	return fmt.Sprintf("%11.4f Mbit/s", formatted)
+	unit := throughputUnit()
+	return fmt.Sprintf("%11.4f %s", speed.In(unit), unit)
+}
+
+// parseLocation parses a location written as "latitude,longitude".
+func parseLocation(s string) (*ndt5.GeoLocation, error) {
+	lat, lon, found := strings.Cut(s, ",")
+	if !found {
+		return nil, fmt.Errorf("expected latitude,longitude, got %q", s)
+	}
+	latitude, err := strconv.ParseFloat(strings.TrimSpace(lat), 64)
+	if err != nil {
+		return nil, err
+	}
+	longitude, err := strconv.ParseFloat(strings.TrimSpace(lon), 64)
+	if err != nil {
+		return nil, err
+	}
+	return &ndt5.GeoLocation{Latitude: latitude, Longitude: longitude}, nil
+}
+
+// parsePortRange parses a port range written as "min-max".
+func parsePortRange(s string) (ndt5.PortRange, error) {
+	min, max, found := strings.Cut(s, "-")
+	if !found {
+		return ndt5.PortRange{}, fmt.Errorf("expected min-max, got %q", s)
+	}
+	minPort, err := strconv.Atoi(strings.TrimSpace(min))
+	if err != nil {
+		return ndt5.PortRange{}, err
+	}
+	maxPort, err := strconv.Atoi(strings.TrimSpace(max))
+	if err != nil {
+		return ndt5.PortRange{}, err
+	}
+	return ndt5.PortRange{Min: minPort, Max: maxPort}, nil
+}
+
+// anonymizationModes maps the values of -anonymize-client-ip to modes.
+var anonymizationModes = map[string]ndt5.AnonymizationMode{
+	"none":     ndt5.AnonymizeNone,
+	"netblock": ndt5.AnonymizeNetblock,
+	"remove":   ndt5.AnonymizeRemove,
+}
+
+// throughputUnit returns the unit selected using -units.
+func throughputUnit() ndt5.ThroughputUnit {
+	return ndt5.ThroughputUnit(flagUnits.Value)
 }
 
 type verboseFrameReadWriteObserverFactory struct{}
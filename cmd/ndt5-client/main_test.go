@@ -1,8 +1,18 @@
 package main
 
 import (
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/m-lab/ndt5-client-go"
+	"github.com/m-lab/ndt5-client-go/cmd/ndt5-client/internal/emitter"
+	"github.com/m-lab/ndt5-client-go/cmd/ndt5-client/internal/mocks"
 )
 
 func TestIntegrationMainRaw(t *testing.T) {
@@ -41,6 +51,245 @@ func TestIntegrationMainWSS(t *testing.T) {
 	main()
 }
 
+func TestRunTestDiscoveryFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	client := ndt5.NewClient(clientName, clientVersion, server.URL)
+	code, summary := runTest(client, emitter.NewJSON(&mocks.SavingWriter{}))
+	if code != exitCodeDiscoveryFailure || summary != nil {
+		t.Fatalf("unexpected outcome: %d %+v", code, summary)
+	}
+}
+
+func TestRunTestStartFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close() // make sure that nobody is listening
+	client := ndt5.NewClient(clientName, clientVersion, "")
+	client.ProtocolFactory = ndt5.NewProtocolFactory5()
+	client.FQDN = address
+	code, summary := runTest(client, emitter.NewJSON(&mocks.SavingWriter{}))
+	if code != exitCodeTestFailure || summary != nil {
+		t.Fatalf("unexpected outcome: %d %+v", code, summary)
+	}
+}
+
+func TestRunTestStrict(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// Serve no tests using an invalid version, which is a warning.
+			conn.Read(make([]byte, 4)) // login
+			conn.Write([]byte("123456 654321"))
+			for _, frame := range [][]byte{
+				{1, 0, 1, '0'}, {2, 0, 5, 'b', 'o', 'g', 'u', 's'}, {2, 0, 0}, {9, 0, 0},
+			} {
+				conn.Write(frame)
+			}
+			conn.Close()
+		}
+	}()
+	defer func(value bool) { *flagStrict = value }(*flagStrict)
+	for _, strict := range []bool{false, true} {
+		*flagStrict = strict
+		factory := ndt5.NewProtocolFactory5()
+		factory.ConnectionsFactory = ndt5.NewRawConnectionsFactory(new(net.Dialer))
+		client := ndt5.NewClient(clientName, clientVersion, "")
+		client.ProtocolFactory = factory
+		client.FQDN = listener.Addr().String()
+		code, summary := runTest(client, emitter.NewJSON(&mocks.SavingWriter{}))
+		if summary == nil || (code == exitCodeTestFailure) != strict {
+			t.Fatalf("strict %v: unexpected outcome: %d %+v", strict, code, summary)
+		}
+	}
+}
+
+// serveNoTests returns a listener serving no tests, or failing the tests
+// when fail is true, and counting the accepted conns.
+func serveNoTests(t *testing.T, fail bool) (net.Listener, *int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	accepted := new(int32)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepted, 1)
+			if !fail {
+				conn.Read(make([]byte, 4)) // login
+				conn.Write([]byte("123456 654321"))
+				for _, frame := range [][]byte{
+					{1, 0, 1, '0'}, {2, 0, 6, 'v', '3', '.', '7', '.', '0'}, {2, 0, 0}, {9, 0, 0},
+				} {
+					conn.Write(frame)
+				}
+			}
+			conn.Close()
+		}
+	}()
+	return listener, accepted
+}
+
+func TestRunServers(t *testing.T) {
+	failing, failingAccepted := serveNoTests(t, true)
+	working, workingAccepted := serveNoTests(t, false)
+	factory := ndt5.NewProtocolFactory5()
+	factory.ConnectionsFactory = ndt5.NewRawConnectionsFactory(new(net.Dialer))
+	client := ndt5.NewClient(clientName, clientVersion, "")
+	client.ProtocolFactory = factory
+	code := runServers(client, emitter.NewJSON(&mocks.SavingWriter{}),
+		[]string{failing.Addr().String(), working.Addr().String()})
+	// The failure of the first server does not prevent testing the second
+	// one, and determines the exit code.
+	if code != exitCodeTestFailure {
+		t.Fatalf("unexpected exit code: %d", code)
+	}
+	if atomic.LoadInt32(failingAccepted) != 1 || atomic.LoadInt32(workingAccepted) != 1 {
+		t.Fatal("expected to test each server once")
+	}
+	if client.FQDN != working.Addr().String() {
+		t.Fatalf("unexpected FQDN: %s", client.FQDN)
+	}
+}
+
+func TestMakeTimings(t *testing.T) {
+	if timings := makeTimings(ndt5.Timings{}); len(timings) != 0 {
+		t.Fatalf("unexpected timings: %+v", timings)
+	}
+	timings := makeTimings(ndt5.Timings{
+		DNSResolve: 1500 * time.Microsecond,
+		LoginRTT:   2 * time.Millisecond,
+	})
+	if got := timings["DNSResolve"]; got.Value != 1.5 || got.Unit != "ms" {
+		t.Fatalf("unexpected DNSResolve: %+v", got)
+	}
+	if got := timings["LoginRTT"]; got.Value != 2 || got.Unit != "ms" {
+		t.Fatalf("unexpected LoginRTT: %+v", got)
+	}
+}
+
+func TestMakeSummaryUnits(t *testing.T) {
+	defer func(value string) { flagUnits.Value = value }(flagUnits.Value)
+	flagUnits.Value = "MB/s"
+	summary := makeSummary("ndt5.example.com", ndt5.TestResult{
+		ClientMeasuredDownload: ndt5.Speed{Count: 12_500_000, Elapsed: time.Second},
+		ServerMeasuredUpload:   100_000,
+	})
+	expect := emitter.ValueUnitPair{Value: 12.5, Unit: "MB/s"}
+	if summary.Download != expect || summary.Upload != expect {
+		t.Fatalf("unexpected summary: %+v", summary)
+	}
+	speed := computeSpeed(&ndt5.Speed{Count: 12_500_000, Elapsed: time.Second})
+	if speed != "    12.5000 MB/s" {
+		t.Fatalf("unexpected speed: %q", speed)
+	}
+}
+
+func TestMakeSummaryUploadSource(t *testing.T) {
+	defer func(value string) { flagUpload.Value = value }(flagUpload.Value)
+	result := ndt5.TestResult{
+		ClientMeasuredUpload: ndt5.Speed{Count: 12_500_000, Elapsed: time.Second},
+		ServerMeasuredUpload: 90_000,
+	}
+	for source, expect := range map[string]float64{
+		"server":       90,
+		"client-sent":  100,
+		"client-acked": 100,
+	} {
+		flagUpload.Value = source
+		if got := makeSummary("ndt5.example.com", result).Upload.Value; got != expect {
+			t.Fatalf("%s: expected %f, got %f", source, expect, got)
+		}
+	}
+}
+
+func TestMakeSummaryStatus(t *testing.T) {
+	summary := makeSummary("ndt5.example.com", ndt5.TestResult{
+		Subtests: []ndt5.SubtestRecord{
+			{Direction: "download", Success: true},
+			{Direction: "upload", Error: "upload failed: mocked error"},
+		},
+	})
+	if summary.DownloadStatus != emitter.StatusSucceeded || summary.UploadStatus != emitter.StatusFailed {
+		t.Fatalf("unexpected status: %+v", summary)
+	}
+	summary = makeSummary("ndt5.example.com", ndt5.TestResult{})
+	if summary.DownloadStatus != emitter.StatusSkipped || summary.UploadStatus != emitter.StatusSkipped {
+		t.Fatalf("unexpected status: %+v", summary)
+	}
+}
+
+func TestMakeSummaryTTFB(t *testing.T) {
+	summary := makeSummary("ndt5.example.com", ndt5.TestResult{
+		DownloadTTFB: 1500 * time.Microsecond,
+	})
+	expect := emitter.ValueUnitPair{Value: 1.5, Unit: "ms"}
+	if summary.DownloadTTFB != expect {
+		t.Fatalf("unexpected TTFB: %+v", summary.DownloadTTFB)
+	}
+}
+
+func TestPrintDiscovered(t *testing.T) {
+	defer func(value string) { flagFormat.Value = value }(flagFormat.Value)
+	for format, expect := range map[string]string{
+		"human":        "ndt5.example.com\n",
+		"json":         `{"ServerFQDN":"ndt5.example.com"}` + "\n",
+		"json-summary": `{"ServerFQDN":"ndt5.example.com"}` + "\n",
+		"kv":           "server=ndt5.example.com\n",
+	} {
+		flagFormat.Value = format
+		builder := new(strings.Builder)
+		if err := printDiscovered(builder, "ndt5.example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if builder.String() != expect {
+			t.Fatalf("%s: expected %q, got %q", format, expect, builder.String())
+		}
+	}
+}
+
+func TestParseLocation(t *testing.T) {
+	location, err := parseLocation("40.7, -74")
+	if err != nil || *location != (ndt5.GeoLocation{Latitude: 40.7, Longitude: -74}) {
+		t.Fatalf("unexpected location: %+v %v", location, err)
+	}
+	for _, s := range []string{"40.7", "x,-74", "40.7,y"} {
+		if _, err := parseLocation(s); err == nil {
+			t.Fatalf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	ports, err := parsePortRange("40000-40100")
+	if err != nil || ports != (ndt5.PortRange{Min: 40000, Max: 40100}) {
+		t.Fatalf("unexpected port range: %+v %v", ports, err)
+	}
+	for _, s := range []string{"40000", "x-40100", "40000-y"} {
+		if _, err := parsePortRange(s); err == nil {
+			t.Fatalf("%q: expected an error", s)
+		}
+	}
+}
+
 func TestMain(m *testing.M) {
 	// Do not use production servers for CI.
 	*flagNSURL = "https://mlab-sandbox.appspot.com/"
@@ -0,0 +1,105 @@
+package ndt5
+
+import (
+	"context"
+	"sync"
+)
+
+// ConformanceStep is the outcome of a step of the protocol, i.e., of a
+// phase of the test (see Phase). The login phase yields two steps, since
+// it occurs before and after the queue phase.
+type ConformanceStep struct {
+	Phase Phase
+
+	// Pass indicates whether the server conformed to the protocol during
+	// the step, i.e., whether we did not emit any error or warning.
+	Pass bool
+
+	// Failures contains the errors and the warnings emitted during the
+	// step, e.g., an unexpected message type or an unparseable body.
+	Failures []string `json:",omitempty"`
+}
+
+// ConformanceReport is the report created by Client.Conform.
+type ConformanceReport struct {
+	// FQDN is the FQDN of the server we checked.
+	FQDN string
+
+	// ServerVersion is the version sent by the server, if any.
+	ServerVersion string `json:",omitempty"`
+
+	// Pass indicates whether all the steps passed.
+	Pass bool
+
+	// Steps contains the steps in the order in which they occurred.
+	Steps []ConformanceStep
+
+	// Result is the result of the test we ran to exercise the protocol.
+	Result TestResult
+}
+
+// Conform checks whether the server conforms to the ndt5 protocol, e.g.,
+// while developing a server, rather than measuring its performance. It
+// runs a whole test, like Start, and reports whether each step passed,
+// along with the failures of the steps that did not. Every error and
+// warning counts as a failure, including the ones not concerning the
+// protocol, so you should not enable checks such as MinDownload. It only
+// returns an error if the test could not start, e.g., because we could
+// not connect to the server, in which case there is nothing to check.
+func (c *Client) Conform(ctx context.Context) (*ConformanceReport, error) {
+	c.conformance = new(conformanceRecorder)
+	defer func() {
+		c.conformance = nil
+	}()
+	c.Result = TestResult{}
+	ch, err := c.Start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for range ch {
+		// The conformanceRecorder records the failures.
+	}
+	report := &ConformanceReport{
+		FQDN:          c.FQDN,
+		ServerVersion: c.Result.ServerVersion,
+		Pass:          true,
+		Steps:         c.conformance.snapshot(),
+		Result:        c.Result,
+	}
+	for _, step := range report.Steps {
+		report.Pass = report.Pass && step.Pass
+	}
+	return report, nil
+}
+
+// conformanceRecorder records the steps of the protocol for Conform.
+type conformanceRecorder struct {
+	mu    sync.Mutex
+	steps []ConformanceStep
+}
+
+// enter starts a new step for the given phase.
+func (cr *conformanceRecorder) enter(phase string) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.steps = append(cr.steps, ConformanceStep{Phase: Phase(phase), Pass: true})
+}
+
+// fail records the failure of the current step.
+func (cr *conformanceRecorder) fail(err error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if len(cr.steps) == 0 {
+		return // cannot happen, since Start sets the phase first
+	}
+	step := &cr.steps[len(cr.steps)-1]
+	step.Pass = false
+	step.Failures = append(step.Failures, err.Error())
+}
+
+// snapshot returns a copy of the recorded steps.
+func (cr *conformanceRecorder) snapshot() []ConformanceStep {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return append([]ConformanceStep(nil), cr.steps...)
+}
@@ -0,0 +1,88 @@
+package ndt5_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt5-client-go"
+)
+
+// conformancePhases returns the phases of the steps of report.
+func conformancePhases(report *ndt5.ConformanceReport) []ndt5.Phase {
+	var phases []ndt5.Phase
+	for _, step := range report.Steps {
+		phases = append(phases, step.Phase)
+	}
+	return phases
+}
+
+func TestUnitClientConform(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:         "4 2",
+		Duration:        100 * time.Millisecond,
+		DownloadTestMsg: "1000",
+		UploadTestMsg:   "1000",
+	}
+	client := NewFakeServerClient(server)
+	report, err := client.Conform(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ndt5.Phase{
+		ndt5.PhaseConnect, ndt5.PhaseLogin, ndt5.PhaseQueue, ndt5.PhaseLogin,
+		ndt5.PhaseDownload, ndt5.PhaseUpload, ndt5.PhaseResults,
+	}
+	if !report.Pass || report.ServerVersion != "v3.7.0" {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if phases := conformancePhases(report); !reflect.DeepEqual(phases, expected) {
+		t.Fatalf("unexpected phases: %v", phases)
+	}
+}
+
+func TestUnitClientConformFailure(t *testing.T) {
+	client := NewScriptedClient(func(conn net.Conn) {
+		defer conn.Close()
+		login := make([]byte, 4)
+		if _, err := io.ReadFull(conn, login); err != nil {
+			return
+		}
+		conn.Write([]byte("123456 654321"))
+		WriteFrame(conn, 1, "0")
+		WriteFrame(conn, 2, "3.7.0")
+		WriteFrame(conn, 2, "")
+		WriteFrame(conn, 42, "vendor")
+	})
+	report, err := client.Conform(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Pass || len(report.Steps) != 5 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	for _, step := range report.Steps[:4] {
+		if !step.Pass {
+			t.Fatalf("unexpected failure: %+v", step)
+		}
+	}
+	step := report.Steps[4]
+	if step.Phase != ndt5.PhaseResults || step.Pass || len(step.Failures) != 1 ||
+		!strings.Contains(step.Failures[0], ndt5.ErrUnexpectedMessage.Error()) {
+		t.Fatalf("unexpected step: %+v", step)
+	}
+}
+
+func TestUnitClientConformStartFailure(t *testing.T) {
+	client := NewFakeServerClient(&FakeServer{})
+	client.ProtocolFactory.(*ndt5.ProtocolFactory5).ConnectionsFactory =
+		ndt5.NewRawConnectionsFactory(new(AlwaysFailingDialer))
+	if _, err := client.Conform(context.Background()); !errors.Is(err, ErrMocked) {
+		t.Fatalf("expected ErrMocked, got %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package ndt5
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// ConnectedInfo describes the control connection we established. We emit
+// it after receiving the server version, so that it's complete.
+type ConnectedInfo struct {
+	// Transport is "raw", "tls" (raw ndt5 over TLS), "ws", or "wss". It's
+	// empty if the ControlConn does not expose it.
+	Transport string `json:",omitempty"`
+
+	// RemoteAddr is the remote address of the control connection, if known.
+	RemoteAddr string `json:",omitempty"`
+
+	// TLSVersion is the negotiated TLS version (e.g. "TLS 1.3"), if any.
+	TLSVersion string `json:",omitempty"`
+
+	// ServerVersion is the version sent by the server (e.g. "v3.7.0").
+	ServerVersion string
+}
+
+// transporter is implemented by a Protocol or a ControlConn exposing the
+// transport of the control connection (see ConnectedInfo).
+type transporter interface {
+	Transport() (transport, tlsVersion string)
+}
+
+// tlsVersion returns the negotiated TLS version of conn, or an empty
+// string if conn does not use TLS.
+func tlsVersion(conn net.Conn) string {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	return tls.VersionName(tc.ConnectionState().Version)
+}
+
+// emitConnected emits the ConnectedInfo of proto.
+func (c *Client) emitConnected(ctx context.Context, proto Protocol, ch chan<- *Output) {
+	info := &ConnectedInfo{ServerVersion: c.Result.ServerVersion}
+	if conn, ok := proto.(transporter); ok {
+		info.Transport, info.TLSVersion = conn.Transport()
+	}
+	if conn, ok := proto.(remoteAddrer); ok && conn.RemoteAddr() != nil {
+		info.RemoteAddr = conn.RemoteAddr().String()
+	}
+	c.emit(ctx, &Output{Connected: info}, ch)
+}
@@ -0,0 +1,73 @@
+package ndt5
+
+import (
+	"math"
+	"time"
+)
+
+// convergenceInterval is the speed measured between two samples.
+type convergenceInterval struct {
+	start, end time.Duration
+	kbitps     float64
+}
+
+// convergenceDetector detects when the speed measured between consecutive
+// samples has stabilized, i.e., when their coefficient of variation (the
+// standard deviation divided by the mean) stays below threshold over the
+// last window. A nil *convergenceDetector is valid and never converges.
+type convergenceDetector struct {
+	threshold float64
+	window    time.Duration
+	last      Speed
+	intervals []convergenceInterval
+}
+
+// minConvergenceIntervals is the minimum number of intervals we need
+// to compute a meaningful coefficient of variation.
+const minConvergenceIntervals = 3
+
+// newConvergenceDetector returns a new convergenceDetector, or nil when
+// threshold or window is not positive, which disables the detection.
+func newConvergenceDetector(threshold float64, window time.Duration) *convergenceDetector {
+	if threshold <= 0 || window <= 0 {
+		return nil
+	}
+	return &convergenceDetector{threshold: threshold, window: window}
+}
+
+// add adds a sample and returns the mean speed in kbit/s over the window
+// and true if the speed has converged.
+func (cd *convergenceDetector) add(s Speed) (float64, bool) {
+	if cd == nil || s.Elapsed <= cd.last.Elapsed {
+		return 0, false
+	}
+	elapsed := s.Elapsed - cd.last.Elapsed
+	cd.intervals = append(cd.intervals, convergenceInterval{
+		start:  cd.last.Elapsed,
+		end:    s.Elapsed,
+		kbitps: 8 * float64(s.Count-cd.last.Count) / 1000 / elapsed.Seconds(),
+	})
+	cd.last = s
+	// Only keep the intervals needed to cover the window.
+	windowStart := s.Elapsed - cd.window
+	for len(cd.intervals) > 1 && cd.intervals[1].start <= windowStart {
+		cd.intervals = cd.intervals[1:]
+	}
+	if cd.intervals[0].start > windowStart || len(cd.intervals) < minConvergenceIntervals {
+		return 0, false
+	}
+	var sum float64
+	for _, interval := range cd.intervals {
+		sum += interval.kbitps
+	}
+	mean := sum / float64(len(cd.intervals))
+	if mean <= 0 {
+		return 0, false
+	}
+	var squares float64
+	for _, interval := range cd.intervals {
+		squares += (interval.kbitps - mean) * (interval.kbitps - mean)
+	}
+	stddev := math.Sqrt(squares / float64(len(cd.intervals)))
+	return mean, stddev/mean < cd.threshold
+}
@@ -0,0 +1,77 @@
+package ndt5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrControlConnUsed indicates that the control conn passed to
+// NewCustomConnectionsFactoryWithConn has already been used.
+var ErrControlConnUsed = errors.New("the control conn has already been used")
+
+// CustomConnectionsFactory is a ConnectionsFactory speaking the raw ndt5
+// protocol over the conns returned by caller-provided funcs, which may come
+// from transports we don't support natively, such as an in-memory network
+// used for simulations.
+type CustomConnectionsFactory struct {
+	// DialControl returns the control conn for address, which includes
+	// port 3001 unless the FQDN already specified another port.
+	DialControl func(ctx context.Context, address string) (net.Conn, error)
+
+	// DialMeasurement returns a measurement conn for address, which is
+	// composed of the host of the FQDN and the port indicated by the server.
+	DialMeasurement func(ctx context.Context, address string) (net.Conn, error)
+}
+
+// NewCustomConnectionsFactory creates a CustomConnectionsFactory calling
+// dialControl and dialMeasurement to get the control and measurement conns.
+func NewCustomConnectionsFactory(
+	dialControl, dialMeasurement func(ctx context.Context, address string) (net.Conn, error),
+) *CustomConnectionsFactory {
+	return &CustomConnectionsFactory{
+		DialControl:     dialControl,
+		DialMeasurement: dialMeasurement,
+	}
+}
+
+// NewCustomConnectionsFactoryWithConn is like NewCustomConnectionsFactory
+// but uses the pre-established control conn, which can only be used once.
+func NewCustomConnectionsFactoryWithConn(control net.Conn,
+	dialMeasurement func(ctx context.Context, address string) (net.Conn, error)) *CustomConnectionsFactory {
+	var once sync.Once
+	return NewCustomConnectionsFactory(
+		func(ctx context.Context, address string) (net.Conn, error) {
+			conn := net.Conn(nil)
+			once.Do(func() {
+				conn = control
+			})
+			if conn == nil {
+				return nil, ErrControlConnUsed
+			}
+			return conn, nil
+		},
+		dialMeasurement,
+	)
+}
+
+// DialControlConn implements ConnectionsFactory.DialControlConn
+func (cf *CustomConnectionsFactory) DialControlConn(
+	ctx context.Context, address, userAgent string) (ControlConn, error) {
+	conn, err := cf.DialControl(ctx, withDefaultPort(address, "3001"))
+	if err != nil {
+		return nil, err
+	}
+	return NewRawControlConn(conn), nil
+}
+
+// DialMeasurementConn implements ConnectionsFactory.DialMeasurementConn.
+func (cf *CustomConnectionsFactory) DialMeasurementConn(
+	ctx context.Context, address, userAgent string) (MeasurementConn, error) {
+	conn, err := cf.DialMeasurement(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewRawMeasurementConn(conn), nil
+}
@@ -0,0 +1,51 @@
+package ndt5
+
+import (
+	"sync"
+	"time"
+)
+
+// TimestampedOutput is an Output along with the time when it was emitted.
+type TimestampedOutput struct {
+	Time   time.Time
+	Output *Output
+}
+
+// eventRecorder records the emitted events. It's safe to read the events
+// while the test goroutine is recording them.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []TimestampedOutput
+}
+
+// reset discards the recorded events.
+func (er *eventRecorder) reset() {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	er.events = nil
+}
+
+// record records msg as emitted now.
+func (er *eventRecorder) record(msg *Output) {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	er.events = append(er.events, TimestampedOutput{Time: time.Now(), Output: msg})
+}
+
+// snapshot returns a copy of the recorded events.
+func (er *eventRecorder) snapshot() []TimestampedOutput {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	if er.events == nil {
+		return nil
+	}
+	return append([]TimestampedOutput(nil), er.events...)
+}
+
+// Events returns the events emitted by the most recent test started by
+// Start, along with the time when they were emitted, if c.RecordEvents is
+// true. It's safe to call this method while the test is running. Events
+// emitted by a FrameReadWriteObserver are not recorded.
+func (c *Client) Events() []TimestampedOutput {
+	return c.events.snapshot()
+}
@@ -3,6 +3,7 @@ package ndt5_test
 import (
 	"context"
 	"log"
+	"net"
 	"time"
 
 	"github.com/m-lab/ndt5-client-go"
@@ -21,3 +22,19 @@ func Example() {
 		log.Printf("%+v", ev)
 	}
 }
+
+// This shows how to run a ndt5 test using a custom transport.
+func ExampleConnectionsFactory() {
+	protocolFactory := ndt5.NewProtocolFactory5()
+	dial := func(ctx context.Context, address string) (net.Conn, error) {
+		return new(net.Dialer).DialContext(ctx, "tcp", address)
+	}
+	protocolFactory.ConnectionsFactory = ndt5.NewCustomConnectionsFactory(dial, dial)
+	client := ndt5.NewClient("ndt5-client-go-example", "0.1.0", "https://locate.measurementlab.net")
+	client.ProtocolFactory = protocolFactory
+	results, err := client.RunN(context.Background(), 1)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%+v", results[0])
+}
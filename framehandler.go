@@ -0,0 +1,52 @@
+package ndt5
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrReservedMessageType indicates that we cannot register a FrameHandler
+// for a message type that the core ndt5 protocol already uses.
+var ErrReservedMessageType = errors.New("the message type is reserved")
+
+// FrameHandler handles a frame whose type the core ndt5 protocol does not
+// use, e.g., an experimental or vendor-specific message. If it fails, the
+// subtest (or the test, when receiving the results) fails with its error.
+type FrameHandler func(frame *Frame) error
+
+// RegisterFrameHandler registers the handler for frames of the given type,
+// replacing the previous one, if any. When we receive such a frame while
+// reading the TestMsg messages at the end of the download, or the results
+// at the end of the test, we pass it to the handler and keep reading,
+// instead of failing with ErrUnexpectedMessage. The handler is called by
+// the goroutine running the test. It fails with ErrReservedMessageType if
+// mtype is used by the core protocol.
+func (c *Client) RegisterFrameHandler(mtype uint8, handler FrameHandler) error {
+	if mtype <= msgExtendedLogin {
+		return fmt.Errorf("%w: %d", ErrReservedMessageType, mtype)
+	}
+	if c.frameHandlers == nil {
+		c.frameHandlers = make(map[uint8]FrameHandler)
+	}
+	c.frameHandlers[mtype] = handler
+	return nil
+}
+
+// handleFrame passes the frame of the UnexpectedFrameError wrapped by err,
+// if any, to the registered FrameHandler, if any. It returns nil if the
+// handler succeeded, the error of the handler if it failed, and err if
+// there is no frame or no handler.
+func (c *Client) handleFrame(err error) error {
+	var ufe *UnexpectedFrameError
+	if !errors.As(err, &ufe) {
+		return err
+	}
+	handler, found := c.frameHandlers[ufe.Frame.Type]
+	if !found {
+		return err
+	}
+	if err := handler(ufe.Frame); err != nil {
+		return fmt.Errorf("frame handler for message type %d failed: %w", ufe.Frame.Type, err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package ndt5_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/m-lab/ndt5-client-go"
+)
+
+func TestUnitClientRegisterFrameHandler(t *testing.T) {
+	handler := func(conn net.Conn) {
+		defer conn.Close()
+		login := make([]byte, 4)
+		if _, err := io.ReadFull(conn, login); err != nil {
+			return
+		}
+		conn.Write([]byte("123456 654321"))
+		WriteFrame(conn, 1, "0")
+		WriteFrame(conn, 2, "v3.7.0")
+		WriteFrame(conn, 2, "")
+		WriteFrame(conn, 42, "vendor")
+		WriteFrame(conn, 8, "results")
+		WriteFrame(conn, 9, "")
+	}
+
+	client := NewScriptedClient(handler)
+	if _, err := client.RunN(context.Background(), 1); !errors.Is(err, ndt5.ErrUnexpectedMessage) {
+		t.Fatalf("expected ErrUnexpectedMessage, got %v", err)
+	}
+
+	client = NewScriptedClient(handler)
+	var frames []string
+	err := client.RegisterFrameHandler(42, func(frame *ndt5.Frame) error {
+		frames = append(frames, string(frame.Message))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.RunN(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 || frames[0] != "vendor" {
+		t.Fatalf("unexpected frames: %v", frames)
+	}
+
+	client.RegisterFrameHandler(42, func(frame *ndt5.Frame) error {
+		return ErrMocked
+	})
+	if _, err := client.RunN(context.Background(), 1); !errors.Is(err, ErrMocked) {
+		t.Fatalf("expected ErrMocked, got %v", err)
+	}
+
+	err = client.RegisterFrameHandler(8, func(frame *ndt5.Frame) error { return nil })
+	if !errors.Is(err, ndt5.ErrReservedMessageType) {
+		t.Fatalf("expected ErrReservedMessageType, got %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package ndt5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+)
+
+// ErrServerTooFar is the warning emitted when the server is farther from
+// the client than Client.MaxServerDistance.
+var ErrServerTooFar = errors.New("the server is implausibly far from the client")
+
+// GeoLocation is a location on the Earth.
+type GeoLocation struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// earthRadius is the mean radius of the Earth in km.
+const earthRadius = 6371.0
+
+// DistanceTo returns the great-circle distance to other in km.
+func (l GeoLocation) DistanceTo(other GeoLocation) float64 {
+	lat1, lat2 := l.Latitude*math.Pi/180, other.Latitude*math.Pi/180
+	dlat := lat2 - lat1
+	dlon := (other.Longitude - l.Longitude) * math.Pi / 180
+	a := math.Pow(math.Sin(dlat/2), 2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dlon/2), 2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// mlabMetroRegexp matches the metro of a M-Lab server FQDN, i.e., the
+// airport code in the site name, e.g., "lga" in "mlab1-lga05".
+var mlabMetroRegexp = regexp.MustCompile(`mlab\d+[.-]([a-z]{3})\d+`)
+
+// mlabMetros contains the approximate location of M-Lab metros, i.e.,
+// the location of the airports after which they're named.
+var mlabMetros = map[string]GeoLocation{
+	"acc": {5.61, -0.17},
+	"akl": {-37.01, 174.79},
+	"ams": {52.31, 4.76},
+	"arn": {59.65, 17.92},
+	"ath": {37.94, 23.94},
+	"atl": {33.64, -84.43},
+	"beg": {44.82, 20.31},
+	"bkk": {13.69, 100.75},
+	"bne": {-27.38, 153.12},
+	"bog": {4.70, -74.15},
+	"bom": {19.09, 72.87},
+	"bru": {50.90, 4.48},
+	"bud": {47.44, 19.26},
+	"cdg": {49.01, 2.55},
+	"chs": {32.90, -80.04},
+	"cmn": {33.37, -7.59},
+	"cph": {55.62, 12.66},
+	"del": {28.56, 77.10},
+	"den": {39.86, -104.67},
+	"dfw": {32.90, -97.04},
+	"dub": {53.42, -6.27},
+	"eze": {-34.82, -58.54},
+	"fco": {41.80, 12.25},
+	"fra": {50.03, 8.56},
+	"gru": {-23.44, -46.47},
+	"ham": {53.63, 9.99},
+	"hel": {60.32, 24.96},
+	"hkg": {22.31, 113.91},
+	"hnd": {35.55, 139.78},
+	"iad": {38.95, -77.46},
+	"jnb": {-26.14, 28.25},
+	"lax": {33.94, -118.41},
+	"lga": {40.77, -73.87},
+	"lhr": {51.47, -0.45},
+	"lim": {-12.02, -77.11},
+	"lis": {38.77, -9.13},
+	"los": {6.58, 3.32},
+	"mad": {40.47, -3.56},
+	"mel": {-37.67, 144.84},
+	"mia": {25.80, -80.29},
+	"mil": {45.63, 8.72},
+	"mnl": {14.51, 121.02},
+	"muc": {48.35, 11.79},
+	"nbo": {-1.32, 36.93},
+	"nrt": {35.77, 140.39},
+	"ord": {41.98, -87.90},
+	"osl": {60.19, 11.10},
+	"per": {-31.94, 115.97},
+	"prg": {50.10, 14.26},
+	"scl": {-33.39, -70.79},
+	"sea": {47.45, -122.31},
+	"sin": {1.36, 103.99},
+	"sjc": {37.36, -121.93},
+	"slc": {40.79, -111.98},
+	"sof": {42.70, 23.41},
+	"syd": {-33.95, 151.18},
+	"tpe": {25.08, 121.23},
+	"trn": {45.20, 7.65},
+	"tun": {36.85, 10.23},
+	"vie": {48.11, 16.57},
+	"waw": {52.17, 20.97},
+	"yul": {45.47, -73.74},
+	"yvr": {49.19, -123.18},
+	"yyz": {43.68, -79.63},
+	"zrh": {47.46, 8.55},
+}
+
+// ServerLocation returns the approximate location of the M-Lab server with
+// the given FQDN (e.g. "ndt-mlab1-lga05.mlab-oti.measurement-lab.org"),
+// based on its metro, or false if we don't know it.
+func ServerLocation(fqdn string) (GeoLocation, bool) {
+	m := mlabMetroRegexp.FindStringSubmatch(fqdn)
+	if m == nil {
+		return GeoLocation{}, false
+	}
+	location, ok := mlabMetros[m[1]]
+	return location, ok
+}
+
+// checkServerDistance saves the distance between c.ClientLocation and the
+// server, if we know both, and emits a warning if it's farther than
+// c.MaxServerDistance.
+func (c *Client) checkServerDistance(ctx context.Context, ch chan<- *Output) {
+	if c.ClientLocation == nil {
+		return
+	}
+	server, ok := ServerLocation(c.FQDN)
+	if !ok {
+		return
+	}
+	c.Result.ServerDistance = c.ClientLocation.DistanceTo(server)
+	if c.MaxServerDistance > 0 && c.Result.ServerDistance > c.MaxServerDistance {
+		c.emitWarning(ctx, fmt.Errorf("%w: %s is about %.0f km away",
+			ErrServerTooFar, c.FQDN, c.Result.ServerDistance), ch)
+	}
+}
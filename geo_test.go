@@ -0,0 +1,64 @@
+package ndt5_test
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/m-lab/ndt5-client-go"
+)
+
+func TestUnitServerLocation(t *testing.T) {
+	for _, fqdn := range []string{
+		"ndt-mlab1-lga05.mlab-oti.measurement-lab.org",
+		"ndt-iupui-mlab2-lga03.mlab-oti.measurement-lab.org:3010",
+		"ndt.iupui.mlab3.lga04.measurement-lab.org",
+	} {
+		if location, ok := ndt5.ServerLocation(fqdn); !ok || math.Round(location.Latitude) != 41 {
+			t.Errorf("%s: unexpected location: %+v %v", fqdn, location, ok)
+		}
+	}
+	for _, fqdn := range []string{"127.0.0.1", "ndt-mlab1-xyz01.mlab-oti.measurement-lab.org"} {
+		if _, ok := ndt5.ServerLocation(fqdn); ok {
+			t.Errorf("%s: expected an unknown location", fqdn)
+		}
+	}
+}
+
+func TestUnitGeoLocationDistanceTo(t *testing.T) {
+	lga, _ := ndt5.ServerLocation("mlab1-lga01")
+	lhr, _ := ndt5.ServerLocation("mlab1-lhr01")
+	// New York to London is about 5500 km.
+	if distance := lga.DistanceTo(lhr); distance < 5400 || distance > 5600 {
+		t.Fatalf("unexpected distance: %f", distance)
+	}
+	if distance := lga.DistanceTo(lga); distance != 0 {
+		t.Fatalf("unexpected distance: %f", distance)
+	}
+}
+
+func TestUnitClientServerDistance(t *testing.T) {
+	for _, maxDistance := range []float64{0, 1000, 10000} {
+		client := NewScriptedClient(ServeNoTests)
+		client.FQDN = "ndt-mlab1-lhr01.mlab-oti.measurement-lab.org"
+		client.ClientLocation = &ndt5.GeoLocation{Latitude: 40.7, Longitude: -74}
+		client.MaxServerDistance = maxDistance
+		ch, err := client.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var warned bool
+		for ev := range ch {
+			if ev.WarningMessage != nil && errors.Is(ev.WarningMessage.Error, ndt5.ErrServerTooFar) {
+				warned = true
+			}
+		}
+		if warned != (maxDistance == 1000) {
+			t.Fatalf("%f: unexpected warned: %v", maxDistance, warned)
+		}
+		if client.Result.ServerDistance < 5400 || client.Result.ServerDistance > 5600 {
+			t.Fatalf("unexpected distance: %f", client.Result.ServerDistance)
+		}
+	}
+}
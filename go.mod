@@ -1,11 +1,13 @@
 module github.com/m-lab/ndt5-client-go
 
-go 1.20
+go 1.21
 
 require (
 	github.com/google/martian/v3 v3.1.0
 	github.com/gorilla/websocket v1.4.2
 	github.com/m-lab/go v0.1.43
+	golang.org/x/sys v0.15.0
+	gopkg.in/yaml.v2 v2.2.8
 )
 
 require github.com/araddon/dateparse v0.0.0-20200409225146-d820a6159ab1 // indirect
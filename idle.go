@@ -0,0 +1,98 @@
+package ndt5
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrIdleTimeout indicates that we aborted the test because nothing
+// happened for longer than Client.IdleTimeout.
+var ErrIdleTimeout = errors.New("the control session has been idle for too long")
+
+// activityNotifier is implemented by a Protocol able to call a hook each
+// time it reads or writes a control message.
+type activityNotifier interface {
+	SetActivityHook(hook func())
+}
+
+// idleWatchdog closes the Protocol it watches when it's not reset for
+// longer than its timeout. A nil *idleWatchdog is valid and does nothing.
+type idleWatchdog struct {
+	mu      sync.Mutex
+	fired   bool
+	proto   Protocol
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+// newIdleWatchdog creates a new idleWatchdog. Use watch to start it.
+func newIdleWatchdog(timeout time.Duration) *idleWatchdog {
+	w := &idleWatchdog{timeout: timeout}
+	w.timer = time.AfterFunc(timeout, w.fire)
+	w.timer.Stop()
+	return w
+}
+
+// watch starts watching proto, which replaces the Protocol we were
+// watching, if any. If proto implements activityNotifier, reading or
+// writing control messages resets the watchdog.
+func (w *idleWatchdog) watch(proto Protocol) {
+	if w == nil {
+		return
+	}
+	if notifier, ok := proto.(activityNotifier); ok {
+		notifier.SetActivityHook(w.reset)
+	}
+	w.mu.Lock()
+	w.fired = false
+	w.proto = proto
+	w.mu.Unlock()
+	w.reset()
+}
+
+// reset postpones firing by the timeout, unless we already fired.
+func (w *idleWatchdog) reset() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.fired {
+		w.timer.Reset(w.timeout)
+	}
+}
+
+// fire closes the watched Protocol, which unblocks any pending I/O.
+func (w *idleWatchdog) fire() {
+	w.mu.Lock()
+	w.fired = true
+	proto := w.proto
+	w.mu.Unlock()
+	if proto != nil {
+		proto.Close()
+	}
+}
+
+// stop stops the watchdog.
+func (w *idleWatchdog) stop() {
+	if w != nil {
+		w.timer.Stop()
+	}
+}
+
+// wrap wraps err with ErrIdleTimeout if the watchdog fired, since the
+// error is then most likely caused by us closing the Protocol.
+func (w *idleWatchdog) wrap(err error) error {
+	if w == nil {
+		return err
+	}
+	w.mu.Lock()
+	fired := w.fired
+	w.mu.Unlock()
+	if !fired || errors.Is(err, ErrIdleTimeout) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrIdleTimeout, err)
+}
@@ -0,0 +1,39 @@
+package ndt5
+
+import "context"
+
+// Limiter limits the number of tests running concurrently, e.g., in a
+// service starting tests on demand, where too many concurrent tests would
+// saturate the host's uplink and produce garbage results. You may share a
+// Limiter among several clients. See Client.Limiter.
+type Limiter interface {
+	// Acquire blocks until a test can run or the context is done, in
+	// which case it returns the context's error.
+	Acquire(ctx context.Context) error
+
+	// Release signals that a test previously allowed by Acquire is over.
+	Release()
+}
+
+// semaphoreLimiter is a Limiter implemented using a buffered channel.
+type semaphoreLimiter chan struct{}
+
+// NewLimiter returns a Limiter allowing up to n concurrent tests.
+func NewLimiter(n int) Limiter {
+	return make(semaphoreLimiter, n)
+}
+
+// Acquire implements Limiter.Acquire.
+func (sl semaphoreLimiter) Acquire(ctx context.Context) error {
+	select {
+	case sl <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release implements Limiter.Release.
+func (sl semaphoreLimiter) Release() {
+	<-sl
+}
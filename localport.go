@@ -0,0 +1,90 @@
+package ndt5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"syscall"
+)
+
+// ErrInvalidPortRange indicates that a PortRange is not valid.
+var ErrInvalidPortRange = errors.New("invalid port range")
+
+// ErrLocalPortNotSupported indicates that we cannot bind the measurement
+// connections to a LocalPortRange because the dialer of the connections
+// factory is not a *net.Dialer (e.g. when traffic shaping is enabled).
+var ErrLocalPortNotSupported = errors.New("the dialer does not support binding a local port")
+
+// ErrLocalPortRangeExhausted indicates that all the ports of a PortRange
+// are in use.
+var ErrLocalPortRangeExhausted = errors.New("all the ports in the range are in use")
+
+// PortRange is an inclusive range of ports. The zero value is the empty
+// range, which means that the system chooses the port.
+type PortRange struct {
+	Min, Max int
+}
+
+// IsZero tells whether r is the zero PortRange.
+func (r PortRange) IsZero() bool {
+	return r == PortRange{}
+}
+
+func (r PortRange) validate() error {
+	if r.Min < 1 || r.Max > 65535 || r.Min > r.Max {
+		return fmt.Errorf("%w: %d-%d", ErrInvalidPortRange, r.Min, r.Max)
+	}
+	return nil
+}
+
+// withLocalPortRange returns a NetDialer binding each connection it dials
+// to a local port in ports, starting from a random port and retrying with
+// the next one when a port is in use. It returns dialer if ports is zero,
+// and fails with ErrLocalPortNotSupported if dialer is not a *net.Dialer.
+func withLocalPortRange(dialer NetDialer, ports PortRange) (NetDialer, error) {
+	if ports.IsZero() {
+		return dialer, nil
+	}
+	if err := ports.validate(); err != nil {
+		return nil, err
+	}
+	nd, ok := dialer.(*net.Dialer)
+	if !ok {
+		return nil, ErrLocalPortNotSupported
+	}
+	return &portRangeDialer{dialer: nd, ports: ports}, nil
+}
+
+// portRangeDialer is the NetDialer returned by withLocalPortRange.
+type portRangeDialer struct {
+	dialer *net.Dialer
+	ports  PortRange
+}
+
+func (d *portRangeDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *portRangeDialer) DialContext(
+	ctx context.Context, network, address string) (net.Conn, error) {
+	// Keep the local IP address of the dialer, if any.
+	var ip net.IP
+	if addr, ok := d.dialer.LocalAddr.(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	size := d.ports.Max - d.ports.Min + 1
+	offset := rand.Intn(size)
+	for i := 0; i < size; i++ {
+		port := d.ports.Min + (offset+i)%size
+		copied := *d.dialer
+		copied.LocalAddr = &net.TCPAddr{IP: ip, Port: port}
+		conn, err := copied.DialContext(ctx, network, address)
+		if errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL) {
+			continue
+		}
+		return conn, err
+	}
+	return nil, fmt.Errorf("%w: %d-%d", ErrLocalPortRangeExhausted, d.ports.Min, d.ports.Max)
+}
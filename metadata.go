@@ -0,0 +1,63 @@
+package ndt5
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+)
+
+// These are the keys of the metadata describing the client, which we send
+// to the server using the META test and store in TestResult.Metadata.
+const (
+	MetadataKeyOSName         = "client.os.name"
+	MetadataKeyArch           = "client.arch"
+	MetadataKeyGoVersion      = "client.go.version"
+	MetadataKeyLibraryName    = "client.library.name"
+	MetadataKeyLibraryVersion = "client.library.version"
+	MetadataKeyApplication    = "client.application"
+)
+
+// metadata returns the metadata describing the client.
+func (c *Client) metadata() map[string]string {
+	return map[string]string{
+		MetadataKeyOSName:         runtime.GOOS,
+		MetadataKeyArch:           runtime.GOARCH,
+		MetadataKeyGoVersion:      runtime.Version(),
+		MetadataKeyLibraryName:    libraryName,
+		MetadataKeyLibraryVersion: libraryVersion,
+		MetadataKeyApplication:    c.ClientName + "/" + c.ClientVersion,
+	}
+}
+
+// runMeta runs the META test, where we send the metadata to the server,
+// one "key:value" TestMsg message for each entry, followed by an empty
+// TestMsg message.
+func (c *Client) runMeta(ctx context.Context, proto Protocol, ch chan<- *Output) error {
+	if _, err := proto.ExpectTestPrepare(); err != nil {
+		return fmt.Errorf("cannot get TestPrepare message: %w", err)
+	}
+	if err := proto.ExpectTestStart(); err != nil {
+		return fmt.Errorf("cannot get TestStart message: %w", err)
+	}
+	keys := make([]string, 0, len(c.Result.Metadata))
+	for key := range c.Result.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		entry := key + ":" + c.Result.Metadata[key]
+		if err := proto.SendTestMsg([]byte(entry)); err != nil {
+			return fmt.Errorf("cannot send metadata: %w", err)
+		}
+		c.emitProgress(ctx, fmt.Sprintf("sent metadata: %s", entry), ch)
+	}
+	if err := proto.SendTestMsg(nil); err != nil {
+		return fmt.Errorf("cannot send the end of the metadata: %w", err)
+	}
+	if err := proto.ExpectTestFinalize(); err != nil {
+		return fmt.Errorf("cannot get TestFinalize message: %w", err)
+	}
+	c.emitProgress(ctx, "test terminated", ch)
+	return nil
+}
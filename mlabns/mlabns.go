@@ -40,6 +40,10 @@ type Client struct {
 	// Tool is the mandatory tool to use. This is initialized by NewClient.
 	Tool string
 
+	// Service is the locate v2 service to use in QueryV2. This is
+	// initialized by NewClient to "ndt/ndt5", but you may override it.
+	Service string
+
 	// UserAgent is the mandatory user agent to be used. Also this
 	// field is initialized by NewClient.
 	UserAgent string
@@ -60,6 +64,7 @@ func NewClient(tool, userAgent string) *Client {
 		HTTPClient:   http.DefaultClient,
 		Timeout:      DefaultTimeout,
 		RequestMaker: http.NewRequest,
+		Service:      "ndt/ndt5",
 		Tool:         tool,
 		UserAgent:    userAgent,
 	}
@@ -71,6 +76,39 @@ type serverEntry struct {
 	FQDN string `json:"fqdn"`
 }
 
+// Target is a server returned by the locate v2 API.
+type Target struct {
+	// Machine is the name of the server's machine.
+	Machine string `json:"machine"`
+
+	// FQDN is the FQDN of the server.
+	FQDN string `json:"hostname"`
+
+	// URLs maps each access URL template (e.g. "wss:///ndt_protocol")
+	// to the corresponding URL, which includes the access token.
+	URLs map[string]string `json:"urls"`
+}
+
+// AccessToken returns the access token embedded in the access URLs,
+// or an empty string if there is no access token.
+func (t *Target) AccessToken() string {
+	for _, value := range t.URLs {
+		URL, err := url.Parse(value)
+		if err != nil {
+			continue
+		}
+		if token := URL.Query().Get("access_token"); token != "" {
+			return token
+		}
+	}
+	return ""
+}
+
+// v2Response is the response of the locate v2 API.
+type v2Response struct {
+	Results []Target `json:"results"`
+}
+
 // ErrNoAvailableServers is returned when there are no available servers. A
 // background client should treat this error specially as described in the
 // specification of the ndt7 protocol.
@@ -122,3 +160,26 @@ func (c *Client) Query(ctx context.Context) (string, error) {
 	}
 	return server.FQDN, nil
 }
+
+// QueryV2 uses the locate v2 API to return a nearby mlab server, along
+// with its access URLs. Returns an error on failure.
+func (c *Client) QueryV2(ctx context.Context) (*Target, error) {
+	URL, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	URL.Path = "/v2/nearest/" + c.Service
+	data, err := c.doGET(ctx, URL.String())
+	if err != nil {
+		return nil, err
+	}
+	var response v2Response
+	err = json.Unmarshal(data, &response)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Results) < 1 {
+		return nil, ErrNoAvailableServers
+	}
+	return &response.Results[0], nil
+}
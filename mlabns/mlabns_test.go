@@ -163,3 +163,54 @@ func TestIntegration(t *testing.T) {
 		t.Fatal("unexpected empty fqdn")
 	}
 }
+
+func TestQueryV2CommonCase(t *testing.T) {
+	const (
+		expectedFQDN  = "ndt-mlab1-nai01.mlab-oti.measurement-lab.org"
+		expectedToken = "xyz"
+	)
+	client := NewClient(toolName, userAgent)
+	var requestURL string
+	client.RequestMaker = func(
+		method, URL string, body io.Reader) (*http.Request, error,
+	) {
+		requestURL = URL
+		return http.NewRequest(method, URL, body)
+	}
+	client.HTTPClient = newHTTPClient(200, []byte(fmt.Sprintf(`{"results": [{
+		"machine": "mlab1-nai01.mlab-oti.measurement-lab.org",
+		"hostname": "%s",
+		"urls": {"wss:///ndt_protocol": "wss://%s:3010/ndt_protocol?access_token=%s"}
+	}]}`, expectedFQDN, expectedFQDN, expectedToken)), nil)
+	target, err := client.QueryV2(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requestURL != "https://locate.measurementlab.net/v2/nearest/ndt/ndt5" {
+		t.Fatalf("unexpected request URL: %s", requestURL)
+	}
+	if target.FQDN != expectedFQDN {
+		t.Fatal("Not the FQDN we were expecting")
+	}
+	if target.AccessToken() != expectedToken {
+		t.Fatal("Not the access token we were expecting")
+	}
+}
+
+func TestQueryV2NoResults(t *testing.T) {
+	client := NewClient(toolName, userAgent)
+	client.HTTPClient = newHTTPClient(200, []byte(`{"results": []}`), nil)
+	_, err := client.QueryV2(context.Background())
+	if err != ErrNoAvailableServers {
+		t.Fatal("Not the error we were expecting")
+	}
+}
+
+func TestQueryV2JSONParseError(t *testing.T) {
+	client := NewClient(toolName, userAgent)
+	client.HTTPClient = newHTTPClient(200, []byte("{"), nil)
+	_, err := client.QueryV2(context.Background())
+	if err == nil {
+		t.Fatal("We expected an error here")
+	}
+}
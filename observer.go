@@ -0,0 +1,92 @@
+package ndt5
+
+import (
+	"net"
+	"time"
+)
+
+// Phase is a phase of the test.
+type Phase string
+
+// These are the phases of the test, in the order in which they usually
+// occur. The login phase occurs twice, before and after the queue phase.
+// The download, upload, and meta phases occur in the order chosen by the
+// server, and only when the server asks us to run them.
+const (
+	PhaseDiscovery = Phase(phaseDiscovery)
+	PhaseConnect   = Phase(phaseConnect)
+	PhaseLogin     = Phase(phaseLogin)
+	PhaseQueue     = Phase(phaseQueue)
+	PhaseDownload  = Phase(phaseDownload)
+	PhaseUpload    = Phase(phaseUpload)
+	PhaseMeta      = Phase(phaseMeta)
+	PhaseResults   = Phase(phaseResults)
+)
+
+// ClientObserver is a typed alternative to consuming the Output channel,
+// e.g., for GUIs, which is notified of the progress of each test started
+// by Start. See Client.Observer.
+//
+// The methods are never called concurrently, but they may be called by
+// different goroutines: OnPhaseChange may be called by the goroutine
+// calling Start, while OnFirstByte and OnSample are called synchronously
+// by the goroutine performing the measurement. Hence, they must not block,
+// or they would slow down the test, and a GUI should pass the events to
+// its own UI thread rather than updating widgets directly.
+type ClientObserver interface {
+	// OnPhaseChange is called when the test enters a new phase.
+	OnPhaseChange(phase Phase)
+
+	// OnConnected is called when the control connection is established,
+	// with the address of the server, if known.
+	OnConnected(addr net.Addr)
+
+	// OnFirstByte is called when we receive the first byte of the download,
+	// with the time elapsed since the download started.
+	OnFirstByte(ttfb time.Duration)
+
+	// OnSample is called with each sample of the download and of the upload,
+	// whose direction is "download" or "upload".
+	OnSample(direction string, s Speed)
+
+	// OnPhaseComplete is called at the end of the download, upload, and
+	// meta phases, with the error that caused the phase to fail, if any.
+	OnPhaseComplete(phase Phase, err error)
+
+	// OnComplete is called with the Result when a test completes,
+	// successfully or not, after ResultProcessor and OnComplete.
+	OnComplete(result TestResult)
+}
+
+// NopClientObserver is a ClientObserver doing nothing, which you can embed
+// to only implement the methods you care about.
+type NopClientObserver struct{}
+
+// OnPhaseChange implements ClientObserver.OnPhaseChange.
+func (NopClientObserver) OnPhaseChange(Phase) {}
+
+// OnConnected implements ClientObserver.OnConnected.
+func (NopClientObserver) OnConnected(net.Addr) {}
+
+// OnFirstByte implements ClientObserver.OnFirstByte.
+func (NopClientObserver) OnFirstByte(time.Duration) {}
+
+// OnSample implements ClientObserver.OnSample.
+func (NopClientObserver) OnSample(string, Speed) {}
+
+// OnPhaseComplete implements ClientObserver.OnPhaseComplete.
+func (NopClientObserver) OnPhaseComplete(Phase, error) {}
+
+// OnComplete implements ClientObserver.OnComplete.
+func (NopClientObserver) OnComplete(TestResult) {}
+
+// setPhase sets the current phase and notifies the Observer, if any.
+func (c *Client) setPhase(phase string) {
+	c.phase = phase
+	if c.conformance != nil {
+		c.conformance.enter(phase)
+	}
+	if c.Observer != nil {
+		c.Observer.OnPhaseChange(Phase(phase))
+	}
+}
@@ -0,0 +1,155 @@
+package ndt5
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// dialMeasurementConns dials the measurement connections to address using
+// dial. That's a single connection, unless we asked for Client.Streams and
+// the server announced several streams, in which case we combine them.
+func (c *Client) dialMeasurementConns(ctx context.Context, proto Protocol, address string,
+	dial func(context.Context, string, string) (MeasurementConn, error)) (MeasurementConn, error) {
+	streams := 1
+	if counter, ok := proto.(streamCounter); ok && c.Streams > 1 {
+		streams = counter.Streams()
+	}
+	userAgent := makeUserAgent(c.ClientName, c.ClientVersion)
+	var conns []MeasurementConn
+	for len(conns) < streams {
+		conn, err := dial(ctx, address, userAgent)
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	if len(conns) == 1 {
+		return conns[0], nil
+	}
+	return newParallelConn(conns), nil
+}
+
+// parallelConn is a MeasurementConn using several parallel streams. Each
+// stream reads or writes in its own goroutine, and ReadDiscard and
+// WritePreparedMessage return the result of the next read or write of any
+// of them. The first stream failing stops the measurement.
+type parallelConn struct {
+	conns     []MeasurementConn
+	results   chan parallelResult
+	done      chan struct{}
+	startOnce sync.Once
+	closeOnce sync.Once
+}
+
+// parallelResult is the result of a read or write of a stream.
+type parallelResult struct {
+	num int64
+	err error
+}
+
+func newParallelConn(conns []MeasurementConn) *parallelConn {
+	return &parallelConn{
+		conns:   conns,
+		results: make(chan parallelResult),
+		done:    make(chan struct{}),
+	}
+}
+
+// next starts running op on each stream, on the first call, and returns
+// the result of the next op of any stream.
+func (pc *parallelConn) next(op func(MeasurementConn) (int64, error)) (int64, error) {
+	pc.startOnce.Do(func() {
+		for _, conn := range pc.conns {
+			go pc.loop(conn, op)
+		}
+	})
+	select {
+	case result := <-pc.results:
+		return result.num, result.err
+	case <-pc.done:
+		return 0, net.ErrClosed
+	}
+}
+
+// loop runs op on conn until it fails or we are closed.
+func (pc *parallelConn) loop(conn MeasurementConn, op func(MeasurementConn) (int64, error)) {
+	for {
+		num, err := op(conn)
+		select {
+		case pc.results <- parallelResult{num: num, err: err}:
+		case <-pc.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (pc *parallelConn) SetDeadline(deadline time.Time) error {
+	for _, conn := range pc.conns {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pc *parallelConn) AllocReadBuffer(size int) {
+	for _, conn := range pc.conns {
+		conn.AllocReadBuffer(size)
+	}
+}
+
+func (pc *parallelConn) ReadDiscard() (int64, error) {
+	return pc.next(MeasurementConn.ReadDiscard)
+}
+
+func (pc *parallelConn) SetPreparedMessage(b []byte) {
+	for _, conn := range pc.conns {
+		conn.SetPreparedMessage(b)
+	}
+}
+
+func (pc *parallelConn) WritePreparedMessage() (int, error) {
+	num, err := pc.next(func(conn MeasurementConn) (int64, error) {
+		num, err := conn.WritePreparedMessage()
+		return int64(num), err
+	})
+	return int(num), err
+}
+
+// CongestionControl returns the congestion control of the first stream,
+// since all the streams use the same one.
+func (pc *parallelConn) CongestionControl() (string, error) {
+	return pc.conns[0].CongestionControl()
+}
+
+// LocalAddr returns the local address of the first stream.
+func (pc *parallelConn) LocalAddr() net.Addr {
+	return pc.conns[0].LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the first stream.
+func (pc *parallelConn) RemoteAddr() net.Addr {
+	return pc.conns[0].RemoteAddr()
+}
+
+// Close closes all the streams, which stops their goroutines.
+func (pc *parallelConn) Close() error {
+	var err error
+	pc.closeOnce.Do(func() {
+		close(pc.done)
+		for _, conn := range pc.conns {
+			if cerr := conn.Close(); err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,70 @@
+package ndt5
+
+import (
+	"context"
+	"errors"
+)
+
+// PhaseError is the error returned by Start and emitted as ErrorMessage when
+// the test fails. It tells the phase of the test (e.g. "discovery", "queue"
+// or "download") during which Err occurred. Its message is the message of
+// Err, so you may keep printing it as before. See also ErrorCode.
+type PhaseError struct {
+	Phase string
+	Err   error
+}
+
+func (e *PhaseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PhaseError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorPhase returns the phase of the PhaseError wrapped by err, if any,
+// and an empty string otherwise.
+func ErrorPhase(err error) string {
+	var pe *PhaseError
+	if errors.As(err, &pe) {
+		return pe.Phase
+	}
+	return ""
+}
+
+// errorCodes maps the errors we know to their codes. The order matters
+// because an error may wrap several of them, e.g., ErrTestTimeout wraps
+// the error that occurred when the deadline expired.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrTestTimeout, "test_timeout"},
+	{ErrIdleTimeout, "idle_timeout"},
+	{ErrSubtestTimeout, "subtest_timeout"},
+	{ErrDiscoveryFailed, "discovery_failed"},
+	{ErrServerBusy, "server_busy"},
+	{ErrServerFault, "server_fault"},
+	{ErrProtocolMismatch, "protocol_mismatch"},
+	{ErrWSHandshake, "websocket_handshake"},
+	{ErrInvalidKickoff, "invalid_kickoff"},
+	{ErrMeasurementPortUnreachable, "measurement_port_unreachable"},
+	{ErrAbnormalClose, "abnormal_close"},
+	{ErrUnexpectedMessage, "unexpected_message"},
+	{ErrExpectedNonEmptyMessage, "empty_message"},
+	{ErrMessageSize, "message_size"},
+	{ErrControlNotSupported, "control_not_supported"},
+	{context.Canceled, "canceled"},
+}
+
+// ErrorCode returns a stable code (e.g. "server_busy") telling the category
+// of err, so that you can branch on it rather than on the error message. It
+// returns "unknown" for the errors without a specific code.
+func ErrorCode(err error) string {
+	for _, entry := range errorCodes {
+		if errors.Is(err, entry.err) {
+			return entry.code
+		}
+	}
+	return "unknown"
+}
@@ -0,0 +1,60 @@
+package ndt5_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/m-lab/ndt5-client-go"
+)
+
+func TestUnitErrorCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code string
+	}{
+		{ndt5.ErrServerBusy, "server_busy"},
+		{fmt.Errorf("%w during the queue phase: %w", ndt5.ErrTestTimeout, ndt5.ErrServerBusy), "test_timeout"},
+		{&ndt5.PhaseError{Phase: "download", Err: ndt5.ErrAbnormalClose}, "abnormal_close"},
+		{context.Canceled, "canceled"},
+		{ErrMocked, "unknown"},
+	} {
+		if code := ndt5.ErrorCode(tc.err); code != tc.code {
+			t.Fatalf("%s: expected %s, got %s", tc.err, tc.code, code)
+		}
+	}
+}
+
+func TestUnitErrorPhase(t *testing.T) {
+	err := fmt.Errorf("wrapped: %w", &ndt5.PhaseError{Phase: "queue", Err: ErrMocked})
+	if phase := ndt5.ErrorPhase(err); phase != "queue" {
+		t.Fatalf("unexpected phase: %s", phase)
+	}
+	if err.Error() != "wrapped: mocked error" || !errors.Is(err, ErrMocked) {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if phase := ndt5.ErrorPhase(ErrMocked); phase != "" {
+		t.Fatalf("unexpected phase: %s", phase)
+	}
+}
+
+func TestUnitClientStartPhaseError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close() // make sure that nobody is listening
+	factory := ndt5.NewProtocolFactory5()
+	factory.ConnectionsFactory = ndt5.NewRawConnectionsFactory(new(net.Dialer))
+	client := ndt5.NewClient("ndt5-client-go-testing", "0.1.0", "")
+	client.ProtocolFactory = factory
+	client.FQDN = address
+	_, err = client.Start(context.Background())
+	var pe *ndt5.PhaseError
+	if !errors.As(err, &pe) || pe.Phase != "connect" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
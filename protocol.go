@@ -3,10 +3,12 @@ package ndt5
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -25,6 +27,19 @@ type ProtocolFactory5 struct {
 	// ObserverFactory allows you to observe frame events. It's set to its
 	// default value by NewClient; you may override it.
 	ObserverFactory FrameReadWriteObserverFactory
+
+	// ControlRTTInterval is the optional interval at which we probe the
+	// application-layer RTT of the control connection while waiting in
+	// queue. It only works with a ControlConn implementing RTTProber (i.e.
+	// with WebSocket). Zero, the default, means that we don't probe.
+	ControlRTTInterval time.Duration
+
+	// SkipKickoff indicates that the server does not send the kickoff
+	// message, as some newer raw ndt5 servers do, so we should not try to
+	// read it. Otherwise, we would consume the bytes of the first frame and
+	// lose sync with the server. It has no effect with WebSocket, which
+	// never sends a kickoff message.
+	SkipKickoff bool
 }
 
 // NewProtocolFactory5 creates a new ProtocolFactory5 instance
@@ -42,22 +57,74 @@ func (p *ProtocolFactory5) NewProtocol(
 	if err != nil {
 		return nil, err
 	}
+	return p.NewProtocolWithConn(ctx, cc, ch)
+}
+
+// NewProtocolWithConn is like NewProtocol but uses an existing control
+// connection rather than dialing a new one. We still use ConnectionsFactory
+// to dial the measurement connections. The returned Protocol owns cc and
+// closes it when you call its Close method.
+func (p *ProtocolFactory5) NewProtocolWithConn(
+	ctx context.Context, cc ControlConn, ch chan<- *Output) (Protocol, error) {
 	cc.SetFrameReadWriteObserver(p.ObserverFactory.New(ch))
-	if err := cc.SetDeadline(time.Now().Add(45 * time.Second)); err != nil {
+	if err := cc.SetDeadline(clampDeadline(ctx, time.Now().Add(controlDeadline))); err != nil {
 		return nil, fmt.Errorf("cannot set control connection deadline: %w", err)
 	}
-	return &protocol5{cc: cc, connectionsFactory: p.ConnectionsFactory}, nil
+	return &protocol5{
+		cc:                 cc,
+		connectionsFactory: p.ConnectionsFactory,
+		ctx:                ctx,
+		out:                ch,
+		rttInterval:        p.ControlRTTInterval,
+		skipKickoff:        p.SkipKickoff,
+		suite:              testSuite,
+	}, nil
+}
+
+// controlDeadline is the deadline for the control connection.
+const controlDeadline = 45 * time.Second
+
+// clampDeadline returns the earliest between deadline and the deadline of
+// ctx, if any, so that the I/O deadlines respect the overall deadline.
+func clampDeadline(ctx context.Context, deadline time.Time) time.Time {
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		return d
+	}
+	return deadline
 }
 
 type protocol5 struct {
 	cc                 ControlConn
 	connectionsFactory ConnectionsFactory
+	ctx                context.Context
+	out                chan<- *Output
+	rttInterval        time.Duration
+	skipKickoff        bool
+	streams            int
+	suite              uint8
+
+	// activity is called each time we read or write a control frame.
+	activity func()
+
+	// emitHook, if set, emits our events instead of writing them to out.
+	emitHook func(msg *Output)
 }
 
+const testSuite = nettestUpload | nettestDownload | nettestStatus
+
 func (p *protocol5) SendLogin() error {
 	const ndt5VersionCompat = "v3.7.0"
-	flags := nettestUpload | nettestDownload | nettestStatus
-	return p.cc.WriteLogin(ndt5VersionCompat, flags)
+	err := p.cc.WriteLogin(ndt5VersionCompat, p.suite)
+	if err == nil {
+		p.notifyActivity()
+	}
+	return err
+}
+
+// SetTestSuite sets the tests to request when logging in, which by
+// default are the download, the upload, and the status tests.
+func (p *protocol5) SetTestSuite(suite uint8) {
+	p.suite = suite
 }
 
 var (
@@ -72,6 +139,10 @@ var (
 	// ErrServerBusy indicates that the server is busy
 	ErrServerBusy = errors.New("WaitInQueue: server is busy")
 
+	// ErrServerFault indicates that the server terminated the test
+	// while we were waiting in queue for an unknown reason.
+	ErrServerFault = errors.New("WaitInQueue: server fault")
+
 	// ErrUnexpectedMessage indicates we received a message that
 	// we were not expecting at this stage.
 	ErrUnexpectedMessage = errors.New("unexpected message type")
@@ -79,34 +150,215 @@ var (
 	kickoffMessage = []byte("123456 654321")
 )
 
+// ServerBusyError is the error returned by WaitInQueue when the server
+// is busy. It wraps ErrServerBusy, so errors.Is(err, ErrServerBusy) works.
+type ServerBusyError struct {
+	// Code is the queue message sent by the server, which is either 9988
+	// (busy) or 9999 (busy for more than 60 seconds), or -1 if the server
+	// sent a value we could not parse.
+	Code int
+}
+
+// Error implements error.Error.
+func (e *ServerBusyError) Error() string {
+	return fmt.Sprintf("%s (code %d)", ErrServerBusy.Error(), e.Code)
+}
+
+// Unwrap returns ErrServerBusy.
+func (e *ServerBusyError) Unwrap() error {
+	return ErrServerBusy
+}
+
+// UnexpectedFrameError is the error returned by ReceiveTestFinalizeOrTestMsg
+// and ReceiveLogoutOrResults when we receive a frame whose type we do not
+// handle, e.g., a vendor-specific message. It wraps ErrUnexpectedMessage and
+// allows the Client to pass the Frame to a FrameHandler.
+type UnexpectedFrameError struct {
+	// Op is the operation that received the frame.
+	Op string
+
+	// Frame is the frame we received.
+	Frame *Frame
+}
+
+// Error implements error.Error.
+func (e *UnexpectedFrameError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Op, ErrUnexpectedMessage.Error())
+}
+
+// Unwrap returns ErrUnexpectedMessage.
+func (e *UnexpectedFrameError) Unwrap() error {
+	return ErrUnexpectedMessage
+}
+
 func (p *protocol5) ReceiveKickoff() error {
+	if p.skipKickoff {
+		return nil
+	}
 	received := make([]byte, len(kickoffMessage))
 	if err := p.cc.ReadKickoffMessage(received); err != nil {
 		return err
 	}
+	p.notifyActivity()
+	if bytes.HasPrefix(received, httpResponsePrefix) {
+		return fmt.Errorf("ReceiveKickoff: received HTTP response: %w", ErrProtocolMismatch)
+	}
 	if !bytes.Equal(kickoffMessage, received) {
 		return ErrInvalidKickoff
 	}
 	return nil
 }
 
+// These are the special values of a SrvQueue message. Any other
+// positive value is our position in the server's queue.
+const (
+	srvQueueTestStartsNow = 0
+	srvQueueServerFault   = 9977
+	srvQueueServerBusy    = 9988
+	srvQueueHeartbeat     = 9990
+	srvQueueServerBusy60s = 9999
+
+	srvQueueSecondsPerTest = 45
+)
+
+// WaitInQueue waits until the server clears us to run the tests. Like the
+// reference client, we assume that each client ahead of us in the queue
+// takes about 45 seconds and, while waiting for the next queue message,
+// we emit the estimated remaining wait time each second.
 func (p *protocol5) WaitInQueue() error {
-	frame, err := p.cc.ReadFrame()
-	if err != nil {
-		return err
+	if prober, ok := p.cc.(RTTProber); ok && p.rttInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go p.probeRTT(prober, done)
 	}
-	if frame.Type != msgSrvQueue {
-		return fmt.Errorf("WaitInQueue: %w", ErrUnexpectedMessage)
+	var position int
+	for {
+		frame, err := p.readQueueFrame(position)
+		if err != nil {
+			return err
+		}
+		if frame.Type != msgSrvQueue {
+			return fmt.Errorf("WaitInQueue: %w", ErrUnexpectedMessage)
+		}
+		value, err := strconv.Atoi(string(frame.Message))
+		if err != nil || value < 0 {
+			return &ServerBusyError{Code: -1}
+		}
+		switch value {
+		case srvQueueTestStartsNow:
+			if position == 0 {
+				return nil
+			}
+			return p.SetDeadline(time.Now().Add(controlDeadline))
+		case srvQueueServerFault:
+			return ErrServerFault
+		case srvQueueServerBusy, srvQueueServerBusy60s:
+			return &ServerBusyError{Code: value}
+		case srvQueueHeartbeat:
+			err := p.writeMessage(msgWaiting, []byte{p.suite})
+			if err != nil {
+				return err
+			}
+		default:
+			position = value
+		}
 	}
-	if !bytes.Equal(frame.Message, []byte("0")) {
-		// Like libndt, we have chosen not to wait in queue here
-		return ErrServerBusy
+}
+
+// probeRTT sends RTT probes until done is closed.
+func (p *protocol5) probeRTT(prober RTTProber, done <-chan struct{}) {
+	ticker := time.NewTicker(p.rttInterval)
+	defer ticker.Stop()
+	for {
+		if err := prober.SendRTTProbe(); err != nil {
+			return
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ControlRTT returns the RTT of the control connection measured while
+// waiting in queue, or nil if we did not measure it.
+func (p *protocol5) ControlRTT() *RTTStats {
+	prober, ok := p.cc.(RTTProber)
+	if !ok {
+		return nil
+	}
+	return newRTTStats(prober.RTTSamples())
+}
+
+// readQueueFrame reads the next queue message. When we're in queue, it
+// emits the estimated remaining wait time each second while reading.
+func (p *protocol5) readQueueFrame(position int) (*Frame, error) {
+	if position == 0 {
+		return p.readFrame()
+	}
+	wait := time.Duration(position*srvQueueSecondsPerTest) * time.Second
+	deadline := time.Now().Add(wait)
+	if err := p.SetDeadline(deadline.Add(controlDeadline)); err != nil {
+		return nil, err
+	}
+	type result struct {
+		frame *Frame
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		frame, err := p.readFrame()
+		done <- result{frame: frame, err: err}
+	}()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		remaining := time.Until(deadline).Round(time.Second)
+		if remaining < 0 {
+			remaining = 0
+		}
+		if err := p.emitProgress(fmt.Sprintf(
+			"waiting in queue: position %d, about %s remaining",
+			position, remaining)); err != nil {
+			p.cc.SetDeadline(time.Now()) // unblock the reader
+			<-done
+			return nil, err
+		}
+		select {
+		case r := <-done:
+			return r.frame, r.err
+		case <-ticker.C:
+		case <-p.ctx.Done():
+			p.cc.SetDeadline(time.Now()) // unblock the reader
+			<-done
+			return nil, p.ctx.Err()
+		}
+	}
+}
+
+// SetEmitHook sets the func emitting our events, which otherwise we write
+// directly to the channel passed to NewProtocol.
+func (p *protocol5) SetEmitHook(hook func(msg *Output)) {
+	p.emitHook = hook
+}
+
+func (p *protocol5) emitProgress(msg string) error {
+	out := &Output{InfoMessage: &LogMessage{Message: msg}}
+	if p.emitHook != nil {
+		p.emitHook(out)
+		return p.ctx.Err()
+	}
+	select {
+	case p.out <- out:
+		return nil
+	case <-p.ctx.Done():
+		return p.ctx.Err()
 	}
-	return nil
 }
 
 func (p *protocol5) ReceiveVersion() (string, error) {
-	frame, err := p.cc.ReadFrame()
+	frame, err := p.readFrame()
 	if err != nil {
 		return "", err
 	}
@@ -117,7 +369,7 @@ func (p *protocol5) ReceiveVersion() (string, error) {
 }
 
 func (p *protocol5) ReceiveTestIDs() ([]uint8, error) {
-	frame, err := p.cc.ReadFrame()
+	frame, err := p.readFrame()
 	if err != nil {
 		return nil, err
 	}
@@ -139,8 +391,17 @@ func (p *protocol5) ReceiveTestIDs() ([]uint8, error) {
 	return testIDs, nil
 }
 
+// ExpectTestPrepare receives the TestPrepare message and returns the port
+// of the measurement connection.
+//
+// The extended tests of the legacy web100srv server (NDT v3.7, requested
+// with the TEST_S2C_EXT and TEST_C2S_EXT bits of the login when using
+// Client.Streams) may use several parallel streams, in which case the
+// message also contains the test duration, the throughput snapshot
+// parameters, and the number of streams, which Streams returns. The M-Lab
+// ndt-server does not implement them and sends just the port.
 func (p *protocol5) ExpectTestPrepare() (port string, err error) {
-	frame, err := p.cc.ReadFrame()
+	frame, err := p.readFrame()
 	if err != nil {
 		return
 	}
@@ -148,10 +409,25 @@ func (p *protocol5) ExpectTestPrepare() (port string, err error) {
 		err = fmt.Errorf("ExpectTestPrepare: %w", ErrUnexpectedMessage)
 		return
 	}
-	port = string(frame.Message)
+	port, p.streams = string(frame.Message), 1
+	if fields := strings.Fields(port); len(fields) > 1 {
+		port = fields[0]
+		if len(fields) == 5 {
+			if streams, err := strconv.Atoi(fields[4]); err == nil && streams > 1 {
+				p.streams = streams
+			}
+		}
+	}
 	return
 }
 
+// Streams returns the number of parallel streams announced by the last
+// TestPrepare message, which is one unless the server runs an extended
+// test using several streams.
+func (p *protocol5) Streams() int {
+	return p.streams
+}
+
 func (p *protocol5) DialDownloadConn(
 	ctx context.Context, address, userAgent string,
 ) (MeasurementConn, error) {
@@ -165,7 +441,7 @@ func (p *protocol5) DialUploadConn(
 }
 
 func (p *protocol5) ExpectTestStart() error {
-	frame, err := p.cc.ReadFrame()
+	frame, err := p.readFrame()
 	if err != nil {
 		return err
 	}
@@ -175,22 +451,45 @@ func (p *protocol5) ExpectTestStart() error {
 	return nil
 }
 
-func (p *protocol5) ExpectTestMsg() (string, error) {
-	frame, err := p.cc.ReadFrame()
+func (p *protocol5) ExpectTestMsg() (*TestMsg, error) {
+	frame, err := p.readFrame()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if frame.Type != msgTestMsg {
-		return "", fmt.Errorf("ExpectTestMsg: %w", ErrUnexpectedMessage)
+		return nil, fmt.Errorf("ExpectTestMsg: %w", ErrUnexpectedMessage)
 	}
 	if len(frame.Message) == 0 {
-		return "", fmt.Errorf("ExpectTestMsg: %w", ErrExpectedNonEmptyMessage)
+		return nil, fmt.Errorf("ExpectTestMsg: %w", ErrExpectedNonEmptyMessage)
 	}
-	return string(frame.Message), nil
+	return parseTestMsg(frame.Message)
+}
+
+// parseTestMsg parses the body of a TestMsg message. A JSON body is first
+// converted to the legacy plain-text format, which we then parse. We are
+// lenient with the plain-text format, because it used to be opaque.
+func parseTestMsg(body []byte) (*TestMsg, error) {
+	msg := &TestMsg{Message: string(body)}
+	if bytes.HasPrefix(body, []byte("{")) {
+		var wsmsg wsMessage
+		if err := json.Unmarshal(body, &wsmsg); err != nil {
+			return nil, fmt.Errorf("ExpectTestMsg: cannot parse JSON body: %w", err)
+		}
+		msg.Message = wsmsg.legacyValue()
+	}
+	fields := strings.Fields(msg.Message)
+	if len(fields) > 0 {
+		msg.ThroughputValue, _ = strconv.ParseFloat(fields[0], 64)
+	}
+	if len(fields) == 3 {
+		msg.UnsentDataAmount, _ = strconv.ParseInt(fields[1], 10, 64)
+		msg.TotalSentByte, _ = strconv.ParseInt(fields[2], 10, 64)
+	}
+	return msg, nil
 }
 
 func (p *protocol5) ExpectTestFinalize() error {
-	frame, err := p.cc.ReadFrame()
+	frame, err := p.readFrame()
 	if err != nil {
 		return err
 	}
@@ -201,11 +500,14 @@ func (p *protocol5) ExpectTestFinalize() error {
 }
 
 func (p *protocol5) SendTestMsg(data []byte) error {
-	return p.cc.WriteMessage(msgTestMsg, data)
+	if len(data) > maxMessageSize {
+		return fmt.Errorf("SendTestMsg: %w", ErrMessageSize)
+	}
+	return p.writeMessage(msgTestMsg, data)
 }
 
 func (p *protocol5) ReceiveTestFinalizeOrTestMsg() (uint8, []byte, error) {
-	frame, err := p.cc.ReadFrame()
+	frame, err := p.readFrame()
 	if err != nil {
 		return 0, nil, err
 	}
@@ -213,14 +515,14 @@ func (p *protocol5) ReceiveTestFinalizeOrTestMsg() (uint8, []byte, error) {
 		return msgTestFinalize, nil, nil
 	}
 	if frame.Type != msgTestMsg {
-		err = fmt.Errorf("ReceiveLogoutOrTestMsg: %w", ErrUnexpectedMessage)
+		err = &UnexpectedFrameError{Op: "ReceiveLogoutOrTestMsg", Frame: frame}
 		return 0, nil, err
 	}
 	return msgTestMsg, frame.Message, nil
 }
 
 func (p *protocol5) ReceiveLogoutOrResults() (uint8, []byte, error) {
-	frame, err := p.cc.ReadFrame()
+	frame, err := p.readFrame()
 	if err != nil {
 		return 0, nil, err
 	}
@@ -228,12 +530,67 @@ func (p *protocol5) ReceiveLogoutOrResults() (uint8, []byte, error) {
 		return msgLogout, nil, nil
 	}
 	if frame.Type != msgResults {
-		err = fmt.Errorf("ReceiveLogoutOrTestMsg: %w", ErrUnexpectedMessage)
+		err = &UnexpectedFrameError{Op: "ReceiveLogoutOrTestMsg", Frame: frame}
 		return 0, nil, err
 	}
 	return msgResults, frame.Message, nil
 }
 
+// RemoteAddr returns the remote address of the control connection, or nil
+// if the ControlConn does not expose it.
+func (p *protocol5) RemoteAddr() net.Addr {
+	if conn, ok := p.cc.(remoteAddrer); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+// Transport returns the transport of the control connection and the
+// negotiated TLS version, if any, or empty strings if the ControlConn does
+// not expose them.
+func (p *protocol5) Transport() (string, string) {
+	if conn, ok := p.cc.(transporter); ok {
+		return conn.Transport()
+	}
+	return "", ""
+}
+
+// SetActivityHook sets the func called each time we successfully read or
+// write a control message, which may be called from another goroutine.
+func (p *protocol5) SetActivityHook(hook func()) {
+	p.activity = hook
+}
+
+func (p *protocol5) notifyActivity() {
+	if p.activity != nil {
+		p.activity()
+	}
+}
+
+// readFrame is like p.cc.ReadFrame but notifies the activity hook.
+func (p *protocol5) readFrame() (*Frame, error) {
+	frame, err := p.cc.ReadFrame()
+	if err == nil {
+		p.notifyActivity()
+	}
+	return frame, err
+}
+
+// writeMessage is like p.cc.WriteMessage but notifies the activity hook.
+func (p *protocol5) writeMessage(mtype uint8, data []byte) error {
+	err := p.cc.WriteMessage(mtype, data)
+	if err == nil {
+		p.notifyActivity()
+	}
+	return err
+}
+
+// SetDeadline sets the deadline of the control connection, which cannot
+// exceed the deadline of the context used to create the protocol.
+func (p *protocol5) SetDeadline(deadline time.Time) error {
+	return p.cc.SetDeadline(clampDeadline(p.ctx, deadline))
+}
+
 func (p *protocol5) Close() error {
 	return p.cc.Close()
 }
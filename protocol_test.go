@@ -7,6 +7,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/m-lab/ndt5-client-go"
 )
@@ -35,6 +36,18 @@ func TestUnitProtocolReceiveKickoffReadKickoffWrongBytes(t *testing.T) {
 	wg.Wait()
 }
 
+func TestUnitProtocolReceiveKickoffHTTPResponse(t *testing.T) {
+	dialer, proto := NewMockableProtocol(t)
+	go func() {
+		dialer.ServerConn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		dialer.ServerConn.Close()
+	}()
+	err := proto.ReceiveKickoff()
+	if !errors.Is(err, ndt5.ErrProtocolMismatch) {
+		t.Fatal("expected ndt5.ErrProtocolMismatch here")
+	}
+}
+
 func TestUnitProtocolWaitInQueueReadFrameFailure(t *testing.T) {
 	dialer, proto := NewMockableProtocol(t)
 	dialer.ServerConn.Close()
@@ -73,7 +86,108 @@ func TestUnitProtocolWaitInQueueServerBusy(t *testing.T) {
 	if !errors.Is(err, ndt5.ErrServerBusy) {
 		t.Fatal("expected ndt5.ErrServerBusy here")
 	}
+	var busy *ndt5.ServerBusyError
+	if !errors.As(err, &busy) || busy.Code != 9999 {
+		t.Fatal("expected a ServerBusyError with code 9999")
+	}
+	wg.Wait()
+}
+
+func TestUnitProtocolWaitInQueueInvalidValue(t *testing.T) {
+	dialer, proto := NewMockableProtocol(t)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		frame, _ := ndt5.NewFrame(1, []byte("xo"))
+		dialer.ServerConn.Write(frame.Raw)
+		wg.Done()
+	}()
+	err := proto.WaitInQueue()
+	var busy *ndt5.ServerBusyError
+	if !errors.As(err, &busy) || busy.Code != -1 {
+		t.Fatal("expected a ServerBusyError with code -1")
+	}
+	if !errors.Is(err, ndt5.ErrServerBusy) {
+		t.Fatal("expected ndt5.ErrServerBusy here")
+	}
+	wg.Wait()
+}
+
+func TestUnitProtocolWaitInQueueServerFault(t *testing.T) {
+	dialer, proto := NewMockableProtocol(t)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		frame, _ := ndt5.NewFrame(1, []byte("9977"))
+		dialer.ServerConn.Write(frame.Raw)
+		wg.Done()
+	}()
+	err := proto.WaitInQueue()
+	if !errors.Is(err, ndt5.ErrServerFault) {
+		t.Fatal("expected ndt5.ErrServerFault here")
+	}
+	wg.Wait()
+}
+
+func TestUnitProtocolWaitInQueueHeartbeat(t *testing.T) {
+	dialer, proto := NewMockableProtocol(t)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	waiting := make([]byte, 4)
+	go func() {
+		frame, _ := ndt5.NewFrame(1, []byte("9990"))
+		dialer.ServerConn.Write(frame.Raw)
+		io.ReadFull(dialer.ServerConn, waiting)
+		frame, _ = ndt5.NewFrame(1, []byte("0"))
+		dialer.ServerConn.Write(frame.Raw)
+		wg.Done()
+	}()
+	if err := proto.WaitInQueue(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if waiting[0] != 10 {
+		t.Fatal("expected a MSG_WAITING message here")
+	}
+}
+
+func TestUnitProtocolWaitInQueuePosition(t *testing.T) {
+	dialer, proto, out := NewMockableProtocolWithOutput(t, context.Background())
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		frame, _ := ndt5.NewFrame(1, []byte("2"))
+		dialer.ServerConn.Write(frame.Raw)
+		time.Sleep(1500 * time.Millisecond)
+		frame, _ = ndt5.NewFrame(1, []byte("0"))
+		dialer.ServerConn.Write(frame.Raw)
+		wg.Done()
+	}()
+	if err := proto.WaitInQueue(); err != nil {
+		t.Fatal(err)
+	}
 	wg.Wait()
+	if len(out) < 2 {
+		t.Fatal("expected at least two progress messages here")
+	}
+	ev := <-out
+	if ev.InfoMessage.Message != "waiting in queue: position 2, about 1m30s remaining" {
+		t.Fatalf("unexpected progress message: %s", ev.InfoMessage.Message)
+	}
+}
+
+func TestUnitProtocolWaitInQueueContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	dialer, proto, _ := NewMockableProtocolWithOutput(t, ctx)
+	go func() {
+		frame, _ := ndt5.NewFrame(1, []byte("5"))
+		dialer.ServerConn.Write(frame.Raw)
+		cancel()
+	}()
+	err := proto.WaitInQueue()
+	if !errors.Is(err, context.Canceled) {
+		t.Fatal("expected context.Canceled here")
+	}
 }
 
 func TestUnitProtocolReceiveVersionReadFrameFailure(t *testing.T) {
@@ -241,8 +355,8 @@ func TestUnitProtocolExpectTestMsgReadFrameFailure(t *testing.T) {
 	if !errors.Is(err, io.EOF) {
 		t.Fatal("expected io.EOF here")
 	}
-	if msg != "" {
-		t.Fatal("expected empty msg here")
+	if msg != nil {
+		t.Fatal("expected nil msg here")
 	}
 }
 
@@ -259,8 +373,8 @@ func TestUnitProtocolExpectTestMsgWrongMessageType(t *testing.T) {
 	if !errors.Is(err, ndt5.ErrUnexpectedMessage) {
 		t.Fatal("expected ndt5.ErrUnexpectedMessage here")
 	}
-	if msg != "" {
-		t.Fatal("expected empty msg here")
+	if msg != nil {
+		t.Fatal("expected nil msg here")
 	}
 	wg.Wait()
 }
@@ -278,8 +392,8 @@ func TestUnitProtocolExpectTestMsgEmptyMsg(t *testing.T) {
 	if !errors.Is(err, ndt5.ErrExpectedNonEmptyMessage) {
 		t.Fatal("expected ndt5.ErrExpectedNonEmptyMessage here")
 	}
-	if msg != "" {
-		t.Fatal("expected empty msg here")
+	if msg != nil {
+		t.Fatal("expected nil msg here")
 	}
 	wg.Wait()
 }
@@ -359,6 +473,32 @@ func TestUnitProtocolReceiveLogoutOrResultsWrongMessageType(t *testing.T) {
 	wg.Wait()
 }
 
+func TestUnitProtocolSendTestMsgTooLarge(t *testing.T) {
+	_, proto := NewMockableProtocol(t)
+	err := proto.SendTestMsg(make([]byte, 1<<16+1))
+	if !errors.Is(err, ndt5.ErrMessageSize) {
+		t.Fatal("expected ndt5.ErrMessageSize here")
+	}
+}
+
+func TestUnitProtocolSendTestMsgMaxSize(t *testing.T) {
+	dialer, proto := NewMockableProtocol(t)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	var count int64
+	go func() {
+		count, _ = io.CopyN(io.Discard, dialer.ServerConn, 3+65535)
+		wg.Done()
+	}()
+	if err := proto.SendTestMsg(make([]byte, 65535)); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if count != 3+65535 {
+		t.Fatal("expected a single full-size frame here")
+	}
+}
+
 func NewMockableProtocol(t *testing.T) (*PipeDialer, ndt5.Protocol) {
 	dialer := NewPipeDialer()
 	connfactory := ndt5.NewRawConnectionsFactory(dialer)
@@ -372,3 +512,93 @@ func NewMockableProtocol(t *testing.T) (*PipeDialer, ndt5.Protocol) {
 	}
 	return dialer, proto
 }
+
+func NewMockableProtocolWithOutput(
+	t *testing.T, ctx context.Context,
+) (*PipeDialer, ndt5.Protocol, <-chan *ndt5.Output) {
+	dialer := NewPipeDialer()
+	connfactory := ndt5.NewRawConnectionsFactory(dialer)
+	protofactory := ndt5.NewProtocolFactory5()
+	protofactory.ConnectionsFactory = connfactory
+	ch := make(chan *ndt5.Output, 128)
+	proto, err := protofactory.NewProtocol(ctx, "127.0.0.1", UserAgent, ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialer, proto, ch
+}
+
+func TestUnitProtocolExpectTestMsgFormats(t *testing.T) {
+	var tests = []struct {
+		body string
+		want ndt5.TestMsg
+	}{{
+		body: "1234.5",
+		want: ndt5.TestMsg{Message: "1234.5", ThroughputValue: 1234.5},
+	}, {
+		body: "1234.5 17 65536",
+		want: ndt5.TestMsg{
+			Message: "1234.5 17 65536", ThroughputValue: 1234.5,
+			UnsentDataAmount: 17, TotalSentByte: 65536,
+		},
+	}, {
+		body: `{"msg": "1234.5"}`,
+		want: ndt5.TestMsg{Message: "1234.5", ThroughputValue: 1234.5},
+	}, {
+		body: `{"ThroughputValue": "1234.5", "UnsentDataAmount": "17", "TotalSentByte": "65536"}`,
+		want: ndt5.TestMsg{
+			Message: "1234.5 17 65536", ThroughputValue: 1234.5,
+			UnsentDataAmount: 17, TotalSentByte: 65536,
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.body, func(t *testing.T) {
+			dialer, proto := NewMockableProtocol(t)
+			go func() {
+				frame, _ := ndt5.NewFrame(5, []byte(tt.body))
+				dialer.ServerConn.Write(frame.Raw)
+			}()
+			msg, err := proto.ExpectTestMsg()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *msg != tt.want {
+				t.Fatalf("got %+v, want %+v", *msg, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnitProtocolExpectTestMsgInvalidJSON(t *testing.T) {
+	dialer, proto := NewMockableProtocol(t)
+	go func() {
+		frame, _ := ndt5.NewFrame(5, []byte("{"))
+		dialer.ServerConn.Write(frame.Raw)
+	}()
+	msg, err := proto.ExpectTestMsg()
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if msg != nil {
+		t.Fatal("expected nil msg here")
+	}
+}
+
+func TestUnitProtocolExpectTestPrepareExtendedFormat(t *testing.T) {
+	dialer, proto := NewMockableProtocol(t)
+	go func() {
+		frame, _ := ndt5.NewFrame(3, []byte("3002 10000 0 0 4"))
+		dialer.ServerConn.Write(frame.Raw)
+	}()
+	portnum, err := proto.ExpectTestPrepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if portnum != "3002" {
+		t.Fatalf("expected the first field to be the port, got %s", portnum)
+	}
+	counter, ok := proto.(interface{ Streams() int })
+	if !ok || counter.Streams() != 4 {
+		t.Fatal("expected the number of streams to be 4")
+	}
+}
@@ -1,14 +1,67 @@
 package ndt5
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// LoginMode is the login message sent by the raw transport.
+type LoginMode int
+
+const (
+	// LoginLegacy is the legacy login message, which only contains the
+	// test suite and which all servers support. It's the default.
+	LoginLegacy = LoginMode(iota)
+
+	// LoginExtended is the extended login message, which also contains
+	// the client version, encoded as JSON like we do with WebSocket. Some
+	// servers require it.
+	LoginExtended
+)
+
 // RawConnectionsFactory creates ndt5 connections
 type RawConnectionsFactory struct {
+	// CongestionControl is the optional TCP congestion control algorithm
+	// (e.g. "cubic" or "bbr") to use for measurement connections. This is
+	// only supported on Linux and, when empty, we use the system default.
+	CongestionControl string
+
+	// EnableNagle enables Nagle's algorithm (i.e. clears TCP_NODELAY) on
+	// measurement connections, which Go disables by default. It has no
+	// effect on connections that are not TCP connections.
+	EnableNagle bool
+
+	// LoginMode is the login message we send, which by default is the
+	// legacy one. You may override it.
+	LoginMode LoginMode
+
+	// Control is the optional function called with the socket of each
+	// connection before connecting it, e.g., to set socket options. It
+	// requires the dialer to be a *net.Dialer; otherwise, dialing fails
+	// with ErrControlNotSupported.
+	Control ControlFunc
+
+	// LocalPortRange is the optional range of local ports to which we bind
+	// measurement connections, e.g., for firewall rules keying on the source
+	// port. We try the next port when a port is in use. It requires the
+	// dialer to be a *net.Dialer; otherwise, dialing measurement connections
+	// fails with ErrLocalPortNotSupported.
+	LocalPortRange PortRange
+
+	// WriteChunkSize is the optional size of the chunks in which we write
+	// each upload message, which is an experimental knob for studying how
+	// the write size interacts with TSO/GSO and the socket buffer. Zero,
+	// the default, means that we write each message at once.
+	WriteChunkSize int
+
 	dialer NetDialer
 }
 
@@ -20,49 +73,137 @@ func NewRawConnectionsFactory(dialer NetDialer) *RawConnectionsFactory {
 // DialControlConn implements ConnectionsFactory.DialControlConn
 func (cf *RawConnectionsFactory) DialControlConn(
 	ctx context.Context, address, userAgent string) (ControlConn, error) {
-	_, _, err := net.SplitHostPort(address)
-	if err != nil {
-		address = net.JoinHostPort(address, "3001")
+	return cf.dialControlConn(ctx, withDefaultPort(address, "3001"))
+}
+
+// withDefaultPort returns address if it already includes a port (e.g.
+// "example.com:3001" or "[::1]:3001"), and otherwise joins it with port,
+// handling IPv6 literals with (e.g. "[::1]") or without (e.g. "::1")
+// brackets.
+func withDefaultPort(address, port string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
 	}
-	return cf.dialControlConn(ctx, address)
+	return net.JoinHostPort(hostOf(address), port)
+}
+
+// hostOf returns the host of address, which may or may not include a
+// port, without the brackets of IPv6 literals (e.g. "::1" for "[::1]",
+// "[::1]:3001" or "::1").
+func hostOf(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
 }
 
 func (cf *RawConnectionsFactory) dialControlConn(
 	ctx context.Context, address string) (ControlConn, error) {
-	conn, err := cf.dialer.DialContext(ctx, "tcp", address)
+	conn, err := cf.dial(ctx, address, PortRange{})
 	if err != nil {
 		return nil, err
 	}
+	cc := newRawControlConn(conn)
+	cc.loginMode = cf.LoginMode
+	return cc, nil
+}
+
+// dial dials a TCP connection to address, applying cf.Control, if any, and
+// binding it to a local port in ports, unless ports is zero.
+func (cf *RawConnectionsFactory) dial(
+	ctx context.Context, address string, ports PortRange) (net.Conn, error) {
+	dialer, err := withControl(cf.dialer, cf.Control)
+	if err != nil {
+		return nil, err
+	}
+	if dialer, err = withLocalPortRange(dialer, ports); err != nil {
+		return nil, err
+	}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// NewRawControlConn creates a raw ndt5 ControlConn using an existing conn,
+// e.g., a pipe or a pre-authenticated socket. See also the NewProtocolWithConn
+// method of ProtocolFactory5.
+func NewRawControlConn(conn net.Conn) ControlConn {
+	return newRawControlConn(conn)
+}
+
+func newRawControlConn(conn net.Conn) *rawControlConn {
 	return &rawControlConn{
 		conn:     conn,
 		observer: new(defaultFrameReadWriteObserver),
-	}, nil
+	}
 }
 
 // DialMeasurementConn implements ConnectionsFactory.DialMeasurementConn.
 func (cf *RawConnectionsFactory) DialMeasurementConn(
 	ctx context.Context, address, userAgent string) (MeasurementConn, error) {
-	conn, err := cf.dialer.DialContext(ctx, "tcp", address)
+	conn, err := cf.dial(ctx, address, cf.LocalPortRange)
 	if err != nil {
 		return nil, err
 	}
-	return &rawMeasurementConn{conn: conn}, nil
+	if cf.CongestionControl != "" {
+		if err := setCongestionControl(conn, cf.CongestionControl); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if cf.EnableNagle {
+		if err := enableNagle(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return &rawMeasurementConn{conn: conn, chunkSize: cf.WriteChunkSize}, nil
+}
+
+// NewRawMeasurementConn creates a raw ndt5 MeasurementConn using an existing
+// conn. Together with NewRawControlConn, it allows you to implement a custom
+// ConnectionsFactory speaking ndt5 over any transport providing a net.Conn.
+func NewRawMeasurementConn(conn net.Conn) MeasurementConn {
+	return &rawMeasurementConn{conn: conn}
 }
 
 type rawControlConn struct {
-	conn     net.Conn
-	observer FrameReadWriteObserver
+	conn      net.Conn
+	observer  FrameReadWriteObserver
+	loginMode LoginMode
+	header    [3]byte
+	vectors   [2][]byte
+	buffers   net.Buffers
 }
 
 func (cc *rawControlConn) SetFrameReadWriteObserver(observer FrameReadWriteObserver) {
 	cc.observer = observer
 }
 
+func (cc *rawControlConn) RemoteAddr() net.Addr {
+	return cc.conn.RemoteAddr()
+}
+
+func (cc *rawControlConn) Transport() (string, string) {
+	if version := tlsVersion(cc.conn); version != "" {
+		return "tls", version
+	}
+	return "raw", ""
+}
+
 func (cc *rawControlConn) SetDeadline(deadline time.Time) error {
 	return cc.conn.SetDeadline(deadline)
 }
 
 func (cc *rawControlConn) WriteLogin(versionCompat string, testSuite byte) error {
+	if cc.loginMode == LoginExtended {
+		body, err := json.Marshal(wsLoginMessage{
+			Msg:   versionCompat,
+			Tests: strconv.Itoa(int(testSuite)),
+		})
+		if err != nil {
+			return err
+		}
+		return cc.WriteMessage(msgExtendedLogin, body)
+	}
 	// Note that versionCompat is ignored with the legacy login message
 	return cc.WriteMessage(msgLogin, []byte{testSuite})
 }
@@ -80,6 +221,9 @@ func (cc *rawControlConn) ReadFrame() (*Frame, error) {
 	if err := cc.readn(b[1:3]); err != nil {
 		return nil, err
 	}
+	if bytes.Equal(b[:3], httpResponsePrefix[:3]) {
+		return nil, fmt.Errorf("raw: received HTTP response: %w", ErrProtocolMismatch)
+	}
 	size := binary.BigEndian.Uint16(b[1:3]) + 3
 	if err := cc.readn(b[3:size]); err != nil {
 		return nil, err
@@ -94,6 +238,9 @@ func (cc *rawControlConn) ReadFrame() (*Frame, error) {
 }
 
 func (cc *rawControlConn) WriteMessage(mtype uint8, data []byte) error {
+	if _, ok := cc.observer.(*defaultFrameReadWriteObserver); ok {
+		return cc.writeMessageInto(mtype, data)
+	}
 	frame, err := NewFrame(mtype, data)
 	if err != nil {
 		return err
@@ -107,6 +254,26 @@ func (cc *rawControlConn) WriteFrame(frame *Frame) error {
 	return err
 }
 
+// writeMessageInto writes the frame header and data using net.Buffers,
+// which uses writev when possible, without allocating a Frame and hence
+// without copying data. Because there is no Frame, we can only use it
+// when nobody is observing frames.
+func (cc *rawControlConn) writeMessageInto(mtype uint8, data []byte) error {
+	if len(data) > maxMessageSize {
+		return ErrMessageSize
+	}
+	cc.header[0] = mtype
+	binary.BigEndian.PutUint16(cc.header[1:3], uint16(len(data)))
+	cc.vectors[0], cc.vectors[1] = cc.header[:], data
+	cc.buffers = cc.vectors[:] // WriteTo consumes buffers
+	if len(data) == 0 {
+		cc.buffers = cc.vectors[:1] // avoid an empty write
+	}
+	_, err := cc.buffers.WriteTo(cc.conn)
+	cc.vectors[1] = nil // don't retain data
+	return err
+}
+
 func (cc *rawControlConn) readn(data []byte) error {
 	// We don't care too much about performance when reading
 	// control messages, hence this simple implementation
@@ -126,9 +293,11 @@ func (cc *rawControlConn) Close() error {
 }
 
 type rawMeasurementConn struct {
-	conn     net.Conn
-	prepared []byte
-	rbuf     []byte
+	conn      net.Conn
+	prepared  []byte
+	rbuf      []byte
+	capture   io.Writer
+	chunkSize int
 }
 
 func (mc *rawMeasurementConn) SetDeadline(deadline time.Time) error {
@@ -142,6 +311,9 @@ func (mc *rawMeasurementConn) AllocReadBuffer(bufsiz int) {
 func (mc *rawMeasurementConn) ReadDiscard() (int64, error) {
 	// We assume the read buffer has been initialized
 	count, err := mc.conn.Read(mc.rbuf)
+	if mc.capture != nil && count > 0 {
+		mc.capture.Write(mc.rbuf[:count])
+	}
 	return int64(count), err
 }
 
@@ -151,7 +323,49 @@ func (mc *rawMeasurementConn) SetPreparedMessage(b []byte) {
 
 func (mc *rawMeasurementConn) WritePreparedMessage() (int, error) {
 	// We assume the prepared message has been initialized
-	return mc.conn.Write(mc.prepared)
+	if mc.chunkSize <= 0 || mc.chunkSize >= len(mc.prepared) {
+		return mc.write(mc.prepared)
+	}
+	var total int
+	for off := 0; off < len(mc.prepared); off += mc.chunkSize {
+		count, err := mc.write(mc.prepared[off:min(off+mc.chunkSize, len(mc.prepared))])
+		total += count
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// write writes b, copying what we wrote to the capture writer, if any.
+func (mc *rawMeasurementConn) write(b []byte) (int, error) {
+	count, err := mc.conn.Write(b)
+	if mc.capture != nil && count > 0 {
+		mc.capture.Write(b[:count])
+	}
+	return count, err
+}
+
+// SetCapture sets the writer to which we copy the payload we read
+// and write. The writer must not fail.
+func (mc *rawMeasurementConn) SetCapture(w io.Writer) {
+	mc.capture = w
+}
+
+func (mc *rawMeasurementConn) CongestionControl() (string, error) {
+	return getCongestionControl(mc.conn)
+}
+
+func (mc *rawMeasurementConn) MSS() (int, error) {
+	return getMSS(mc.conn)
+}
+
+func (mc *rawMeasurementConn) LocalAddr() net.Addr {
+	return mc.conn.LocalAddr()
+}
+
+func (mc *rawMeasurementConn) RemoteAddr() net.Addr {
+	return mc.conn.RemoteAddr()
 }
 
 func (mc *rawMeasurementConn) Close() error {
@@ -4,8 +4,12 @@ import (
 	"context"
 	"errors"
 	"io"
+	"net"
+	"reflect"
 	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/m-lab/ndt5-client-go"
 )
@@ -25,6 +29,10 @@ func TestUnitRawDialControlConnDefaultPort(t *testing.T) {
 	if dialer.Address != "[::1]:3001" {
 		t.Fatal("unexpected address was dialed")
 	}
+	f.DialControlConn(context.Background(), "[::1]", UserAgent)
+	if dialer.Address != "[::1]:3001" {
+		t.Fatal("unexpected address was dialed")
+	}
 	f.DialControlConn(context.Background(), "127.0.0.1:54321", UserAgent)
 	if dialer.Address != "127.0.0.1:54321" {
 		t.Fatal("unexpected address was dialed")
@@ -39,6 +47,34 @@ func TestUnitRawDialControlConnDefaultPort(t *testing.T) {
 	}
 }
 
+func TestUnitRawClientDownloadAddress(t *testing.T) {
+	for fqdn, expect := range map[string]string{
+		"::1":            "[::1]:3002",
+		"[::1]":          "[::1]:3002",
+		"[::1]:3001":     "[::1]:3002",
+		"127.0.0.1:3001": "127.0.0.1:3002",
+		"localhost:3001": "localhost:3002",
+	} {
+		server := &FakeServer{
+			TestIDs:         "4",
+			Duration:        100 * time.Millisecond,
+			DownloadTestMsg: "1000",
+		}
+		client := NewFakeServerClient(server)
+		client.FQDN = fqdn
+		results, err := client.RunN(context.Background(), 1)
+		if err != nil {
+			t.Fatalf("%s: %s", fqdn, err)
+		}
+		if subtests := results[0].Subtests; len(subtests) != 1 || !subtests[0].Success {
+			t.Fatalf("%s: unexpected subtests: %+v", fqdn, subtests)
+		}
+		if len(server.Addresses) != 2 || server.Addresses[1] != expect {
+			t.Fatalf("%s: unexpected addresses: %v", fqdn, server.Addresses)
+		}
+	}
+}
+
 func TestUnitRawDialControlConnSuccess(t *testing.T) {
 	f := ndt5.NewRawConnectionsFactory(NewPipeDialer())
 	cc, err := f.DialControlConn(context.Background(), "127.0.0.1:3001", UserAgent)
@@ -154,3 +190,294 @@ func TestUnitRawControlConnReadFrameThirdReadnFailure(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestUnitRawControlConnReadFrameHTTPResponse(t *testing.T) {
+	dialer := NewPipeDialer()
+	f := ndt5.NewRawConnectionsFactory(dialer)
+	cc, err := f.DialControlConn(context.Background(), "127.0.0.1:3001", UserAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		dialer.ServerConn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		wg.Done()
+	}()
+	frame, err := cc.ReadFrame()
+	if !errors.Is(err, ndt5.ErrProtocolMismatch) {
+		t.Fatal("expected ndt5.ErrProtocolMismatch here")
+	}
+	if frame != nil {
+		t.Fatal("expected nil frame here")
+	}
+	dialer.ServerConn.Close()
+	wg.Wait()
+}
+
+// CountingObserver is a FrameReadWriteObserver counting written frames
+// and recording the read ones.
+type CountingObserver struct {
+	Writes int
+	Reads  []*ndt5.Frame
+}
+
+func (o *CountingObserver) OnRead(frame *ndt5.Frame) {
+	o.Reads = append(o.Reads, frame)
+}
+
+func (o *CountingObserver) OnWrite(frame *ndt5.Frame) {
+	o.Writes++
+}
+
+// NewDiscardingControlConn returns a raw ControlConn whose writes are
+// discarded by the other end of the pipe.
+func NewDiscardingControlConn(tb testing.TB) ndt5.ControlConn {
+	dialer := NewPipeDialer()
+	go io.Copy(io.Discard, dialer.ServerConn)
+	tb.Cleanup(func() { dialer.ServerConn.Close() })
+	f := ndt5.NewRawConnectionsFactory(dialer)
+	cc, err := f.DialControlConn(context.Background(), "127.0.0.1:3001", UserAgent)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return cc
+}
+
+func TestUnitRawControlConnWriteMessageObserved(t *testing.T) {
+	for _, observer := range []*CountingObserver{nil, new(CountingObserver)} {
+		dialer := NewPipeDialer()
+		f := ndt5.NewRawConnectionsFactory(dialer)
+		cc, err := f.DialControlConn(context.Background(), "127.0.0.1:3001", UserAgent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if observer != nil {
+			cc.SetFrameReadWriteObserver(observer)
+		}
+		go cc.WriteMessage(5, []byte("1234.5"))
+		mtype, body, err := ReadFrame(dialer.ServerConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mtype != 5 || body != "1234.5" {
+			t.Fatalf("unexpected frame: %d %q", mtype, body)
+		}
+		if observer != nil && observer.Writes != 1 {
+			t.Fatal("the observer did not see the frame")
+		}
+	}
+}
+
+func TestUnitRawControlConnWriteLogin(t *testing.T) {
+	for _, tc := range []struct {
+		mode  ndt5.LoginMode
+		mtype uint8
+		body  string
+	}{
+		{ndt5.LoginLegacy, 2, "\x16"},
+		{ndt5.LoginExtended, 11, `{"msg":"v3.7.0","tests":"22"}`},
+	} {
+		dialer := NewPipeDialer()
+		f := ndt5.NewRawConnectionsFactory(dialer)
+		f.LoginMode = tc.mode
+		cc, err := f.DialControlConn(context.Background(), "127.0.0.1:3001", UserAgent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go cc.WriteLogin("v3.7.0", 22)
+		mtype, body, err := ReadFrame(dialer.ServerConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mtype != tc.mtype || body != tc.body {
+			t.Fatalf("mode %d: unexpected frame: %d %q", tc.mode, mtype, body)
+		}
+	}
+}
+
+// BenchmarkRawControlConnWriteMessage writes bursts of 100 small control
+// messages, with and without an observer. Only the latter needs to allocate
+// a Frame for each message, so compare their allocations.
+func BenchmarkRawControlConnWriteMessage(b *testing.B) {
+	for _, observed := range []bool{false, true} {
+		name := "writev"
+		if observed {
+			name = "observed"
+		}
+		b.Run(name, func(b *testing.B) {
+			cc := NewDiscardingControlConn(b)
+			if observed {
+				cc.SetFrameReadWriteObserver(new(CountingObserver))
+			}
+			message := []byte("TCPInfo.Retransmits: 0")
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < 100; j++ {
+					if err := cc.WriteMessage(5, message); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestUnitRawConnectionsFactoryControl(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	var addresses []string
+	f := ndt5.NewRawConnectionsFactory(new(net.Dialer))
+	f.Control = func(network, address string, c syscall.RawConn) error {
+		addresses = append(addresses, address)
+		return nil
+	}
+	cc, err := f.DialControlConn(context.Background(), listener.Addr().String(), UserAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Close()
+	mc, err := f.DialMeasurementConn(context.Background(), listener.Addr().String(), UserAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc.Close()
+	if len(addresses) != 2 || addresses[0] != listener.Addr().String() {
+		t.Fatalf("unexpected Control calls: %v", addresses)
+	}
+	f.Control = func(network, address string, c syscall.RawConn) error {
+		return ErrMocked
+	}
+	if _, err := f.DialControlConn(context.Background(), listener.Addr().String(), UserAgent); !errors.Is(err, ErrMocked) {
+		t.Fatalf("expected ErrMocked, got %v", err)
+	}
+	f = ndt5.NewRawConnectionsFactory(new(RecordParametersDialer))
+	f.Control = func(network, address string, c syscall.RawConn) error {
+		return nil
+	}
+	if _, err := f.DialMeasurementConn(context.Background(), "127.0.0.1:3002", UserAgent); !errors.Is(err, ndt5.ErrControlNotSupported) {
+		t.Fatalf("expected ErrControlNotSupported, got %v", err)
+	}
+}
+
+func TestUnitRawConnectionsFactoryLocalPortRange(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	// The port of the listener is in use, so we must skip it.
+	busy := listener.Addr().(*net.TCPAddr).Port
+	ports := ndt5.PortRange{Min: busy, Max: busy + 20}
+	f := ndt5.NewRawConnectionsFactory(new(net.Dialer))
+	f.LocalPortRange = ports
+	for i := 0; i < 5; i++ {
+		mc, err := f.DialMeasurementConn(context.Background(), listener.Addr().String(), UserAgent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := mc.LocalAddr().(*net.TCPAddr).Port
+		mc.Close()
+		if port <= ports.Min || port > ports.Max {
+			t.Fatalf("local port %d not in %d-%d", port, ports.Min+1, ports.Max)
+		}
+	}
+	f.LocalPortRange = ndt5.PortRange{Min: busy, Max: busy}
+	if _, err := f.DialMeasurementConn(context.Background(), listener.Addr().String(), UserAgent); !errors.Is(err, ndt5.ErrLocalPortRangeExhausted) {
+		t.Fatalf("expected ErrLocalPortRangeExhausted, got %v", err)
+	}
+	f.LocalPortRange = ndt5.PortRange{Min: 2000, Max: 1000}
+	if _, err := f.DialMeasurementConn(context.Background(), listener.Addr().String(), UserAgent); !errors.Is(err, ndt5.ErrInvalidPortRange) {
+		t.Fatalf("expected ErrInvalidPortRange, got %v", err)
+	}
+	// The control connection does not use the range.
+	cc, err := f.DialControlConn(context.Background(), listener.Addr().String(), UserAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Close()
+	f = ndt5.NewRawConnectionsFactory(new(RecordParametersDialer))
+	f.LocalPortRange = ports
+	if _, err := f.DialMeasurementConn(context.Background(), "127.0.0.1:3002", UserAgent); !errors.Is(err, ndt5.ErrLocalPortNotSupported) {
+		t.Fatalf("expected ErrLocalPortNotSupported, got %v", err)
+	}
+}
+
+// WriteSizesDialer dials conns recording the size of each write, whose
+// peer discards all the data.
+type WriteSizesDialer struct {
+	mu    sync.Mutex
+	Sizes []int
+}
+
+func (d *WriteSizesDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *WriteSizesDialer) DialContext(
+	ctx context.Context, network, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go io.Copy(io.Discard, server)
+	return &writeSizesConn{Conn: client, dialer: d}, nil
+}
+
+type writeSizesConn struct {
+	net.Conn
+	dialer *WriteSizesDialer
+}
+
+func (c *writeSizesConn) Write(b []byte) (int, error) {
+	c.dialer.mu.Lock()
+	c.dialer.Sizes = append(c.dialer.Sizes, len(b))
+	c.dialer.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func TestUnitRawMeasurementConnWriteChunkSize(t *testing.T) {
+	for _, tc := range []struct {
+		chunkSize int
+		sizes     []int
+	}{
+		{0, []int{10000}},
+		{4096, []int{4096, 4096, 1808}},
+		{20000, []int{10000}},
+	} {
+		dialer := new(WriteSizesDialer)
+		f := ndt5.NewRawConnectionsFactory(dialer)
+		f.WriteChunkSize = tc.chunkSize
+		mc, err := f.DialMeasurementConn(context.Background(), "127.0.0.1:3002", UserAgent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mc.SetPreparedMessage(make([]byte, 10000))
+		count, err := mc.WritePreparedMessage()
+		mc.Close()
+		if err != nil || count != 10000 {
+			t.Fatalf("chunk size %d: unexpected write: %d %v", tc.chunkSize, count, err)
+		}
+		if !reflect.DeepEqual(dialer.Sizes, tc.sizes) {
+			t.Fatalf("chunk size %d: unexpected writes: %v", tc.chunkSize, dialer.Sizes)
+		}
+	}
+}
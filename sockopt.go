@@ -0,0 +1,82 @@
+package ndt5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// ErrNotTCPConn indicates that a connection is not a TCP connection, or
+// that it wraps a TCP connection in a way that does not allow us to get
+// the underlying socket (e.g. when traffic shaping is enabled).
+var ErrNotTCPConn = errors.New("not a TCP connection")
+
+// ErrNotSupported indicates that a feature is not supported on this platform.
+var ErrNotSupported = errors.New("not supported on this platform")
+
+// ErrControlNotSupported indicates that we cannot apply the Control
+// function of a connections factory because its dialer is not a
+// *net.Dialer (e.g. when traffic shaping is enabled).
+var ErrControlNotSupported = errors.New("the dialer does not support a Control function")
+
+// ControlFunc is the signature of net.Dialer.Control, which is called
+// after creating a socket and before connecting it, e.g., to set socket
+// options such as SO_MARK for policy routing.
+type ControlFunc func(network, address string, c syscall.RawConn) error
+
+// withControl returns a copy of dialer calling control before connecting,
+// after the Control or ControlContext function of dialer, if any. It fails
+// with ErrControlNotSupported if dialer is not a *net.Dialer.
+func withControl(dialer NetDialer, control ControlFunc) (NetDialer, error) {
+	if control == nil {
+		return dialer, nil
+	}
+	nd, ok := dialer.(*net.Dialer)
+	if !ok {
+		return nil, ErrControlNotSupported
+	}
+	copied := *nd
+	previous, previousContext := nd.Control, nd.ControlContext
+	copied.Control = nil
+	copied.ControlContext = func(
+		ctx context.Context, network, address string, c syscall.RawConn) error {
+		var err error
+		switch {
+		case previousContext != nil:
+			err = previousContext(ctx, network, address, c)
+		case previous != nil:
+			err = previous(network, address, c)
+		}
+		if err != nil {
+			return err
+		}
+		return control(network, address, c)
+	}
+	return &copied, nil
+}
+
+// tcpConn returns the *net.TCPConn underlying conn, if any.
+func tcpConn(conn net.Conn) (*net.TCPConn, error) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, nil
+		case interface{ NetConn() net.Conn }: // e.g. *tls.Conn
+			conn = c.NetConn()
+		default:
+			return nil, ErrNotTCPConn
+		}
+	}
+}
+
+// enableNagle clears TCP_NODELAY on the *net.TCPConn underlying conn, if
+// any. When conn does not allow us to get the underlying socket (e.g. it's
+// not a TCP connection), we leave it alone rather than failing the dial.
+func enableNagle(conn net.Conn) error {
+	tc, err := tcpConn(conn)
+	if err != nil {
+		return nil
+	}
+	return tc.SetNoDelay(false)
+}
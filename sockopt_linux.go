@@ -0,0 +1,64 @@
+package ndt5
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// getCongestionControl returns the congestion control algorithm of conn.
+func getCongestionControl(conn net.Conn) (algo string, err error) {
+	tc, err := tcpConn(conn)
+	if err != nil {
+		return "", err
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	cerr := rc.Control(func(fd uintptr) {
+		algo, err = unix.GetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION)
+	})
+	if cerr != nil {
+		return "", cerr
+	}
+	return algo, err
+}
+
+// getMSS returns the maximum segment size (TCP_MAXSEG) of conn.
+func getMSS(conn net.Conn) (mss int, err error) {
+	tc, err := tcpConn(conn)
+	if err != nil {
+		return 0, err
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	cerr := rc.Control(func(fd uintptr) {
+		mss, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_MAXSEG)
+	})
+	if cerr != nil {
+		return 0, cerr
+	}
+	return mss, err
+}
+
+// setCongestionControl sets the congestion control algorithm of conn.
+func setCongestionControl(conn net.Conn, algo string) (err error) {
+	tc, err := tcpConn(conn)
+	if err != nil {
+		return err
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	cerr := rc.Control(func(fd uintptr) {
+		err = unix.SetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION, algo)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,181 @@
+package ndt5_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/m-lab/ndt5-client-go"
+	"github.com/m-lab/ndt5-client-go/internal/trafficshaping"
+	"golang.org/x/sys/unix"
+)
+
+// NewLoopbackListener returns a listener accepting and holding conns
+// on the loopback interface until the test is over.
+func NewLoopbackListener(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(chan net.Conn, 16)
+	go func() {
+		defer close(conns)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		for conn := range conns {
+			conn.Close()
+		}
+	})
+	return listener
+}
+
+func TestUnitRawMeasurementConnCongestionControl(t *testing.T) {
+	listener := NewLoopbackListener(t)
+	f := ndt5.NewRawConnectionsFactory(new(net.Dialer))
+	mc, err := f.DialMeasurementConn(
+		context.Background(), listener.Addr().String(), UserAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+	algo, err := mc.CongestionControl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algo == "" {
+		t.Fatal("expected a non-empty congestion control algorithm")
+	}
+}
+
+func TestUnitRawMeasurementConnSetCongestionControl(t *testing.T) {
+	listener := NewLoopbackListener(t)
+	f := ndt5.NewRawConnectionsFactory(new(net.Dialer))
+	f.CongestionControl = "reno"
+	mc, err := f.DialMeasurementConn(
+		context.Background(), listener.Addr().String(), UserAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+	algo, err := mc.CongestionControl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algo != "reno" {
+		t.Fatalf("expected reno, got %s", algo)
+	}
+}
+
+func TestUnitRawMeasurementConnCongestionControlNotTCP(t *testing.T) {
+	listener := NewLoopbackListener(t)
+	f := ndt5.NewRawConnectionsFactory(trafficshaping.NewDialer())
+	mc, err := f.DialMeasurementConn(
+		context.Background(), listener.Addr().String(), UserAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+	if _, err := mc.CongestionControl(); !errors.Is(err, ndt5.ErrNotTCPConn) {
+		t.Fatal("expected ndt5.ErrNotTCPConn here")
+	}
+}
+
+func TestUnitRawMeasurementConnMSS(t *testing.T) {
+	listener := NewLoopbackListener(t)
+	f := ndt5.NewRawConnectionsFactory(new(net.Dialer))
+	mc, err := f.DialMeasurementConn(
+		context.Background(), listener.Addr().String(), UserAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+	reader, ok := mc.(interface{ MSS() (int, error) })
+	if !ok {
+		t.Fatal("the measurement conn does not expose the MSS")
+	}
+	mss, err := reader.MSS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The loopback MTU is usually 65536, but the MSS must be plausible.
+	if mss < 500 || mss > 65535 {
+		t.Fatalf("unexpected MSS: %d", mss)
+	}
+}
+
+// RecordingDialer is a dialer that records the last conn it dialed.
+type RecordingDialer struct {
+	Conn net.Conn
+}
+
+func (d *RecordingDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *RecordingDialer) DialContext(
+	ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := new(net.Dialer).DialContext(ctx, network, address)
+	d.Conn = conn
+	return conn, err
+}
+
+// NoDelay returns the TCP_NODELAY value of conn.
+func NoDelay(t *testing.T, conn net.Conn) int {
+	rawconn, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		value   int
+		sockErr error
+	)
+	err = rawconn.Control(func(fd uintptr) {
+		value, sockErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_NODELAY)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	return value
+}
+
+func TestUnitRawMeasurementConnEnableNagle(t *testing.T) {
+	for _, nagle := range []bool{false, true} {
+		listener := NewLoopbackListener(t)
+		dialer := new(RecordingDialer)
+		f := ndt5.NewRawConnectionsFactory(dialer)
+		f.EnableNagle = nagle
+		mc, err := f.DialMeasurementConn(
+			context.Background(), listener.Addr().String(), UserAgent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mc.Close()
+		if got := NoDelay(t, dialer.Conn); (got == 0) != nagle {
+			t.Fatalf("EnableNagle %v: got TCP_NODELAY %d", nagle, got)
+		}
+	}
+}
+
+func TestUnitRawMeasurementConnEnableNagleNotTCP(t *testing.T) {
+	listener := NewLoopbackListener(t)
+	f := ndt5.NewRawConnectionsFactory(trafficshaping.NewDialer())
+	f.EnableNagle = true
+	mc, err := f.DialMeasurementConn(
+		context.Background(), listener.Addr().String(), UserAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc.Close()
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package ndt5
+
+import "net"
+
+// getCongestionControl returns the congestion control algorithm of conn.
+func getCongestionControl(conn net.Conn) (string, error) {
+	return "", ErrNotSupported
+}
+
+// getMSS returns the maximum segment size (TCP_MAXSEG) of conn.
+func getMSS(conn net.Conn) (int, error) {
+	return 0, ErrNotSupported
+}
+
+// setCongestionControl sets the congestion control algorithm of conn.
+func setCongestionControl(conn net.Conn, algo string) error {
+	return ErrNotSupported
+}
@@ -0,0 +1,108 @@
+package ndt5
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the measurement in progress.
+type Stats struct {
+	// Direction is "download" or "upload" while measuring and
+	// empty when no measurement is in progress.
+	Direction string
+
+	// Count is the number of bytes transferred so far.
+	Count int64
+
+	// Elapsed is the time elapsed since the beginning of the measurement.
+	Elapsed time.Duration
+
+	// CurrentMbps is the speed measured between the last two samples.
+	CurrentMbps float64
+
+	// AverageMbps is the average speed since the beginning.
+	AverageMbps float64
+}
+
+// statsTracker tracks the measurement in progress. The byte counter is
+// updated atomically by the sampler goroutines for each I/O operation,
+// while the other fields are updated with the mutex held.
+type statsTracker struct {
+	count atomic.Int64
+
+	mu          sync.Mutex
+	direction   string
+	begin       time.Time
+	currentMbps float64
+	lastCount   int64
+	lastElapsed time.Duration
+}
+
+// start starts tracking a measurement in the given direction.
+func (st *statsTracker) start(direction string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.count.Store(0)
+	st.direction = direction
+	st.begin = time.Now()
+	st.currentMbps = 0
+	st.lastCount = 0
+	st.lastElapsed = 0
+}
+
+// add adds num bytes to the byte counter.
+func (st *statsTracker) add(num int64) {
+	st.count.Add(num)
+}
+
+// sample records a speed sample, which updates the current speed.
+func (st *statsTracker) sample(speed *Speed) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if delta := speed.Elapsed - st.lastElapsed; delta > 0 {
+		st.currentMbps = mbps(speed.Count-st.lastCount, delta)
+	}
+	st.lastCount = speed.Count
+	st.lastElapsed = speed.Elapsed
+}
+
+// stop stops tracking the measurement in progress.
+func (st *statsTracker) stop() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.direction = ""
+}
+
+// snapshot returns a snapshot of the measurement in progress.
+func (st *statsTracker) snapshot() Stats {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.direction == "" {
+		return Stats{}
+	}
+	s := Stats{
+		Direction:   st.direction,
+		Count:       st.count.Load(),
+		Elapsed:     time.Since(st.begin),
+		CurrentMbps: st.currentMbps,
+	}
+	s.AverageMbps = mbps(s.Count, s.Elapsed)
+	return s
+}
+
+// mbps computes the speed in Mbit/s.
+func mbps(count int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return 8 * float64(count) / elapsed.Seconds() / 1e06
+}
+
+// CurrentStats returns a snapshot of the measurement in progress. It is
+// safe to call this method from any goroutine while the test is running,
+// which allows you to poll the state at your own pace. When there is no
+// measurement in progress, it returns an empty Stats.
+func (c *Client) CurrentStats() Stats {
+	return c.stats.snapshot()
+}
@@ -2,8 +2,17 @@ package ndt5_test
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt5-client-go"
 )
 
 const UserAgent = "ndt5-client-go-testing/0.1.0"
@@ -57,3 +66,429 @@ func (d *PipeDialer) DialContext(
 	ctx context.Context, network, address string) (net.Conn, error) {
 	return d.ClientConn, nil
 }
+
+// ScriptedDialer creates a new net.Pipe for each dial and runs
+// Handler on the server side of the pipe in a background goroutine.
+type ScriptedDialer struct {
+	Handler func(conn net.Conn)
+}
+
+func (d *ScriptedDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *ScriptedDialer) DialContext(
+	ctx context.Context, network, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go d.Handler(server)
+	return client, nil
+}
+
+// ServeNoTests is a raw ndt5 server that reads the login, clears the
+// client to run, announces no tests, and logs the client out.
+func ServeNoTests(conn net.Conn) {
+	ServeTestIDs("")(conn)
+}
+
+// ServeTestIDs returns a raw ndt5 server like ServeNoTests, except that it
+// announces the given test IDs, without running them.
+func ServeTestIDs(testIDs string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		defer conn.Close()
+		login := make([]byte, 4)
+		if _, err := io.ReadFull(conn, login); err != nil {
+			return
+		}
+		conn.Write([]byte("123456 654321"))
+		for _, frame := range []struct {
+			mtype   uint8
+			message string
+		}{
+			{1, "0"},
+			{2, "v3.7.0"},
+			{2, testIDs},
+			{9, ""},
+		} {
+			f, _ := ndt5.NewFrame(frame.mtype, []byte(frame.message))
+			if _, err := conn.Write(f.Raw); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// NewScriptedClient returns a client using the raw transport and
+// dialing a ScriptedDialer using the specified handler.
+func NewScriptedClient(handler func(conn net.Conn)) *ndt5.Client {
+	protocolFactory := ndt5.NewProtocolFactory5()
+	protocolFactory.ConnectionsFactory = ndt5.NewRawConnectionsFactory(
+		&ScriptedDialer{Handler: handler},
+	)
+	client := ndt5.NewClient("ndt5-client-go-testing", "0.1.0", "")
+	client.ProtocolFactory = protocolFactory
+	client.FQDN = "127.0.0.1"
+	return client
+}
+
+// RedirectDialer dials Address regardless of the requested address.
+type RedirectDialer struct {
+	Address string
+
+	// Requested contains the requested addresses.
+	Requested []string
+}
+
+func (d *RedirectDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *RedirectDialer) DialContext(
+	ctx context.Context, network, address string) (net.Conn, error) {
+	d.Requested = append(d.Requested, address)
+	return new(net.Dialer).DialContext(ctx, network, d.Address)
+}
+
+// FakeServer is a scripted raw ndt5 server. It implements NetDialer and
+// serves the control protocol on conns dialed to port 3001 and uses
+// conns dialed to any other port as measurement conns.
+type FakeServer struct {
+	// TestIDs is the list of tests to run (e.g. "4" or "4 2").
+	TestIDs string
+
+	// Duration is the duration of each measurement.
+	Duration time.Duration
+
+	// DownloadTestMsg is the download speed measured by the server.
+	DownloadTestMsg string
+
+	// DownloadStall is how long we wait before sending DownloadTestMsg.
+	DownloadStall time.Duration
+
+	// UploadTestMsg is the upload speed measured by the server.
+	UploadTestMsg string
+
+	// UploadStall is how long we wait before reading the upload.
+	UploadStall time.Duration
+
+	// UploadReadLimit, if positive, is the number of bytes of the upload
+	// after which we stop reading, without closing the conn, until the
+	// Duration expires, simulating a stalled connection.
+	UploadReadLimit int
+
+	// Web100 contains the web100 messages sent after the download.
+	Web100 []string
+
+	// ClientTestMsg is the TestMsg body sent by the client.
+	ClientTestMsg string
+
+	// DropControl indicates that we should close the control connection
+	// after the download measurement, once.
+	DropControl bool
+
+	// Logins contains the test suites requested by the client's logins.
+	Logins []uint8
+
+	// Addresses contains the addresses dialed by the client.
+	Addresses []string
+
+	// NoKickoff indicates that we should not send the kickoff message.
+	NoKickoff bool
+
+	// Version is the server version, which defaults to v3.7.0.
+	Version string
+
+	// Metadata contains the TestMsg bodies received during the META test.
+	Metadata []string
+
+	// Streams, if greater than one, is the number of parallel streams we
+	// announce when the client requests the extended tests.
+	Streams int
+
+	mconns chan net.Conn
+	once   sync.Once
+}
+
+func (s *FakeServer) Dial(network, address string) (net.Conn, error) {
+	return s.DialContext(context.Background(), network, address)
+}
+
+func (s *FakeServer) DialContext(
+	ctx context.Context, network, address string) (net.Conn, error) {
+	s.init()
+	s.Addresses = append(s.Addresses, address)
+	client, server := net.Pipe()
+	if _, port, _ := net.SplitHostPort(address); port == "3001" {
+		go s.serveControl(server)
+	} else {
+		s.mconns <- server
+	}
+	return client, nil
+}
+
+func (s *FakeServer) init() {
+	s.once.Do(func() {
+		s.mconns = make(chan net.Conn, 1)
+	})
+}
+
+func (s *FakeServer) serveControl(conn net.Conn) {
+	s.init()
+	defer conn.Close()
+	login := make([]byte, 4)
+	if _, err := io.ReadFull(conn, login); err != nil {
+		return
+	}
+	s.Logins = append(s.Logins, login[3])
+	streams := 1
+	if s.Streams > 1 && login[3]&(64|128) != 0 {
+		streams = s.Streams
+	}
+	var testIDs []string
+	for _, id := range strings.Fields(s.TestIDs) {
+		if value, _ := strconv.Atoi(id); login[3]&uint8(value) != 0 {
+			testIDs = append(testIDs, id)
+		}
+	}
+	if !s.NoKickoff {
+		conn.Write([]byte("123456 654321"))
+	}
+	WriteFrame(conn, 1, "0")
+	version := s.Version
+	if version == "" {
+		version = "v3.7.0"
+	}
+	WriteFrame(conn, 2, version)
+	WriteFrame(conn, 2, strings.Join(testIDs, " "))
+	for _, id := range testIDs {
+		switch id {
+		case "4":
+			if !s.serveDownload(conn, streams) {
+				return
+			}
+		case "2":
+			s.serveUpload(conn, streams)
+		case "32":
+			if !s.serveMeta(conn) {
+				return
+			}
+		}
+	}
+	WriteFrame(conn, 8, "results")
+	WriteFrame(conn, 9, "")
+}
+
+// serveDownload returns false if the control conn is not usable anymore.
+func (s *FakeServer) serveDownload(conn net.Conn, streams int) bool {
+	WriteFrame(conn, 3, s.testPrepare("3002", streams))
+	mconns := s.acceptStreams(streams)
+	WriteFrame(conn, 4, "")
+	s.eachStream(mconns, func(mconn net.Conn) {
+		buf := make([]byte, 1<<14)
+		for begin := time.Now(); time.Since(begin) < s.Duration; {
+			if _, err := mconn.Write(buf); err != nil {
+				break
+			}
+		}
+		mconn.Close()
+	})
+	if s.DropControl {
+		s.DropControl = false
+		return false
+	}
+	time.Sleep(s.DownloadStall)
+	WriteFrame(conn, 5, s.DownloadTestMsg)
+	_, body, err := ReadFrame(conn)
+	if err != nil {
+		return false
+	}
+	s.ClientTestMsg = body
+	for _, m := range s.Web100 {
+		WriteFrame(conn, 5, m)
+	}
+	WriteFrame(conn, 6, "")
+	return true
+}
+
+// serveMeta returns false if the control conn is not usable anymore.
+func (s *FakeServer) serveMeta(conn net.Conn) bool {
+	WriteFrame(conn, 3, "")
+	WriteFrame(conn, 4, "")
+	for {
+		_, body, err := ReadFrame(conn)
+		if err != nil {
+			return false
+		}
+		if body == "" {
+			break
+		}
+		s.Metadata = append(s.Metadata, body)
+	}
+	WriteFrame(conn, 6, "")
+	return true
+}
+
+func (s *FakeServer) serveUpload(conn net.Conn, streams int) {
+	WriteFrame(conn, 3, s.testPrepare("3003", streams))
+	mconns := s.acceptStreams(streams)
+	WriteFrame(conn, 4, "")
+	time.Sleep(s.UploadStall)
+	s.eachStream(mconns, func(mconn net.Conn) {
+		buf := make([]byte, 1<<14)
+		var total int
+		for begin := time.Now(); time.Since(begin) < s.Duration; {
+			if s.UploadReadLimit > 0 && total >= s.UploadReadLimit {
+				time.Sleep(s.Duration - time.Since(begin))
+				break
+			}
+			n, err := mconn.Read(buf)
+			if err != nil {
+				break
+			}
+			total += n
+		}
+		mconn.Close()
+	})
+	WriteFrame(conn, 5, s.UploadTestMsg)
+	WriteFrame(conn, 6, "")
+}
+
+// testPrepare returns the TestPrepare message for port, which uses the
+// extended format when announcing several streams.
+func (s *FakeServer) testPrepare(port string, streams int) string {
+	if streams > 1 {
+		return fmt.Sprintf("%s %d 0 0 %d", port, s.Duration.Milliseconds(), streams)
+	}
+	return port
+}
+
+// acceptStreams returns the next streams measurement conns.
+func (s *FakeServer) acceptStreams(streams int) []net.Conn {
+	var mconns []net.Conn
+	for len(mconns) < streams {
+		mconns = append(mconns, <-s.mconns)
+	}
+	return mconns
+}
+
+// eachStream runs serve on each of mconns in parallel and waits for them.
+func (s *FakeServer) eachStream(mconns []net.Conn, serve func(mconn net.Conn)) {
+	var wg sync.WaitGroup
+	for _, mconn := range mconns {
+		wg.Add(1)
+		go func(mconn net.Conn) {
+			defer wg.Done()
+			serve(mconn)
+		}(mconn)
+	}
+	wg.Wait()
+}
+
+// NewFakeServerClient returns a client using the raw transport to
+// connect to the specified FakeServer.
+func NewFakeServerClient(server *FakeServer) *ndt5.Client {
+	protocolFactory := ndt5.NewProtocolFactory5()
+	protocolFactory.ConnectionsFactory = ndt5.NewRawConnectionsFactory(server)
+	client := ndt5.NewClient("ndt5-client-go-testing", "0.1.0", "")
+	client.ProtocolFactory = protocolFactory
+	client.FQDN = "127.0.0.1"
+	return client
+}
+
+// WriteFrame writes a raw ndt5 frame on conn.
+func WriteFrame(conn net.Conn, mtype uint8, message string) error {
+	frame, err := ndt5.NewFrame(mtype, []byte(message))
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(frame.Raw)
+	return err
+}
+
+// ReadFrame reads a raw ndt5 frame from conn.
+func ReadFrame(conn net.Conn) (uint8, string, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, "", err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[1:3]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return 0, "", err
+	}
+	return header[0], string(body), nil
+}
+
+// FaultyProtocolFactory wraps the Protocol created by Factory to inject
+// faults. Each step named in Faults (e.g. "ExpectTestStart") fails once
+// with the given error, after actually running, so that the server does
+// not block; a measurement conn dialed by a failing step is closed.
+type FaultyProtocolFactory struct {
+	Factory ndt5.ProtocolFactory
+	Faults  map[string]error
+
+	mu sync.Mutex
+}
+
+func (f *FaultyProtocolFactory) NewProtocol(
+	ctx context.Context, fqdn, userAgent string, ch chan<- *ndt5.Output) (ndt5.Protocol, error) {
+	proto, err := f.Factory.NewProtocol(ctx, fqdn, userAgent, ch)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyProtocol{Protocol: proto, factory: f}, nil
+}
+
+// fault returns the error of the given step, if any, and forgets it.
+func (f *FaultyProtocolFactory) fault(step string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.Faults[step]
+	delete(f.Faults, step)
+	return err
+}
+
+type faultyProtocol struct {
+	ndt5.Protocol
+	factory *FaultyProtocolFactory
+}
+
+// SetTestSuite forwards to the wrapped Protocol, which we need to reconnect.
+func (p *faultyProtocol) SetTestSuite(suite uint8) {
+	if setter, ok := p.Protocol.(interface{ SetTestSuite(uint8) }); ok {
+		setter.SetTestSuite(suite)
+	}
+}
+
+func (p *faultyProtocol) DialDownloadConn(
+	ctx context.Context, address, userAgent string) (ndt5.MeasurementConn, error) {
+	conn, err := p.Protocol.DialDownloadConn(ctx, address, userAgent)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.factory.fault("DialDownloadConn"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (p *faultyProtocol) ExpectTestStart() error {
+	if err := p.Protocol.ExpectTestStart(); err != nil {
+		return err
+	}
+	return p.factory.fault("ExpectTestStart")
+}
+
+func (p *faultyProtocol) ExpectTestMsg() (*ndt5.TestMsg, error) {
+	msg, err := p.Protocol.ExpectTestMsg()
+	if err == nil {
+		err = p.factory.fault("ExpectTestMsg")
+	}
+	return msg, err
+}
+
+func (p *faultyProtocol) ExpectTestFinalize() error {
+	if err := p.Protocol.ExpectTestFinalize(); err != nil {
+		return err
+	}
+	return p.factory.fault("ExpectTestFinalize")
+}
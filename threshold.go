@@ -0,0 +1,51 @@
+package ndt5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrBelowThreshold is the warning emitted when the measured speed is
+// below Client.MinDownload or Client.MinUpload.
+var ErrBelowThreshold = errors.New("speed is below the minimum")
+
+// BelowThresholdError is the warning emitted when the measured speed is
+// below the configured minimum. It wraps ErrBelowThreshold, so that
+// errors.Is(err, ErrBelowThreshold) works.
+type BelowThresholdError struct {
+	// Direction is "download" or "upload".
+	Direction string
+
+	// Speed is the measured speed in kbit/s.
+	Speed float64
+
+	// Threshold is the minimum speed in kbit/s.
+	Threshold float64
+}
+
+// Error implements error.Error.
+func (e *BelowThresholdError) Error() string {
+	return fmt.Sprintf("%s %s: %.1f kbit/s < %.1f kbit/s", e.Direction,
+		ErrBelowThreshold.Error(), e.Speed, e.Threshold)
+}
+
+// Unwrap returns ErrBelowThreshold.
+func (e *BelowThresholdError) Unwrap() error {
+	return ErrBelowThreshold
+}
+
+// checkThreshold emits a BelowThresholdError warning and records the
+// direction in Result.BelowThreshold if speed is below threshold. A zero
+// threshold disables the check.
+func (c *Client) checkThreshold(ctx context.Context, direction string, speed, threshold float64, ch chan<- *Output) {
+	if threshold <= 0 || speed >= threshold {
+		return
+	}
+	c.Result.BelowThreshold = append(c.Result.BelowThreshold, direction)
+	c.emitWarning(ctx, &BelowThresholdError{
+		Direction: direction,
+		Speed:     speed,
+		Threshold: threshold,
+	}, ch)
+}
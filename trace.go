@@ -0,0 +1,96 @@
+package ndt5
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FrameTraceTimeFormat is the format of the timestamps written by the
+// FrameTraceObserverFactory, which you should pass to text2pcap as
+// "%Y-%m-%dT%H:%M:%S." (the trailing dot parses the microseconds).
+const FrameTraceTimeFormat = "2006-01-02T15:04:05.000000"
+
+// FrameTraceObserverFactory is a FrameReadWriteObserverFactory writing the
+// control frames to a writer as a text2pcap-compatible hex dump, which you
+// can import into Wireshark, e.g., when filing interoperability bugs:
+//
+//	text2pcap -D -t "%Y-%m-%dT%H:%M:%S." -T 50000,3001 trace.txt trace.pcap
+//
+// Each frame is preceded by "I" when read and by "O" when written, and by
+// its UTC timestamp (see FrameTraceTimeFormat). The dump contains the raw
+// ndt5 frames regardless of the transport, i.e., without the WebSocket
+// framing. A factory may be shared by several clients and connections,
+// whose frames are then interleaved.
+type FrameTraceObserverFactory struct {
+	// Next is the optional factory of the observer to which we forward
+	// the frames after tracing them, e.g., to also log them.
+	Next FrameReadWriteObserverFactory
+
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// NewFrameTraceObserverFactory creates a new FrameTraceObserverFactory
+// writing to w.
+func NewFrameTraceObserverFactory(w io.Writer) *FrameTraceObserverFactory {
+	return &FrameTraceObserverFactory{w: w}
+}
+
+// New implements FrameReadWriteObserverFactory.New.
+func (f *FrameTraceObserverFactory) New(out chan<- *Output) FrameReadWriteObserver {
+	observer := &frameTraceObserver{factory: f}
+	if f.Next != nil {
+		observer.next = f.Next.New(out)
+	}
+	return observer
+}
+
+// Err returns the first error that occurred writing the trace, after
+// which we stopped writing it.
+func (f *FrameTraceObserverFactory) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// trace writes frame to the trace using the given direction indicator.
+func (f *FrameTraceObserverFactory) trace(direction string, frame *Frame) {
+	builder := new(strings.Builder)
+	fmt.Fprintf(builder, "%s %s\n", direction, time.Now().UTC().Format(FrameTraceTimeFormat))
+	for offset := 0; offset < len(frame.Raw); offset += 16 {
+		fmt.Fprintf(builder, "%06x", offset)
+		for _, b := range frame.Raw[offset:min(offset+16, len(frame.Raw))] {
+			fmt.Fprintf(builder, " %02x", b)
+		}
+		builder.WriteString("\n")
+	}
+	builder.WriteString("\n")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err == nil {
+		_, f.err = io.WriteString(f.w, builder.String())
+	}
+}
+
+type frameTraceObserver struct {
+	factory *FrameTraceObserverFactory
+	next    FrameReadWriteObserver
+}
+
+func (observer *frameTraceObserver) OnRead(frame *Frame) {
+	observer.factory.trace("I", frame)
+	if observer.next != nil {
+		observer.next.OnRead(frame)
+	}
+}
+
+func (observer *frameTraceObserver) OnWrite(frame *Frame) {
+	observer.factory.trace("O", frame)
+	if observer.next != nil {
+		observer.next.OnWrite(frame)
+	}
+}
@@ -0,0 +1,71 @@
+package ndt5_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt5-client-go"
+)
+
+func TestUnitFrameTraceObserverFactory(t *testing.T) {
+	server := &FakeServer{
+		TestIDs:       "2",
+		Duration:      100 * time.Millisecond,
+		UploadTestMsg: "1000",
+	}
+	client := NewFakeServerClient(server)
+	client.DisableMetadata = true
+	buf := new(bytes.Buffer)
+	trace := ndt5.NewFrameTraceObserverFactory(buf)
+	client.ProtocolFactory.(*ndt5.ProtocolFactory5).ObserverFactory = trace
+	ch, err := client.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ev := range ch {
+		if ev.ErrorMessage != nil {
+			t.Fatal(ev.ErrorMessage.Error)
+		}
+	}
+	if trace.Err() != nil {
+		t.Fatal(trace.Err())
+	}
+	packets := strings.Split(strings.TrimSpace(buf.String()), "\n\n")
+	if len(packets) < 2 {
+		t.Fatalf("unexpected trace: %q", buf.String())
+	}
+	// We write the login message and we read the queue message "0".
+	for i, expect := range []struct {
+		direction string
+		dump      string
+	}{
+		{"O", "000000 02 00 01 16"},
+		{"I", "000000 01 00 01 30"},
+	} {
+		lines := strings.Split(packets[i], "\n")
+		if len(lines) != 2 || lines[0][:2] != expect.direction+" " || lines[1] != expect.dump {
+			t.Fatalf("unexpected packet: %q", packets[i])
+		}
+		if _, err := time.Parse(ndt5.FrameTraceTimeFormat, lines[0][2:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUnitFrameTraceObserverFactoryWriteError(t *testing.T) {
+	trace := ndt5.NewFrameTraceObserverFactory(FailingWriter{})
+	frame, err := ndt5.NewFrame(1, []byte("0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	observer := trace.New(nil)
+	observer.OnRead(frame)
+	observer.OnWrite(frame)
+	if !errors.Is(trace.Err(), ErrMocked) {
+		t.Fatalf("unexpected error: %v", trace.Err())
+	}
+}
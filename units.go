@@ -0,0 +1,66 @@
+package ndt5
+
+import (
+	"fmt"
+	"math"
+)
+
+// ThroughputUnit is a unit of measurement of throughput. We always store
+// the speeds in their canonical form (i.e. bytes and elapsed time for the
+// client-measured ones and kbit/s for the server-measured ones), so use
+// this type to present them in the unit the user prefers.
+type ThroughputUnit string
+
+// These are the supported units.
+const (
+	UnitKbitps = ThroughputUnit("kbit/s")
+	UnitMbitps = ThroughputUnit("Mbit/s")
+	UnitGbitps = ThroughputUnit("Gbit/s")
+	UnitMBps   = ThroughputUnit("MB/s")
+)
+
+// ThroughputUnits returns all the supported units.
+func ThroughputUnits() []ThroughputUnit {
+	return []ThroughputUnit{UnitKbitps, UnitMbitps, UnitGbitps, UnitMBps}
+}
+
+// ParseThroughputUnit returns the unit called s (e.g. "Mbit/s").
+func ParseThroughputUnit(s string) (ThroughputUnit, error) {
+	for _, unit := range ThroughputUnits() {
+		if string(unit) == s {
+			return unit, nil
+		}
+	}
+	return "", fmt.Errorf("unknown throughput unit: %q", s)
+}
+
+// FromBitsPerSecond converts bps, in bit/s, to this unit. It returns NaN
+// if this unit is not one of the supported units.
+func (u ThroughputUnit) FromBitsPerSecond(bps float64) float64 {
+	switch u {
+	case UnitKbitps:
+		return bps / 1e3
+	case UnitMbitps:
+		return bps / 1e6
+	case UnitGbitps:
+		return bps / 1e9
+	case UnitMBps:
+		return bps / 8 / 1e6
+	default:
+		return math.NaN()
+	}
+}
+
+// FromKbitps is like FromBitsPerSecond but converts kbitps, in kbit/s,
+// like the speeds measured by the server.
+func (u ThroughputUnit) FromKbitps(kbitps float64) float64 {
+	return u.FromBitsPerSecond(kbitps * 1e3)
+}
+
+// In returns the speed in the given unit, or zero if no time elapsed.
+func (s Speed) In(unit ThroughputUnit) float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return unit.FromBitsPerSecond(8 * float64(s.Count) / s.Elapsed.Seconds())
+}
@@ -0,0 +1,43 @@
+package ndt5_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt5-client-go"
+)
+
+func TestUnitThroughputUnits(t *testing.T) {
+	// 12.5 MB in one second is 100 Mbit/s.
+	speed := ndt5.Speed{Count: 12_500_000, Elapsed: time.Second}
+	for _, tc := range []struct {
+		unit   ndt5.ThroughputUnit
+		expect float64
+	}{
+		{ndt5.UnitKbitps, 100_000},
+		{ndt5.UnitMbitps, 100},
+		{ndt5.UnitGbitps, 0.1},
+		{ndt5.UnitMBps, 12.5},
+	} {
+		if got := speed.In(tc.unit); math.Abs(got-tc.expect) > 1e-9 {
+			t.Errorf("%s: expected %f, got %f", tc.unit, tc.expect, got)
+		}
+		if got := tc.unit.FromKbitps(100_000); math.Abs(got-tc.expect) > 1e-9 {
+			t.Errorf("%s: expected %f, got %f", tc.unit, tc.expect, got)
+		}
+		unit, err := ndt5.ParseThroughputUnit(string(tc.unit))
+		if err != nil || unit != tc.unit {
+			t.Errorf("%s: cannot parse: %v", tc.unit, err)
+		}
+	}
+	if got := (ndt5.Speed{Count: 1}).In(ndt5.UnitMbitps); got != 0 {
+		t.Fatalf("expected zero without elapsed time, got %f", got)
+	}
+	if _, err := ndt5.ParseThroughputUnit("furlongs/fortnight"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if got := ndt5.ThroughputUnit("bogus").FromBitsPerSecond(1); !math.IsNaN(got) {
+		t.Fatalf("expected NaN, got %f", got)
+	}
+}
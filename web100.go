@@ -0,0 +1,54 @@
+package ndt5
+
+// These are the keys of the web100 variables, sent by the server after the
+// download, that we know about. See TestResult.Web100. M-Lab servers send
+// the NDTResult and TCPInfo variables, while the others are legacy web100
+// variables sent by older servers.
+const (
+	// Web100KeyServerIP is the IP address of the server.
+	Web100KeyServerIP = "NDTResult.S2C.ServerIP"
+
+	// Web100KeyClientIP is the IP address of the client seen by the server.
+	Web100KeyClientIP = "NDTResult.S2C.ClientIP"
+
+	// Web100KeyUUID is the UUID of the download measurement.
+	Web100KeyUUID = "NDTResult.S2C.UUID"
+
+	// Web100KeyMinRTT is the minimum RTT in microseconds.
+	Web100KeyMinRTT = "TCPInfo.MinRTT"
+
+	// Web100KeyRTT is the smoothed RTT in microseconds.
+	Web100KeyRTT = "TCPInfo.RTT"
+
+	// Web100KeyBytesRetrans is the number of bytes retransmitted.
+	Web100KeyBytesRetrans = "TCPInfo.BytesRetrans"
+
+	// Web100KeyBytesSent is the number of bytes sent, including the
+	// retransmitted bytes.
+	Web100KeyBytesSent = "TCPInfo.BytesSent"
+
+	// Web100KeyCurCwnd is the legacy congestion window in bytes.
+	Web100KeyCurCwnd = "CurCwnd"
+
+	// Web100KeySndbuf is the legacy send buffer size in bytes.
+	Web100KeySndbuf = "X_Sndbuf"
+
+	// Web100KeySmoothedRTT is the legacy smoothed RTT in milliseconds.
+	Web100KeySmoothedRTT = "SmoothedRTT"
+)
+
+// KnownWeb100Keys returns the keys of the web100 variables we know about.
+func KnownWeb100Keys() []string {
+	return []string{
+		Web100KeyServerIP,
+		Web100KeyClientIP,
+		Web100KeyUUID,
+		Web100KeyMinRTT,
+		Web100KeyRTT,
+		Web100KeyBytesRetrans,
+		Web100KeyBytesSent,
+		Web100KeyCurCwnd,
+		Web100KeySndbuf,
+		Web100KeySmoothedRTT,
+	}
+}
@@ -0,0 +1,25 @@
+package ndt5_test
+
+import (
+	"testing"
+
+	"github.com/m-lab/ndt5-client-go"
+)
+
+func TestUnitKnownWeb100Keys(t *testing.T) {
+	keys := ndt5.KnownWeb100Keys()
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if key == "" || seen[key] {
+			t.Fatalf("empty or duplicate key: %q", key)
+		}
+		seen[key] = true
+	}
+	if !seen[ndt5.Web100KeyMinRTT] {
+		t.Fatal("expected Web100KeyMinRTT to be known")
+	}
+	keys[0] = "" // make sure we get a copy
+	if ndt5.KnownWeb100Keys()[0] == "" {
+		t.Fatal("expected a copy of the keys")
+	}
+}
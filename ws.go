@@ -2,6 +2,7 @@ package ndt5
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -12,6 +13,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -20,8 +22,66 @@ import (
 
 // WSConnectionsFactory creates ndt5+wss connections
 type WSConnectionsFactory struct {
+	// Dialer is the dialer used for the control connection and by DialEx
+	// and, with the ReadBufferSize and WriteBufferSize below, for measurement
+	// ones. NewWSConnectionsFactory sets its buffer sizes to 1 MiB, so that
+	// changing ReadBufferSize and WriteBufferSize does not affect the
+	// control connection and DialEx.
 	Dialer *websocket.Dialer
 	URL    *url.URL
+
+	// ReadBufferSize and WriteBufferSize are the sizes in bytes of the I/O
+	// buffers of measurement connections, which benefit from large buffers
+	// on fast links. NewWSConnectionsFactory sets both to 1 MiB; you may
+	// want smaller buffers on constrained devices. Zero means using the
+	// buffer sizes of Dialer.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// KeepaliveInterval is the interval at which we send WebSocket ping
+	// frames on the control connection, to prevent intermediaries from
+	// closing it while idle (e.g. while waiting in queue). Pings are
+	// WebSocket control frames and do not interfere with the ndt5 framing.
+	// Pings sent by the server are answered while reading frames. Zero,
+	// the default, means that we don't send pings.
+	KeepaliveInterval time.Duration
+
+	// CongestionControl is the optional TCP congestion control algorithm
+	// (e.g. "cubic" or "bbr") to use for measurement connections. This is
+	// only supported on Linux and, when empty, we use the system default.
+	CongestionControl string
+
+	// EnableNagle enables Nagle's algorithm (i.e. clears TCP_NODELAY) on
+	// measurement connections, which Go disables by default. It has no
+	// effect on connections that are not TCP connections.
+	EnableNagle bool
+
+	// AccessToken is the optional access token required by token-gated
+	// servers. When set, we pass it as the access_token query parameter
+	// of the control and measurement connections' URLs.
+	AccessToken string
+
+	// ReadKickoff indicates that the server sends the kickoff message as
+	// a binary WebSocket message, which we then read and validate, failing
+	// with ErrProtocolMismatch if we get a text message instead. By default,
+	// we assume that, like most ndt5+wss servers, it does not send it.
+	ReadKickoff bool
+
+	// Control is the optional function called with the socket of each
+	// connection before connecting it, e.g., to set socket options. It
+	// requires the dialer passed to NewWSConnectionsFactory to be a
+	// *net.Dialer; otherwise, dialing fails with ErrControlNotSupported.
+	// When set, it replaces the NetDial functions of Dialer.
+	Control ControlFunc
+
+	// LocalPortRange is the optional range of local ports to which we bind
+	// measurement connections, e.g., for firewall rules keying on the source
+	// port. We try the next port when a port is in use. Like Control, it
+	// requires a *net.Dialer, otherwise dialing measurement connections fails
+	// with ErrLocalPortNotSupported, and replaces the NetDial functions.
+	LocalPortRange PortRange
+
+	dialer NetDialer
 }
 
 // defaultURL creates the default url for connecting to the NDT wss server.
@@ -46,7 +106,10 @@ func NewWSConnectionsFactory(dialer NetDialer, u *url.URL) *WSConnectionsFactory
 			ReadBufferSize:   bufferSize,
 			WriteBufferSize:  bufferSize,
 		},
-		URL: u,
+		URL:             u,
+		ReadBufferSize:  bufferSize,
+		WriteBufferSize: bufferSize,
+		dialer:          dialer,
 	}
 }
 
@@ -54,15 +117,22 @@ func NewWSConnectionsFactory(dialer NetDialer, u *url.URL) *WSConnectionsFactory
 func (cf *WSConnectionsFactory) DialControlConn(
 	ctx context.Context, address, userAgent string) (ControlConn, error) {
 	u := *cf.URL
-	u.Host = net.JoinHostPort(address, "3010")
+	u.Host = withDefaultPort(address, "3010")
 	conn, err := cf.DialEx(ctx, u, "ndt", userAgent)
 	if err != nil {
 		return nil, err
 	}
-	return &wsControlConn{
-		conn:     conn,
-		observer: new(defaultFrameReadWriteObserver),
-	}, nil
+	cc := &wsControlConn{
+		conn:        conn,
+		done:        make(chan struct{}),
+		observer:    new(defaultFrameReadWriteObserver),
+		readKickoff: cf.ReadKickoff,
+	}
+	conn.SetPongHandler(cc.onPong)
+	if cf.KeepaliveInterval > 0 {
+		go cc.keepalive(cf.KeepaliveInterval)
+	}
+	return cc, nil
 }
 
 // DialMeasurementConn implements ConnectionsFactory.DialMeasurementConn.
@@ -70,27 +140,155 @@ func (cf *WSConnectionsFactory) DialMeasurementConn(
 	ctx context.Context, address, userAgent string) (MeasurementConn, error) {
 	u := *cf.URL
 	u.Host = address
-	conn, err := cf.DialEx(ctx, u, "ndt", userAgent)
+	conn, err := cf.dialEx(ctx, cf.measurementDialer(), u, "ndt", userAgent, cf.LocalPortRange)
 	if err != nil {
 		return nil, err
 	}
+	if cf.CongestionControl != "" {
+		err := setCongestionControl(conn.UnderlyingConn(), cf.CongestionControl)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if cf.EnableNagle {
+		if err := enableNagle(conn.UnderlyingConn()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
 	return &wsMeasurementConn{conn: conn}, nil
 }
 
+// setServerName configures TLS to verify the given server name, which
+// we need when we're dialing an IP address.
+func (cf *WSConnectionsFactory) setServerName(serverName string) {
+	config := &tls.Config{}
+	if cf.Dialer.TLSClientConfig != nil {
+		config = cf.Dialer.TLSClientConfig.Clone()
+	}
+	config.ServerName = serverName
+	cf.Dialer.TLSClientConfig = config
+}
+
 // DialEx is the extended WebSocket dial function
 func (cf *WSConnectionsFactory) DialEx(
 	ctx context.Context, u url.URL, wsProtocol, userAgent string,
 ) (*websocket.Conn, error) {
+	return cf.dialEx(ctx, cf.Dialer, u, wsProtocol, userAgent, PortRange{})
+}
+
+// measurementDialer returns a copy of Dialer using the ReadBufferSize and
+// WriteBufferSize of measurement connections, when set.
+func (cf *WSConnectionsFactory) measurementDialer() *websocket.Dialer {
+	copied := *cf.Dialer
+	if cf.ReadBufferSize > 0 {
+		copied.ReadBufferSize = cf.ReadBufferSize
+	}
+	if cf.WriteBufferSize > 0 {
+		copied.WriteBufferSize = cf.WriteBufferSize
+	}
+	return &copied
+}
+
+// dialEx is like DialEx but uses the given websocket.Dialer and binds the
+// connection to a local port in ports, unless ports is zero.
+func (cf *WSConnectionsFactory) dialEx(
+	ctx context.Context, wsDialer *websocket.Dialer, u url.URL,
+	wsProtocol, userAgent string, ports PortRange,
+) (*websocket.Conn, error) {
+	if cf.AccessToken != "" {
+		query := u.Query()
+		query.Set("access_token", cf.AccessToken)
+		u.RawQuery = query.Encode()
+	}
 	headers := http.Header{}
 	headers.Add("Sec-WebSocket-Protocol", wsProtocol)
 	headers.Add("User-Agent", userAgent)
-	conn, _, err := cf.Dialer.DialContext(ctx, u.String(), headers)
+	if cf.Control != nil || !ports.IsZero() {
+		dialer, err := withControl(cf.dialer, cf.Control)
+		if err != nil {
+			return nil, err
+		}
+		if dialer, err = withLocalPortRange(dialer, ports); err != nil {
+			return nil, err
+		}
+		copied := *wsDialer
+		copied.NetDial, copied.NetDialContext = dialer.Dial, dialer.DialContext
+		wsDialer = &copied
+	}
+	conn, resp, err := wsDialer.DialContext(ctx, u.String(), headers)
+	if err != nil && resp != nil {
+		err = &WSHandshakeError{StatusCode: resp.StatusCode, Err: err}
+	}
 	return conn, err
 }
 
+// ErrWSHandshake indicates that the server rejected the WebSocket
+// handshake with an HTTP error. See WSHandshakeError.
+var ErrWSHandshake = errors.New("WebSocket handshake failed")
+
+// WSHandshakeError is the error returned by DialEx when the server rejects
+// the WebSocket handshake with an HTTP error. It wraps ErrWSHandshake as
+// well as the error returned by the websocket.Dialer.
+type WSHandshakeError struct {
+	// StatusCode is the HTTP status code of the handshake response.
+	StatusCode int
+
+	// Err is the error returned by the websocket.Dialer.
+	Err error
+}
+
+// Error implements error.Error.
+func (e *WSHandshakeError) Error() string {
+	return fmt.Sprintf("%s (HTTP status %d): %s", ErrWSHandshake.Error(), e.StatusCode, e.Err.Error())
+}
+
+// Unwrap returns ErrWSHandshake and the error returned by the dialer.
+func (e *WSHandshakeError) Unwrap() []error {
+	return []error{ErrWSHandshake, e.Err}
+}
+
+// ServerBusy returns whether the status code indicates that the server is
+// busy or overloaded (i.e. 429 or 503), in which case you may want to retry
+// using another server. Other status codes usually indicate a protocol or
+// configuration error, e.g., a wrong URL or a missing access token, in
+// which case retrying won't help.
+func (e *WSHandshakeError) ServerBusy() bool {
+	return e.StatusCode == http.StatusTooManyRequests ||
+		e.StatusCode == http.StatusServiceUnavailable
+}
+
 type wsControlConn struct {
 	conn     *websocket.Conn
+	done     chan struct{}
+	once     sync.Once
 	observer FrameReadWriteObserver
+
+	// readKickoff indicates that the server sends the kickoff message.
+	readKickoff bool
+
+	mu   sync.Mutex
+	rtts []time.Duration
+}
+
+// keepalive periodically sends ping frames until the conn is closed.
+func (cc *wsControlConn) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cc.done:
+			return
+		case <-ticker.C:
+			// Note that WriteControl may be called concurrently with
+			// the other methods writing on the conn.
+			deadline := time.Now().Add(interval)
+			if err := cc.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				return
+			}
+		}
+	}
 }
 
 func (cc *wsControlConn) SetFrameReadWriteObserver(observer FrameReadWriteObserver) {
@@ -109,6 +307,34 @@ type wsLoginMessage struct {
 	Tests string `json:"tests"`
 }
 
+// SendRTTProbe implements RTTProber.SendRTTProbe. The probe is a ping
+// whose payload is the time when we sent it.
+func (cc *wsControlConn) SendRTTProbe() error {
+	payload := strconv.FormatInt(time.Now().UnixNano(), 10)
+	deadline := time.Now().Add(time.Second)
+	return cc.conn.WriteControl(websocket.PingMessage, []byte(payload), deadline)
+}
+
+// onPong records the RTT of the probe that the pong replies to. It
+// ignores the pongs that reply to keepalive pings.
+func (cc *wsControlConn) onPong(payload string) error {
+	sent, err := strconv.ParseInt(payload, 10, 64)
+	if err != nil {
+		return nil
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.rtts = append(cc.rtts, time.Since(time.Unix(0, sent)))
+	return nil
+}
+
+// RTTSamples implements RTTProber.RTTSamples.
+func (cc *wsControlConn) RTTSamples() []time.Duration {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return append([]time.Duration(nil), cc.rtts...)
+}
+
 func (cc *wsControlConn) WriteLogin(versionCompat string, testSuite byte) error {
 	return cc.writeJSON(msgExtendedLogin, wsLoginMessage{
 		Msg:   versionCompat,
@@ -117,6 +343,26 @@ func (cc *wsControlConn) WriteLogin(versionCompat string, testSuite byte) error
 }
 
 func (cc *wsControlConn) ReadKickoffMessage(b []byte) error {
+	if cc.readKickoff {
+		mtype, data, err := cc.conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if mtype == websocket.TextMessage {
+			return fmt.Errorf("ws: expected BinaryMessage kickoff, got TextMessage: %w",
+				ErrProtocolMismatch)
+		}
+		if mtype != websocket.BinaryMessage {
+			return errors.New("ws: expected BinaryMessage kickoff")
+		}
+		// The kickoff is not a ndt5 frame, so it has no type.
+		cc.observer.OnRead(&Frame{Message: data, Raw: data})
+		if len(data) != len(b) {
+			return ErrInvalidKickoff
+		}
+		copy(b, data)
+		return nil
+	}
 	// Here we pretend that we're reading the kickoff message but there is
 	// no such kickoff message on the wire with WebSocket
 	copy(b, kickoffMessage)
@@ -130,12 +376,28 @@ type wsMessage struct {
 	UnsentDataAmount string
 }
 
+// legacyValue returns the message value in the legacy plain-text format.
+// There is a bunch of JSON message possibilities. The approach here is to
+// reconstruct what a raw client would have sent us.
+func (msg wsMessage) legacyValue() string {
+	if msg.ThroughputValue != "" && msg.UnsentDataAmount != "" && msg.TotalSentByte != "" {
+		return fmt.Sprintf(
+			"%s %s %s", msg.ThroughputValue, msg.UnsentDataAmount, msg.TotalSentByte,
+		)
+	}
+	return msg.Msg
+}
+
 func (cc *wsControlConn) ReadFrame() (*Frame, error) {
 	// <type: uint8> <length: uint16> <message: [0..65536]byte>
 	mtype, mdata, err := cc.conn.ReadMessage()
 	if err != nil {
 		return nil, err
 	}
+	if mtype == websocket.TextMessage {
+		return nil, fmt.Errorf("ws: expected BinaryMessage, got TextMessage: %w",
+			ErrProtocolMismatch)
+	}
 	if mtype != websocket.BinaryMessage {
 		return nil, errors.New("ws: expected BinaryMessage")
 	}
@@ -154,16 +416,7 @@ func (cc *wsControlConn) ReadFrame() (*Frame, error) {
 	if err := json.Unmarshal(mdata[3:size], &msg); err != nil {
 		return nil, err
 	}
-	// There is a bunch of JSON message possibilities. The approach here
-	// is to reconstruct what a raw client would have sent us.
-	var messagevalue string
-	if msg.ThroughputValue != "" && msg.UnsentDataAmount != "" && msg.TotalSentByte != "" {
-		messagevalue = fmt.Sprintf(
-			"%s %s %s", msg.ThroughputValue, msg.UnsentDataAmount, msg.TotalSentByte,
-		)
-	} else {
-		messagevalue = msg.Msg
-	}
+	messagevalue := msg.legacyValue()
 	// We don't bother with fixing up the raw message; indeed we want
 	// such message to contain JSON for debugging. Upstream users will
 	// be using just the Message and Type fields anyway.
@@ -197,14 +450,49 @@ func (cc *wsControlConn) WriteFrame(frame *Frame) error {
 	return cc.conn.WriteMessage(websocket.BinaryMessage, frame.Raw)
 }
 
+func (cc *wsControlConn) Transport() (string, string) {
+	if version := tlsVersion(cc.conn.UnderlyingConn()); version != "" {
+		return "wss", version
+	}
+	return "ws", ""
+}
+
+func (cc *wsControlConn) RemoteAddr() net.Addr {
+	return cc.conn.RemoteAddr()
+}
+
 func (cc *wsControlConn) Close() error {
+	cc.once.Do(func() {
+		close(cc.done)
+	})
 	return cc.conn.Close()
 }
 
+// ErrAbnormalClose indicates that the server closed the WebSocket
+// measurement connection with a code other than the normal closure (1000),
+// e.g., 1006 when the connection dropped without a close frame or 1011
+// when the server failed. The error also contains the close code.
+var ErrAbnormalClose = errors.New("the measurement connection was closed abnormally")
+
+// classifyClose maps a normal WebSocket closure to io.EOF, since it's the
+// expected end of the test, and an abnormal closure to ErrAbnormalClose.
+// Other errors are returned unchanged.
+func classifyClose(err error) error {
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) {
+		return err
+	}
+	if ce.Code == websocket.CloseNormalClosure {
+		return io.EOF
+	}
+	return fmt.Errorf("%w: code %d: %w", ErrAbnormalClose, ce.Code, err)
+}
+
 type wsMeasurementConn struct {
 	conn     *websocket.Conn
 	prepared *websocket.PreparedMessage
-	prepsiz  int
+	prepraw  []byte
+	capture  io.Writer
 }
 
 func (mc *wsMeasurementConn) SetDeadline(deadline time.Time) (err error) {
@@ -221,9 +509,13 @@ func (mc *wsMeasurementConn) AllocReadBuffer(bufsiz int) {
 func (mc *wsMeasurementConn) ReadDiscard() (int64, error) {
 	_, reader, err := mc.conn.NextReader()
 	if err != nil {
-		return 0, err
+		return 0, classifyClose(err)
 	}
-	return io.Copy(ioutil.Discard, reader)
+	if mc.capture != nil {
+		reader = io.TeeReader(reader, mc.capture)
+	}
+	n, err := io.Copy(ioutil.Discard, reader)
+	return n, classifyClose(err)
 }
 
 func (mc *wsMeasurementConn) SetPreparedMessage(b []byte) {
@@ -232,13 +524,38 @@ func (mc *wsMeasurementConn) SetPreparedMessage(b []byte) {
 	)
 	rtx.PanicOnError(err, "websocket.NewPreparedMessage failed unexpectedly")
 	mc.prepared = pm
-	mc.prepsiz = len(b)
+	mc.prepraw = b
 }
 
 func (mc *wsMeasurementConn) WritePreparedMessage() (int, error) {
 	// We assume the prepared message has been initialized
 	err := mc.conn.WritePreparedMessage(mc.prepared)
-	return mc.prepsiz, err
+	if mc.capture != nil && err == nil {
+		mc.capture.Write(mc.prepraw)
+	}
+	return len(mc.prepraw), err
+}
+
+// SetCapture sets the writer to which we copy the payload we read
+// and write. The writer must not fail.
+func (mc *wsMeasurementConn) SetCapture(w io.Writer) {
+	mc.capture = w
+}
+
+func (mc *wsMeasurementConn) CongestionControl() (string, error) {
+	return getCongestionControl(mc.conn.UnderlyingConn())
+}
+
+func (mc *wsMeasurementConn) MSS() (int, error) {
+	return getMSS(mc.conn.UnderlyingConn())
+}
+
+func (mc *wsMeasurementConn) LocalAddr() net.Addr {
+	return mc.conn.LocalAddr()
+}
+
+func (mc *wsMeasurementConn) RemoteAddr() net.Addr {
+	return mc.conn.RemoteAddr()
 }
 
 func (mc *wsMeasurementConn) Close() error {
@@ -0,0 +1,563 @@
+package ndt5_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-lab/ndt5-client-go"
+)
+
+// NewWSServer starts a WebSocket server running handler for each conn
+// and returns it along with a factory connecting to it.
+func NewWSServer(
+	t *testing.T, handler func(conn *websocket.Conn),
+) (*httptest.Server, *ndt5.WSConnectionsFactory) {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"ndt"}}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			handler(conn)
+		}))
+	t.Cleanup(server.Close)
+	factory := ndt5.NewWSConnectionsFactory(
+		&RedirectDialer{Address: server.Listener.Addr().String()},
+		&url.URL{Scheme: "ws", Path: "/ndt_protocol"},
+	)
+	return server, factory
+}
+
+func TestUnitWSControlConnKeepalive(t *testing.T) {
+	var pings int64
+	_, factory := NewWSServer(t, func(conn *websocket.Conn) {
+		conn.SetPingHandler(func(string) error {
+			atomic.AddInt64(&pings, 1)
+			return nil
+		})
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+	factory.KeepaliveInterval = 10 * time.Millisecond
+	cc, err := factory.DialControlConn(context.Background(), "127.0.0.1", UserAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := cc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt64(&pings) < 1 {
+		t.Fatal("expected to see at least one ping here")
+	}
+}
+
+func TestUnitWSControlConnNoKeepaliveByDefault(t *testing.T) {
+	var pings int64
+	_, factory := NewWSServer(t, func(conn *websocket.Conn) {
+		conn.SetPingHandler(func(string) error {
+			atomic.AddInt64(&pings, 1)
+			return nil
+		})
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+	cc, err := factory.DialControlConn(context.Background(), "127.0.0.1", UserAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	cc.Close()
+	if atomic.LoadInt64(&pings) != 0 {
+		t.Fatal("expected to see no pings here")
+	}
+}
+
+func TestUnitWSControlConnReadFrameTextMessage(t *testing.T) {
+	_, factory := NewWSServer(t, func(conn *websocket.Conn) {
+		conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+		conn.ReadMessage() // wait for the client to close
+	})
+	cc, err := factory.DialControlConn(context.Background(), "127.0.0.1", UserAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	frame, err := cc.ReadFrame()
+	if !errors.Is(err, ndt5.ErrProtocolMismatch) {
+		t.Fatal("expected ndt5.ErrProtocolMismatch here")
+	}
+	if frame != nil {
+		t.Fatal("expected nil frame here")
+	}
+}
+
+func TestUnitWSConnectionsFactoryAccessToken(t *testing.T) {
+	tokens := make(chan string, 1)
+	upgrader := websocket.Upgrader{Subprotocols: []string{"ndt"}}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			tokens <- r.URL.Query().Get("access_token")
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}))
+	defer server.Close()
+	factory := ndt5.NewWSConnectionsFactory(
+		&RedirectDialer{Address: server.Listener.Addr().String()},
+		&url.URL{Scheme: "ws", Path: "/ndt_protocol"},
+	)
+	factory.AccessToken = "xyz"
+	cc, err := factory.DialControlConn(context.Background(), "127.0.0.1", UserAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	if token := <-tokens; token != "xyz" {
+		t.Fatalf("unexpected access token: %q", token)
+	}
+}
+
+func TestUnitWSMeasurementConnClose(t *testing.T) {
+	for _, tc := range []struct {
+		code     int
+		expectOK bool
+	}{
+		{websocket.CloseNormalClosure, true},
+		{websocket.CloseInternalServerErr, false},
+		{websocket.CloseGoingAway, false},
+	} {
+		_, factory := NewWSServer(t, func(conn *websocket.Conn) {
+			conn.WriteMessage(websocket.BinaryMessage, make([]byte, 1024))
+			conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(tc.code, ""))
+		})
+		mc, err := factory.DialMeasurementConn(context.Background(), "127.0.0.1", UserAgent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := mc.ReadDiscard(); n != 1024 || err != nil {
+			t.Fatalf("unexpected read: %d %v", n, err)
+		}
+		_, err = mc.ReadDiscard()
+		if tc.expectOK && err != io.EOF {
+			t.Fatalf("%d: expected io.EOF, got %v", tc.code, err)
+		}
+		if !tc.expectOK && (!errors.Is(err, ndt5.ErrAbnormalClose) ||
+			!strings.Contains(err.Error(), fmt.Sprintf("code %d", tc.code))) {
+			t.Fatalf("%d: unexpected error: %v", tc.code, err)
+		}
+		mc.Close()
+	}
+}
+
+func TestUnitWSMeasurementConnDropped(t *testing.T) {
+	_, factory := NewWSServer(t, func(conn *websocket.Conn) {
+		conn.UnderlyingConn().Close() // no close frame
+	})
+	mc, err := factory.DialMeasurementConn(context.Background(), "127.0.0.1", UserAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+	_, err = mc.ReadDiscard()
+	if !errors.Is(err, ndt5.ErrAbnormalClose) || !strings.Contains(err.Error(), "code 1006") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestUnitWSConnectionsFactoryControl(t *testing.T) {
+	server, _ := NewWSServer(t, func(conn *websocket.Conn) {
+		conn.ReadMessage() // wait for the client to close
+	})
+	var calls int
+	factory := ndt5.NewWSConnectionsFactory(new(net.Dialer),
+		&url.URL{Scheme: "ws", Path: "/ndt_protocol"})
+	factory.Control = func(network, address string, c syscall.RawConn) error {
+		calls++
+		return nil
+	}
+	mc, err := factory.DialMeasurementConn(context.Background(), server.Listener.Addr().String(), UserAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc.Close()
+	if calls != 1 {
+		t.Fatalf("expected one Control call, got %d", calls)
+	}
+	_, factory = NewWSServer(t, func(conn *websocket.Conn) {})
+	factory.Control = func(network, address string, c syscall.RawConn) error {
+		return nil
+	}
+	_, err = factory.DialControlConn(context.Background(), "127.0.0.1", UserAgent)
+	if !errors.Is(err, ndt5.ErrControlNotSupported) {
+		t.Fatalf("expected ErrControlNotSupported, got %v", err)
+	}
+}
+
+func TestUnitWSDialControlConnDefaultPort(t *testing.T) {
+	dialer := new(RecordParametersDialer)
+	f := ndt5.NewWSConnectionsFactory(dialer, nil)
+	for address, expect := range map[string]string{
+		"127.0.0.1":          "127.0.0.1:3010",
+		"localhost":          "localhost:3010",
+		"::1":                "[::1]:3010",
+		"[::1]":              "[::1]:3010",
+		"2001:db8::1":        "[2001:db8::1]:3010",
+		"127.0.0.1:54321":    "127.0.0.1:54321",
+		"localhost:54321":    "localhost:54321",
+		"[::1]:54321":        "[::1]:54321",
+		"[2001:db8::1]:4443": "[2001:db8::1]:4443",
+	} {
+		dialer.Address = ""
+		// The handshake fails quickly, since nobody is serving the pipe.
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		f.DialControlConn(ctx, address, UserAgent)
+		cancel()
+		if dialer.Address != expect {
+			t.Fatalf("%s: expected %q, got %q", address, expect, dialer.Address)
+		}
+	}
+}
+
+func TestUnitWSClientDownloadAddress(t *testing.T) {
+	for fqdn, expect := range map[string]string{
+		"::1":            "[::1]:3002",
+		"[::1]":          "[::1]:3002",
+		"[::1]:4443":     "[::1]:3002",
+		"127.0.0.1:4443": "127.0.0.1:3002",
+		"localhost:4443": "localhost:3002",
+	} {
+		var conns int32
+		measured := make(chan struct{})
+		server, _ := NewWSServer(t, func(conn *websocket.Conn) {
+			if atomic.AddInt32(&conns, 1) > 1 {
+				// This is the measurement conn.
+				defer close(measured)
+				for begin := time.Now(); time.Since(begin) < 100*time.Millisecond; {
+					if err := conn.WriteMessage(websocket.BinaryMessage, make([]byte, 1<<14)); err != nil {
+						return
+					}
+				}
+				return
+			}
+			// Reading in the background consumes the client's messages.
+			go func() {
+				for {
+					if _, _, err := conn.ReadMessage(); err != nil {
+						return
+					}
+				}
+			}()
+			WriteWSFrame(conn, 1, "0")
+			WriteWSFrame(conn, 2, "v3.7.0")
+			WriteWSFrame(conn, 2, "4")
+			WriteWSFrame(conn, 3, "3002")
+			WriteWSFrame(conn, 4, "")
+			<-measured
+			WriteWSFrame(conn, 5, "1000")
+			WriteWSFrame(conn, 6, "")
+			WriteWSFrame(conn, 8, "results")
+			WriteWSFrame(conn, 9, "")
+		})
+		dialer := &RedirectDialer{Address: server.Listener.Addr().String()}
+		protocolFactory := ndt5.NewProtocolFactory5()
+		protocolFactory.ConnectionsFactory = ndt5.NewWSConnectionsFactory(
+			dialer, &url.URL{Scheme: "ws", Path: "/ndt_protocol"})
+		client := ndt5.NewClient("ndt5-client-go-testing", "0.1.0", "")
+		client.ProtocolFactory = protocolFactory
+		client.FQDN = fqdn
+		client.DisableMetadata = true
+		results, err := client.RunN(context.Background(), 1)
+		if err != nil {
+			t.Fatalf("%s: %s", fqdn, err)
+		}
+		if subtests := results[0].Subtests; len(subtests) != 1 || !subtests[0].Success {
+			t.Fatalf("%s: unexpected subtests: %+v", fqdn, subtests)
+		}
+		if len(dialer.Requested) != 2 || dialer.Requested[1] != expect {
+			t.Fatalf("%s: unexpected addresses: %v", fqdn, dialer.Requested)
+		}
+	}
+}
+
+func TestUnitWSControlConnKickoff(t *testing.T) {
+	const kickoff = "123456 654321"
+	for _, tc := range []struct {
+		name    string
+		read    bool
+		mtype   int
+		message string
+		expect  error
+	}{
+		{"faked", false, websocket.BinaryMessage, "", nil},
+		{"read", true, websocket.BinaryMessage, kickoff, nil},
+		{"invalid", true, websocket.BinaryMessage, "123456", ndt5.ErrInvalidKickoff},
+		{"text", true, websocket.TextMessage, `{"msg": "hello"}`, ndt5.ErrProtocolMismatch},
+	} {
+		_, factory := NewWSServer(t, func(conn *websocket.Conn) {
+			if tc.message != "" {
+				conn.WriteMessage(tc.mtype, []byte(tc.message))
+			}
+			WriteWSFrame(conn, 1, "0")
+			conn.ReadMessage() // wait for the client to close
+		})
+		factory.ReadKickoff = tc.read
+		cc, err := factory.DialControlConn(context.Background(), "127.0.0.1", UserAgent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		observer := new(CountingObserver)
+		cc.SetFrameReadWriteObserver(observer)
+		received := make([]byte, len(kickoff))
+		err = cc.ReadKickoffMessage(received)
+		if !errors.Is(err, tc.expect) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.expect, err)
+		}
+		// We tell the observer about the binary kickoff we read, if any.
+		if tc.read && tc.mtype == websocket.BinaryMessage {
+			if len(observer.Reads) != 1 || string(observer.Reads[0].Raw) != tc.message {
+				t.Fatalf("%s: unexpected observed reads: %+v", tc.name, observer.Reads)
+			}
+		} else if len(observer.Reads) != 0 {
+			t.Fatalf("%s: unexpected observed reads: %+v", tc.name, observer.Reads)
+		}
+		if err == nil {
+			if string(received) != kickoff {
+				t.Fatalf("%s: unexpected kickoff: %q", tc.name, received)
+			}
+			// We must still be in sync with the server.
+			frame, err := cc.ReadFrame()
+			if err != nil || frame.Type != 1 {
+				t.Fatalf("%s: unexpected frame: %+v %v", tc.name, frame, err)
+			}
+		}
+		cc.Close()
+	}
+}
+
+// WriteWSFrame writes a ndt5 frame with a JSON body on conn.
+func WriteWSFrame(conn *websocket.Conn, mtype uint8, message string) error {
+	body, err := json.Marshal(map[string]string{"msg": message})
+	if err != nil {
+		return err
+	}
+	frame, err := ndt5.NewFrame(mtype, body)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(websocket.BinaryMessage, frame.Raw)
+}
+
+func TestUnitClientControlRTT(t *testing.T) {
+	_, factory := NewWSServer(t, func(conn *websocket.Conn) {
+		// Reading in the background answers the client's pings.
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		WriteWSFrame(conn, 1, "1")
+		time.Sleep(300 * time.Millisecond)
+		WriteWSFrame(conn, 1, "0")
+		WriteWSFrame(conn, 2, "v3.7.0")
+		WriteWSFrame(conn, 2, "")
+		WriteWSFrame(conn, 9, "")
+	})
+	protocolFactory := ndt5.NewProtocolFactory5()
+	protocolFactory.ConnectionsFactory = factory
+	protocolFactory.ControlRTTInterval = 50 * time.Millisecond
+	client := ndt5.NewClient("ndt5-client-go-testing", "0.1.0", "")
+	client.ProtocolFactory = protocolFactory
+	client.FQDN = "127.0.0.1"
+	ch, err := client.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ev := range ch {
+		if ev.ErrorMessage != nil {
+			t.Fatal(ev.ErrorMessage.Error)
+		}
+	}
+	rtt := client.Result.ControlRTT
+	if rtt == nil || rtt.Count < 1 {
+		t.Fatal("expected some RTT samples")
+	}
+	if rtt.Min <= 0 || rtt.Min > rtt.Avg || rtt.Avg > rtt.Max {
+		t.Fatalf("inconsistent RTT stats: %+v", rtt)
+	}
+}
+
+func TestUnitWSHandshakeError(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		busy   bool
+	}{
+		{http.StatusServiceUnavailable, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusUnauthorized, false},
+		{http.StatusNotFound, false},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+			}))
+		factory := ndt5.NewWSConnectionsFactory(
+			&RedirectDialer{Address: server.Listener.Addr().String()},
+			&url.URL{Scheme: "ws", Path: "/ndt_protocol"},
+		)
+		_, err := factory.DialControlConn(context.Background(), "127.0.0.1", UserAgent)
+		server.Close()
+		var handshakeErr *ndt5.WSHandshakeError
+		if !errors.As(err, &handshakeErr) || !errors.Is(err, ndt5.ErrWSHandshake) ||
+			!errors.Is(err, websocket.ErrBadHandshake) {
+			t.Fatalf("%d: unexpected error: %v", tc.status, err)
+		}
+		if handshakeErr.StatusCode != tc.status || handshakeErr.ServerBusy() != tc.busy {
+			t.Fatalf("%d: unexpected handshake error: %+v", tc.status, handshakeErr)
+		}
+	}
+}
+
+func TestUnitWSDialErrorWithoutResponse(t *testing.T) {
+	factory := ndt5.NewWSConnectionsFactory(
+		&AlwaysFailingDialer{}, &url.URL{Scheme: "ws", Path: "/ndt_protocol"})
+	_, err := factory.DialControlConn(context.Background(), "127.0.0.1", UserAgent)
+	if !errors.Is(err, ErrMocked) || errors.Is(err, ndt5.ErrWSHandshake) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// MaxReadDialer dials Address recording the size of the largest read.
+type MaxReadDialer struct {
+	Address string
+	MaxRead atomic.Int64
+}
+
+func (d *MaxReadDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *MaxReadDialer) DialContext(
+	ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := new(net.Dialer).DialContext(ctx, network, d.Address)
+	if err != nil {
+		return nil, err
+	}
+	return &maxReadConn{Conn: conn, dialer: d}, nil
+}
+
+type maxReadConn struct {
+	net.Conn
+	dialer *MaxReadDialer
+}
+
+func (c *maxReadConn) Read(b []byte) (int, error) {
+	if size := int64(len(b)); size > c.dialer.MaxRead.Load() {
+		c.dialer.MaxRead.Store(size)
+	}
+	return c.Conn.Read(b)
+}
+
+func TestUnitWSConnectionsFactoryBufferSize(t *testing.T) {
+	server, _ := NewWSServer(t, func(conn *websocket.Conn) {
+		conn.ReadMessage() // wait for the client to close
+	})
+	for _, tc := range []struct {
+		control  bool
+		size     int
+		expected int64
+	}{
+		{false, 0, 1 << 20},
+		{false, 8192, 8192},
+		{true, 8192, 1 << 20},
+	} {
+		dialer := &MaxReadDialer{Address: server.Listener.Addr().String()}
+		factory := ndt5.NewWSConnectionsFactory(dialer,
+			&url.URL{Scheme: "ws", Path: "/ndt_protocol"})
+		if tc.size > 0 {
+			factory.ReadBufferSize = tc.size
+		}
+		var err error
+		if tc.control {
+			var cc ndt5.ControlConn
+			cc, err = factory.DialControlConn(context.Background(), "127.0.0.1", UserAgent)
+			if err == nil {
+				cc.Close()
+			}
+		} else {
+			var mc ndt5.MeasurementConn
+			mc, err = factory.DialMeasurementConn(context.Background(), "127.0.0.1", UserAgent)
+			if err == nil {
+				mc.Close()
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := dialer.MaxRead.Load(); got != tc.expected {
+			t.Fatalf("%+v: unexpected largest read: %d", tc, got)
+		}
+	}
+}
+
+func TestUnitWSControlConnTransport(t *testing.T) {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"ndt"}}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.ReadMessage() // wait for the client to close
+		}))
+	server.StartTLS()
+	defer server.Close()
+	for _, scheme := range []string{"ws", "wss"} {
+		address := server.Listener.Addr().String()
+		if scheme == "ws" {
+			plain, _ := NewWSServer(t, func(conn *websocket.Conn) {
+				conn.ReadMessage()
+			})
+			address = plain.Listener.Addr().String()
+		}
+		factory := ndt5.NewWSConnectionsFactory(&RedirectDialer{Address: address},
+			&url.URL{Scheme: scheme, Path: "/ndt_protocol"})
+		factory.Dialer.TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+		cc, err := factory.DialControlConn(context.Background(), "127.0.0.1", UserAgent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transport, version := cc.(interface{ Transport() (string, string) }).Transport()
+		cc.Close()
+		if transport != scheme || (version != "") != (scheme == "wss") {
+			t.Fatalf("unexpected transport: %s %s", transport, version)
+		}
+	}
+}